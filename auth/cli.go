@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+const keysUsage = `usage: main keys <command> [flags]
+
+commands:
+  create -name <name> -role <reader|editor|admin>   generate a new key, printed once
+  list                                              list keys (hashes are never shown)
+  revoke -id <id>                                   delete a key
+
+every command accepts -file <path>, defaulting to $API_KEYS_FILE`
+
+// entrypoint for the "keys" subcommand of the API binary
+func RunKeysCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	fs := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("file", os.Getenv("API_KEYS_FILE"), "path to the API key file")
+	name := fs.String("name", "", "human readable name for the key")
+	role := fs.String("role", string(RoleReader), "role granted by the key")
+	id := fs.String("id", "", "id of the key to revoke")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("no key file given, set -file or API_KEYS_FILE")
+	}
+	keys, err := LoadKeyStore(*file)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if *name == "" {
+			return errors.New("-name is required")
+		}
+		parsedRole, err := ParseRole(*role)
+		if err != nil {
+			return err
+		}
+
+		key, stored, err := keys.Create(*name, parsedRole)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "created %s key %q with id %s\n", stored.Role, stored.Name, stored.Id)
+		fmt.Fprintf(out, "key (shown once, store it somewhere safe): %s\n", key)
+	case "list":
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLE\tCREATED")
+		for _, stored := range keys.List() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", stored.Id, stored.Name, stored.Role, stored.CreatedAt.Format("2006-01-02 15:04:05"))
+		}
+		return w.Flush()
+	case "revoke":
+		if *id == "" {
+			return errors.New("-id is required")
+		}
+		if err := keys.Revoke(*id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "revoked key %s\n", *id)
+	default:
+		return errors.New(keysUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a JSON Web Key, only the fields needed for RSA and EC signature keys
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// public keys loaded from a JWKS file or URL. Unknown key ids trigger a refetch,
+// at most once per minRefresh, so rotated signing keys are picked up
+type JWKS struct {
+	source     string
+	client     *http.Client
+	keys       map[string]crypto.PublicKey
+	checkedAt  time.Time // the last fetch attempt, successful or not
+	minRefresh time.Duration
+	mu         sync.Mutex
+}
+
+// loads a key set from an http(s) URL or a local file path
+func NewJWKS(source string) (*JWKS, error) {
+	j := &JWKS{
+		source:     source,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		minRefresh: time.Minute,
+	}
+	keys, err := j.fetch()
+	if err != nil {
+		return nil, err
+	}
+	j.keys = keys
+	j.checkedAt = time.Now()
+	return j, nil
+}
+
+// the key for a token's "kid" header. Tokens without a kid are accepted when the set has a single key
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	key, ok := j.lookup(kid)
+	// claiming the refetch before unlocking keeps concurrent requests from fetching too
+	refetch := !ok && time.Since(j.checkedAt) >= j.minRefresh
+	if refetch {
+		j.checkedAt = time.Now()
+	}
+	j.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if refetch {
+		keys, err := j.fetch()
+		if err != nil {
+			return nil, err
+		}
+
+		j.mu.Lock()
+		j.keys = keys
+		key, ok = j.lookup(kid)
+		j.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no signing key found for kid %q", kid)
+}
+
+func (j *JWKS) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// reads and parses the key set. Keys that can't be used, with an unsupported
+// type or curve or bad parameters, are logged and skipped rather than failing the set
+func (j *JWKS) fetch() (map[string]crypto.PublicKey, error) {
+	data, err := j.read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load JWKS from %s: %v", j.source, err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("unable to parse JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("Skipping key %q in JWKS: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+
+	return keys, nil
+}
+
+func (j *JWKS) read() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(j.source)
+	}
+
+	resp, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// shorter RSA moduli are within reach of factoring
+const minRSABits = 2048
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA modulus of %d bits is below the minimum of %d", n.BitLen(), minRSABits)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		// the exponent has to be odd and fit in an int32, anything else would be
+		// truncated or rejected when a signature is checked
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > math.MaxInt32 || e.Bit(0) == 0 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// register the hash functions used by the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// signature algorithms accepted on tokens. "none" and the HMAC algorithms are
+// deliberately missing, tokens must be signed by a key in the JWKS
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// checks bearer tokens against a JWKS and the configured issuer and audience,
+// mapping a claim onto the caller's role
+type JWTVerifier struct {
+	jwks       *JWKS
+	issuer     string
+	audience   string
+	rolesClaim string
+	roleMap    map[string]Role
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+type JWTConfig struct {
+	Issuer     string // both are required, tokens are refused while either is empty
+	Audience   string
+	RolesClaim string          // claim holding the caller's roles, "roles" when empty
+	RoleMap    map[string]Role // claim values to roles, values matching a role name map onto it directly
+	Leeway     time.Duration   // allowed clock skew for exp and nbf
+}
+
+func NewJWTVerifier(jwks *JWKS, config JWTConfig) *JWTVerifier {
+	if config.RolesClaim == "" {
+		config.RolesClaim = "roles"
+	}
+	return &JWTVerifier{
+		jwks:       jwks,
+		issuer:     config.Issuer,
+		audience:   config.Audience,
+		rolesClaim: config.RolesClaim,
+		roleMap:    config.RoleMap,
+		leeway:     config.Leeway,
+		now:        time.Now,
+	}
+}
+
+// validates a compact JWS token, returning the caller's identity
+func (v *JWTVerifier) Verify(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, fmt.Errorf("malformed token header: %v", err)
+	}
+
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return Identity{}, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := v.jwks.Key(header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("malformed token signature: %v", err)
+	}
+	if err := verifySignature(header.Alg, hash, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := v.validateClaims(claims); err != nil {
+		return Identity{}, err
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return Identity{}, errors.New("token has no subject")
+	}
+	issuer, _ := claims["iss"].(string)
+
+	return Identity{
+		Subject: subject,
+		Issuer:  issuer,
+		Role:    v.role(claims),
+		Method:  "jwt",
+	}, nil
+}
+
+func (v *JWTVerifier) validateClaims(claims map[string]any) error {
+	now := v.now()
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(exp, 0).Add(v.leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(v.leeway).Before(time.Unix(nbf, 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	// without both any token signed by a key in the JWKS would do, including ones issued for other services
+	if v.issuer == "" || v.audience == "" {
+		return errors.New("no issuer or audience is configured")
+	}
+	if iss, _ := claims["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !containsString(claims["aud"], v.audience) {
+		return errors.New("token is not intended for this audience")
+	}
+
+	return nil
+}
+
+// the most privileged role granted by the roles claim, which can be a list or a
+// space separated string like an OAuth scope
+func (v *JWTVerifier) role(claims map[string]any) Role {
+	var values []string
+	switch claim := claims[v.rolesClaim].(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []any:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var best Role
+	for _, value := range values {
+		role, ok := v.roleMap[value]
+		if !ok {
+			role = Role(value)
+		}
+		if _, known := roleRank[role]; known && roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	return best
+}
+
+func verifySignature(alg string, hash crypto.Hash, key crypto.PublicKey, signed string, signature []byte) error {
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s doesn't match an RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("algorithm %s doesn't match an EC key", alg)
+		}
+		// JWS encodes ECDSA signatures as fixed width r || s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported key type")
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	n, ok := claims[name].(float64)
+	return int64(n), ok
+}
+
+// the aud claim can be a single string or a list of them
+func containsString(claim any, want string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == want {
+				return true
+			}
+		}
+	}
+	return false
+}
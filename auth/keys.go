@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// prefix on every generated key, so leaked keys are easy to spot
+const keyPrefix = "gba_"
+
+// an API key as stored on disk, only the SHA-256 hash of the key itself is kept
+type StoredKey struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// file backed set of API keys, reloaded when the file changes so keys
+// created or revoked with the CLI apply without a restart
+type KeyStore struct {
+	path    string
+	keys    []StoredKey
+	modTime time.Time
+	size    int64
+	mu      sync.RWMutex
+}
+
+// opens a key file, a missing file is treated as an empty store
+func LoadKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *KeyStore) reload() error {
+	info, err := os.Stat(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		ks.keys = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat key file: %v", err)
+	}
+
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return fmt.Errorf("unable to read key file: %v", err)
+	}
+
+	var keys []StoredKey
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return fmt.Errorf("unable to parse key file: %v", err)
+		}
+	}
+
+	ks.keys = keys
+	ks.modTime = info.ModTime()
+	ks.size = info.Size()
+	return nil
+}
+
+// reloads the file if it's been modified since it was last read. The size is compared
+// too, as file timestamps can be too coarse to tell apart two quick writes
+func (ks *KeyStore) refresh() {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return
+	}
+
+	ks.mu.RLock()
+	stale := !info.ModTime().Equal(ks.modTime) || info.Size() != ks.size
+	ks.mu.RUnlock()
+
+	if stale {
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		if err := ks.reload(); err != nil {
+			// keep serving the previous keys rather than locking everyone out
+			return
+		}
+	}
+}
+
+// looks up the stored key matching a plaintext key
+func (ks *KeyStore) Authenticate(key string) (StoredKey, bool) {
+	ks.refresh()
+
+	hash := hashKey(key)
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, stored := range ks.keys {
+		if subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hash)) == 1 {
+			return stored, true
+		}
+	}
+	return StoredKey{}, false
+}
+
+// generates a new key, saving its hash. The plaintext key is only ever returned here
+func (ks *KeyStore) Create(name string, role Role) (string, StoredKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", StoredKey{}, fmt.Errorf("unable to generate key: %v", err)
+	}
+	key := keyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	stored := StoredKey{
+		Id:        utils.UUID(),
+		Name:      name,
+		Role:      role,
+		Hash:      hashKey(key),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = append(ks.keys, stored)
+	if err := ks.save(); err != nil {
+		return "", StoredKey{}, err
+	}
+
+	return key, stored, nil
+}
+
+// deletes a key by id
+func (ks *KeyStore) Revoke(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i, stored := range ks.keys {
+		if stored.Id == id {
+			ks.keys = append(ks.keys[:i], ks.keys[i+1:]...)
+			return ks.save()
+		}
+	}
+	return fmt.Errorf("no key found with id %s", id)
+}
+
+func (ks *KeyStore) List() []StoredKey {
+	ks.refresh()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return append([]StoredKey(nil), ks.keys...)
+}
+
+// writes the keys back to disk, callers must hold the write lock
+func (ks *KeyStore) save() error {
+	data, err := json.MarshalIndent(ks.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so the server never reads a half written file
+	tmp := ks.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write key file: %v", err)
+	}
+	if err := os.Rename(tmp, ks.path); err != nil {
+		return fmt.Errorf("unable to replace key file: %v", err)
+	}
+
+	if info, err := os.Stat(ks.path); err == nil {
+		ks.modTime = info.ModTime()
+		ks.size = info.Size()
+	}
+	return nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
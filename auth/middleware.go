@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// gin context key holding the caller's Identity
+const IdentityKey = "identity"
+
+// who made a request, and how they proved it
+type Identity struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer,omitempty"` // set for JWTs
+	Role    Role   `json:"role"`
+	Method  string `json:"method"` // "api_key", "jwt", or "none" when auth is disabled
+}
+
+// the identity used for every request when authentication is turned off
+var anonymous = Identity{Subject: "anonymous", Role: RoleAdmin, Method: "none"}
+
+// accepts API keys, JWT bearer tokens, or both. Either can be nil, and with
+// neither every authenticated route is refused unless disabled is set
+type Authenticator struct {
+	keys     *KeyStore
+	jwt      *JWTVerifier
+	disabled bool
+}
+
+func NewAuthenticator(keys *KeyStore, jwt *JWTVerifier) *Authenticator {
+	return &Authenticator{keys: keys, jwt: jwt}
+}
+
+// builds an Authenticator from the environment:
+//
+//	API_KEYS_FILE    path to the API key file
+//	JWT_JWKS         URL or file path of the JWKS used to verify bearer tokens
+//	JWT_ISSUER       required "iss" claim, must be set with JWT_JWKS
+//	JWT_AUDIENCE     required "aud" claim, must be set with JWT_JWKS
+//	JWT_ROLES_CLAIM  claim holding the caller's roles, defaults to "roles"
+//	JWT_ROLE_MAP     maps claim values to roles, e.g. "library-admins=admin,staff=editor"
+//	AUTH_DISABLED    "true" to run without credentials, treating every request as an admin
+//
+// When neither API_KEYS_FILE nor JWT_JWKS is set every authenticated route
+// responds 401, unless AUTH_DISABLED opts into running open
+func FromEnv() *Authenticator {
+	a := &Authenticator{}
+
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		keys, err := LoadKeyStore(path)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		a.keys = keys
+	}
+
+	if source := os.Getenv("JWT_JWKS"); source != "" {
+		jwks, err := NewJWKS(source)
+		if err != nil {
+			log.Fatalf("Failed to load JWKS: %v", err)
+		}
+		if os.Getenv("JWT_ISSUER") == "" || os.Getenv("JWT_AUDIENCE") == "" {
+			log.Fatal("JWT_ISSUER and JWT_AUDIENCE must be set along with JWT_JWKS")
+		}
+		roleMap, err := ParseRoleMap(os.Getenv("JWT_ROLE_MAP"))
+		if err != nil {
+			log.Fatalf("Failed to parse JWT_ROLE_MAP: %v", err)
+		}
+		a.jwt = NewJWTVerifier(jwks, JWTConfig{
+			Issuer:     os.Getenv("JWT_ISSUER"),
+			Audience:   os.Getenv("JWT_AUDIENCE"),
+			RolesClaim: os.Getenv("JWT_ROLES_CLAIM"),
+			RoleMap:    roleMap,
+			Leeway:     time.Minute,
+		})
+	}
+
+	open := os.Getenv("AUTH_DISABLED") == "true"
+	switch {
+	case a.configured() && open:
+		log.Warn("AUTH_DISABLED is ignored because API_KEYS_FILE or JWT_JWKS is set")
+	case open:
+		a.disabled = true
+		log.Warn("AUTH_DISABLED is set, authentication is disabled and every request is treated as an admin")
+	case !a.configured():
+		log.Error("Neither API_KEYS_FILE nor JWT_JWKS is set, authenticated routes will refuse every request. Set AUTH_DISABLED=true to run without authentication")
+	}
+	return a
+}
+
+func (a *Authenticator) Enabled() bool {
+	return !a.disabled
+}
+
+// whether any credentials can be checked
+func (a *Authenticator) configured() bool {
+	return a.keys != nil || a.jwt != nil
+}
+
+// parses "claim-value=role" pairs separated by commas
+func ParseRoleMap(s string) (map[string]Role, error) {
+	roleMap := map[string]Role{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		value, roleName, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected value=role, got %q", pair)
+		}
+		role, err := ParseRole(strings.TrimSpace(roleName))
+		if err != nil {
+			return nil, err
+		}
+		roleMap[strings.TrimSpace(value)] = role
+	}
+	return roleMap, nil
+}
+
+// middleware allowing only callers with at least the given role, responding
+// 401 when no valid credentials were sent and 403 when the role is too low
+func (a *Authenticator) Require(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.Enabled() {
+			c.Set(IdentityKey, anonymous)
+			c.Next()
+			return
+		}
+
+		identity, failure := a.identify(c)
+		if failure != "" {
+			if challenge := a.challenge(); challenge != "" {
+				c.Header("WWW-Authenticate", challenge)
+			}
+			problem.Abort(c, problem.New(http.StatusUnauthorized, failure))
+			return
+		}
+		if !identity.Role.Allows(role) {
+			problem.Abort(c, problem.New(http.StatusForbidden, "This route requires the "+string(role)+" role"))
+			return
+		}
+
+		c.Set(IdentityKey, identity)
+		c.Next()
+	}
+}
+
+// works out who the caller is, returning a message for the 401 response if they can't be identified
+func (a *Authenticator) identify(c *gin.Context) (Identity, string) {
+	if token := bearerToken(c); token != "" && a.jwt != nil {
+		identity, err := a.jwt.Verify(token)
+		if err != nil {
+			log.Infof("Rejected bearer token: %v", err)
+			return Identity{}, "The bearer token is invalid or has expired"
+		}
+		return identity, ""
+	}
+
+	if key := apiKey(c); key != "" && a.keys != nil {
+		stored, ok := a.keys.Authenticate(key)
+		if !ok {
+			return Identity{}, "The API key is invalid"
+		}
+		return Identity{Subject: "key:" + stored.Id, Role: stored.Role, Method: "api_key"}, ""
+	}
+
+	return Identity{}, "Authentication is required"
+}
+
+// the WWW-Authenticate challenges for the enabled schemes
+func (a *Authenticator) challenge() string {
+	challenges := []string{}
+	if a.jwt != nil {
+		challenges = append(challenges, `Bearer realm="gin-books-api"`)
+	}
+	if a.keys != nil {
+		challenges = append(challenges, `ApiKey realm="gin-books-api"`)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+func bearerToken(c *gin.Context) string {
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// API keys can be sent as "X-API-Key: <key>" or "Authorization: ApiKey <key>"
+func apiKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+
+	scheme, key, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "ApiKey") {
+		return strings.TrimSpace(key)
+	}
+	return ""
+}
+
+// the identity set by Require, or the anonymous identity on unauthenticated routes
+func CurrentIdentity(c *gin.Context) Identity {
+	if v, ok := c.Get(IdentityKey); ok {
+		if identity, ok := v.(Identity); ok {
+			return identity
+		}
+	}
+	return Identity{Subject: "anonymous", Method: "none"}
+}
+
+// tells callers apart for rate limits and idempotency keys: authenticated callers
+// by who they are, everyone else by address
+func ClientKey(c *gin.Context) string {
+	identity := CurrentIdentity(c)
+	if identity.Method != "none" {
+		return identity.Method + ":" + identity.Issuer + ":" + identity.Subject
+	}
+	return AddressKey(c)
+}
+
+func AddressKey(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
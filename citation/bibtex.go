@@ -0,0 +1,275 @@
+package citation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// characters LaTeX treats specially and how they're escaped in field values
+var bibtexEscapes = []string{
+	`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`, "%", `\%`,
+	"$", `\$`, "#", `\#`, "_", `\_`, "~", `\textasciitilde{}`, "^", `\textasciicircum{}`,
+}
+
+var bibtexEscaper = strings.NewReplacer(bibtexEscapes...)
+
+// @book entries keyed like borges1944ficciones. The format goes unrecorded,
+// BibTeX has no field for it
+func encodeBibTeX(w io.Writer, books []models.Book) error {
+	out := bufio.NewWriter(w)
+	keys := map[string]int{}
+
+	for i, book := range books {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+
+		key := bibtexKey(book)
+		// repeated keys get a letter, like borges1944ficcionesa
+		if n := keys[key]; n > 0 {
+			keys[key]++
+			key += string(rune('a' + (n-1)%26))
+		} else {
+			keys[key] = 1
+		}
+
+		fmt.Fprintf(out, "@book{%s,\n", key)
+		field := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(out, "  %s = {%s},\n", name, bibtexEscaper.Replace(value))
+			}
+		}
+		field("title", book.Title)
+		field("author", invertName(book.Author))
+		if book.Year != 0 {
+			field("year", strconv.Itoa(book.Year))
+		}
+		field("isbn", book.ISBN)
+		field("keywords", strings.Join(book.Tags, ", "))
+		out.WriteString("}\n")
+	}
+
+	return out.Flush()
+}
+
+// the author's surname, the year and the first word of the title that isn't an article
+func bibtexKey(book models.Book) string {
+	words := strings.Fields(book.Author)
+	surname := ""
+	if len(words) > 0 {
+		surname = words[len(words)-1]
+	}
+
+	title := ""
+	for _, word := range strings.Fields(book.Title) {
+		switch strings.ToLower(word) {
+		case "the", "a", "an":
+			continue
+		}
+		title = word
+		break
+	}
+
+	year := ""
+	if book.Year != 0 {
+		year = strconv.Itoa(book.Year)
+	}
+
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, surname+year+title)
+	if key == "" {
+		return "book"
+	}
+	return key
+}
+
+// a small parser for the entries encodeBibTeX writes and the ones reference managers
+// export, with values in braces, quotes or bare. Entries other than @book are skipped
+func decodeBibTeX(input string) ([]models.Book, error) {
+	books := []models.Book{}
+	p := &bibtexParser{input: input}
+
+	for {
+		at := strings.IndexByte(p.input[p.pos:], '@')
+		if at < 0 {
+			return books, nil
+		}
+		p.pos += at + 1
+
+		entryType := strings.ToLower(p.readUntil("{("))
+		if p.pos >= len(p.input) {
+			return nil, fmt.Errorf("bibtex: entry @%s isn't closed", entryType)
+		}
+		p.pos++
+
+		fields, err := p.readFields()
+		if err != nil {
+			return nil, err
+		}
+		if entryType != "book" {
+			continue
+		}
+
+		book := models.Book{Title: fields["title"], ISBN: fields["isbn"]}
+		authors := strings.Split(fields["author"], " and ")
+		for i := range authors {
+			authors[i] = uninvertName(authors[i])
+		}
+		book.Author = strings.Join(authors, " and ")
+		book.Year = parseYear(fields["year"])
+		for _, tag := range strings.Split(fields["keywords"], ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				book.Tags = append(book.Tags, tag)
+			}
+		}
+		books = append(books, book)
+	}
+}
+
+type bibtexParser struct {
+	input string
+	pos   int
+}
+
+// reads up to one of the stop characters, trimmed
+func (p *bibtexParser) readUntil(stop string) string {
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(stop, rune(p.input[p.pos])) {
+		p.pos++
+	}
+	return strings.TrimSpace(p.input[start:p.pos])
+}
+
+// reads the key and the fields of an entry up to its closing brace
+func (p *bibtexParser) readFields() (map[string]string, error) {
+	fields := map[string]string{}
+
+	// the citation key
+	p.readUntil(",})")
+	for p.pos < len(p.input) {
+		switch p.input[p.pos] {
+		case '}', ')':
+			p.pos++
+			return fields, nil
+		case ',':
+			p.pos++
+		}
+
+		name := strings.ToLower(p.readUntil("=,})"))
+		if p.pos >= len(p.input) {
+			break
+		}
+		if p.input[p.pos] != '=' {
+			continue
+		}
+		p.pos++
+
+		value, err := p.readValue()
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = value
+	}
+	return nil, fmt.Errorf("bibtex: entry isn't closed")
+}
+
+// a value in braces, which can nest, in quotes or bare, joined with # when concatenated
+func (p *bibtexParser) readValue() (string, error) {
+	var value strings.Builder
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return "", fmt.Errorf("bibtex: value isn't closed")
+		}
+
+		switch c := p.input[p.pos]; c {
+		case '{', '"':
+			delimited, err := p.readDelimited(c)
+			if err != nil {
+				return "", err
+			}
+			value.WriteString(delimited)
+		default:
+			// bare numbers, and @string macros which are kept as their names
+			value.WriteString(p.readUntil("#,})"))
+		}
+
+		p.skipSpace()
+		if p.pos < len(p.input) && p.input[p.pos] == '#' {
+			p.pos++
+			continue
+		}
+		return cleanBibTeX(value.String()), nil
+	}
+}
+
+// reads the text between an opening brace or quote and its close, skipping nested braces
+func (p *bibtexParser) readDelimited(open byte) (string, error) {
+	close := byte('}')
+	if open == '"' {
+		close = '"'
+	}
+
+	depth := 0
+	start := p.pos + 1
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		switch ch := p.input[p.pos]; {
+		case ch == '\\':
+			p.pos++
+		case ch == close && depth == 0:
+			p.pos++
+			return p.input[start : p.pos-1], nil
+		case ch == '{':
+			depth++
+		case ch == '}':
+			depth--
+		}
+	}
+	return "", fmt.Errorf("bibtex: value isn't closed")
+}
+
+func (p *bibtexParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// unescapes a value and drops the braces used to protect capitals, {Borges} is Borges.
+// Accents written as LaTeX commands are left as they are
+func cleanBibTeX(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '{' || value[i] == '}' {
+			continue
+		}
+		if value[i] == '\\' {
+			if literal, n := bibtexUnescape(value[i:]); n > 0 {
+				out.WriteString(literal)
+				i += n - 1
+				continue
+			}
+		}
+		out.WriteByte(value[i])
+	}
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+// the character an escape at the start of s stands for and the escape's length
+func bibtexUnescape(s string) (string, int) {
+	for i := 0; i < len(bibtexEscapes); i += 2 {
+		if strings.HasPrefix(s, bibtexEscapes[i+1]) {
+			return bibtexEscapes[i], len(bibtexEscapes[i+1])
+		}
+	}
+	return "", 0
+}
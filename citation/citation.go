@@ -0,0 +1,126 @@
+package citation
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// bibliographic formats books can be cited in
+const (
+	BibTeX     = "bibtex"
+	RIS        = "ris"
+	MARCXML    = "marcxml"
+	DublinCore = "dc"
+)
+
+// every format, in the order they're offered to clients
+var Formats = []string{BibTeX, RIS, MARCXML, DublinCore}
+
+var ContentTypes = map[string]string{
+	BibTeX:     "application/x-bibtex",
+	RIS:        "application/x-research-info-systems",
+	MARCXML:    "application/marcxml+xml",
+	DublinCore: "application/dc+xml",
+}
+
+// writes books as a list of records. In the XML formats that's a <collection> of
+// MARC records or a <records> element holding Dublin Core ones
+func Encode(w io.Writer, format string, books []models.Book) error {
+	switch format {
+	case BibTeX:
+		return encodeBibTeX(w, books)
+	case RIS:
+		return encodeRIS(w, books)
+	case MARCXML:
+		return encodeMARC(w, books, false)
+	case DublinCore:
+		return encodeDublinCore(w, books, false)
+	}
+	return unknownFormat(format)
+}
+
+// writes a single book. The XML formats write the record on its own rather than in a list
+func EncodeBook(w io.Writer, format string, book models.Book) error {
+	switch format {
+	case MARCXML:
+		return encodeMARC(w, []models.Book{book}, true)
+	case DublinCore:
+		return encodeDublinCore(w, []models.Book{book}, true)
+	}
+	return Encode(w, format, []models.Book{book})
+}
+
+// reads every record, whether it was written as a list or on its own. Only the fields
+// a format carries are filled in, and none of them carry ratings
+func Decode(r io.Reader, format string) ([]models.Book, error) {
+	switch format {
+	case BibTeX:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return decodeBibTeX(string(data))
+	case RIS:
+		return decodeRIS(r)
+	case MARCXML:
+		return decodeMARC(r)
+	case DublinCore:
+		return decodeDublinCore(r)
+	}
+	return nil, unknownFormat(format)
+}
+
+func unknownFormat(format string) error {
+	return fmt.Errorf("unknown citation format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// citation formats want authors surname first, "Jorge Luis Borges" is "Borges, Jorge Luis"
+func invertName(name string) string {
+	name = strings.TrimSpace(name)
+	i := strings.LastIndex(name, " ")
+	if i < 0 || strings.Contains(name, ",") {
+		return name
+	}
+	return name[i+1:] + ", " + name[:i]
+}
+
+// the other way around, as authors are stored
+func uninvertName(name string) string {
+	last, first, found := strings.Cut(strings.TrimSpace(name), ",")
+	if !found || strings.Contains(first, ",") {
+		return strings.TrimSpace(name)
+	}
+	return strings.TrimSpace(first) + " " + strings.TrimSpace(last)
+}
+
+// a four digit year from the start of a date like "1944", "1962-05" or "c1962."
+func parseYear(s string) int {
+	s = strings.TrimLeft(s, "c[© ")
+	if len(s) < 4 {
+		return 0
+	}
+	year := 0
+	for _, r := range s[:4] {
+		if r < '0' || r > '9' {
+			return 0
+		}
+		year = year*10 + int(r-'0')
+	}
+	return year
+}
+
+// an XML declaration and the encoded document, indented
+func writeXML(w io.Writer, encode func(buf *bytes.Buffer) error) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	if err := encode(&buf); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,145 @@
+package citation
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+const (
+	oaiDCNamespace = "http://www.openarchives.org/OAI/2.0/oai_dc/"
+	dcNamespace    = "http://purl.org/dc/elements/1.1/"
+)
+
+// Go's encoder can't declare namespace prefixes, so records are written with the
+// prefixes spelled out in the names and read back with dublinCoreIn
+type dublinCoreOut struct {
+	XMLName     xml.Name `xml:"oai_dc:dc"`
+	OAIDC       string   `xml:"xmlns:oai_dc,attr,omitempty"`
+	DC          string   `xml:"xmlns:dc,attr,omitempty"`
+	Title       string   `xml:"dc:title,omitempty"`
+	Creator     string   `xml:"dc:creator,omitempty"`
+	Date        string   `xml:"dc:date,omitempty"`
+	Identifiers []string `xml:"dc:identifier"`
+	Subjects    []string `xml:"dc:subject"`
+	Format      string   `xml:"dc:format,omitempty"`
+	Type        string   `xml:"dc:type"`
+}
+
+type dublinCoreList struct {
+	XMLName xml.Name        `xml:"records"`
+	OAIDC   string          `xml:"xmlns:oai_dc,attr"`
+	DC      string          `xml:"xmlns:dc,attr"`
+	Records []dublinCoreOut `xml:"oai_dc:dc"`
+}
+
+type dublinCoreIn struct {
+	Titles      []string `xml:"http://purl.org/dc/elements/1.1/ title"`
+	Creators    []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Dates       []string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Identifiers []string `xml:"http://purl.org/dc/elements/1.1/ identifier"`
+	Subjects    []string `xml:"http://purl.org/dc/elements/1.1/ subject"`
+	Formats     []string `xml:"http://purl.org/dc/elements/1.1/ format"`
+}
+
+// OAI-PMH's oai_dc records. The ISBN and the book's id are identifiers, as
+// urn:isbn: and urn:x-book: URNs, and the tags are subjects
+func dublinCoreFromBook(book models.Book) dublinCoreOut {
+	record := dublinCoreOut{
+		Title:       book.Title,
+		Creator:     invertName(book.Author),
+		Identifiers: []string{},
+		Subjects:    book.Tags,
+		Format:      book.Format,
+		Type:        "Text",
+	}
+	if book.Year != 0 {
+		record.Date = strconv.Itoa(book.Year)
+	}
+	if book.ISBN != "" {
+		record.Identifiers = append(record.Identifiers, "urn:isbn:"+book.ISBN)
+	}
+	if book.Id != "" {
+		record.Identifiers = append(record.Identifiers, "urn:x-book:"+book.Id)
+	}
+	return record
+}
+
+func bookFromDublinCore(record dublinCoreIn) models.Book {
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(values[0])
+	}
+
+	creators := []string{}
+	for _, creator := range record.Creators {
+		creators = append(creators, uninvertName(creator))
+	}
+
+	book := models.Book{
+		Title:  first(record.Titles),
+		Author: strings.Join(creators, " and "),
+		Year:   parseYear(first(record.Dates)),
+		Format: first(record.Formats),
+	}
+	for _, identifier := range record.Identifiers {
+		identifier = strings.TrimSpace(identifier)
+		lower := strings.ToLower(identifier)
+		switch {
+		case strings.HasPrefix(lower, "urn:isbn:"):
+			book.ISBN = identifier[len("urn:isbn:"):]
+		case strings.HasPrefix(lower, "isbn:"), strings.HasPrefix(lower, "isbn "):
+			book.ISBN = strings.TrimSpace(identifier[len("isbn:"):])
+		case strings.HasPrefix(lower, "urn:x-book:"):
+			book.Id = identifier[len("urn:x-book:"):]
+		}
+	}
+	for _, subject := range record.Subjects {
+		if subject = strings.TrimSpace(subject); subject != "" {
+			book.Tags = append(book.Tags, subject)
+		}
+	}
+	return book
+}
+
+func encodeDublinCore(w io.Writer, books []models.Book, single bool) error {
+	return writeXML(w, func(buf *bytes.Buffer) error {
+		enc := xml.NewEncoder(buf)
+		enc.Indent("", "  ")
+
+		if single {
+			record := dublinCoreFromBook(books[0])
+			record.OAIDC, record.DC = oaiDCNamespace, dcNamespace
+			return enc.Encode(record)
+		}
+
+		list := dublinCoreList{OAIDC: oaiDCNamespace, DC: dcNamespace, Records: []dublinCoreOut{}}
+		for _, book := range books {
+			list.Records = append(list.Records, dublinCoreFromBook(book))
+		}
+		return enc.Encode(list)
+	})
+}
+
+// reads every oai_dc:dc record, whether in a list or on its own
+func decodeDublinCore(r io.Reader) ([]models.Book, error) {
+	books := []models.Book{}
+	err := eachElement(r, "dc", func(dec *xml.Decoder, start xml.StartElement) error {
+		if start.Name.Space != oaiDCNamespace {
+			return nil
+		}
+		var record dublinCoreIn
+		if err := dec.DecodeElement(&record, &start); err != nil {
+			return err
+		}
+		books = append(books, bookFromDublinCore(record))
+		return nil
+	})
+	return books, err
+}
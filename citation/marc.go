@@ -0,0 +1,186 @@
+package citation
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+const marcNamespace = "http://www.loc.gov/MARC21/slim"
+
+// a language material monograph, with the lengths and offsets left for a MARC
+// transmission format encoder to fill in
+const marcLeader = "00000nam a2200000 a 4500"
+
+type marcCollection struct {
+	XMLName xml.Name     `xml:"collection"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Records []marcRecord `xml:"record"`
+}
+
+type marcRecord struct {
+	XMLName       xml.Name           `xml:"record"`
+	Xmlns         string             `xml:"xmlns,attr,omitempty"`
+	Leader        string             `xml:"leader"`
+	ControlFields []marcControlField `xml:"controlfield"`
+	DataFields    []marcDataField    `xml:"datafield"`
+}
+
+type marcControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcDataField struct {
+	Tag       string         `xml:"tag,attr"`
+	Ind1      string         `xml:"ind1,attr"`
+	Ind2      string         `xml:"ind2,attr"`
+	Subfields []marcSubfield `xml:"subfield"`
+}
+
+type marcSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// the fields a book maps onto: 001 id, 020 $a ISBN and $q format, 100 author,
+// 245 title, 264 $c year of publication and a 653 index term per tag
+func marcFromBook(book models.Book) marcRecord {
+	record := marcRecord{Leader: marcLeader}
+	if book.Id != "" {
+		record.ControlFields = append(record.ControlFields, marcControlField{Tag: "001", Value: book.Id})
+	}
+
+	field := func(tag, ind1, ind2 string, subfields ...marcSubfield) {
+		kept := []marcSubfield{}
+		for _, subfield := range subfields {
+			if subfield.Value != "" {
+				kept = append(kept, subfield)
+			}
+		}
+		if len(kept) > 0 {
+			record.DataFields = append(record.DataFields, marcDataField{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: kept})
+		}
+	}
+
+	field("020", " ", " ", marcSubfield{"a", book.ISBN}, marcSubfield{"q", book.Format})
+	field("100", "1", " ", marcSubfield{"a", invertName(book.Author)})
+	field("245", "1", "0", marcSubfield{"a", book.Title})
+	if book.Year != 0 {
+		field("264", " ", "1", marcSubfield{"c", strconv.Itoa(book.Year)})
+	}
+	for _, tag := range book.Tags {
+		field("653", " ", " ", marcSubfield{"a", tag})
+	}
+	return record
+}
+
+// also reads records catalogued elsewhere, ignoring ISBD punctuation like the
+// trailing " /" on titles and older 260 imprints in place of 264
+func bookFromMARC(record marcRecord) models.Book {
+	book := models.Book{}
+	for _, field := range record.ControlFields {
+		if field.Tag == "001" {
+			book.Id = strings.TrimSpace(field.Value)
+		}
+	}
+
+	for _, field := range record.DataFields {
+		subfield := func(code string) string {
+			for _, s := range field.Subfields {
+				if s.Code == code {
+					return strings.TrimRight(strings.TrimSpace(s.Value), " /:;,.")
+				}
+			}
+			return ""
+		}
+
+		switch field.Tag {
+		case "020":
+			// older records put the qualifier in $a, "9780802130303 (pbk.)"
+			isbn, qualifier, _ := strings.Cut(subfield("a"), " ")
+			if book.ISBN == "" {
+				book.ISBN = isbn
+			}
+			format := subfield("q")
+			if format == "" {
+				format = strings.Trim(qualifier, "(). ")
+			}
+			if book.Format == "" {
+				book.Format = format
+			}
+		case "100", "110":
+			book.Author = uninvertName(subfield("a"))
+		case "245":
+			book.Title = subfield("a")
+			if remainder := subfield("b"); remainder != "" {
+				book.Title += ": " + remainder
+			}
+		case "264", "260":
+			if book.Year == 0 {
+				book.Year = parseYear(subfield("c"))
+			}
+		case "653", "650":
+			if tag := subfield("a"); tag != "" {
+				book.Tags = append(book.Tags, tag)
+			}
+		}
+	}
+	return book
+}
+
+func encodeMARC(w io.Writer, books []models.Book, single bool) error {
+	return writeXML(w, func(buf *bytes.Buffer) error {
+		enc := xml.NewEncoder(buf)
+		enc.Indent("", "  ")
+
+		if single {
+			record := marcFromBook(books[0])
+			record.Xmlns = marcNamespace
+			return enc.Encode(record)
+		}
+
+		collection := marcCollection{Xmlns: marcNamespace, Records: []marcRecord{}}
+		for _, book := range books {
+			collection.Records = append(collection.Records, marcFromBook(book))
+		}
+		return enc.Encode(collection)
+	})
+}
+
+// reads every <record>, whether in a <collection> or on its own
+func decodeMARC(r io.Reader) ([]models.Book, error) {
+	books := []models.Book{}
+	err := eachElement(r, "record", func(dec *xml.Decoder, start xml.StartElement) error {
+		var record marcRecord
+		if err := dec.DecodeElement(&record, &start); err != nil {
+			return err
+		}
+		books = append(books, bookFromMARC(record))
+		return nil
+	})
+	return books, err
+}
+
+// calls fn for every element with the local name, wherever it's nested
+func eachElement(r io.Reader, local string, fn func(dec *xml.Decoder, start xml.StartElement) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == local {
+			if err := fn(dec, start); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package citation
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// BOOK records, one tag per line with CRLF endings as the spec asks for
+func encodeRIS(w io.Writer, books []models.Book) error {
+	out := bufio.NewWriter(w)
+
+	for _, book := range books {
+		tag := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(out, "%s  - %s\r\n", name, oneLine(value))
+			}
+		}
+
+		tag("TY", "BOOK")
+		tag("ID", book.Id)
+		tag("TI", book.Title)
+		tag("AU", invertName(book.Author))
+		if book.Year != 0 {
+			tag("PY", fmt.Sprintf("%04d", book.Year))
+		}
+		tag("SN", book.ISBN)
+		tag("M3", book.Format)
+		for _, keyword := range book.Tags {
+			tag("KW", keyword)
+		}
+		out.WriteString("ER  - \r\n")
+	}
+
+	return out.Flush()
+}
+
+// reads every record whatever its type, as reference managers often export books as
+// GEN or CHAP. Tags this model has no place for are ignored
+func decodeRIS(r io.Reader) ([]models.Book, error) {
+	books := []models.Book{}
+	var book *models.Book
+	authors := []string{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r ")
+		if line == 1 {
+			text = strings.TrimPrefix(text, "\ufeff")
+		}
+		if text == "" {
+			continue
+		}
+
+		// tags are two characters then "  - ", the value can be empty on ER
+		if len(text) < 5 || text[2:5] != "  -" {
+			return nil, fmt.Errorf("ris: line %d isn't a tag", line)
+		}
+		name, value := text[:2], strings.TrimSpace(text[5:])
+
+		if name == "TY" {
+			book = &models.Book{}
+			authors = authors[:0]
+			continue
+		}
+		if book == nil {
+			return nil, fmt.Errorf("ris: line %d comes before a TY tag", line)
+		}
+
+		switch name {
+		case "ID":
+			book.Id = value
+		case "TI", "T1", "BT":
+			if book.Title == "" {
+				book.Title = value
+			}
+		case "AU", "A1":
+			authors = append(authors, uninvertName(value))
+		case "PY", "Y1", "DA":
+			if book.Year == 0 {
+				book.Year = parseYear(value)
+			}
+		case "SN":
+			book.ISBN = value
+		case "M3":
+			book.Format = value
+		case "KW":
+			book.Tags = append(book.Tags, value)
+		case "ER":
+			book.Author = strings.Join(authors, " and ")
+			books = append(books, *book)
+			book = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if book != nil {
+		return nil, fmt.Errorf("ris: the last record has no ER tag")
+	}
+
+	return books, nil
+}
+
+// RIS values can't span lines
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
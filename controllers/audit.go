@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// GET /audit?actor=&action=&book_id=&since=&until=&limit=
+// List audit entries newest first. since and until are RFC 3339 timestamps
+func (h *Handler) GetAudit(c *gin.Context) {
+	filter := models.AuditFilter{
+		Actor:  c.Query("actor"),
+		Action: c.Query("action"),
+		BookId: c.Query("book_id"),
+		Limit:  defaultAuditLimit,
+	}
+
+	for param, dst := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				problem.Abort(c, problem.New(http.StatusBadRequest, "'"+param+"' must be an RFC 3339 timestamp"))
+				return
+			}
+			*dst = t
+		}
+	}
+
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "'limit' must be between 1 and "+strconv.Itoa(maxAuditLimit)))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	// a page asked for replaces the limit, and is counted so the whole trail can be paged through
+	page, paged := requestedPage(c)
+	if paged {
+		filter.Limit, filter.Offset = page.PerPage, (page.Page-1)*page.PerPage
+	}
+
+	entries, err := h.primaryDB.GetAuditEntries(context.Background(), filter)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	if paged {
+		total, err := h.primaryDB.CountAuditEntries(context.Background(), filter)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		setTotal(c, page, total)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": entries})
+}
+
+// records a write in the audit trail. The write has already happened by the time
+// this is called, so a failure is logged rather than failing the request
+func (h *Handler) audit(c *gin.Context, action, bookId, resourceId string, before, after any) {
+	entry := models.AuditEntry{
+		Actor:      auth.CurrentIdentity(c).Subject,
+		Action:     action,
+		BookId:     bookId,
+		ResourceId: resourceId,
+		Before:     snapshot(before),
+		After:      snapshot(after),
+		RequestId:  requestId(c),
+	}
+	h.recordAudit(entry)
+}
+
+// appends an entry to the audit trail, stamping it with the current time
+func (h *Handler) recordAudit(entry models.AuditEntry) {
+	entry.Timestamp = time.Now().UTC()
+	if _, err := h.primaryDB.InsertAuditEntry(context.Background(), entry); err != nil {
+		log.Errorf("Unable to record audit entry %s for %s: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+// the current state of a book for the audit trail, nil if it can't be found
+func (h *Handler) auditedBook(ctx context.Context, bookId string) *models.Book {
+	books, err := h.primaryDB.Get(ctx, "books", "Id", bookId)
+	if err != nil || len(books) == 0 {
+		return nil
+	}
+	return &books[0]
+}
+
+// flattens a record to its JSON fields so every backend can store it, nil stays nil
+func snapshot(record any) map[string]any {
+	if record == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(record); v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Unable to snapshot %T for the audit trail: %v", record, err)
+		return nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		log.Errorf("Unable to snapshot %T for the audit trail: %v", record, err)
+		return nil
+	}
+	return fields
+}
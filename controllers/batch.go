@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// POST /books:action
+// Custom methods on the books collection. Gin can't match a literal colon inside a
+// path segment, so the action arrives as a parameter including its colon
+func (h *Handler) BookAction(c *gin.Context) {
+	switch c.Param("action") {
+	case ":batch":
+		h.BatchBooks(c)
+	default:
+		problem.Abort(c, problem.New(http.StatusNotFound, "No such action on books"))
+	}
+}
+
+// POST /books:batch
+// Create, update and delete many books in one request, with a result for each
+// operation. With "atomic" set either every operation is applied or none are
+func (h *Handler) BatchBooks(c *gin.Context) {
+	ctx := context.Background()
+
+	var input models.BatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	results, valid, ok := h.validateBatch(ctx, c, input.Operations, input.Atomic)
+	if !ok {
+		return
+	}
+
+	// an atomic batch with an invalid operation is refused before anything is written
+	if input.Atomic && len(valid) < len(input.Operations) {
+		for i := range results {
+			if results[i].Status == 0 {
+				results[i].Status = http.StatusFailedDependency
+				results[i].Error = "Not applied because another operation failed"
+			}
+		}
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"data": results})
+		return
+	}
+
+	// keep what's about to change for the audit trail
+	ops := make([]models.BatchOperation, len(valid))
+	before := make([]*models.Book, len(valid))
+	for j, i := range valid {
+		ops[j] = input.Operations[i]
+		if ops[j].Op != "create" {
+			before[j] = h.auditedBook(ctx, ops[j].Id)
+		}
+	}
+
+	applied, err := h.primaryDB.ApplyBatch(ctx, "books", ops, input.Atomic)
+	if errors.Is(err, database.ErrNotSupported) {
+		problem.Abort(c, problem.New(http.StatusNotImplemented, "Atomic batches aren't supported by this database"))
+		return
+	}
+	if err != nil {
+		log.Errorf("Database (primary) batch failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+
+	failed := false
+	created := []models.InsertBookInput{}
+	for j, i := range valid {
+		result := &results[i]
+		if applied[j].Err != nil {
+			failed = true
+			result.Status, result.Error = batchError(applied[j].Err)
+			continue
+		}
+
+		book := applied[j].Book
+		result.Status = http.StatusOK
+		result.Id = book.Id
+		switch ops[j].Op {
+		case "create":
+			result.Book = &book
+			created = append(created, *ops[j].Book)
+			h.audit(c, "book.create", book.Id, "", nil, book)
+		case "update":
+			result.Book = &book
+			h.audit(c, "book.update", book.Id, "", before[j], book)
+		case "delete":
+			h.audit(c, "book.delete", book.Id, "", before[j], nil)
+		}
+	}
+
+	// new books are mirrored to the secondary like single creates are
+	if h.secondaryDB != nil && len(created) > 0 {
+		if _, err := h.secondaryDB.InsertMany(ctx, "books", created); err != nil {
+			log.Errorf("Database (secondary) insert failed: %v", err)
+		}
+	}
+
+	if input.Atomic && failed {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"data": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": results})
+}
+
+// a book a batch's creates are compared with, either in the catalogue or created
+// by an earlier operation in the batch
+type batchBook struct {
+	models.Book
+	op int // index of the operation creating it, -1 for books already stored
+}
+
+// checks every operation in a batch the way the single book routes would. Returns a
+// result per operation, with a status set on the invalid ones, and the indexes of the
+// valid ones. Aborts and returns false when the checks themselves can't be done
+func (h *Handler) validateBatch(ctx context.Context, c *gin.Context, ops []models.BatchOperation, atomic bool) ([]models.BatchResult, []int, bool) {
+	// ISBNs in use, including by books created earlier in the batch, the ISBN each book has
+	// now and the books under each title and author, all read in one pass over the catalogue
+	isbns := map[string]string{}
+	bookISBNs := map[string]string{}
+	byTitleAuthor := map[string][]batchBook{}
+	err := h.primaryDB.Each(ctx, "books", func(book models.Book) error {
+		if book.ISBN != "" {
+			isbns[book.ISBN] = book.Id
+			bookISBNs[book.Id] = book.ISBN
+		}
+		key := titleAuthorKey(book)
+		byTitleAuthor[key] = append(byTitleAuthor[key], batchBook{Book: book, op: -1})
+		return nil
+	})
+	if err != nil {
+		abortWithDBError(c, err)
+		return nil, nil, false
+	}
+	genres, err := h.primaryDB.AllGenres(ctx)
+	if err != nil {
+		abortWithDBError(c, err)
+		return nil, nil, false
+	}
+
+	knownGenres := map[string]bool{}
+	for _, genre := range genres {
+		knownGenres[genre.Id] = true
+	}
+
+	// frees the ISBN a book had, unless another operation has taken it since. Only
+	// an atomic batch can count on the update or delete that frees it going through,
+	// otherwise the ISBN stays taken for the rest of the batch
+	release := func(id string) {
+		if !atomic {
+			return
+		}
+		if old, ok := bookISBNs[id]; ok && isbns[old] == id {
+			delete(isbns, old)
+		}
+	}
+
+	policy := duplicatePolicy()
+	canDelete := auth.CurrentIdentity(c).Role.Allows(auth.RoleAdmin)
+
+	results := make([]models.BatchResult, len(ops))
+	valid := []int{}
+	for i := range ops {
+		op := &ops[i]
+		result := &results[i]
+		result.Index, result.Op, result.Id = i, op.Op, op.Id
+
+		fail := func(status int, message string) {
+			result.Status, result.Error = status, message
+		}
+
+		if err := binding.Validator.ValidateStruct(op); err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			continue
+		}
+
+		switch op.Op {
+		case "create":
+			op.Book.Tags = normaliseTags(op.Book.Tags)
+			if op.Book.GenreId != "" && !knownGenres[op.Book.GenreId] {
+				fail(http.StatusNotFound, "No genre found with that id")
+				continue
+			}
+			if op.Book.WorkId != "" {
+				if _, err := h.primaryDB.GetWork(ctx, op.Book.WorkId); errors.Is(err, database.ErrNotFound) {
+					fail(http.StatusNotFound, "No work found with that id")
+					continue
+				} else if err != nil {
+					fail(batchError(err))
+					continue
+				}
+			}
+			if id, taken := isbns[op.Book.ISBN]; op.Book.ISBN != "" && taken {
+				fail(http.StatusConflict, "A book with that ISBN already exists")
+				result.Id = id
+				continue
+			}
+
+			candidate := models.Book{Title: op.Book.Title, Author: op.Book.Author, ISBN: op.Book.ISBN}
+			if policy != duplicatesAllow {
+				for _, book := range byTitleAuthor[titleAuthorKey(candidate)] {
+					if !isDuplicate(candidate, book.Book) {
+						continue
+					}
+					switch {
+					case policy == duplicatesReject && book.op >= 0:
+						fail(http.StatusConflict, fmt.Sprintf("Operation %d creates a book with the same title and author", book.op))
+					case policy == duplicatesReject:
+						fail(http.StatusConflict, "A book with that title and author already exists")
+						result.Id = book.Id
+					case book.op >= 0:
+						result.Warning = fmt.Sprintf("Possible duplicate of the book created by operation %d", book.op)
+					default:
+						result.Warning = "Possible duplicate of " + book.Id
+					}
+					break
+				}
+				if result.Status != 0 {
+					continue
+				}
+			}
+			if op.Book.ISBN != "" {
+				isbns[op.Book.ISBN] = ""
+			}
+			key := titleAuthorKey(candidate)
+			byTitleAuthor[key] = append(byTitleAuthor[key], batchBook{Book: candidate, op: i})
+
+		case "update":
+			if op.Changes.Tags != nil {
+				tags := normaliseTags(*op.Changes.Tags)
+				op.Changes.Tags = &tags
+			}
+			if op.Changes.GenreId != nil && *op.Changes.GenreId != "" && !knownGenres[*op.Changes.GenreId] {
+				fail(http.StatusNotFound, "No genre found with that id")
+				continue
+			}
+			if isbn := op.Changes.ISBN; isbn != nil {
+				if id, taken := isbns[*isbn]; *isbn != "" && taken && id != op.Id {
+					fail(http.StatusConflict, "A book with that ISBN already exists")
+					continue
+				}
+				release(op.Id)
+				if *isbn != "" {
+					isbns[*isbn] = op.Id
+					bookISBNs[op.Id] = *isbn
+				}
+			}
+
+		case "delete":
+			if !canDelete {
+				fail(http.StatusForbidden, "Deleting books requires the admin role")
+				continue
+			}
+			release(op.Id)
+		}
+
+		valid = append(valid, i)
+	}
+
+	return results, valid, true
+}
+
+// the status and message for an operation the database couldn't apply
+func batchError(err error) (int, string) {
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return http.StatusNotFound, "No book found with that id"
+	case errors.Is(err, database.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, "The book has changed since it was read"
+	case errors.Is(err, database.ErrBatchAborted):
+		return http.StatusFailedDependency, "Not applied because another operation failed"
+	}
+	log.Errorf("Database (primary) batch operation failed: %v", err)
+	p := dbProblem(err)
+	return p.Status, p.Detail
+}
@@ -4,19 +4,24 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/importer"
 	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
 	"github.com/garbhank/gin-books-api/utils"
 )
 
 type Handler struct {
 	primaryDB   database.Database
 	secondaryDB database.Database
+
+	imports *importer.Jobs // background imports started by this instance
 }
 
 func NewHandler(primary database.Database, secondary database.Database) *Handler {
@@ -34,6 +39,7 @@ func NewHandler(primary database.Database, secondary database.Database) *Handler
 	return &Handler{
 		primaryDB:   primary,
 		secondaryDB: secondary,
+		imports:     importer.NewJobs(),
 	}
 }
 
@@ -91,25 +97,155 @@ func (h *Handler) Ping(c *gin.Context) {
 }
 
 // GET /books/?table=books
-// Get all books
+// Get all books, or every book as it was at ?as_of=
 func (h *Handler) GetAllBooks(c *gin.Context) {
 	ctx := context.Background()
 
-	// parse out author name in query params
+	// the table to read, only books for now
 	table, err := utils.GetParams(c, "table")
 	log.Infof("table: %s\n", table)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No 'title' parameter provided"})
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'table' parameter provided"))
+		return
+	}
+
+	asOf, ok := asOfParam(c)
+	if !ok {
+		return
+	}
+	format, ok := citationFormat(c)
+	if !ok {
+		return
+	}
+
+	var data []models.Book
+	if asOf.IsZero() {
+		data, err = h.primaryDB.All(ctx, table)
+	} else {
+		data, err = h.primaryDB.BooksAsOf(ctx, table, asOf)
+	}
+	if err != nil {
+		abortWithDBError(c, err)
 		return
 	}
+	h.attachRatings(ctx, data)
 
-	data, err := h.primaryDB.All(ctx, table)
+	genres, err := h.primaryDB.AllGenres(ctx)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Unable to complete query"})
+		abortWithDBError(c, err)
 		return
 	}
+	data = filterBooks(data, c.Query("tag"), c.Query("genre"), genres)
+
+	// optionally order the results, e.g. ?sort=-rating for the best rated first
+	if sortBy := c.Query("sort"); sortBy != "" {
+		if err := sortBooks(data, sortBy); err != nil {
+			problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
 
-	c.JSON(http.StatusOK, gin.H{"data": data})
+	if format != "" {
+		renderCitation(c, format, data, false)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data, "facets": computeFacets(data, genres)})
+}
+
+// GET /books, v2
+// List the books, narrowed down by ?title=, ?author=, ?tag= and ?genre=. Takes
+// the place of v1's GET /books/?table=, /books/title/ and /books/author/, and
+// isn't capped like All is on some backends. The books are read one at a time
+// and only the page asked for is kept, unless they have to be sorted first
+func (h *Handler) ListBooks(c *gin.Context) {
+	ctx := context.Background()
+
+	asOf, ok := asOfParam(c)
+	if !ok {
+		return
+	}
+	format, ok := citationFormat(c)
+	if !ok {
+		return
+	}
+	sortBy := c.Query("sort")
+	if sortBy != "" {
+		if err := sortBooks(nil, sortBy); err != nil {
+			problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
+
+	genres, err := h.primaryDB.AllGenres(ctx)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	title, author := c.Query("title"), c.Query("author")
+	matches := bookFilter(c.Query("tag"), c.Query("genre"), genres)
+	facets := newFacetCounter(genres)
+
+	page, paged := requestedPage(c)
+	keepAll := !paged || sortBy != "" || format != ""
+	start, end := 0, 0
+	if paged {
+		start = (page.Page - 1) * page.PerPage
+		end = start + page.PerPage
+	}
+
+	books := []models.Book{}
+	total := 0
+	add := func(book models.Book) error {
+		if (title != "" && book.Title != title) || (author != "" && book.Author != author) || !matches(book) {
+			return nil
+		}
+		facets.add(book)
+		if keepAll || (total >= start && total < end) {
+			books = append(books, book)
+		}
+		total++
+		return nil
+	}
+	if asOf.IsZero() {
+		err = h.primaryDB.Each(ctx, "books", add)
+	} else {
+		var past []models.Book
+		if past, err = h.primaryDB.BooksAsOf(ctx, "books", asOf); err == nil {
+			for _, book := range past {
+				add(book)
+			}
+		}
+	}
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	// sorting by rating needs every book's rating, otherwise only the page's are looked up
+	byRating := strings.HasPrefix(strings.TrimPrefix(sortBy, "-"), "rating")
+	if byRating {
+		h.attachRatings(ctx, books)
+	}
+	if sortBy != "" {
+		sortBooks(books, sortBy)
+	}
+
+	if format != "" {
+		renderCitation(c, format, books, false)
+		return
+	}
+	if paged {
+		setTotal(c, page, total)
+		if keepAll {
+			from, to := pageBounds(page, total)
+			books = books[from:to]
+		}
+	}
+	if !byRating {
+		h.attachRatings(ctx, books)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": books, "facets": facets.facets})
 }
 
 // POST /books
@@ -120,10 +256,51 @@ func (h *Handler) CreateBook(c *gin.Context) {
 	// Validate input
 	var newBook models.InsertBookInput
 	if err := c.ShouldBindJSON(&newBook); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
 		return
 	}
 
+	newBook.Tags = normaliseTags(newBook.Tags)
+	if newBook.GenreId != "" && !h.genreExists(c, newBook.GenreId) {
+		return
+	}
+
+	// editions must belong to an existing work
+	if newBook.WorkId != "" {
+		if _, err := h.primaryDB.GetWork(ctx, newBook.WorkId); err != nil {
+			abortLookup(c, err, "work")
+			return
+		}
+	}
+
+	// every edition has its own ISBN
+	if newBook.ISBN != "" {
+		existing, err := h.primaryDB.Get(ctx, "books", "ISBN", newBook.ISBN)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		if len(existing) > 0 {
+			problem.Abort(c, problem.New(http.StatusConflict, "A book with that ISBN already exists").WithCode(codeDuplicateISBN).With("id", existing[0].Id))
+			return
+		}
+	}
+
+	// the same title and author may already be in the catalogue
+	policy := duplicatePolicy()
+	duplicates := []models.Book{}
+	if policy != duplicatesAllow {
+		var err error
+		if duplicates, err = h.duplicatesOf(ctx, newBook); err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		if policy == duplicatesReject && len(duplicates) > 0 {
+			problem.Abort(c, problem.New(http.StatusConflict, "A book with that title and author already exists").WithCode(codeDuplicateBook).With("id", duplicates[0].Id))
+			return
+		}
+	}
+
 	// struct to carry goroutine db insert results info
 	type insertRes struct {
 		Book models.Book // insert response book
@@ -156,16 +333,33 @@ func (h *Handler) CreateBook(c *gin.Context) {
 	}
 
 	var respBook = models.Book{}
+	var primaryErr error
 	for i := 0; i < numResults; i++ {
 		res := <-results
 		if res.Err != nil {
 			log.Errorf("Database (%s) insert failed: %v", res.DB, res.Err)
 		}
 		if res.DB == "primary" {
-			respBook = res.Book
+			respBook, primaryErr = res.Book, res.Err
 		}
 	}
+	// the secondary is only a mirror, but nothing was created unless the primary took it
+	if primaryErr != nil {
+		abortWithDBError(c, primaryErr)
+		return
+	}
+	h.audit(c, "book.create", respBook.Id, "", nil, respBook)
+	c.Header("ETag", bookETag(respBook))
 
+	if len(duplicates) > 0 {
+		ids := []string{}
+		for _, duplicate := range duplicates {
+			ids = append(ids, duplicate.Id)
+		}
+		log.Warnf("Book %s may duplicate %v", respBook.Id, ids)
+		c.JSON(http.StatusOK, gin.H{"data": respBook, "warning": "Possible duplicate of an existing book", "duplicates": ids})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": respBook})
 }
 
@@ -178,37 +372,81 @@ func (h *Handler) FindBook(c *gin.Context) {
 	bookTitle, err := utils.GetParams(c, "title")
 	fmt.Printf("bookTitle: %s\n", bookTitle)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No 'title' parameter provided"})
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'title' parameter provided"))
+		return
+	}
+	format, ok := citationFormat(c)
+	if !ok {
 		return
 	}
 
 	// array of books to return
 	bookDocs, err := h.primaryDB.Get(ctx, "books", "Title", bookTitle)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Unable to complete query"})
+		abortWithDBError(c, err)
 		return
 	}
+	h.attachRatings(ctx, bookDocs)
 
+	if format != "" {
+		renderCitation(c, format, bookDocs, false)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": bookDocs})
 }
 
+// GET /books/:id
+// Find a single edition by id, optionally as it was at ?as_of=. Citation formats are
+// picked with ?format= or the Accept header
+func (h *Handler) GetBook(c *gin.Context) {
+	asOf, ok := asOfParam(c)
+	if !ok {
+		return
+	}
+	format, ok := citationFormat(c)
+	if !ok {
+		return
+	}
+
+	if !asOf.IsZero() {
+		h.respondWithBookAsOf(c, c.Param("id"), asOf, format)
+		return
+	}
+	if format != "" {
+		if book, ok := h.currentBook(c, c.Param("id")); ok {
+			renderCitation(c, format, []models.Book{book}, true)
+		}
+		return
+	}
+	h.respondWithBook(c, c.Param("id"))
+}
+
 func (h *Handler) FindAuthor(c *gin.Context) {
 	ctx := context.Background()
 
 	// parse out author name in query params
 	author, err := utils.GetParams(c, "name")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No 'name' parameter provided"})
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'name' parameter provided"))
+		return
+	}
+	format, ok := citationFormat(c)
+	if !ok {
 		return
 	}
 
 	// array of books to return
 	authorBooks, err := h.primaryDB.Get(ctx, "books", "Author", author)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Unable to complete query"})
+		abortWithDBError(c, err)
 		return
 	}
+	h.attachRatings(ctx, authorBooks)
 
+	if format != "" {
+		renderCitation(c, format, authorBooks, false)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"data": authorBooks})
 }
 
@@ -219,15 +457,82 @@ func (h *Handler) DeleteBook(c *gin.Context) {
 	// parse out author name in query params
 	title, err := utils.GetParams(c, "title")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No 'title' parameter provided"})
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'title' parameter provided"))
 		return
 	}
 
-	booksDeleted, err := h.primaryDB.Drop(ctx, "books", "Title", title)
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" && ifMatchRequired() {
+		problem.Abort(c, problem.New(http.StatusPreconditionRequired, "An If-Match header with the ETag of every book with that title is required"))
+		return
+	}
+
+	if ifMatch == "" {
+		deleted, err := h.primaryDB.Drop(ctx, "books", "Title", title)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		for _, book := range deleted {
+			h.audit(c, "book.delete", book.Id, "", book, nil)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": len(deleted)})
+		return
+	}
+
+	// with If-Match every book with the title has to match it, and they're deleted
+	// together only if they're still the versions that were checked
+	matched, err := h.primaryDB.Get(ctx, "books", "Title", title)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "Unable to complete query"})
+		abortWithDBError(c, err)
+		return
+	}
+	if len(matched) == 0 {
+		problem.Abort(c, problem.New(http.StatusPreconditionFailed, "No book with that title exists"))
+		return
+	}
+	revisions := map[string]int{}
+	for _, book := range matched {
+		if !ifMatches(ifMatch, book) {
+			problem.Abort(c, problem.New(http.StatusPreconditionFailed, "A book with that title has changed since it was read").With("id", book.Id).With("etag", bookETag(book)))
+			return
+		}
+		revisions[book.Id] = book.Revision
+	}
+
+	deleted, err := h.primaryDB.Drop(database.ExpectRevisions(ctx, revisions), "books", "Title", title)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	for _, book := range deleted {
+		h.audit(c, "book.delete", book.Id, "", book, nil)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": len(deleted)})
+}
+
+// DELETE /books/:id
+// Delete a single edition, leaving other editions sharing its title untouched
+func (h *Handler) DeleteBookById(c *gin.Context) {
+	bookId := c.Param("id")
+
+	ctx, ok := h.precondition(c, bookId)
+	if !ok {
+		return
+	}
+
+	deleted, err := h.primaryDB.Drop(ctx, "books", "Id", bookId)
+	if err != nil {
+		abortLookup(c, err, "book")
+		return
+	}
+	if len(deleted) == 0 {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No book found with that id"))
 		return
 	}
+	h.audit(c, "book.delete", bookId, "", deleted[0], nil)
 
-	c.JSON(http.StatusOK, gin.H{"data": booksDeleted})
+	c.JSON(http.StatusOK, gin.H{"data": len(deleted)})
 }
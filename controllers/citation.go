@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/citation"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// what an Accept header is matched against, JSON first so that */* gets it
+var citationOffers = []string{
+	gin.MIMEJSON,
+	citation.ContentTypes[citation.BibTeX],
+	citation.ContentTypes[citation.RIS],
+	citation.ContentTypes[citation.MARCXML],
+	citation.ContentTypes[citation.DublinCore],
+}
+
+// the citation format a read of books asks for with ?format=, or failing that the
+// Accept header. Empty means JSON. Aborts with a 400 for an unknown ?format=
+func citationFormat(c *gin.Context) (string, bool) {
+	varyAccept(c)
+
+	format := strings.ToLower(c.Query("format"))
+	switch {
+	case format == "":
+		return acceptedCitation(c), true
+	case format == "json":
+		return "", true
+	case slices.Contains(citation.Formats, format):
+		return format, true
+	}
+
+	problem.Abort(c, problem.New(http.StatusBadRequest, "'format' must be json or one of "+strings.Join(citation.Formats, ", ")))
+	return "", false
+}
+
+func acceptedCitation(c *gin.Context) string {
+	if c.GetHeader("Accept") == "" {
+		return ""
+	}
+
+	offer := c.NegotiateFormat(citationOffers...)
+	for format, contentType := range citation.ContentTypes {
+		if contentType == offer {
+			return format
+		}
+	}
+	return ""
+}
+
+// reports whether the Accept header asks for something other than JSON. The page
+// cache keys on the URL alone, so those responses have to skip it
+func Negotiated(c *gin.Context) bool {
+	return acceptedCitation(c) != ""
+}
+
+// responds with books as citations, a single book as a record on its own rather than a list
+func renderCitation(c *gin.Context, format string, books []models.Book, single bool) {
+	var buf bytes.Buffer
+	var err error
+	if single {
+		err = citation.EncodeBook(&buf, format, books[0])
+	} else {
+		err = citation.Encode(&buf, format, books)
+	}
+	if err != nil {
+		log.Errorf("Unable to write %s citations: %v", format, err)
+		problem.Abort(c, problem.New(http.StatusInternalServerError, "Unable to write the citations"))
+		return
+	}
+
+	// the XML formats declare their encoding themselves
+	contentType := citation.ContentTypes[format]
+	if !strings.HasSuffix(contentType, "+xml") {
+		contentType += "; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
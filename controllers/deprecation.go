@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// v1 routes that select books with query parameters, and the v2 routes that take
+// their place. Deleting every book with a title has no successor, v2 only deletes
+// books one at a time by id
+var v1Replaced = map[string]string{
+	"GET /api/v1/books/":        "/api/v2/books",
+	"GET /api/v1/books/author/": "/api/v2/books",
+	"GET /api/v1/books/title/":  "/api/v2/books",
+	"DELETE /api/v1/books/":     "",
+}
+
+// middleware marking responses as coming from v1, which is deprecated since the
+// given time and goes away at sunset. Every response gets Deprecation (RFC 9745)
+// and Sunset (RFC 8594) headers, and a successor-version link to the v2 route
+// replacing it if there is one
+func DeprecatedV1(since, sunset time.Time) gin.HandlerFunc {
+	deprecation := "@" + strconv.FormatInt(since.Unix(), 10)
+	sunsetAt := sunset.UTC().Format(http.TimeFormat)
+
+	return func(c *gin.Context) {
+		successor, ok := v1Replaced[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			successor = strings.Replace(c.Request.URL.Path, "/api/v1", "/api/v2", 1)
+		}
+
+		c.Header("Deprecation", deprecation)
+		c.Header("Sunset", sunsetAt)
+		if successor != "" {
+			c.Writer.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// what CreateBook does with a book that has the same title and author as an existing one
+const (
+	duplicatesReject = "reject" // 409 with the existing book's id
+	duplicatesWarn   = "warn"   // insert it, but point out the possible duplicates
+	duplicatesAllow  = "allow"  // insert it without checking
+)
+
+// GET /books/duplicates
+// Report groups of existing books that share an ISBN or look like the same edition
+func (h *Handler) GetDuplicates(c *gin.Context) {
+	books := []models.Book{}
+	err := h.primaryDB.Each(context.Background(), "books", func(book models.Book) error {
+		books = append(books, book)
+		return nil
+	})
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, findDuplicateGroups(books))})
+}
+
+// the DUPLICATE_POLICY setting, unknown values fall back to warning
+func duplicatePolicy() string {
+	policy := strings.ToLower(utils.GetenvDefault("DUPLICATE_POLICY", duplicatesWarn))
+	switch policy {
+	case duplicatesReject, duplicatesWarn, duplicatesAllow:
+		return policy
+	}
+	log.Warnf("Unknown DUPLICATE_POLICY %q, warning about duplicates instead", policy)
+	return duplicatesWarn
+}
+
+// existing books that a new one would duplicate by title and author
+func (h *Handler) duplicatesOf(ctx context.Context, newBook models.InsertBookInput) ([]models.Book, error) {
+	// the databases can't match normalised titles, so every book is compared here
+	book := models.Book{Title: newBook.Title, Author: newBook.Author, ISBN: newBook.ISBN}
+	duplicates := []models.Book{}
+	err := h.primaryDB.Each(ctx, "books", func(candidate models.Book) error {
+		if isDuplicate(book, candidate) {
+			duplicates = append(duplicates, candidate)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// books with the same normalised title and author are duplicates unless both have
+// an ISBN, in which case they're different editions of the same work
+func isDuplicate(a, b models.Book) bool {
+	if titleAuthorKey(a) != titleAuthorKey(b) {
+		return false
+	}
+	return a.ISBN == "" || b.ISBN == "" || a.ISBN == b.ISBN
+}
+
+// titles and authors are compared ignoring case, punctuation, spacing and a leading article
+func titleAuthorKey(book models.Book) string {
+	title := normaliseText(book.Title)
+	for _, article := range []string{"the ", "a ", "an "} {
+		if strings.HasPrefix(title, article) && len(title) > len(article) {
+			title = title[len(article):]
+			break
+		}
+	}
+	return title + "|" + normaliseText(book.Author)
+}
+
+// lowercases, drops punctuation and collapses whitespace
+func normaliseText(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteRune(' ')
+			}
+			b.WriteRune(r)
+			space = false
+		case unicode.IsSpace(r):
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// groups books sharing an ISBN, then books sharing a title and author that
+// aren't told apart by their ISBNs. Groups are ordered by reason and key
+func findDuplicateGroups(books []models.Book) []models.DuplicateGroup {
+	byISBN := map[string][]models.Book{}
+	byTitleAuthor := map[string][]models.Book{}
+	for _, book := range books {
+		if book.ISBN != "" {
+			byISBN[book.ISBN] = append(byISBN[book.ISBN], book)
+		}
+		byTitleAuthor[titleAuthorKey(book)] = append(byTitleAuthor[titleAuthorKey(book)], book)
+	}
+
+	groups := []models.DuplicateGroup{}
+	for isbn, matches := range byISBN {
+		if len(matches) > 1 {
+			groups = append(groups, models.DuplicateGroup{Reason: "isbn", Key: isbn, Books: matches})
+		}
+	}
+	for key, matches := range byTitleAuthor {
+		// keep the books that duplicate at least one other, distinct editions drop out
+		duplicated := []models.Book{}
+		for i, book := range matches {
+			for j, other := range matches {
+				if i != j && isDuplicate(book, other) {
+					duplicated = append(duplicated, book)
+					break
+				}
+			}
+		}
+		if len(duplicated) > 1 {
+			groups = append(groups, models.DuplicateGroup{Reason: "title_author", Key: key, Books: duplicated})
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Reason != groups[j].Reason {
+			return groups[i].Reason < groups[j].Reason
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
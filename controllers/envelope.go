@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// how many items a page of a v2 list has unless ?per_page= says otherwise, and the most it can
+const (
+	defaultPerPage = 25
+	maxPerPage     = 100
+)
+
+// keys the page asked for and the page a handler returned are kept under in the context
+const (
+	pageRequestKey = "page_request"
+	paginationKey  = "pagination"
+)
+
+// middleware giving every v2 JSON response the same envelope. The resource or
+// list is under "data" and anything else the handler sent with it is under
+// "meta". GETs can ask for a page of a list with ?page= and ?per_page=, which
+// list handlers take from requestedPage. The handlers are v1's, which leave
+// their lists whole when there's no page asked for, so both versions share
+// their behaviour
+func Envelope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !pageParams(c) {
+			return
+		}
+
+		w := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.streaming {
+			return
+		}
+		if w.status < http.StatusBadRequest && strings.HasPrefix(w.Header().Get("Content-Type"), gin.MIMEJSON) && w.body.Len() > 0 {
+			envelop(c, w)
+		}
+		w.flush()
+	}
+}
+
+// reads ?page= and ?per_page= into the page GETs ask for
+func pageParams(c *gin.Context) bool {
+	if c.Request.Method != http.MethodGet {
+		return true
+	}
+
+	page := models.Pagination{Page: 1, PerPage: defaultPerPage}
+	if param := c.Query("page"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "'page' must be a positive number"))
+			return false
+		}
+		page.Page = n
+	}
+	if param := c.Query("per_page"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxPerPage {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "'per_page' must be between 1 and "+strconv.Itoa(maxPerPage)))
+			return false
+		}
+		page.PerPage = n
+	}
+	c.Set(pageRequestKey, page)
+	return true
+}
+
+// the page of a list the request asks for. Only v2 asks for one, v1 gets the whole list
+func requestedPage(c *gin.Context) (models.Pagination, bool) {
+	page, ok := c.Get(pageRequestKey)
+	if !ok {
+		return models.Pagination{}, false
+	}
+	return page.(models.Pagination), true
+}
+
+// records how many items there are in the list a page was taken from, for the envelope
+func setTotal(c *gin.Context, page models.Pagination, total int) {
+	page.Total = total
+	page.TotalPages = max(1, (total+page.PerPage-1)/page.PerPage)
+	c.Set(paginationKey, page)
+}
+
+// the window of a list of total items that a page covers
+func pageBounds(page models.Pagination, total int) (int, int) {
+	start := min((page.Page-1)*page.PerPage, total)
+	return start, min(start+page.PerPage, total)
+}
+
+// pages a list the handler has in full, returning it untouched when no page is asked for
+func paginate[T any](c *gin.Context, items []T) []T {
+	page, ok := requestedPage(c)
+	if !ok {
+		return items
+	}
+	setTotal(c, page, len(items))
+	start, end := pageBounds(page, len(items))
+	return items[start:end]
+}
+
+// rewrites the v1 {"data": ..., ...} body held in w as the v2 envelope. Bodies
+// without "data", like the description itself, are left as they are
+func envelop(c *gin.Context, w *bufferedWriter) {
+	value, err := decodeOrdered(w.body.Bytes())
+	if err != nil {
+		log.Errorf("Unable to read a JSON response to wrap it: %v", err)
+		return
+	}
+	object, ok := value.(orderedObject)
+	if !ok {
+		return
+	}
+	data, ok := object.get("data")
+	if !ok {
+		return
+	}
+
+	meta := orderedObject{}
+	var links *models.PageLinks
+	if value, paged := c.Get(paginationKey); paged {
+		pagination := value.(models.Pagination)
+		meta = append(meta,
+			orderedMember{Key: "page", Value: pagination.Page},
+			orderedMember{Key: "per_page", Value: pagination.PerPage},
+			orderedMember{Key: "total", Value: pagination.Total},
+			orderedMember{Key: "total_pages", Value: pagination.TotalPages},
+		)
+		links = pageLinks(c, pagination)
+	}
+	for _, member := range object {
+		if member.Key != "data" {
+			meta = append(meta, member)
+		}
+	}
+
+	envelope := orderedObject{{Key: "data", Value: data}}
+	if len(meta) > 0 {
+		envelope = append(envelope, orderedMember{Key: "meta", Value: meta})
+	}
+	if links != nil {
+		envelope = append(envelope, orderedMember{Key: "links", Value: links})
+	}
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		log.Errorf("Unable to wrap a JSON response: %v", err)
+		return
+	}
+	w.body.Reset()
+	w.body.Write(body)
+}
+
+// the request's own path and query, at each of the other pages
+func pageLinks(c *gin.Context, pagination models.Pagination) *models.PageLinks {
+	at := func(page int) string {
+		query := c.Request.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(pagination.PerPage))
+		return c.Request.URL.Path + "?" + query.Encode()
+	}
+
+	links := &models.PageLinks{Self: at(pagination.Page), First: at(1), Last: at(pagination.TotalPages)}
+	if pagination.Page > 1 {
+		links.Prev = at(min(pagination.Page-1, pagination.TotalPages))
+	}
+	if pagination.Page < pagination.TotalPages {
+		links.Next = at(pagination.Page + 1)
+	}
+	return links
+}
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// a book's revision is its version, so the ETag changes with every catalogue edit.
+// Rating summaries come from reviews and aren't part of it
+func bookETag(book models.Book) string {
+	return `"` + strconv.Itoa(book.Revision) + `"`
+}
+
+// a strong ETag only stands for one representation, so a response re-encoded
+// from JSON gets the format added to it. Weak tags are left alone
+func formatETag(etag, format string) string {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + format + `"`
+}
+
+// whether an If-Match header lists the book's current ETag in any format
+func bookETagMatches(ifMatch string, book models.Book) bool {
+	etag := bookETag(book)
+	for _, format := range []string{"", renderXML, renderYAML, renderMsgPack, renderCSV} {
+		if format != "" {
+			etag = formatETag(bookETag(book), format)
+		}
+		if etagMatches(ifMatch, etag, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// middleware answering conditional GETs. Responses get an ETag, either the one set
+// by the handler or a hash of the body, and a matching If-None-Match gets a 304
+func ConditionalGet() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+
+		w := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.streaming {
+			return
+		}
+		if w.status != http.StatusOK {
+			w.flush()
+			return
+		}
+
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			sum := sha256.Sum256(w.body.Bytes())
+			etag = `W/"` + hex.EncodeToString(sum[:8]) + `"`
+			w.Header().Set("ETag", etag)
+		}
+
+		ifNoneMatch := c.GetHeader("If-None-Match")
+		if strings.TrimSpace(ifNoneMatch) == "*" || etagMatches(ifNoneMatch, etag, true) {
+			w.Header().Del("Content-Type")
+			w.Header().Del("Content-Length")
+			w.ResponseWriter.WriteHeader(http.StatusNotModified)
+			w.ResponseWriter.WriteHeaderNow()
+			return
+		}
+		w.flush()
+	}
+}
+
+// holds a response back until the handler is done so that its ETag can be
+// checked. Handlers that flush are streaming and are passed straight through
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status    int
+	written   bool
+	streaming bool
+	body      bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	if w.streaming {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *bufferedWriter) Status() int {
+	if w.streaming {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if w.streaming {
+		return w.ResponseWriter.Size()
+	}
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	if w.streaming {
+		return w.ResponseWriter.Written()
+	}
+	return w.written
+}
+
+func (w *bufferedWriter) Flush() {
+	if !w.streaming {
+		w.flush()
+		w.streaming = true
+	}
+	w.ResponseWriter.Flush()
+}
+
+// sends on whatever has been held back
+func (w *bufferedWriter) flush() {
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.body.Len() > 0 {
+		w.ResponseWriter.Write(w.body.Bytes())
+	} else if w.written {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+	w.body.Reset()
+}
+
+// reports whether an If-Match or If-None-Match header lists etag. If-None-Match
+// compares weakly, ignoring W/ prefixes, while If-Match only takes strong tags
+func etagMatches(header, etag string, weak bool) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if candidate == etag && !strings.HasPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checks If-Match before a write to a single book and returns the context the
+// write should use, so the database rejects it if the book changes in between.
+// Aborts with a 428 when REQUIRE_IF_MATCH is set and the header is missing, and
+// a 412 when it doesn't match the book's current ETag or the book is missing
+func (h *Handler) precondition(c *gin.Context, bookId string) (context.Context, bool) {
+	ctx := context.Background()
+
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		if ifMatchRequired() {
+			problem.Abort(c, problem.New(http.StatusPreconditionRequired, "An If-Match header with the book's ETag is required"))
+			return nil, false
+		}
+		return ctx, true
+	}
+
+	books, err := h.primaryDB.Get(ctx, "books", "Id", bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return nil, false
+	}
+	// nothing matches a book that doesn't exist, not even *
+	if len(books) == 0 {
+		problem.Abort(c, problem.New(http.StatusPreconditionFailed, "The book doesn't exist"))
+		return nil, false
+	}
+
+	current := books[0]
+	if !ifMatches(ifMatch, current) {
+		problem.Abort(c, problem.New(http.StatusPreconditionFailed, "The book has changed since it was read").With("etag", bookETag(current)))
+		return nil, false
+	}
+
+	return database.ExpectRevision(ctx, current.Revision), true
+}
+
+// whether REQUIRE_IF_MATCH refuses writes without an If-Match header
+func ifMatchRequired() bool {
+	return strings.ToLower(utils.GetenvDefault("REQUIRE_IF_MATCH", "false")) == "true"
+}
+
+// whether an If-Match header is satisfied by the book, where * takes any current version
+func ifMatches(ifMatch string, book models.Book) bool {
+	return strings.TrimSpace(ifMatch) == "*" || bookETagMatches(ifMatch, book)
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// export formats and their content types
+var exportTypes = map[string]string{
+	"csv":    "text/csv; charset=utf-8",
+	"ndjson": "application/x-ndjson",
+	"json":   "application/json; charset=utf-8",
+}
+
+// named like the importer's fields, so an export can be imported again
+var exportColumns = []string{"id", "title", "author", "work_id", "isbn", "format", "tags", "genre_id", "year"}
+
+// the response is flushed to the client every this many books
+const exportFlushEvery = 100
+
+// GET /export?format=csv|ndjson|json
+// Download the whole catalogue as a file. Books are written out as they're read from the
+// database rather than held in memory, and compressed when the client accepts gzip
+func (h *Handler) ExportBooks(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if _, ok := exportTypes[format]; !ok {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "'format' must be csv, ndjson or json"))
+		return
+	}
+
+	// the request's context, so the query stops if the client goes away
+	stream := &exportStream{c: c, format: format}
+	err := h.primaryDB.Each(c.Request.Context(), "books", stream.write)
+
+	// once the first book is out the status can't change, so a failure part way
+	// through leaves the body cut short instead
+	if err != nil && !stream.started {
+		log.Errorf("Database (primary) export failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	if err != nil {
+		log.Errorf("Export stopped after %d books: %v", stream.count, err)
+		stream.flush()
+		return
+	}
+
+	stream.finish()
+}
+
+// writes books to the response one at a time, sending the headers with the first
+type exportStream struct {
+	c       *gin.Context
+	format  string
+	started bool
+	count   int
+
+	w   io.Writer // the response, or the gzip writer on top of it
+	gz  *gzip.Writer
+	csv *csv.Writer
+}
+
+func (s *exportStream) start() error {
+	s.started = true
+
+	header := s.c.Writer.Header()
+	header.Set("Content-Type", exportTypes[s.format])
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="books-%s.%s"`, time.Now().UTC().Format("20060102"), s.format))
+	header.Add("Vary", "Accept-Encoding")
+
+	s.w = s.c.Writer
+	if acceptsGzip(s.c.GetHeader("Accept-Encoding")) {
+		header.Set("Content-Encoding", "gzip")
+		s.gz = gzip.NewWriter(s.c.Writer)
+		s.w = s.gz
+	}
+	s.c.Status(http.StatusOK)
+
+	switch s.format {
+	case "csv":
+		s.csv = csv.NewWriter(s.w)
+		return s.csv.Write(exportColumns)
+	case "json":
+		_, err := io.WriteString(s.w, "[")
+		return err
+	}
+	return nil
+}
+
+// returns an error once the client has gone, which stops the export
+func (s *exportStream) write(book models.Book) error {
+	if !s.started {
+		if err := s.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch s.format {
+	case "csv":
+		year := ""
+		if book.Year != 0 {
+			year = strconv.Itoa(book.Year)
+		}
+		err = s.csv.Write([]string{book.Id, book.Title, book.Author, book.WorkId, book.ISBN, book.Format, strings.Join(book.Tags, "; "), book.GenreId, year})
+	case "ndjson", "json":
+		var line []byte
+		line, err = json.Marshal(book)
+		if err != nil {
+			return err
+		}
+		if s.format == "ndjson" {
+			line = append(line, '\n')
+		} else if s.count > 0 {
+			line = append([]byte(","), line...)
+		}
+		_, err = s.w.Write(line)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.count++
+	if s.count%exportFlushEvery == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *exportStream) flush() error {
+	if s.csv != nil {
+		s.csv.Flush()
+		if err := s.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if s.gz != nil {
+		if err := s.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+// closes off the file, which is still sent with its headers when there were no books
+func (s *exportStream) finish() {
+	if !s.started {
+		if err := s.start(); err != nil {
+			return
+		}
+	}
+
+	if s.format == "json" {
+		io.WriteString(s.w, "]")
+	}
+	if s.csv != nil {
+		s.csv.Flush()
+	}
+	if s.gz != nil {
+		s.gz.Close()
+	}
+	s.c.Writer.Flush()
+}
+
+// reports whether an Accept-Encoding header allows gzip, which it doesn't when
+// it's given a q of 0
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		return q > 0
+	}
+	return false
+}
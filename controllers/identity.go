@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/auth"
+)
+
+// GET /whoami
+// Show the identity the API resolved for the caller
+func (h *Handler) Whoami(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"data": auth.CurrentIdentity(c)})
+}
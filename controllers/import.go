@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// uploads up to this size are imported while the client waits, larger ones in the background
+const syncImportBytes = 1 << 20
+
+// POST /import?format=csv|ndjson&mapping=Header=field,...&async=true
+// Import books from a CSV or NDJSON file, sent as the body or as the "file" field of a
+// multipart form. Each row is validated like POST /books and failures are reported per row
+func (h *Handler) ImportBooks(c *gin.Context) {
+	upload, filename, err := importUpload(c)
+	if err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Unable to read the upload, send it as the body or a 'file' form field"))
+		return
+	}
+	defer upload.Close()
+
+	format := c.Query("format")
+	if format == "" {
+		format = importer.DetectFormat(filename, c.ContentType())
+	}
+	if format != importer.CSV && format != importer.NDJSON {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Unable to tell the file format, set ?format=csv or ?format=ndjson"))
+		return
+	}
+
+	mapping, err := importer.ParseMapping(c.Query("mapping"))
+	if err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	// the upload is kept on disk so a background import can outlive the request
+	file, size, err := spool(upload)
+	if err != nil {
+		log.Errorf("Unable to store import upload: %v", err)
+		problem.Abort(c, problem.New(http.StatusInternalServerError, "Unable to store the upload"))
+		return
+	}
+
+	// the gin context is recycled once the request is done, so take what the audit needs now
+	actor, request := auth.CurrentIdentity(c).Subject, requestId(c)
+	opts := importer.Options{Format: format, Mapping: mapping, OnInsert: func(book models.Book) {
+		h.recordAudit(models.AuditEntry{Actor: actor, Action: "book.create", BookId: book.Id, After: snapshot(book), RequestId: request})
+	}}
+
+	async := c.Query("async") == "true" || (size > syncImportBytes && c.Query("async") != "false")
+	if async {
+		job := h.imports.Start(h.primaryDB, file, opts)
+		c.Header("Location", "/api/v1/import/"+job.Id())
+		c.JSON(http.StatusAccepted, gin.H{"data": job.Progress()})
+		return
+	}
+
+	defer file.Close()
+	job := importer.NewJob()
+	if err := importer.Run(context.Background(), h.primaryDB, file, opts, job); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()).With("data", job.Progress()))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": job.Progress()})
+}
+
+// POST /users/:id/import?source=goodreads|librarything&async=true
+// Import a user's Goodreads or LibraryThing export onto their shelves, with their ratings
+// and dates read. Books missing from the catalogue are added when the caller is an editor
+func (h *Handler) ImportHistory(c *gin.Context) {
+	userId := c.Param("id")
+
+	source := strings.ToLower(c.Query("source"))
+	if source != importer.Goodreads && source != importer.LibraryThing {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Set ?source=goodreads or ?source=librarything"))
+		return
+	}
+
+	if !h.actingAs(c, userId) {
+		return
+	}
+
+	upload, _, err := importUpload(c)
+	if err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Unable to read the upload, send it as the body or a 'file' form field"))
+		return
+	}
+	defer upload.Close()
+
+	file, size, err := spool(upload)
+	if err != nil {
+		log.Errorf("Unable to store import upload: %v", err)
+		problem.Abort(c, problem.New(http.StatusInternalServerError, "Unable to store the upload"))
+		return
+	}
+
+	identity, request := auth.CurrentIdentity(c), requestId(c)
+	opts := importer.HistoryOptions{
+		Source:      source,
+		UserId:      userId,
+		CreateBooks: identity.Role.Allows(auth.RoleEditor),
+		OnInsert: func(book models.Book) {
+			h.recordAudit(models.AuditEntry{Actor: identity.Subject, Action: "book.create", BookId: book.Id, After: snapshot(book), RequestId: request})
+		},
+		OnRecord: func(before *models.ReadingRecord, after models.ReadingRecord) {
+			h.recordAudit(models.AuditEntry{Actor: identity.Subject, Action: "reading.update", BookId: after.BookId, ResourceId: userId, Before: snapshot(before), After: snapshot(after), RequestId: request})
+		},
+	}
+
+	async := c.Query("async") == "true" || (size > syncImportBytes && c.Query("async") != "false")
+	if async {
+		job := h.imports.StartHistory(h.primaryDB, file, opts)
+		c.Header("Location", "/api/v1/import/"+job.Id())
+		c.JSON(http.StatusAccepted, gin.H{"data": job.Progress()})
+		return
+	}
+
+	defer file.Close()
+	job := importer.NewJob()
+	if err := importer.RunHistory(context.Background(), h.primaryDB, file, opts, job); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()).With("data", job.Progress()))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": job.Progress()})
+}
+
+// GET /import/:id
+// Poll the progress of a background import
+func (h *Handler) GetImport(c *gin.Context) {
+	job, ok := h.imports.Get(c.Param("id"))
+	if !ok {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No import found with that id"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": job.Progress()})
+}
+
+// the uploaded file and its name, from a multipart form or the raw body
+func importUpload(c *gin.Context) (io.ReadCloser, string, error) {
+	if c.ContentType() != "multipart/form-data" {
+		return c.Request.Body, "", nil
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	return file, header.Filename, nil
+}
+
+// copies an upload to a temporary file, removed again when it's closed
+func spool(upload io.Reader) (*spooledFile, int64, error) {
+	f, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(f, upload)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	return &spooledFile{File: f}, size, nil
+}
+
+type spooledFile struct {
+	*os.File
+}
+
+func (s *spooledFile) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// POST /books/:id/copies
+// Add a physical copy of a book to the library
+func (h *Handler) CreateCopy(c *gin.Context) {
+	bookId := c.Param("id")
+
+	// the body is optional, copies don't need a barcode
+	var input models.InsertCopyInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
+
+	if !h.bookExists(c, bookId) {
+		return
+	}
+
+	newCopy, err := h.primaryDB.InsertCopy(context.Background(), bookId, input)
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "copy.create", bookId, newCopy.Id, nil, newCopy)
+
+	c.JSON(http.StatusOK, gin.H{"data": newCopy})
+}
+
+// GET /books/:id/copies
+// List a book's copies and whether they're available
+func (h *Handler) GetCopies(c *gin.Context) {
+	bookId := c.Param("id")
+
+	if !h.bookExists(c, bookId) {
+		return
+	}
+
+	copies, err := h.primaryDB.GetCopies(context.Background(), bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, copies)})
+}
+
+// POST /books/:id/checkouts
+// Borrow a copy of a book, due back after the requested number of days or LOAN_DAYS
+func (h *Handler) CheckoutBook(c *gin.Context) {
+	bookId := c.Param("id")
+
+	var input models.CheckoutInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if !h.bookExists(c, bookId) || !h.actingAs(c, input.UserId) {
+		return
+	}
+
+	days := input.Days
+	if days == 0 {
+		days = utils.GetEnvInt("LOAN_DAYS", 14)
+	}
+	due := time.Now().UTC().AddDate(0, 0, days)
+
+	checkout, err := h.primaryDB.Checkout(context.Background(), bookId, input.UserId, due)
+	if errors.Is(err, database.ErrConflict) {
+		problem.Abort(c, problem.New(http.StatusConflict, "No copies are available, place a hold instead").WithCode(codeNoCopiesAvailable))
+		return
+	}
+	if err != nil {
+		log.Errorf("Database (primary) checkout failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "checkout.create", bookId, checkout.Id, nil, checkout)
+
+	c.JSON(http.StatusOK, gin.H{"data": checkout})
+}
+
+// POST /checkouts/:id/return
+// Return a borrowed copy, passing it on to the next hold if there is one
+func (h *Handler) ReturnBook(c *gin.Context) {
+	ctx := context.Background()
+
+	// only the borrower, or an admin, can return a loan
+	borrowed, err := h.primaryDB.GetCheckout(ctx, c.Param("id"))
+	if err != nil {
+		abortLookup(c, err, "checkout")
+		return
+	}
+	if !h.actingAs(c, borrowed.UserId) {
+		return
+	}
+
+	checkout, err := h.primaryDB.Return(ctx, c.Param("id"))
+	if errors.Is(err, database.ErrConflict) {
+		problem.Abort(c, problem.New(http.StatusConflict, "That checkout has already been returned").WithCode(codeAlreadyReturned))
+		return
+	}
+	if err != nil {
+		abortLookup(c, err, "checkout")
+		return
+	}
+	h.audit(c, "checkout.return", checkout.BookId, checkout.Id, nil, checkout)
+
+	c.JSON(http.StatusOK, gin.H{"data": checkout})
+}
+
+// GET /checkouts/overdue
+// List every loan past its due date
+func (h *Handler) GetOverdue(c *gin.Context) {
+	overdue, err := h.primaryDB.OverdueCheckouts(context.Background(), time.Now().UTC())
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, overdue)})
+}
+
+// POST /books/:id/holds
+// Join the queue for a book, holds are fulfilled first come first served
+func (h *Handler) PlaceHold(c *gin.Context) {
+	bookId := c.Param("id")
+
+	var input models.HoldInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if !h.bookExists(c, bookId) || !h.actingAs(c, input.UserId) {
+		return
+	}
+
+	hold, err := h.primaryDB.PlaceHold(context.Background(), bookId, input.UserId)
+	if errors.Is(err, database.ErrConflict) {
+		problem.Abort(c, problem.New(http.StatusConflict, "That user already has a hold on this book").WithCode(codeHoldExists))
+		return
+	}
+	if err != nil {
+		log.Errorf("Database (primary) hold failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "hold.create", bookId, hold.Id, nil, hold)
+
+	c.JSON(http.StatusOK, gin.H{"data": hold})
+}
+
+// GET /books/:id/holds
+// List the holds queue for a book, oldest first
+func (h *Handler) GetHolds(c *gin.Context) {
+	bookId := c.Param("id")
+
+	if !h.bookExists(c, bookId) {
+		return
+	}
+
+	holds, err := h.primaryDB.GetHolds(context.Background(), bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, holds)})
+}
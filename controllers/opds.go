@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/opds"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// entries on each page of an OPDS feed
+const opdsPageSize = 25
+
+// GET /opds
+// the root navigation feed, leading to the acquisition feeds and the author index
+func (h *Handler) OPDSRoot(c *gin.Context) {
+	base := opdsBase(c)
+	now := time.Now()
+
+	feed := opds.NewFeed("urn:x-opds:root", "Books", now)
+	feed.Links = append(feed.Links,
+		opds.Link{Rel: "self", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "start", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "search", Href: base + "/opds/opensearch.xml", Type: opds.OpenSearchType},
+		opds.Link{Rel: opds.RelSortNew, Href: base + "/opds/new", Type: opds.AcquisitionType},
+		opds.Link{Rel: opds.RelSortPopular, Href: base + "/opds/popular", Type: opds.AcquisitionType},
+	)
+	feed.Entries = append(feed.Entries,
+		opds.NavigationEntry("urn:x-opds:new", "New", "The most recently published books first",
+			opds.Link{Rel: opds.RelSortNew, Href: base + "/opds/new", Type: opds.AcquisitionType}, now),
+		opds.NavigationEntry("urn:x-opds:popular", "Popular", "The most reviewed books first",
+			opds.Link{Rel: opds.RelSortPopular, Href: base + "/opds/popular", Type: opds.AcquisitionType}, now),
+		opds.NavigationEntry("urn:x-opds:authors", "Authors", "Books by each author",
+			opds.Link{Rel: "subsection", Href: base + "/opds/authors", Type: opds.NavigationType}, now),
+	)
+
+	renderFeed(c, feed, opds.NavigationType)
+}
+
+// GET /opds/new
+// every book, the most recently published first
+func (h *Handler) OPDSNew(c *gin.Context) {
+	h.opdsSorted(c, "urn:x-opds:new", "New", "/opds/new", "-year")
+}
+
+// GET /opds/popular
+// every book, the most reviewed first and the best rated of those breaking ties
+func (h *Handler) OPDSPopular(c *gin.Context) {
+	h.opdsSorted(c, "urn:x-opds:popular", "Popular", "/opds/popular", "-rating", "-rating_count")
+}
+
+// sorts by each key in turn, so the last one given decides the order and the
+// ones before it only break ties
+func (h *Handler) opdsSorted(c *gin.Context, id, title, path string, sortBy ...string) {
+	ctx := context.Background()
+
+	page, ok := opdsPage(c)
+	if !ok {
+		return
+	}
+
+	// every book has to be read to sort them
+	books := []models.Book{}
+	err := h.primaryDB.Each(ctx, "books", func(book models.Book) error {
+		books = append(books, book)
+		return nil
+	})
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	h.attachRatings(ctx, books)
+	for _, key := range sortBy {
+		sortBooks(books, key)
+	}
+
+	h.renderAcquisition(c, id, title, path, nil, page, books)
+}
+
+// GET /opds/authors
+// a navigation feed with an entry per author, leading to their books
+func (h *Handler) OPDSAuthors(c *gin.Context) {
+	ctx := context.Background()
+	base := opdsBase(c)
+	now := time.Now()
+
+	page, ok := opdsPage(c)
+	if !ok {
+		return
+	}
+
+	counts := map[string]int{}
+	err := h.primaryDB.Each(ctx, "books", func(book models.Book) error {
+		if book.Author != "" {
+			counts[book.Author]++
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	authors := make([]string, 0, len(counts))
+	for author := range counts {
+		authors = append(authors, author)
+	}
+	sort.Strings(authors)
+
+	page.Total = len(authors)
+	start := min((page.Number-1)*page.Size, len(authors))
+	end := min(start+page.Size, len(authors))
+
+	feed := opds.NewFeed("urn:x-opds:authors", "Authors", now)
+	feed.Links = append(feed.Links,
+		opds.Link{Rel: "start", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "up", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "search", Href: base + "/opds/opensearch.xml", Type: opds.OpenSearchType},
+	)
+	feed.Paginate(base+"/opds/authors", nil, page, opds.NavigationType)
+	for _, author := range authors[start:end] {
+		href := base + "/opds/author?" + url.Values{"name": {author}}.Encode()
+		description := strconv.Itoa(counts[author]) + " books"
+		if counts[author] == 1 {
+			description = "1 book"
+		}
+		feed.Entries = append(feed.Entries, opds.NavigationEntry("urn:x-opds:author:"+url.PathEscape(author), author, description,
+			opds.Link{Rel: "subsection", Href: href, Type: opds.AcquisitionType}, now))
+	}
+
+	renderFeed(c, feed, opds.NavigationType)
+}
+
+// GET /opds/author?name=<author>
+// the author's books, by title
+func (h *Handler) OPDSAuthor(c *gin.Context) {
+	ctx := context.Background()
+
+	author := c.Query("name")
+	if author == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'name' parameter provided"))
+		return
+	}
+	page, ok := opdsPage(c)
+	if !ok {
+		return
+	}
+
+	books, err := h.primaryDB.Get(ctx, "books", "Author", author)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	h.attachRatings(ctx, books)
+	sortBooks(books, "title")
+
+	h.renderAcquisition(c, "urn:x-opds:author:"+url.PathEscape(author), author, "/opds/author", url.Values{"name": {author}}, page, books)
+}
+
+// GET /opds/search?q=<terms>
+// books whose title or author contains the terms, ignoring case
+func (h *Handler) OPDSSearch(c *gin.Context) {
+	ctx := context.Background()
+
+	terms := strings.TrimSpace(c.Query("q"))
+	if terms == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "No 'q' parameter provided"))
+		return
+	}
+	page, ok := opdsPage(c)
+	if !ok {
+		return
+	}
+
+	needle := strings.ToLower(terms)
+	matches := []models.Book{}
+	err := h.primaryDB.Each(ctx, "books", func(book models.Book) error {
+		if strings.Contains(strings.ToLower(book.Title), needle) || strings.Contains(strings.ToLower(book.Author), needle) {
+			matches = append(matches, book)
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	h.attachRatings(ctx, matches)
+	sortBooks(matches, "title")
+
+	h.renderAcquisition(c, "urn:x-opds:search", "Search results for "+terms, "/opds/search", url.Values{"q": {terms}}, page, matches)
+}
+
+// GET /opds/opensearch.xml
+// describes the search feed to OPDS clients. The template has to be an absolute
+// URL, so it's built from the host the request came in on
+func (h *Handler) OPDSOpenSearch(c *gin.Context) {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	template := scheme + "://" + c.Request.Host + opdsBase(c) + "/opds/search?q={searchTerms}&page={startPage?}"
+
+	var buf bytes.Buffer
+	if err := opds.NewOpenSearchDescription(template).Write(&buf); err != nil {
+		log.Errorf("Unable to write the OpenSearch description: %v", err)
+		problem.Abort(c, problem.New(http.StatusInternalServerError, "Unable to write the feed"))
+		return
+	}
+	c.Data(http.StatusOK, opds.OpenSearchType, buf.Bytes())
+}
+
+// responds with one page of books as an acquisition feed
+func (h *Handler) renderAcquisition(c *gin.Context, id, title, path string, query url.Values, page opds.Page, books []models.Book) {
+	base := opdsBase(c)
+	now := time.Now()
+
+	page.Total = len(books)
+	feed := opds.NewFeed(id, title, now)
+	feed.Links = append(feed.Links,
+		opds.Link{Rel: "start", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "up", Href: base + "/opds", Type: opds.NavigationType},
+		opds.Link{Rel: "search", Href: base + "/opds/opensearch.xml", Type: opds.OpenSearchType},
+	)
+	feed.Paginate(base+path, query, page, opds.AcquisitionType)
+	for _, book := range page.Slice(books) {
+		feed.Entries = append(feed.Entries, opds.BookEntry(book, base, now))
+	}
+
+	renderFeed(c, feed, opds.AcquisitionType)
+}
+
+func renderFeed(c *gin.Context, feed *opds.Feed, contentType string) {
+	var buf bytes.Buffer
+	if err := feed.Write(&buf); err != nil {
+		log.Errorf("Unable to write the %s feed: %v", feed.Id, err)
+		problem.Abort(c, problem.New(http.StatusInternalServerError, "Unable to write the feed"))
+		return
+	}
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// the page asked for with ?page=, 1 when it isn't given
+func opdsPage(c *gin.Context) (opds.Page, bool) {
+	page := opds.Page{Number: 1, Size: opdsPageSize}
+	if value := c.Query("page"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "'page' must be a positive number"))
+			return page, false
+		}
+		page.Number = number
+	}
+	return page, true
+}
+
+// the path the API is mounted at, like /api/v1, so that feed links work under any group
+func opdsBase(c *gin.Context) string {
+	path := c.FullPath()
+	if i := strings.Index(path, "/opds"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
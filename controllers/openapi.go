@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/citation"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/opds"
+	"github.com/garbhank/gin-books-api/openapi"
+)
+
+var apiInfo = openapi.Info{
+	Title:   "gin-books-api",
+	Version: "1.0.0",
+	Description: "A catalogue of books with reviews, shelves and lending. Send an API key in X-API-Key " +
+		"or a bearer token, unless auth is disabled. Responses are JSON unless the Accept header asks for " +
+		"XML, YAML, MessagePack or, for lists, CSV.",
+}
+
+// query parameters shared by the routes that read books
+var (
+	formatQuery = openapi.Param{Name: "format", Description: "respond with citations rather than JSON", Enum: append([]string{"json"}, citation.Formats...)}
+	asOfQuery   = openapi.Param{Name: "as_of", Description: "the books as they were at an RFC 3339 time"}
+	pageQuery   = openapi.Param{Name: "page", Description: "the page of the feed, from 1", Type: "integer"}
+	asyncQuery  = openapi.Param{Name: "async", Description: "import in the background, answering with a 202", Enum: []string{"true", "false"}}
+)
+
+// the content types a citation-capable route can also respond with
+var citationTypes = []string{
+	citation.ContentTypes[citation.BibTeX],
+	citation.ContentTypes[citation.RIS],
+	citation.ContentTypes[citation.MARCXML],
+	citation.ContentTypes[citation.DublinCore],
+}
+
+// describes every v1 route setupRouter registers, and through routeDescriptions
+// the v2 routes sharing their handlers. GenerateOpenAPI fails when a route is
+// added or removed without updating this
+var apiRoutes = []openapi.Route{
+	{Method: http.MethodGet, Path: "/api/v1/", Tag: "meta", Summary: "Check the API is up", Public: true, Raw: true,
+		Response: struct {
+			Message string `json:"message"`
+		}{}},
+	{Method: http.MethodGet, Path: "/api/v1/ping", Tag: "meta", Summary: "Report the status of the API and its databases", Public: true, Response: models.APIStatus{}},
+	{Method: http.MethodGet, Path: "/api/v1/openapi.json", Tag: "meta", Summary: "This description of the API", Public: true, Raw: true, Response: map[string]any{}},
+	{Method: http.MethodGet, Path: "/api/v1/docs", Tag: "meta", Summary: "Browse this description with Swagger UI", Public: true, Produces: []string{"text/html"}},
+	{Method: http.MethodGet, Path: "/api/v1/whoami", Tag: "meta", Summary: "Show the identity the API resolved for the caller", Response: auth.Identity{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/books/", Tag: "books", Summary: "List the books, with facets for filtering them",
+		Query: []openapi.Param{
+			{Name: "table", Description: "the table to read, books", Required: true},
+			{Name: "tag", Description: "only books with this tag"},
+			{Name: "genre", Description: "only books in this genre or the genres under it"},
+			{Name: "sort", Description: "order by title, author, year, rating or rating_count, prefixed with - for descending"},
+			asOfQuery, formatQuery,
+		},
+		Response: []models.Book{}, Meta: map[string]any{"facets": models.Facets{}}, Produces: citationTypes},
+	{Method: http.MethodPost, Path: "/api/v1/books", Tag: "books", Summary: "Add a book, warning about likely duplicates",
+		Body: models.InsertBookInput{}, Response: models.Book{}, Meta: map[string]any{"warning": "", "duplicates": []string{}}},
+	{Method: http.MethodPost, Path: "/api/v1/books:action", As: "/api/v1/books:batch", Tag: "books", Summary: "Create, update and delete many books in one request",
+		Body: models.BatchInput{}, OwnValidation: true, Response: []models.BatchResult{}},
+	{Method: http.MethodGet, Path: "/api/v1/books/author/", Tag: "books", Summary: "List an author's books",
+		Query:    []openapi.Param{{Name: "name", Description: "the author", Required: true}, formatQuery},
+		Response: []models.Book{}, Produces: citationTypes},
+	{Method: http.MethodGet, Path: "/api/v1/books/title/", Tag: "books", Summary: "List the books with a title",
+		Query:    []openapi.Param{{Name: "title", Description: "the title", Required: true}, formatQuery},
+		Response: []models.Book{}, Produces: citationTypes},
+	{Method: http.MethodDelete, Path: "/api/v1/books/", Tag: "books", Summary: "Move every book with a title to the trash, returning how many were",
+		Query:    []openapi.Param{{Name: "title", Description: "the title", Required: true}},
+		Response: 0},
+	{Method: http.MethodGet, Path: "/api/v1/books/duplicates", Tag: "books", Summary: "List groups of books that look like duplicates", Response: []models.DuplicateGroup{}},
+	{Method: http.MethodGet, Path: "/api/v1/books/:id", Tag: "books", Summary: "Get a book",
+		Query: []openapi.Param{asOfQuery, formatQuery}, Response: models.Book{}, Produces: citationTypes},
+	{Method: http.MethodDelete, Path: "/api/v1/books/:id", Tag: "books", Summary: "Move a book to the trash, returning how many books were", Response: 0},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/restore", Tag: "books", Summary: "Take a book back out of the trash", Response: models.Book{}},
+	{Method: http.MethodGet, Path: "/api/v1/books/:id/revisions", Tag: "books", Summary: "List a book's revisions, oldest first", Response: []models.BookRevision{}},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/revisions/:revision/revert", Tag: "books", Summary: "Restore a book to one of its revisions",
+		Response: models.Book{}, Meta: map[string]any{"revision": 0}},
+	{Method: http.MethodPut, Path: "/api/v1/books/:id/tags/:tag", Tag: "books", Summary: "Tag a book", Response: models.Book{}},
+	{Method: http.MethodDelete, Path: "/api/v1/books/:id/tags/:tag", Tag: "books", Summary: "Remove a tag from a book", Response: models.Book{}},
+	{Method: http.MethodPut, Path: "/api/v1/books/:id/genre", Tag: "books", Summary: "Set a book's genre", Body: models.SetGenreInput{}, Response: models.Book{}},
+	{Method: http.MethodGet, Path: "/api/v1/trash", Tag: "books", Summary: "List the books in the trash", Response: []models.Book{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/books/:id/reviews", Tag: "reviews", Summary: "List a book's reviews with its rating",
+		Response: []models.Review{}, Meta: map[string]any{"rating": models.RatingSummary{}}},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/reviews", Tag: "reviews", Summary: "Review a book", Body: models.InsertReviewInput{}, Response: models.Review{}},
+
+	{Method: http.MethodGet, Path: "/api/v1/books/:id/copies", Tag: "lending", Summary: "List a book's copies", Response: []models.Copy{}},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/copies", Tag: "lending", Summary: "Add a copy of a book to lend", Body: models.InsertCopyInput{}, OptionalBody: true, Response: models.Copy{}},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/checkouts", Tag: "lending", Summary: "Borrow an available copy of a book", Body: models.CheckoutInput{}, Response: models.Checkout{}},
+	{Method: http.MethodGet, Path: "/api/v1/books/:id/holds", Tag: "lending", Summary: "List the holds waiting on a book", Response: []models.Hold{}},
+	{Method: http.MethodPost, Path: "/api/v1/books/:id/holds", Tag: "lending", Summary: "Queue for the next copy of a book", Body: models.HoldInput{}, Response: models.Hold{}},
+	{Method: http.MethodGet, Path: "/api/v1/checkouts/overdue", Tag: "lending", Summary: "List the checkouts past their due date", Response: []models.Checkout{}},
+	{Method: http.MethodPost, Path: "/api/v1/checkouts/:id/return", Tag: "lending", Summary: "Return a borrowed copy", Response: models.Checkout{}},
+
+	{Method: http.MethodPost, Path: "/api/v1/works", Tag: "works", Summary: "Add a work grouping a book's editions", Body: models.InsertWorkInput{}, Response: models.Work{}},
+	{Method: http.MethodGet, Path: "/api/v1/works/:id/editions", Tag: "works", Summary: "List a work's editions", Response: []models.Book{}},
+	{Method: http.MethodPost, Path: "/api/v1/series", Tag: "works", Summary: "Add a series of works", Body: models.InsertSeriesInput{}, Response: models.Series{}},
+	{Method: http.MethodGet, Path: "/api/v1/series/:id/works", Tag: "works", Summary: "List a series' works in order", Response: []models.Work{}},
+	{Method: http.MethodGet, Path: "/api/v1/genres", Tag: "works", Summary: "List the genres", Response: []models.Genre{}},
+	{Method: http.MethodPost, Path: "/api/v1/genres", Tag: "works", Summary: "Add a genre", Body: models.InsertGenreInput{}, Response: models.Genre{}},
+
+	{Method: http.MethodPost, Path: "/api/v1/users", Tag: "users", Summary: "Add a user", Body: models.InsertUserInput{}, Response: models.User{}},
+	{Method: http.MethodGet, Path: "/api/v1/users/:id", Tag: "users", Summary: "Get a user", Response: models.User{}},
+	{Method: http.MethodGet, Path: "/api/v1/users/:id/shelves", Tag: "users", Summary: "List a user's shelves", Response: []models.Shelf{}},
+	{Method: http.MethodPost, Path: "/api/v1/users/:id/shelves", Tag: "users", Summary: "Add a custom shelf", Body: models.InsertShelfInput{}, Response: models.Shelf{}},
+	{Method: http.MethodGet, Path: "/api/v1/users/:id/shelves/:shelf", Tag: "users", Summary: "List the books on a shelf", Response: []models.ReadingRecord{}},
+	{Method: http.MethodPut, Path: "/api/v1/users/:id/shelves/:shelf/books/:book_id", Tag: "users", Summary: "Put a book on a shelf, with the reader's progress",
+		Body: models.ShelveBookInput{}, OptionalBody: true, Response: models.ReadingRecord{}},
+	{Method: http.MethodDelete, Path: "/api/v1/users/:id/shelves/:shelf/books/:book_id", Tag: "users", Summary: "Take a book off a shelf", Response: models.ReadingRecord{}},
+
+	{Method: http.MethodPost, Path: "/api/v1/import", Tag: "import", Summary: "Import books from a CSV or NDJSON file",
+		Query: []openapi.Param{
+			{Name: "format", Description: "the file's format, detected when not given", Enum: []string{"csv", "ndjson"}},
+			{Name: "mapping", Description: "renames columns onto book fields, like Header=field,..."},
+			asyncQuery,
+		},
+		BodyTypes: []string{"text/csv", "application/x-ndjson", "multipart/form-data"}, Response: importer.Progress{}},
+	{Method: http.MethodPost, Path: "/api/v1/users/:id/import", Tag: "import", Summary: "Import a Goodreads or LibraryThing reading history onto a user's shelves",
+		Query:     []openapi.Param{{Name: "source", Description: "where the export came from", Required: true, Enum: []string{importer.Goodreads, importer.LibraryThing}}, asyncQuery},
+		BodyTypes: []string{"text/csv", "text/tab-separated-values", "multipart/form-data"}, Response: importer.Progress{}},
+	{Method: http.MethodGet, Path: "/api/v1/import/:id", Tag: "import", Summary: "Follow a background import", Response: importer.Progress{}},
+	{Method: http.MethodGet, Path: "/api/v1/export", Tag: "import", Summary: "Download the whole catalogue",
+		Query:    []openapi.Param{{Name: "format", Enum: []string{"json", "csv", "ndjson"}}},
+		Produces: []string{"application/json", "text/csv", "application/x-ndjson"}},
+
+	{Method: http.MethodGet, Path: "/api/v1/opds", Tag: "opds", Summary: "The OPDS catalogue's root navigation feed", Produces: []string{opds.NavigationType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/new", Tag: "opds", Summary: "Books, the most recently published first", Query: []openapi.Param{pageQuery}, Produces: []string{opds.AcquisitionType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/popular", Tag: "opds", Summary: "Books, the most reviewed first", Query: []openapi.Param{pageQuery}, Produces: []string{opds.AcquisitionType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/authors", Tag: "opds", Summary: "An index of authors", Query: []openapi.Param{pageQuery}, Produces: []string{opds.NavigationType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/author", Tag: "opds", Summary: "An author's books",
+		Query: []openapi.Param{{Name: "name", Description: "the author", Required: true}, pageQuery}, Produces: []string{opds.AcquisitionType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/search", Tag: "opds", Summary: "Books whose title or author contains the terms",
+		Query: []openapi.Param{{Name: "q", Description: "the terms", Required: true}, pageQuery}, Produces: []string{opds.AcquisitionType}},
+	{Method: http.MethodGet, Path: "/api/v1/opds/opensearch.xml", Tag: "opds", Summary: "The OpenSearch description of the search feed", Produces: []string{opds.OpenSearchType}},
+
+	{Method: http.MethodGet, Path: "/api/v1/audit", Tag: "audit", Summary: "Search the audit trail, newest first",
+		Query: []openapi.Param{
+			{Name: "actor", Description: "who made the change"},
+			{Name: "action", Description: "like book.create"},
+			{Name: "book_id"},
+			{Name: "since", Description: "an RFC 3339 time"},
+			{Name: "until", Description: "an RFC 3339 time"},
+			{Name: "limit", Type: "integer"},
+		},
+		Response: []models.AuditEntry{}},
+}
+
+// routes only v2 has, in place of v1's that select books with query parameters
+var v2Routes = []openapi.Route{
+	{Method: http.MethodGet, Path: "/api/v2/books", Tag: "books", Summary: "List the books, narrowed down by title, author, tag or genre",
+		Query: []openapi.Param{
+			{Name: "title", Description: "only books with exactly this title"},
+			{Name: "author", Description: "only books by exactly this author"},
+			{Name: "tag", Description: "only books with this tag"},
+			{Name: "genre", Description: "only books in this genre or the genres under it"},
+			{Name: "sort", Description: "order by title, author, year, rating or rating_count, prefixed with - for descending"},
+			asOfQuery, formatQuery,
+		},
+		Response: []models.Book{}, Meta: map[string]any{"facets": models.Facets{}}, Produces: citationTypes},
+}
+
+// the query parameters paging a v2 list
+var (
+	listPageQuery = openapi.Param{Name: "page", Description: "the page of the list, from 1", Type: "integer"}
+	perPageQuery  = openapi.Param{Name: "per_page", Description: "how many items a page has, 25 unless set, at most 100", Type: "integer"}
+)
+
+// every route's description. v1's are marked deprecated, and v2 has each of
+// them that v1Replaced doesn't list under the same path, along with v2Routes
+func routeDescriptions() []openapi.Route {
+	routes := []openapi.Route{}
+	v2 := []openapi.Route{}
+	for _, route := range apiRoutes {
+		if _, replaced := v1Replaced[route.Method+" "+route.Path]; !replaced {
+			v2 = append(v2, inV2(route))
+		}
+		route.Deprecated = true
+		routes = append(routes, route)
+	}
+	for _, route := range append(v2, v2Routes...) {
+		routes = append(routes, enveloped(route))
+	}
+	return routes
+}
+
+func inV2(route openapi.Route) openapi.Route {
+	route.Path = strings.Replace(route.Path, "/api/v1", "/api/v2", 1)
+	if route.As != "" {
+		route.As = strings.Replace(route.As, "/api/v1", "/api/v2", 1)
+	}
+	return route
+}
+
+// describes the envelope Envelope gives a v2 route's responses
+func enveloped(route openapi.Route) openapi.Route {
+	if route.Raw || route.Response == nil {
+		return route
+	}
+	list := route.Method == http.MethodGet && reflect.TypeOf(route.Response).Kind() == reflect.Slice
+
+	meta := openapi.Object{}
+	for name, value := range route.Meta {
+		meta[name] = value
+	}
+	envelope := map[string]any{}
+	if list {
+		meta["page"], meta["per_page"], meta["total"], meta["total_pages"] = 0, 0, 0, 0
+		envelope["links"] = models.PageLinks{}
+		route.Query = append(slices.Clone(route.Query), listPageQuery, perPageQuery)
+	}
+	if len(meta) > 0 {
+		envelope["meta"] = meta
+	}
+	route.Meta = envelope
+	return route
+}
+
+// GET /openapi.json
+// The API's OpenAPI 3 description
+func (h *Handler) OpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openapi.Spec)
+}
+
+// GET /docs
+// Browse the description with Swagger UI
+func (h *Handler) SwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", openapi.SwaggerUI)
+}
+
+// describes the routes, failing if any of them are missing from the descriptions
+// or the descriptions list any that aren't routed
+func GenerateOpenAPI(routes gin.RoutesInfo) (*openapi.Document, error) {
+	return openapi.Generate(apiInfo, routes, routeDescriptions())
+}
+
+// writes the description the way openapi/openapi.json is kept
+func WriteOpenAPI(w io.Writer, routes gin.RoutesInfo) error {
+	doc, err := GenerateOpenAPI(routes)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(doc)
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// codes more specific than their status, for the conflicts callers are likely
+// to handle differently
+const (
+	codeDuplicateISBN     = "duplicate_isbn"
+	codeDuplicateBook     = "duplicate_book"
+	codeNoCopiesAvailable = "no_copies_available"
+	codeAlreadyReturned   = "already_returned"
+	codeHoldExists        = "hold_exists"
+	codeReservedShelfName = "reserved_shelf_name"
+	codeShelfExists       = "shelf_exists"
+)
+
+// the problem a database error stands for. Details are never passed on, they
+// can name tables and columns or echo the query
+func dbProblem(err error) problem.Problem {
+	err = database.Classify(err)
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		return problem.New(http.StatusNotFound, "No record found with that id")
+	case errors.Is(err, database.ErrDuplicateISBN):
+		return problem.New(http.StatusConflict, "A book with that ISBN already exists").WithCode(codeDuplicateISBN)
+	case errors.Is(err, database.ErrConflict):
+		return problem.New(http.StatusConflict, "The change conflicts with an existing record")
+	case errors.Is(err, database.ErrVersionMismatch):
+		return problem.New(http.StatusPreconditionFailed, "The record has changed since it was read")
+	case errors.Is(err, database.ErrInvalidArgument):
+		return problem.New(http.StatusBadRequest, "The database can't take that request")
+	case errors.Is(err, database.ErrNotSupported):
+		return problem.New(http.StatusNotImplemented, "Not supported by the primary database")
+	case errors.Is(err, database.ErrUnavailable):
+		return problem.New(http.StatusServiceUnavailable, "The database is unavailable, try again later")
+	}
+	return problem.New(http.StatusInternalServerError, "Unable to complete query")
+}
+
+// ends the request with the problem a database error stands for, logging the
+// ones that aren't the caller's doing and why the database refused the rest
+func abortWithDBError(c *gin.Context, err error) {
+	p := dbProblem(err)
+	switch {
+	case p.Status >= http.StatusInternalServerError:
+		log.Errorf("Database (primary) query failed for request %s: %v", requestId(c), err)
+	case p.Status == http.StatusBadRequest:
+		log.Warnf("Database (primary) refused the query for request %s: %v", requestId(c), err)
+	}
+	if p.Status == http.StatusServiceUnavailable {
+		c.Header("Retry-After", "5")
+	}
+	problem.Abort(c, p)
+}
@@ -0,0 +1,480 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/yaml.v3"
+
+	"github.com/garbhank/gin-books-api/citation"
+	"github.com/garbhank/gin-books-api/opds"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// the formats a JSON response can be re-encoded in
+const (
+	renderJSON    = "json"
+	renderXML     = "xml"
+	renderYAML    = "yaml"
+	renderMsgPack = "msgpack"
+	renderCSV     = "csv"
+)
+
+// what an Accept header is matched against, JSON first so that */* gets it.
+// Each format answers to the names it's commonly asked for by
+var renderOffers = []string{
+	gin.MIMEJSON,
+	gin.MIMEXML, gin.MIMEXML2,
+	"application/yaml", gin.MIMEYAML, "text/yaml",
+	"application/msgpack", "application/x-msgpack",
+	"text/csv",
+}
+
+var renderFormats = map[string]string{
+	gin.MIMEJSON:            renderJSON,
+	gin.MIMEXML:             renderXML,
+	gin.MIMEXML2:            renderXML,
+	"application/yaml":      renderYAML,
+	gin.MIMEYAML:            renderYAML,
+	"text/yaml":             renderYAML,
+	"application/msgpack":   renderMsgPack,
+	"application/x-msgpack": renderMsgPack,
+	"text/csv":              renderCSV,
+}
+
+// everything some route can respond with, whether re-encoded here or written by
+// the handler itself like citations, feeds and exports
+func producible() []string {
+	offers := slices.Clone(renderOffers)
+	for _, contentType := range citation.ContentTypes {
+		offers = append(offers, contentType)
+	}
+	for _, contentType := range exportTypes {
+		offers = append(offers, strings.TrimSuffix(contentType, "; charset=utf-8"))
+	}
+	return append(offers, opds.NavigationType, opds.AcquisitionType, opds.OpenSearchType)
+}
+
+// middleware rendering responses in the type the Accept header asks for. Handlers
+// write JSON, and it's re-encoded here as XML, YAML, MessagePack or, for lists,
+// CSV. Responses handlers write in their own formats pass through untouched, as
+// do streamed ones. Accept headers that nothing can be produced for get a 406
+func Negotiate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		varyAccept(c)
+		if c.GetHeader("Accept") == "" {
+			c.Next()
+			return
+		}
+
+		if c.NegotiateFormat(producible()...) == "" {
+			problem.Abort(c, notAcceptable())
+			return
+		}
+		offer := c.NegotiateFormat(renderOffers...)
+		// ?format= picks the representation itself and wins over Accept
+		if renderFormats[offer] == renderJSON || c.Query("format") != "" {
+			c.Next()
+			return
+		}
+
+		w := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+
+		if w.streaming {
+			return
+		}
+		contentType := w.Header().Get("Content-Type")
+		if (strings.HasPrefix(contentType, gin.MIMEJSON) || strings.HasPrefix(contentType, problem.ContentType)) && w.body.Len() > 0 {
+			rerender(c, w, offer)
+		}
+		w.flush()
+	}
+}
+
+// replaces the JSON held back in w with the offer, or the next best one when the
+// offer is CSV and the response isn't a list. Errors are left as JSON rather than
+// being hidden behind a 406
+func rerender(c *gin.Context, w *bufferedWriter, offer string) {
+	value, err := decodeOrdered(w.body.Bytes())
+	if err != nil {
+		log.Errorf("Unable to read a JSON response to re-encode it: %v", err)
+		return
+	}
+
+	items, isList := listItems(value)
+	if renderFormats[offer] == renderCSV && !isList {
+		offer = c.NegotiateFormat(slices.DeleteFunc(slices.Clone(renderOffers), func(offer string) bool {
+			return renderFormats[offer] == renderCSV
+		})...)
+	}
+
+	var buf bytes.Buffer
+	switch renderFormats[offer] {
+	case renderJSON:
+		return
+	case renderXML:
+		err = encodeXML(&buf, value)
+	case renderYAML:
+		err = encodeYAML(&buf, value)
+	case renderMsgPack:
+		err = encodeMsgPack(&buf, value)
+	case renderCSV:
+		err = encodeCSV(&buf, items)
+	default:
+		if w.status < http.StatusBadRequest {
+			p := notAcceptable().For(c)
+			w.status = p.Status
+			w.Header().Set("Content-Type", problem.ContentType)
+			w.body.Reset()
+			json.NewEncoder(&w.body).Encode(p)
+		}
+		return
+	}
+	if err != nil {
+		log.Errorf("Unable to re-encode a response as %s: %v", offer, err)
+		return
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		w.Header().Set("ETag", formatETag(etag, renderFormats[offer]))
+	}
+
+	contentType := offer
+	switch {
+	case strings.HasPrefix(w.Header().Get("Content-Type"), problem.ContentType) && renderFormats[offer] == renderXML:
+		// RFC 7807's XML form of a problem
+		contentType = "application/problem+xml"
+	case strings.HasPrefix(offer, "text/"):
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.body.Reset()
+	w.body.Write(buf.Bytes())
+}
+
+func notAcceptable() problem.Problem {
+	return problem.New(http.StatusNotAcceptable, "Unable to respond with any of the accepted types, try application/json, application/xml, application/yaml, application/msgpack or text/csv")
+}
+
+// adds Accept to the Vary header once, however many places depend on it
+func varyAccept(c *gin.Context) {
+	for _, value := range c.Writer.Header().Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), "Accept") {
+				return
+			}
+		}
+	}
+	c.Writer.Header().Add("Vary", "Accept")
+}
+
+// a JSON object with its members kept in the order they were written, so that
+// every format lists fields the way the JSON does
+type orderedObject []orderedMember
+
+type orderedMember struct {
+	Key   string
+	Value any
+}
+
+func (o orderedObject) get(key string) (any, bool) {
+	for _, member := range o {
+		if member.Key == key {
+			return member.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, member := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(member.Key)
+		value, err := json.Marshal(member.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// reads JSON into orderedObjects, []any, strings, json.Numbers, bools and nils
+func decodeOrdered(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return readOrdered(dec)
+}
+
+func readOrdered(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			object = append(object, orderedMember{Key: key.(string), Value: value})
+		}
+		_, err = dec.Token()
+		return object, err
+	case json.Delim('['):
+		array := []any{}
+		for dec.More() {
+			value, err := readOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+		_, err = dec.Token()
+		return array, err
+	}
+	return token, nil
+}
+
+// the rows of a list response, either the {"data": [...]} envelope or a bare array
+func listItems(value any) ([]any, bool) {
+	if object, ok := value.(orderedObject); ok {
+		value, _ = object.get("data")
+	}
+	items, ok := value.([]any)
+	return items, ok
+}
+
+func scalarString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// element names come from the JSON keys. Keys that aren't valid names, like
+// tags in a map of tag counts, become <entry key="..."> instead, and array
+// items are <item> elements
+var xmlName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+func encodeXML(w io.Writer, value any) error {
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := writeXMLValue(enc, xml.StartElement{Name: xml.Name{Local: "response"}}, value); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func writeXMLValue(enc *xml.Encoder, start xml.StartElement, value any) error {
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case orderedObject:
+		for _, member := range v {
+			child := xml.StartElement{Name: xml.Name{Local: member.Key}}
+			if !xmlName.MatchString(member.Key) || strings.HasPrefix(strings.ToLower(member.Key), "xml") {
+				child = xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: member.Key}}}
+			}
+			if err := writeXMLValue(enc, child, member.Value); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if err := writeXMLValue(enc, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+	default:
+		if text := scalarString(v); text != "" {
+			if err := enc.EncodeToken(xml.CharData(text)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+func encodeYAML(w io.Writer, value any) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNode(value)); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func yamlNode(value any) *yaml.Node {
+	switch v := value.(type) {
+	case orderedObject:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, member := range v {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: member.Key}, yamlNode(member.Value))
+		}
+		return node
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			node.Content = append(node.Content, yamlNode(item))
+		}
+		return node
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(v.String(), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: v.String()}
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(v)}
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	}
+	// strings that would read back as another type get quoted
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: scalarString(value)}
+}
+
+// MessagePack maps are unordered, so keys are sorted to keep the bytes, and
+// with them the ETag, the same from one response to the next
+func encodeMsgPack(w io.Writer, value any) error {
+	handle := &codec.MsgpackHandle{WriteExt: true}
+	handle.Canonical = true
+	return codec.NewEncoder(w, handle).Encode(plainValue(value))
+}
+
+func plainValue(value any) any {
+	switch v := value.(type) {
+	case orderedObject:
+		object := make(map[string]any, len(v))
+		for _, member := range v {
+			object[member.Key] = plainValue(member.Value)
+		}
+		return object
+	case []any:
+		array := make([]any, len(v))
+		for i, item := range v {
+			array[i] = plainValue(item)
+		}
+		return array
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// a row per item, with a column for every field any of them has. Nested objects
+// are flattened into columns like rating.mean, lists of values are joined with
+// "; " like the export's tags, and anything deeper is written as JSON
+func encodeCSV(w io.Writer, items []any) error {
+	columns := []string{}
+	seen := map[string]bool{}
+	rows := []map[string]string{}
+	for _, item := range items {
+		row := map[string]string{}
+		flattenCSV("", item, func(column, value string) {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+			row[column] = value
+		})
+		rows = append(rows, row)
+	}
+
+	out := csv.NewWriter(w)
+	if err := out.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// calls set for each column of a value. Items that aren't objects go in a single
+// column named value
+func flattenCSV(column string, value any, set func(column, value string)) {
+	if object, ok := value.(orderedObject); ok {
+		for _, member := range object {
+			key := member.Key
+			if column != "" {
+				key = column + "." + key
+			}
+			flattenCSV(key, member.Value, set)
+		}
+		return
+	}
+	if column == "" {
+		column = "value"
+	}
+
+	switch v := value.(type) {
+	case []any:
+		values := []string{}
+		for _, item := range v {
+			switch item.(type) {
+			case orderedObject, []any:
+				data, _ := json.Marshal(v)
+				set(column, string(data))
+				return
+			}
+			values = append(values, scalarString(item))
+		}
+		set(column, strings.Join(values, "; "))
+		return
+	}
+	set(column, scalarString(value))
+}
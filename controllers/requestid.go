@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// gin context key holding the id of the current request
+const RequestIdKey = "request_id"
+
+const requestIdHeader = "X-Request-Id"
+
+// ids passed in by callers are only trusted if they look like an id
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// middleware giving every request an id, echoed back in X-Request-Id. A caller's
+// own X-Request-Id is kept so requests can be traced across services
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIdHeader)
+		if !validRequestId.MatchString(id) {
+			id = utils.UUID()
+		}
+
+		c.Set(RequestIdKey, id)
+		c.Header(requestIdHeader, id)
+		c.Next()
+	}
+}
+
+// the id set by RequestId, empty when the middleware isn't installed
+func requestId(c *gin.Context) string {
+	return c.GetString(RequestIdKey)
+}
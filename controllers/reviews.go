@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// POST /books/:id/reviews
+// Rate and review a book
+func (h *Handler) CreateReview(c *gin.Context) {
+	ctx := context.Background()
+	bookId := c.Param("id")
+
+	var newReview models.InsertReviewInput
+	if err := c.ShouldBindJSON(&newReview); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if !h.bookExists(c, bookId) {
+		return
+	}
+
+	review, err := h.primaryDB.InsertReview(ctx, bookId, newReview)
+	if errors.Is(err, database.ErrNotSupported) {
+		problem.Abort(c, problem.New(http.StatusNotImplemented, "Reviews are not supported by the primary database"))
+		return
+	}
+	if err != nil {
+		log.Errorf("Database (primary) review insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "review.create", bookId, review.Id, nil, review)
+
+	c.JSON(http.StatusOK, gin.H{"data": review})
+}
+
+// GET /books/:id/reviews
+// List a book's reviews alongside its rating summary
+func (h *Handler) GetReviews(c *gin.Context) {
+	ctx := context.Background()
+	bookId := c.Param("id")
+
+	if !h.bookExists(c, bookId) {
+		return
+	}
+
+	reviews, err := h.primaryDB.GetReviews(ctx, bookId)
+	if errors.Is(err, database.ErrNotSupported) {
+		problem.Abort(c, problem.New(http.StatusNotImplemented, "Reviews are not supported by the primary database"))
+		return
+	}
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	summaries, err := h.primaryDB.RatingSummaries(ctx, []string{bookId})
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, reviews), "rating": summaries[bookId]})
+}
+
+// checks a book id exists, aborting with a 404 if not and through abortWithDBError if it can't be read
+func (h *Handler) bookExists(c *gin.Context, bookId string) bool {
+	books, err := h.primaryDB.Get(context.Background(), "books", "Id", bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return false
+	}
+	if len(books) == 0 {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No book found with that id"))
+		return false
+	}
+	return true
+}
+
+// fills in the rating summary of every reviewed book, a failed lookup just leaves them unrated
+func (h *Handler) attachRatings(ctx context.Context, books []models.Book) {
+	ids := make([]string, 0, len(books))
+	for _, book := range books {
+		ids = append(ids, book.Id)
+	}
+
+	summaries, err := h.primaryDB.RatingSummaries(ctx, ids)
+	if err != nil {
+		log.Errorf("Unable to fetch rating summaries: %v", err)
+		return
+	}
+
+	for i := range books {
+		if summary, ok := summaries[books[i].Id]; ok {
+			books[i].Rating = &summary
+		}
+	}
+}
+
+// sorts books in place by a ?sort= value, a leading '-' sorts descending
+func sortBooks(books []models.Book, sortBy string) error {
+	descending := strings.HasPrefix(sortBy, "-")
+	key := strings.TrimPrefix(sortBy, "-")
+
+	var less func(a, b models.Book) bool
+	switch key {
+	case "title":
+		less = func(a, b models.Book) bool { return a.Title < b.Title }
+	case "author":
+		less = func(a, b models.Book) bool { return a.Author < b.Author }
+	case "rating":
+		less = func(a, b models.Book) bool { return ratingMean(a) < ratingMean(b) }
+	case "rating_count":
+		less = func(a, b models.Book) bool { return ratingCount(a) < ratingCount(b) }
+	case "year":
+		less = func(a, b models.Book) bool { return a.Year < b.Year }
+	default:
+		return fmt.Errorf("unknown sort field: %s", key)
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		if descending {
+			return less(books[j], books[i])
+		}
+		return less(books[i], books[j])
+	})
+
+	return nil
+}
+
+func ratingMean(b models.Book) float64 {
+	if b.Rating == nil {
+		return 0
+	}
+	return b.Rating.Mean
+}
+
+func ratingCount(b models.Book) int {
+	if b.Rating == nil {
+		return 0
+	}
+	return b.Rating.Count
+}
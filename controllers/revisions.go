@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// GET /books/:id/revisions
+// List every revision of a book, oldest first. Books in the trash keep their history
+func (h *Handler) GetRevisions(c *gin.Context) {
+	bookId := c.Param("id")
+
+	revisions, err := h.primaryDB.GetRevisions(context.Background(), "books", bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	// books that predate revision history have none, but still exist
+	if len(revisions) == 0 && !h.bookExists(c, bookId) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, revisions)})
+}
+
+// POST /books/:id/revisions/:revision/revert
+// Put a book back the way it was at an earlier revision, recorded as a new revision
+func (h *Handler) RevertBook(c *gin.Context) {
+	bookId := c.Param("id")
+
+	revision, err := strconv.Atoi(c.Param("revision"))
+	if err != nil || revision < 1 {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Revisions are numbered from 1"))
+		return
+	}
+
+	ctx, ok := h.precondition(c, bookId)
+	if !ok {
+		return
+	}
+
+	revisions, err := h.primaryDB.GetRevisions(ctx, "books", bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	var target *models.BookRevision
+	for i := range revisions {
+		if revisions[i].Revision == revision {
+			target = &revisions[i]
+		}
+	}
+	if target == nil {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No revision found with that number"))
+		return
+	}
+
+	before := h.auditedBook(ctx, bookId)
+	if before == nil {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No book found with that id"))
+		return
+	}
+
+	// the old ISBN may have been given to another edition since
+	if target.Book.ISBN != "" && target.Book.ISBN != before.ISBN {
+		existing, err := h.primaryDB.Get(ctx, "books", "ISBN", target.Book.ISBN)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		if len(existing) > 0 {
+			problem.Abort(c, problem.New(http.StatusConflict, "A book with that ISBN already exists").WithCode(codeDuplicateISBN).With("id", existing[0].Id))
+			return
+		}
+	}
+
+	reverted, err := h.primaryDB.RevertBook(ctx, "books", bookId, revision)
+	if err != nil {
+		abortLookup(c, err, "book")
+		return
+	}
+	h.audit(c, "book.revert", bookId, "", before, reverted)
+
+	h.respondWithBook(c, bookId)
+}
+
+// responds with a book as it was at a point in time, as JSON or in a citation format
+func (h *Handler) respondWithBookAsOf(c *gin.Context, bookId string, asOf time.Time, format string) {
+	revisions, err := h.primaryDB.GetRevisions(context.Background(), "books", bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	var latest *models.BookRevision
+	for i := range revisions {
+		if !revisions[i].CreatedAt.After(asOf) {
+			latest = &revisions[i]
+		}
+	}
+	if latest == nil || latest.Book.DeletedAt != nil {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No book found with that id at that time"))
+		return
+	}
+
+	if format != "" {
+		renderCitation(c, format, []models.Book{latest.Book}, true)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": latest.Book, "revision": latest.Revision})
+}
+
+// reads the ?as_of= timestamp, zero when it isn't set. Aborts with a 400 and
+// returns false when it isn't RFC 3339
+func asOfParam(c *gin.Context) (time.Time, bool) {
+	v := c.Query("as_of")
+	if v == "" {
+		return time.Time{}, true
+	}
+
+	asOf, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "'as_of' must be an RFC 3339 timestamp"))
+		return time.Time{}, false
+	}
+	return asOf, true
+}
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// PUT /books/:id/tags/:tag
+// Tag a book, tagging twice with the same tag is a no-op
+func (h *Handler) AddTag(c *gin.Context) {
+	h.updateTag(c, "book.tag", h.primaryDB.AddTag)
+}
+
+// DELETE /books/:id/tags/:tag
+// Remove a tag from a book
+func (h *Handler) RemoveTag(c *gin.Context) {
+	h.updateTag(c, "book.untag", h.primaryDB.RemoveTag)
+}
+
+func (h *Handler) updateTag(c *gin.Context, action string, update func(ctx context.Context, table, id, tag string) error) {
+	bookId := c.Param("id")
+
+	tag := normaliseTag(c.Param("tag"))
+	if tag == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Tags can't be blank"))
+		return
+	}
+
+	ctx, ok := h.precondition(c, bookId)
+	if !ok {
+		return
+	}
+
+	before := h.auditedBook(ctx, bookId)
+	if err := update(ctx, "books", bookId, tag); err != nil {
+		abortLookup(c, err, "book")
+		return
+	}
+	h.audit(c, action, bookId, "", before, h.auditedBook(ctx, bookId))
+
+	h.respondWithBook(c, bookId)
+}
+
+// PUT /books/:id/genre
+// Place a book in the genre taxonomy
+func (h *Handler) SetBookGenre(c *gin.Context) {
+	bookId := c.Param("id")
+
+	var input models.SetGenreInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if !h.genreExists(c, input.GenreId) {
+		return
+	}
+
+	ctx, ok := h.precondition(c, bookId)
+	if !ok {
+		return
+	}
+
+	before := h.auditedBook(ctx, bookId)
+	if err := h.primaryDB.SetGenre(ctx, "books", bookId, input.GenreId); err != nil {
+		abortLookup(c, err, "book")
+		return
+	}
+	h.audit(c, "book.set_genre", bookId, "", before, h.auditedBook(ctx, bookId))
+
+	h.respondWithBook(c, bookId)
+}
+
+// POST /genres
+// Add a genre, optionally beneath a parent genre
+func (h *Handler) CreateGenre(c *gin.Context) {
+	ctx := context.Background()
+
+	var newGenre models.InsertGenreInput
+	if err := c.ShouldBindJSON(&newGenre); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	if newGenre.ParentId != "" && !h.genreExists(c, newGenre.ParentId) {
+		return
+	}
+
+	genre, err := h.primaryDB.InsertGenre(ctx, newGenre)
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "genre.create", "", genre.Id, nil, genre)
+
+	c.JSON(http.StatusOK, gin.H{"data": genre})
+}
+
+// GET /genres
+// List the genre taxonomy
+func (h *Handler) GetGenres(c *gin.Context) {
+	genres, err := h.primaryDB.AllGenres(context.Background())
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, genres)})
+}
+
+// checks a genre id exists, aborting with a 404 if not and through abortWithDBError if it can't be read
+func (h *Handler) genreExists(c *gin.Context, genreId string) bool {
+	genres, err := h.primaryDB.AllGenres(context.Background())
+	if err != nil {
+		abortWithDBError(c, err)
+		return false
+	}
+
+	if !slices.ContainsFunc(genres, func(g models.Genre) bool { return g.Id == genreId }) {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No genre found with that id"))
+		return false
+	}
+	return true
+}
+
+// responds with the current state of a single book
+func (h *Handler) respondWithBook(c *gin.Context, bookId string) {
+	book, ok := h.currentBook(c, bookId)
+	if !ok {
+		return
+	}
+
+	c.Header("ETag", bookETag(book))
+	c.JSON(http.StatusOK, gin.H{"data": book})
+}
+
+// reads a book along with its rating, aborting through abortLookup if it can't be read
+func (h *Handler) currentBook(c *gin.Context, bookId string) (models.Book, bool) {
+	ctx := context.Background()
+
+	books, err := h.primaryDB.Get(ctx, "books", "Id", bookId)
+	if err != nil {
+		abortLookup(c, err, "book")
+		return models.Book{}, false
+	}
+	if len(books) == 0 {
+		abortLookup(c, database.ErrNotFound, "book")
+		return models.Book{}, false
+	}
+	h.attachRatings(ctx, books)
+
+	return books[0], true
+}
+
+// narrows a list of books by the ?tag= and ?genre= filters, a genre also matches its sub-genres
+func filterBooks(books []models.Book, tag string, genreId string, genres []models.Genre) []models.Book {
+	if tag == "" && genreId == "" {
+		return books
+	}
+
+	matches := bookFilter(tag, genreId, genres)
+	filtered := []models.Book{}
+	for _, book := range books {
+		if matches(book) {
+			filtered = append(filtered, book)
+		}
+	}
+
+	return filtered
+}
+
+// the ?tag= and ?genre= filters as a test of a single book
+func bookFilter(tag string, genreId string, genres []models.Genre) func(book models.Book) bool {
+	tag = normaliseTag(tag)
+	var inGenre map[string]bool
+	if genreId != "" {
+		inGenre = descendants(genres, genreId)
+	}
+
+	return func(book models.Book) bool {
+		if tag != "" && !slices.Contains(book.Tags, tag) {
+			return false
+		}
+		return genreId == "" || inGenre[book.GenreId]
+	}
+}
+
+// counts books per genre, author and decade. Books count towards their genre and every ancestor of it
+func computeFacets(books []models.Book, genres []models.Genre) models.Facets {
+	counter := newFacetCounter(genres)
+	for _, book := range books {
+		counter.add(book)
+	}
+	return counter.facets
+}
+
+// facets counted a book at a time, for lists that are never held whole
+type facetCounter struct {
+	facets  models.Facets
+	parents map[string]string
+}
+
+func newFacetCounter(genres []models.Genre) *facetCounter {
+	parents := make(map[string]string, len(genres))
+	for _, genre := range genres {
+		parents[genre.Id] = genre.ParentId
+	}
+	return &facetCounter{
+		facets: models.Facets{
+			Genre:  map[string]int{},
+			Author: map[string]int{},
+			Decade: map[string]int{},
+		},
+		parents: parents,
+	}
+}
+
+func (f *facetCounter) add(book models.Book) {
+	f.facets.Author[book.Author]++
+
+	if book.Year != 0 {
+		f.facets.Decade[fmt.Sprintf("%ds", book.Year/10*10)]++
+	}
+
+	// walk up the taxonomy, guarding against a malformed cycle
+	seen := map[string]bool{}
+	for id := book.GenreId; id != "" && !seen[id]; id = f.parents[id] {
+		seen[id] = true
+		f.facets.Genre[id]++
+	}
+}
+
+// the set of a genre and all genres beneath it
+func descendants(genres []models.Genre, rootId string) map[string]bool {
+	children := make(map[string][]string)
+	for _, genre := range genres {
+		children[genre.ParentId] = append(children[genre.ParentId], genre.Id)
+	}
+
+	found := map[string]bool{rootId: true}
+	queue := []string{rootId}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, child := range children[id] {
+			if !found[child] {
+				found[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	return found
+}
+
+// tags are compared case-insensitively and without surrounding whitespace
+func normaliseTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// normalises and de-duplicates the tags given on a new book
+func normaliseTags(tags []string) []string {
+	normalised := []string{}
+	for _, tag := range tags {
+		tag = normaliseTag(tag)
+		if tag != "" && !slices.Contains(normalised, tag) {
+			normalised = append(normalised, tag)
+		}
+	}
+	return normalised
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// GET /trash
+// List deleted books that haven't been purged yet, most recently deleted first
+func (h *Handler) GetTrash(c *gin.Context) {
+	trash, err := h.primaryDB.Trash(context.Background(), "books")
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, trash)})
+}
+
+// POST /books/:id/restore
+// Take a book back out of the trash
+func (h *Handler) RestoreBook(c *gin.Context) {
+	ctx := context.Background()
+	bookId := c.Param("id")
+
+	trash, err := h.primaryDB.Trash(ctx, "books")
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	var trashed *models.Book
+	for i := range trash {
+		if trash[i].Id == bookId {
+			trashed = &trash[i]
+			break
+		}
+	}
+	if trashed == nil {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No book in the trash with that id"))
+		return
+	}
+
+	// the ISBN may have been reused while the book was in the trash
+	if trashed.ISBN != "" {
+		existing, err := h.primaryDB.Get(ctx, "books", "ISBN", trashed.ISBN)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		if len(existing) > 0 {
+			problem.Abort(c, problem.New(http.StatusConflict, "A book with that ISBN already exists").WithCode(codeDuplicateISBN).With("id", existing[0].Id))
+			return
+		}
+	}
+
+	book, err := h.primaryDB.Restore(ctx, "books", bookId)
+	if err != nil {
+		abortLookup(c, err, "book")
+		return
+	}
+	h.audit(c, "book.restore", bookId, "", trashed, book)
+
+	h.respondWithBook(c, bookId)
+}
+
+// permanently deletes books that have been in the trash for longer than retention
+func (h *Handler) PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	cutoff := time.Now().UTC().Add(-retention)
+
+	// keep what's about to go for the audit trail. Only the books Purge reports
+	// are audited, the trash can change before it runs
+	trash, err := h.primaryDB.Trash(ctx, "books")
+	if err != nil {
+		return 0, err
+	}
+	trashed := map[string]models.Book{}
+	for _, book := range trash {
+		trashed[book.Id] = book
+	}
+
+	purged, err := h.primaryDB.Purge(ctx, "books", cutoff)
+	for _, id := range purged {
+		entry := models.AuditEntry{Actor: "system", Action: "book.purge", BookId: id}
+		if book, ok := trashed[id]; ok {
+			entry.Before = snapshot(book)
+		}
+		h.recordAudit(entry)
+	}
+
+	return len(purged), err
+}
+
+// purges the trash every interval until the returned stop function is called.
+// A retention of zero or less keeps deleted books forever
+func (h *Handler) StartTrashPurge(retention, interval time.Duration) (stop func()) {
+	if retention <= 0 {
+		log.Info("Trash retention is disabled, deleted books are kept until restored")
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			purged, err := h.PurgeTrash(context.Background(), retention)
+			if err != nil {
+				log.Errorf("Unable to purge the trash: %v", err)
+			} else if purged > 0 {
+				log.Infof("Purged %d books deleted more than %v ago", purged, retention)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,348 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// POST /users
+// Create a new user
+func (h *Handler) CreateUser(c *gin.Context) {
+	var newUser models.InsertUserInput
+	if err := c.ShouldBindJSON(&newUser); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	user, err := h.primaryDB.InsertUser(context.Background(), newUser)
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "user.create", "", user.Id, nil, user)
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+// GET /users/:id
+// Find a user by id
+func (h *Handler) GetUser(c *gin.Context) {
+	user, err := h.primaryDB.GetUser(context.Background(), c.Param("id"))
+	if err != nil {
+		abortLookup(c, err, "user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": user})
+}
+
+// GET /users/:id/shelves
+// List a user's status and custom shelves with the number of books on each
+func (h *Handler) GetShelves(c *gin.Context) {
+	ctx := context.Background()
+	userId := c.Param("id")
+
+	if !h.actingAs(c, userId) {
+		return
+	}
+
+	custom, err := h.primaryDB.GetShelves(ctx, userId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	records, err := h.primaryDB.GetReadingRecords(ctx, userId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	shelves := []models.Shelf{}
+	for _, name := range models.StatusShelves {
+		shelves = append(shelves, models.Shelf{UserId: userId, Name: name, Builtin: true})
+	}
+	shelves = append(shelves, custom...)
+
+	for i := range shelves {
+		for _, record := range records {
+			if onShelf(record, shelves[i].Name) {
+				shelves[i].Count++
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, shelves)})
+}
+
+// POST /users/:id/shelves
+// Create a custom shelf
+func (h *Handler) CreateShelf(c *gin.Context) {
+	userId := c.Param("id")
+
+	var input models.InsertShelfInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	name := normaliseTag(input.Name)
+	if name == "" {
+		problem.Abort(c, problem.New(http.StatusBadRequest, "Shelf names can't be blank"))
+		return
+	}
+	if slices.Contains(models.StatusShelves, name) {
+		problem.Abort(c, problem.New(http.StatusConflict, "That name is reserved for a status shelf").WithCode(codeReservedShelfName))
+		return
+	}
+
+	if !h.actingAs(c, userId) {
+		return
+	}
+
+	shelf, err := h.primaryDB.InsertShelf(context.Background(), userId, name)
+	if errors.Is(err, database.ErrConflict) {
+		problem.Abort(c, problem.New(http.StatusConflict, "A shelf with that name already exists").WithCode(codeShelfExists))
+		return
+	}
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "shelf.create", "", userId, nil, shelf)
+
+	c.JSON(http.StatusOK, gin.H{"data": shelf})
+}
+
+// GET /users/:id/shelves/:shelf
+// List the books on one of a user's shelves, with their reading progress
+func (h *Handler) GetShelf(c *gin.Context) {
+	ctx := context.Background()
+	userId := c.Param("id")
+	shelf := normaliseTag(c.Param("shelf"))
+
+	if !h.actingAs(c, userId) || !h.shelfExists(c, userId, shelf) {
+		return
+	}
+
+	records, err := h.primaryDB.GetReadingRecords(ctx, userId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	shelved := []models.ReadingRecord{}
+	for _, record := range records {
+		if onShelf(record, shelf) {
+			shelved = append(shelved, record)
+		}
+	}
+
+	// only the books on the page asked for are looked up
+	shelved = paginate(c, shelved)
+	for i := range shelved {
+		books, err := h.primaryDB.Get(ctx, "books", "Id", shelved[i].BookId)
+		if err != nil {
+			abortWithDBError(c, err)
+			return
+		}
+		if len(books) > 0 {
+			shelved[i].Book = &books[0]
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": shelved})
+}
+
+// PUT /users/:id/shelves/:shelf/books/:book_id
+// Put a book on a shelf and/or update its reading progress. Status shelves are exclusive,
+// so moving a book to "reading" takes it off "want-to-read"
+func (h *Handler) ShelveBook(c *gin.Context) {
+	ctx := context.Background()
+	userId := c.Param("id")
+	bookId := c.Param("book_id")
+	shelf := normaliseTag(c.Param("shelf"))
+
+	// the body is optional, an empty PUT just shelves the book
+	var input models.ShelveBookInput
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+	}
+
+	if !h.actingAs(c, userId) || !h.shelfExists(c, userId, shelf) || !h.bookExists(c, bookId) {
+		return
+	}
+
+	record, found, err := h.readingRecord(ctx, userId, bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	var before *models.ReadingRecord
+	if found {
+		previous := record
+		before = &previous
+	} else {
+		record = models.ReadingRecord{UserId: userId, BookId: bookId}
+	}
+
+	now := time.Now().UTC()
+	if slices.Contains(models.StatusShelves, shelf) {
+		record.Status = shelf
+
+		// starting or finishing a book stamps the date unless one was already recorded
+		if shelf == models.ShelfReading && record.StartedAt == nil {
+			record.StartedAt = &now
+		}
+		if shelf == models.ShelfRead {
+			if record.FinishedAt == nil {
+				record.FinishedAt = &now
+			}
+			record.Percent = 100
+		}
+	} else if !slices.Contains(record.Shelves, shelf) {
+		record.Shelves = append(record.Shelves, shelf)
+	}
+
+	if input.Page != nil {
+		record.Page = *input.Page
+	}
+	if input.Percent != nil {
+		record.Percent = *input.Percent
+	}
+	if input.StartedAt != nil {
+		record.StartedAt = input.StartedAt
+	}
+	if input.FinishedAt != nil {
+		record.FinishedAt = input.FinishedAt
+	}
+	if input.Rating != nil {
+		record.Rating = *input.Rating
+	}
+	record.UpdatedAt = now
+
+	if err := h.primaryDB.PutReadingRecord(ctx, record); err != nil {
+		log.Errorf("Database (primary) reading record update failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "reading.update", bookId, userId, before, record)
+
+	c.JSON(http.StatusOK, gin.H{"data": record})
+}
+
+// DELETE /users/:id/shelves/:shelf/books/:book_id
+// Take a book off a shelf, forgetting the book entirely once it's on no shelves
+func (h *Handler) UnshelveBook(c *gin.Context) {
+	ctx := context.Background()
+	userId := c.Param("id")
+	bookId := c.Param("book_id")
+	shelf := normaliseTag(c.Param("shelf"))
+
+	if !h.actingAs(c, userId) {
+		return
+	}
+
+	record, found, err := h.readingRecord(ctx, userId, bookId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	if !found || !onShelf(record, shelf) {
+		problem.Abort(c, problem.New(http.StatusNotFound, "That book isn't on this shelf"))
+		return
+	}
+
+	before := record
+	before.Shelves = slices.Clone(record.Shelves)
+	if record.Status == shelf {
+		record.Status = ""
+	}
+	record.Shelves = slices.DeleteFunc(record.Shelves, func(s string) bool { return s == shelf })
+	record.UpdatedAt = time.Now().UTC()
+
+	var after *models.ReadingRecord
+	if record.Status == "" && len(record.Shelves) == 0 {
+		err = h.primaryDB.DropReadingRecord(ctx, userId, bookId)
+	} else {
+		err = h.primaryDB.PutReadingRecord(ctx, record)
+		after = &record
+	}
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "reading.update", bookId, userId, before, after)
+
+	c.JSON(http.StatusOK, gin.H{"data": record})
+}
+
+// checks a user id exists and that the caller may act as that user, aborting
+// with the lookup's problem or a 403 if not. Admins act for anyone, everyone
+// else only as the user whose subject matches their identity
+func (h *Handler) actingAs(c *gin.Context, userId string) bool {
+	user, err := h.primaryDB.GetUser(context.Background(), userId)
+	if err != nil {
+		abortLookup(c, err, "user")
+		return false
+	}
+
+	identity := auth.CurrentIdentity(c)
+	if !identity.Role.Allows(auth.RoleAdmin) && (user.Subject == "" || user.Subject != identity.Subject) {
+		problem.Abort(c, problem.New(http.StatusForbidden, "You can only act as your own user"))
+		return false
+	}
+	return true
+}
+
+// status shelves always exist, custom shelves have to be created first
+func (h *Handler) shelfExists(c *gin.Context, userId, shelf string) bool {
+	if slices.Contains(models.StatusShelves, shelf) {
+		return true
+	}
+
+	shelves, err := h.primaryDB.GetShelves(context.Background(), userId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return false
+	}
+	if !slices.ContainsFunc(shelves, func(s models.Shelf) bool { return s.Name == shelf }) {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No shelf found with that name"))
+		return false
+	}
+	return true
+}
+
+// finds a user's reading record for a book, if they have one
+func (h *Handler) readingRecord(ctx context.Context, userId, bookId string) (models.ReadingRecord, bool, error) {
+	records, err := h.primaryDB.GetReadingRecords(ctx, userId)
+	if err != nil {
+		return models.ReadingRecord{}, false, err
+	}
+
+	for _, record := range records {
+		if record.BookId == bookId {
+			return record, true, nil
+		}
+	}
+	return models.ReadingRecord{}, false, nil
+}
+
+func onShelf(record models.ReadingRecord, shelf string) bool {
+	return record.Status == shelf || slices.Contains(record.Shelves, shelf)
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/openapi"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// middleware checking requests against the published description before they
+// reach a handler: required and enumerated query parameters, and JSON bodies'
+// types, lengths, ranges, formats and fields. Every violation is listed in one
+// 400 problem, so callers can fix them all at once. Routes the description
+// doesn't cover yet are let through
+func ValidateRequests() gin.HandlerFunc {
+	var doc openapi.Document
+	if err := json.Unmarshal(openapi.Spec, &doc); err != nil {
+		panic(fmt.Sprintf("openapi/openapi.json isn't valid: %v", err))
+	}
+
+	routes := map[string]openapi.Route{}
+	for _, route := range routeDescriptions() {
+		routes[route.Method+" "+route.Path] = route
+	}
+
+	return func(c *gin.Context) {
+		route, ok := routes[c.Request.Method+" "+c.FullPath()]
+		// a pattern like /books:action is only described for the path it's published as
+		if !ok || (route.As != "" && c.Request.URL.Path != route.As) {
+			c.Next()
+			return
+		}
+		op := doc.Operation(route)
+		if op == nil {
+			c.Next()
+			return
+		}
+		if route.OwnValidation {
+			queryOnly := *op
+			queryOnly.RequestBody = nil
+			op = &queryOnly
+		}
+
+		var body []byte
+		if op.RequestBody != nil && c.Request.Body != nil {
+			if _, json := op.RequestBody.Content["application/json"]; json {
+				var err error
+				body, err = io.ReadAll(c.Request.Body)
+				if err != nil {
+					problem.Abort(c, problem.New(http.StatusBadRequest, "Unable to read the request body").WithCode(problem.InvalidRequest))
+					return
+				}
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+
+		violations := doc.Validate(op, c.Request.URL.Query(), c.ContentType(), body)
+		if len(violations) > 0 {
+			detail := fmt.Sprintf("The request doesn't match the API description in %d place(s)", len(violations))
+			problem.Abort(c, problem.New(http.StatusBadRequest, detail).WithCode(problem.InvalidRequest).With("errors", violations))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// POST /works
+// Create a new work that editions can be attached to
+func (h *Handler) CreateWork(c *gin.Context) {
+	ctx := context.Background()
+
+	var newWork models.InsertWorkInput
+	if err := c.ShouldBindJSON(&newWork); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	// a work can only join a series that already exists
+	if newWork.SeriesId != "" {
+		if _, err := h.primaryDB.GetSeries(ctx, newWork.SeriesId); err != nil {
+			abortLookup(c, err, "series")
+			return
+		}
+	}
+
+	work, err := h.primaryDB.InsertWork(ctx, newWork)
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "work.create", "", work.Id, nil, work)
+
+	c.JSON(http.StatusOK, gin.H{"data": work})
+}
+
+// GET /works/:id/editions
+// List every edition of a work
+func (h *Handler) GetWorkEditions(c *gin.Context) {
+	ctx := context.Background()
+	workId := c.Param("id")
+
+	if _, err := h.primaryDB.GetWork(ctx, workId); err != nil {
+		abortLookup(c, err, "work")
+		return
+	}
+
+	editions, err := h.primaryDB.Get(ctx, "books", "WorkId", workId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+	h.attachRatings(ctx, editions)
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, editions)})
+}
+
+// POST /series
+// Create a new series
+func (h *Handler) CreateSeries(c *gin.Context) {
+	ctx := context.Background()
+
+	var newSeries models.InsertSeriesInput
+	if err := c.ShouldBindJSON(&newSeries); err != nil {
+		problem.Abort(c, problem.New(http.StatusBadRequest, err.Error()))
+		return
+	}
+
+	series, err := h.primaryDB.InsertSeries(ctx, newSeries)
+	if err != nil {
+		log.Errorf("Database (primary) insert failed: %v", err)
+		abortWithDBError(c, err)
+		return
+	}
+	h.audit(c, "series.create", "", series.Id, nil, series)
+
+	c.JSON(http.StatusOK, gin.H{"data": series})
+}
+
+// GET /series/:id/works
+// List the works in a series, in reading order
+func (h *Handler) GetSeriesWorks(c *gin.Context) {
+	ctx := context.Background()
+	seriesId := c.Param("id")
+
+	if _, err := h.primaryDB.GetSeries(ctx, seriesId); err != nil {
+		abortLookup(c, err, "series")
+		return
+	}
+
+	works, err := h.primaryDB.SeriesWorks(ctx, seriesId)
+	if err != nil {
+		abortWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": paginate(c, works)})
+}
+
+// aborts with a 404 when a lookup found nothing, a 412 when the resource has changed,
+// and otherwise with the problem abortWithDBError picks for the error
+func abortLookup(c *gin.Context, err error, resource string) {
+	if errors.Is(err, database.ErrNotFound) {
+		problem.Abort(c, problem.New(http.StatusNotFound, "No "+resource+" found with that id"))
+		return
+	}
+	if errors.Is(err, database.ErrVersionMismatch) {
+		problem.Abort(c, problem.New(http.StatusPreconditionFailed, "The "+resource+" has changed since it was read"))
+		return
+	}
+	abortWithDBError(c, err)
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// returned for the operations of an atomic batch that were rolled back because another one failed
+var ErrBatchAborted = errors.New("batch rolled back")
+
+// the outcome of one operation in a batch, Err is nil when it was applied
+type OperationResult struct {
+	Book models.Book
+	Err  error
+}
+
+// a new book with a fresh id, before its first revision
+func bookFromInput(data models.InsertBookInput) models.Book {
+	return models.Book{
+		Id:      utils.UUID(),
+		Title:   data.Title,
+		Author:  data.Author,
+		WorkId:  data.WorkId,
+		ISBN:    data.ISBN,
+		Format:  data.Format,
+		Tags:    slices.Clone(data.Tags),
+		GenreId: data.GenreId,
+		Year:    data.Year,
+	}
+}
+
+// applies the fields set in an update
+func updateFields(changes models.UpdateBookInput) bookChange {
+	return func(book *models.Book) bool {
+		before := *book
+		if changes.Title != nil {
+			book.Title = *changes.Title
+		}
+		if changes.Author != nil {
+			book.Author = *changes.Author
+		}
+		if changes.ISBN != nil {
+			book.ISBN = *changes.ISBN
+		}
+		if changes.Format != nil {
+			book.Format = *changes.Format
+		}
+		if changes.Tags != nil {
+			book.Tags = slices.Clone(*changes.Tags)
+		}
+		if changes.GenreId != nil {
+			book.GenreId = *changes.GenreId
+		}
+		if changes.Year != nil {
+			book.Year = *changes.Year
+		}
+		return !sameCatalogueFields(before, *book)
+	}
+}
+
+func sameCatalogueFields(a, b models.Book) bool {
+	return a.Title == b.Title && a.Author == b.Author && a.WorkId == b.WorkId && a.ISBN == b.ISBN &&
+		a.Format == b.Format && slices.Equal(a.Tags, b.Tags) && a.GenreId == b.GenreId && a.Year == b.Year
+}
+
+// the context for one operation, conditional on its revision when it has one
+func operationContext(ctx context.Context, op models.BatchOperation) context.Context {
+	if op.Revision != nil {
+		return ExpectRevision(ctx, *op.Revision)
+	}
+	return ctx
+}
+
+// checks an operation has what it needs, callers are expected to have validated it already
+func checkOperation(op models.BatchOperation) error {
+	switch {
+	case op.Op == "create" && op.Book == nil:
+		return fmt.Errorf("create without a book")
+	case op.Op == "update" && (op.Id == "" || op.Changes == nil):
+		return fmt.Errorf("update without an id or changes")
+	case op.Op == "delete" && op.Id == "":
+		return fmt.Errorf("delete without an id")
+	case op.Op != "create" && op.Op != "update" && op.Op != "delete":
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	return nil
+}
+
+// rolls back an atomic batch's results after the operation at failed went wrong
+func abortBatch(results []OperationResult, failed int, err error) []OperationResult {
+	for i := range results {
+		results[i] = OperationResult{Err: ErrBatchAborted}
+	}
+	results[failed].Err = err
+	return results
+}
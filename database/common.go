@@ -2,23 +2,132 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/garbhank/gin-books-api/models"
 )
 
+// returned when a lookup by id doesn't match any record
+var ErrNotFound = errors.New("record not found")
+
+// returned when an insert would duplicate a record that must be unique
+var ErrConflict = errors.New("record already exists")
+
+// a conflict with another book in the catalogue holding the same ISBN
+var ErrDuplicateISBN = fmt.Errorf("isbn already in use: %w", ErrConflict)
+
+// returned when a conditional write finds a book at a different revision than expected
+var ErrVersionMismatch = errors.New("record has been changed")
+
+// returned by backends that don't implement an optional feature
+var ErrNotSupported = errors.New("not supported by this database")
+
+// returned when a request carries something the database can't take, like a value a column can't hold
+var ErrInvalidArgument = errors.New("invalid argument")
+
+// returned when the database can't be reached or is too busy to answer, worth retrying
+var ErrUnavailable = errors.New("database unavailable")
+
 // interface for multiple Database backends
 type Database interface {
 	Conn(ctx context.Context) error
 	Close() error
 	All(ctx context.Context, table string) ([]models.Book, error)
 	Get(ctx context.Context, table, key, val string) ([]models.Book, error)
-	Drop(ctx context.Context, table, key, val string) (int, error)
+	Drop(ctx context.Context, table, key, val string) ([]models.Book, error) // the books trashed, as they were before
 	Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error)
 	IsConnected(ctx context.Context) bool // (test db connection, currently ping just checks for nil)
 	Setup(ctx context.Context) error
 	Type() string
+
+	// calls fn for every book not in the trash without loading the whole table, stopping at
+	// the first error fn returns. All is capped on some backends, Each never is
+	Each(ctx context.Context, table string, fn func(book models.Book) error) error
+
+	// bulk writes for loading a catalogue. InsertMany is all or nothing, except on Firestore where
+	// books are written in chunks and some may fail while the rest are saved. The books returned
+	// with an error line up with data, with an empty id for each one that wasn't saved. ApplyBatch
+	// returns a result per operation, and an atomic batch is rolled back entirely if any of them
+	// fails. Firestore returns ErrNotSupported for atomic batches
+	InsertMany(ctx context.Context, table string, data []models.InsertBookInput) ([]models.Book, error)
+	ApplyBatch(ctx context.Context, table string, ops []models.BatchOperation, atomic bool) ([]OperationResult, error)
+
+	// Drop moves books to the trash, where they're hidden from every other read until
+	// they're restored or purged for good
+	Trash(ctx context.Context, table string) ([]models.Book, error)              // most recently deleted first
+	Restore(ctx context.Context, table, id string) (models.Book, error)          // ErrNotFound unless the book is in the trash
+	Purge(ctx context.Context, table string, before time.Time) ([]string, error) // permanently removes books trashed before the cutoff, returning their ids
+
+	// every change to a book is kept as a numbered revision, starting at 1 on insert.
+	// Writes to a single book made through a context from ExpectRevision are conditional on it
+	GetRevisions(ctx context.Context, table, id string) ([]models.BookRevision, error) // oldest first
+	BooksAsOf(ctx context.Context, table string, asOf time.Time) ([]models.Book, error)
+	RevertBook(ctx context.Context, table, id string, revision int) (models.Book, error) // ErrNotFound for unknown books or revisions
+
+	// works group editions of the same book, series order works
+	GetWork(ctx context.Context, id string) (models.Work, error)
+	InsertWork(ctx context.Context, data models.InsertWorkInput) (models.Work, error)
+	GetSeries(ctx context.Context, id string) (models.Series, error)
+	InsertSeries(ctx context.Context, data models.InsertSeriesInput) (models.Series, error)
+	SeriesWorks(ctx context.Context, seriesId string) ([]models.Work, error) // ordered by series position
+
+	// reviews keep a per-book rating summary updated on every insert
+	InsertReview(ctx context.Context, bookId string, data models.InsertReviewInput) (models.Review, error)
+	GetReviews(ctx context.Context, bookId string) ([]models.Review, error)
+	RatingSummaries(ctx context.Context, bookIds []string) (map[string]models.RatingSummary, error)
+
+	// tags and genres, unknown book ids return ErrNotFound
+	AddTag(ctx context.Context, table, id, tag string) error
+	RemoveTag(ctx context.Context, table, id, tag string) error
+	SetGenre(ctx context.Context, table, id, genreId string) error
+	InsertGenre(ctx context.Context, data models.InsertGenreInput) (models.Genre, error)
+	AllGenres(ctx context.Context) ([]models.Genre, error)
+
+	// users, their custom shelves and one reading record per user and book
+	InsertUser(ctx context.Context, data models.InsertUserInput) (models.User, error)
+	GetUser(ctx context.Context, id string) (models.User, error)
+	InsertShelf(ctx context.Context, userId, name string) (models.Shelf, error)
+	GetShelves(ctx context.Context, userId string) ([]models.Shelf, error) // custom shelves only
+	PutReadingRecord(ctx context.Context, record models.ReadingRecord) error
+	GetReadingRecords(ctx context.Context, userId string) ([]models.ReadingRecord, error)
+	DropReadingRecord(ctx context.Context, userId, bookId string) error
+
+	// lending library. Checkout and Return must be atomic, so two users can never borrow the
+	// same copy and a returned copy goes to the oldest waiting hold
+	InsertCopy(ctx context.Context, bookId string, data models.InsertCopyInput) (models.Copy, error)
+	GetCopies(ctx context.Context, bookId string) ([]models.Copy, error)
+	Checkout(ctx context.Context, bookId, userId string, due time.Time) (models.Checkout, error) // ErrConflict when no copy is free
+	GetCheckout(ctx context.Context, id string) (models.Checkout, error)
+	Return(ctx context.Context, checkoutId string) (models.Checkout, error)
+	PlaceHold(ctx context.Context, bookId, userId string) (models.Hold, error)
+	GetHolds(ctx context.Context, bookId string) ([]models.Hold, error) // active holds, in queue order
+	OverdueCheckouts(ctx context.Context, now time.Time) ([]models.Checkout, error)
+
+	// append-only audit trail of writes, read back newest first
+	InsertAuditEntry(ctx context.Context, entry models.AuditEntry) (models.AuditEntry, error)
+	GetAuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error)
+	CountAuditEntries(ctx context.Context, filter models.AuditFilter) (int, error) // ignores Limit and Offset
+}
+
+// reports whether an audit entry passes every filter that is set
+func auditMatches(entry models.AuditEntry, filter models.AuditFilter) bool {
+	switch {
+	case filter.Actor != "" && entry.Actor != filter.Actor:
+		return false
+	case filter.Action != "" && entry.Action != filter.Action:
+		return false
+	case filter.BookId != "" && entry.BookId != filter.BookId:
+		return false
+	case !filter.Since.IsZero() && entry.Timestamp.Before(filter.Since):
+		return false
+	case !filter.Until.IsZero() && !entry.Timestamp.Before(filter.Until):
+		return false
+	}
+	return true
 }
 
 func GetDB(dbName string) Database {
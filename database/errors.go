@@ -0,0 +1,97 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/lib/pq"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the errors every failure is sorted into, so callers can tell them apart with
+// errors.Is whichever backend they came from
+var kinds = []error{ErrNotFound, ErrConflict, ErrVersionMismatch, ErrNotSupported, ErrBatchAborted, ErrInvalidArgument, ErrUnavailable}
+
+// wraps an error from a driver in the kind of failure it stands for, like a
+// dropped connection in ErrUnavailable. Errors that already wrap one of the
+// kinds, and ones that can't be told apart from any other failure, are returned
+// as they are
+func Classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return err
+		}
+	}
+
+	if kind := kindOf(err); kind != nil {
+		return fmt.Errorf("%w: %w", kind, err)
+	}
+	return err
+}
+
+func kindOf(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return postgresKind(pqErr)
+	}
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return firestoreKind(s.Code())
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.As(err, &netErr):
+		return ErrUnavailable
+	}
+	return nil
+}
+
+// by SQLSTATE class, https://www.postgresql.org/docs/current/errcodes-appendix.html
+func postgresKind(err *pq.Error) error {
+	switch err.Code.Class() {
+	case "22": // data exception
+		return ErrInvalidArgument
+	case "23": // integrity constraint violation
+		if err.Code.Name() == "unique_violation" {
+			if err.Constraint == "books_isbn_idx" {
+				return ErrDuplicateISBN
+			}
+			return ErrConflict
+		}
+		return ErrInvalidArgument
+	case "08", "53", "57": // connection exception, insufficient resources, operator intervention
+		return ErrUnavailable
+	case "40": // transaction rollback, like a serialization failure
+		return ErrConflict
+	}
+	// the rest, like a missing table or column, are faults in the schema or the
+	// queries since tables and columns are never taken from the request
+	return nil
+}
+
+func firestoreKind(code codes.Code) error {
+	switch code {
+	case codes.NotFound:
+		return ErrNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return ErrConflict
+	case codes.InvalidArgument, codes.OutOfRange:
+		return ErrInvalidArgument
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return ErrUnavailable
+	case codes.Unimplemented:
+		return ErrNotSupported
+	}
+	return nil
+}
@@ -8,12 +8,17 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
 	"github.com/garbhank/gin-books-api/models"
 	"github.com/garbhank/gin-books-api/utils"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Firestore struct {
@@ -73,7 +78,7 @@ func (f *Firestore) Get(ctx context.Context, table, key, val string) ([]models.B
 	var bookDocs []models.Book
 
 	// iterate over books collection in firestore
-	iter := f.Client.Collection(table).Where(key, "==", val).Documents(ctx)
+	iter := f.Client.Collection(table).Where(fieldPath(key), "==", val).Documents(ctx)
 	defer iter.Stop() // clean up resources
 
 	// loop until all documents matching title are added to books array
@@ -95,6 +100,12 @@ func (f *Firestore) Get(ctx context.Context, table, key, val string) ([]models.B
 			return nil, err
 		}
 
+		// filtered here rather than in the query, books written before soft deletion
+		// have no deleted_at field and wouldn't match deleted_at == nil
+		if booksBuffer.DeletedAt != nil {
+			continue
+		}
+
 		bookDocs = append(bookDocs, booksBuffer)
 	}
 
@@ -104,13 +115,31 @@ func (f *Firestore) Get(ctx context.Context, table, key, val string) ([]models.B
 func (f *Firestore) Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error) {
 	// create book document with added UUID string
 	newBook := models.Book{
-		Id:     utils.UUID(),
-		Title:  data.Title,
-		Author: data.Author,
+		Id:      utils.UUID(),
+		Title:   data.Title,
+		Author:  data.Author,
+		WorkId:  data.WorkId,
+		ISBN:    data.ISBN,
+		Format:  data.Format,
+		Tags:    data.Tags,
+		GenreId: data.GenreId,
+		Year:    data.Year,
 	}
 
-	// create a DocumentReference
-	_, _, err := f.Client.Collection(table).Add(ctx, newBook)
+	// create a DocumentReference, alongside the book's first revision
+	revision := nextRevision(&newBook, time.Now().UTC())
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := f.checkISBN(tx, table, newBook.ISBN, newBook.Id); err != nil {
+			return err
+		}
+		if err := tx.Create(f.Client.Collection(table).NewDoc(), newBook); err != nil {
+			return err
+		}
+		return tx.Create(f.revisionRef(table, revision), revision)
+	})
+	if errors.Is(err, ErrDuplicateISBN) {
+		return models.Book{}, err
+	}
 	if err != nil {
 		log.Printf("Failed adding document:\n%v", err)
 		return models.Book{}, err
@@ -119,12 +148,161 @@ func (f *Firestore) Insert(ctx context.Context, table string, data models.Insert
 	return newBook, nil
 }
 
-func (f *Firestore) Drop(ctx context.Context, table, key, val string) (int, error) {
+// books per BulkWriter chunk. Each book is two writes, the book and its first revision
+const insertChunkSize = 250
+
+func (f *Firestore) InsertMany(ctx context.Context, table string, data []models.InsertBookInput) ([]models.Book, error) {
+	books, errs := f.insertChunked(ctx, table, data)
+
+	var failed error
+	for i := range books {
+		if errs[i] != nil {
+			books[i] = models.Book{}
+			failed = fmt.Errorf("error adding book %d of %d: %w", i+1, len(data), errs[i])
+		}
+	}
+	return books, failed
+}
+
+func (f *Firestore) ApplyBatch(ctx context.Context, table string, ops []models.BatchOperation, atomic bool) ([]OperationResult, error) {
+	if atomic {
+		return nil, fmt.Errorf("atomic batches: %w", ErrNotSupported)
+	}
+
+	results := make([]OperationResult, len(ops))
+
+	// creates need no reads, so each run of them goes through the BulkWriter together.
+	// A run is written before the update or delete after it, keeping the request's order
+	creates := []models.InsertBookInput{}
+	createdAt := []int{}
+	flush := func() {
+		books, errs := f.insertChunked(ctx, table, creates)
+		for j, i := range createdAt {
+			results[i] = OperationResult{Book: books[j], Err: errs[j]}
+		}
+		creates, createdAt = creates[:0], createdAt[:0]
+	}
+
+	for i, op := range ops {
+		if err := checkOperation(op); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		switch op.Op {
+		case "create":
+			creates = append(creates, *op.Book)
+			createdAt = append(createdAt, i)
+		case "update":
+			flush()
+			results[i].Book, results[i].Err = f.updateBook(operationContext(ctx, op), table, op.Id, updateFields(*op.Changes))
+		case "delete":
+			flush()
+			results[i].Book, results[i].Err = f.updateBook(operationContext(ctx, op), table, op.Id, trashBook(time.Now().UTC()))
+		}
+	}
+	flush()
+
+	return results, nil
+}
+
+// writes new books with a BulkWriter, ending it after every chunk so a large
+// import never holds more than a chunk's writes in memory. Returns an error per book
+func (f *Firestore) insertChunked(ctx context.Context, table string, data []models.InsertBookInput) ([]models.Book, []error) {
+	books := make([]models.Book, len(data))
+	errs := make([]error, len(data))
+
+	for start := 0; start < len(data); start += insertChunkSize {
+		end := min(start+insertChunkSize, len(data))
+		bulkwriter := f.Client.BulkWriter(ctx)
+		now := time.Now().UTC()
+
+		type pending struct{ book, revision *firestore.BulkWriterJob }
+		jobs := make([]pending, end-start)
+		for i := start; i < end; i++ {
+			books[i] = bookFromInput(data[i])
+			revision := nextRevision(&books[i], now)
+
+			var err error
+			if jobs[i-start].book, err = bulkwriter.Create(f.Client.Collection(table).NewDoc(), books[i]); err != nil {
+				errs[i] = err
+				continue
+			}
+			if jobs[i-start].revision, err = bulkwriter.Create(f.revisionRef(table, revision), revision); err != nil {
+				errs[i] = err
+			}
+		}
+		bulkwriter.End()
+
+		for i := start; i < end; i++ {
+			for _, job := range []*firestore.BulkWriterJob{jobs[i-start].book, jobs[i-start].revision} {
+				if job == nil || errs[i] != nil {
+					continue
+				}
+				if _, err := job.Results(); err != nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+
+	return books, errs
+}
+
+func (f *Firestore) Drop(ctx context.Context, table, key, val string) ([]models.Book, error) {
+	// a conditional delete needs the revision checks and the writes in one transaction
+	if conditional(ctx) {
+		var deleted []models.Book
+		err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			docs, err := tx.Documents(f.Client.Collection(table).Where(fieldPath(key), "==", val)).GetAll()
+			if err != nil {
+				return err
+			}
+
+			deleted = []models.Book{}
+			refs := []*firestore.DocumentRef{}
+			for _, doc := range docs {
+				var book models.Book
+				if err := doc.DataTo(&book); err != nil {
+					return fmt.Errorf("can't cast docsnap to Book: %w", err)
+				}
+				if book.DeletedAt == nil {
+					deleted = append(deleted, book)
+					refs = append(refs, doc.Ref)
+				}
+			}
+			if err := checkRevisions(ctx, deleted); err != nil {
+				return err
+			}
+
+			now := time.Now().UTC()
+			for i, book := range deleted {
+				book.DeletedAt = &now
+				revision := nextRevision(&book, now)
+				if err := tx.Set(refs[i], book); err != nil {
+					return err
+				}
+				if err := tx.Create(f.revisionRef(table, revision), revision); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if errors.Is(err, ErrVersionMismatch) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error deleting books: %w", err)
+		}
+		return deleted, nil
+	}
+
 	bulkwriter := f.Client.BulkWriter(ctx)
+	now := time.Now().UTC()
 
 	for {
-		iter := f.Client.Collection(table).Where(key, "==", val).Documents(ctx)
-		numDeleted := 0
+		iter := f.Client.Collection(table).Where(fieldPath(key), "==", val).Documents(ctx)
+		deleted := []models.Book{}
 
 		// lowercase titles for matching book titles
 		valueLower := strings.ToLower(val)
@@ -136,7 +314,7 @@ func (f *Firestore) Drop(ctx context.Context, table, key, val string) (int, erro
 			if err == iterator.Done {
 				bulkwriter.End()
 				bulkwriter.Flush()
-				return numDeleted, nil
+				return deleted, nil
 			}
 			if err != nil {
 				log.Fatalf("Failed to iterate:\n%v", err)
@@ -145,19 +323,27 @@ func (f *Firestore) Drop(ctx context.Context, table, key, val string) (int, erro
 			log.Println(doc.Data())
 
 			if err := doc.DataTo(&bookBuffer); err != nil {
-				return numDeleted, fmt.Errorf("can't cast docsnap to Book: %v", err)
+				return nil, fmt.Errorf("can't cast docsnap to Book: %w", err)
 			}
 
-			// TODO: use utils.GetField() for grabbing struct field by string
-			parsedFirebaseTitle := strings.ToLower(bookBuffer.Title)
-			if parsedFirebaseTitle == valueLower {
-				_, err := bulkwriter.Delete(doc.Ref)
-				if err != nil {
-					return numDeleted, fmt.Errorf("error while performing delete from firestore bulkwriter: %v", err)
+			fieldValue, err := utils.GetField(bookBuffer, key)
+			if err != nil {
+				return nil, fmt.Errorf("error getting field value: %w", err)
+			}
+
+			// matching books are moved to the trash rather than removed
+			if strings.ToLower(fmt.Sprint(fieldValue)) == valueLower && bookBuffer.DeletedAt == nil {
+				deleted = append(deleted, bookBuffer)
+				bookBuffer.DeletedAt = &now
+				revision := nextRevision(&bookBuffer, now)
+				if _, err := bulkwriter.Set(doc.Ref, bookBuffer); err != nil {
+					return nil, fmt.Errorf("error while performing delete from firestore bulkwriter: %w", err)
+				}
+				if _, err := bulkwriter.Create(f.revisionRef(table, revision), revision); err != nil {
+					return nil, fmt.Errorf("error while recording revision in firestore bulkwriter: %w", err)
 				}
 
 				log.Printf("Deleted record: %s", val)
-				numDeleted++
 			}
 		}
 	}
@@ -166,3 +352,926 @@ func (f *Firestore) Drop(ctx context.Context, table, key, val string) (int, erro
 func (f *Firestore) All(ctx context.Context, table string) ([]models.Book, error) {
 	return []models.Book{}, nil
 }
+
+// documents are fetched in pages as the iterator is read, ordered by id
+func (f *Firestore) Each(ctx context.Context, table string, fn func(book models.Book) error) error {
+	iter := f.Client.Collection(table).OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var book models.Book
+		if err := doc.DataTo(&book); err != nil {
+			return fmt.Errorf("can't cast docsnap to Book: %w", err)
+		}
+		// filtered here for the same reason as in Get
+		if book.DeletedAt != nil {
+			continue
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *Firestore) Trash(ctx context.Context, table string) ([]models.Book, error) {
+	iter := f.Client.Collection(table).
+		Where("deleted_at", "!=", nil).
+		OrderBy("deleted_at", firestore.Desc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	trash := []models.Book{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var book models.Book
+		if err := doc.DataTo(&book); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Book: %w", err)
+		}
+		trash = append(trash, book)
+	}
+
+	return trash, nil
+}
+
+func (f *Firestore) Restore(ctx context.Context, table, id string) (models.Book, error) {
+	var book models.Book
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := firstDoc(tx, f.Client.Collection(table).Where("id", "==", id))
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return fmt.Errorf("book %s in trash: %w", id, ErrNotFound)
+		}
+
+		book = models.Book{}
+		if err := doc.DataTo(&book); err != nil {
+			return fmt.Errorf("can't cast docsnap to Book: %w", err)
+		}
+		if book.DeletedAt == nil {
+			return fmt.Errorf("book %s in trash: %w", id, ErrNotFound)
+		}
+		if err := f.checkISBN(tx, table, book.ISBN, book.Id); err != nil {
+			return err
+		}
+
+		book.DeletedAt = nil
+		revision := nextRevision(&book, time.Now().UTC())
+		if err := tx.Set(doc.Ref, book); err != nil {
+			return err
+		}
+		return tx.Create(f.revisionRef(table, revision), revision)
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrDuplicateISBN) {
+		return models.Book{}, err
+	}
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error restoring book %s: %w", id, err)
+	}
+
+	return book, nil
+}
+
+func (f *Firestore) Purge(ctx context.Context, table string, before time.Time) ([]string, error) {
+	iter := f.Client.Collection(table).Where("deleted_at", "<", before).Documents(ctx)
+	defer iter.Stop()
+
+	bulkwriter := f.Client.BulkWriter(ctx)
+	ids := []string{}
+	jobs := []*firestore.BulkWriterJob{}
+	// the books whose deletes went through, once the bulkwriter has ended
+	purged := func() []string {
+		bulkwriter.End()
+		done := []string{}
+		for i, job := range jobs {
+			if _, err := job.Results(); err == nil {
+				done = append(done, ids[i])
+			}
+		}
+		return done
+	}
+
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return purged(), err
+		}
+
+		id, _ := doc.Data()["id"].(string)
+		job, err := bulkwriter.Delete(doc.Ref)
+		if err != nil {
+			return purged(), fmt.Errorf("error while performing delete from firestore bulkwriter: %w", err)
+		}
+		ids = append(ids, id)
+		jobs = append(jobs, job)
+
+		// purged books go for good, history included
+		revisions, err := f.Client.Collection(table+"_revisions").Where("book_id", "==", id).Documents(ctx).GetAll()
+		if err != nil {
+			return purged(), err
+		}
+		for _, revision := range revisions {
+			if _, err := bulkwriter.Delete(revision.Ref); err != nil {
+				return purged(), fmt.Errorf("error while performing delete from firestore bulkwriter: %w", err)
+			}
+		}
+	}
+
+	return purged(), nil
+}
+
+func (f *Firestore) GetRevisions(ctx context.Context, table, id string) ([]models.BookRevision, error) {
+	return f.queryRevisions(ctx, f.Client.Collection(table+"_revisions").
+		Where("book_id", "==", id).
+		OrderBy("revision", firestore.Asc))
+}
+
+func (f *Firestore) BooksAsOf(ctx context.Context, table string, asOf time.Time) ([]models.Book, error) {
+	revisions, err := f.queryRevisions(ctx, f.Client.Collection(table+"_revisions").Where("created_at", "<=", asOf))
+	if err != nil {
+		return nil, err
+	}
+	return latestRevisions(revisions, asOf), nil
+}
+
+func (f *Firestore) RevertBook(ctx context.Context, table, id string, revision int) (models.Book, error) {
+	var old models.BookRevision
+	if err := f.getDoc(ctx, table+"_revisions", fmt.Sprintf("%s@%d", id, revision), &old); err != nil {
+		return models.Book{}, err
+	}
+
+	return f.updateBook(ctx, table, id, revertTo(old.Book))
+}
+
+func (f *Firestore) queryRevisions(ctx context.Context, query firestore.Query) ([]models.BookRevision, error) {
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	revisions := []models.BookRevision{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var revision models.BookRevision
+		if err := doc.DataTo(&revision); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to BookRevision: %w", err)
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+func (f *Firestore) GetWork(ctx context.Context, id string) (models.Work, error) {
+	var work models.Work
+	if err := f.getDoc(ctx, "works", id, &work); err != nil {
+		return models.Work{}, err
+	}
+	return work, nil
+}
+
+func (f *Firestore) InsertWork(ctx context.Context, data models.InsertWorkInput) (models.Work, error) {
+	newWork := models.Work{
+		Id:             utils.UUID(),
+		Title:          data.Title,
+		Author:         data.Author,
+		SeriesId:       data.SeriesId,
+		SeriesPosition: data.SeriesPosition,
+	}
+
+	// works are keyed by their own id so they can be fetched directly
+	if _, err := f.Client.Collection("works").Doc(newWork.Id).Set(ctx, newWork); err != nil {
+		log.Printf("Failed adding document:\n%v", err)
+		return models.Work{}, err
+	}
+
+	return newWork, nil
+}
+
+func (f *Firestore) GetSeries(ctx context.Context, id string) (models.Series, error) {
+	var series models.Series
+	if err := f.getDoc(ctx, "series", id, &series); err != nil {
+		return models.Series{}, err
+	}
+	return series, nil
+}
+
+func (f *Firestore) InsertSeries(ctx context.Context, data models.InsertSeriesInput) (models.Series, error) {
+	newSeries := models.Series{
+		Id:   utils.UUID(),
+		Name: data.Name,
+	}
+
+	if _, err := f.Client.Collection("series").Doc(newSeries.Id).Set(ctx, newSeries); err != nil {
+		log.Printf("Failed adding document:\n%v", err)
+		return models.Series{}, err
+	}
+
+	return newSeries, nil
+}
+
+func (f *Firestore) SeriesWorks(ctx context.Context, seriesId string) ([]models.Work, error) {
+	iter := f.Client.Collection("works").
+		Where("series_id", "==", seriesId).
+		OrderBy("series_position", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	works := []models.Work{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var work models.Work
+		if err := doc.DataTo(&work); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Work: %w", err)
+		}
+		works = append(works, work)
+	}
+
+	return works, nil
+}
+
+func (f *Firestore) AddTag(ctx context.Context, table, id, tag string) error {
+	_, err := f.updateBook(ctx, table, id, addTag(tag))
+	return err
+}
+
+func (f *Firestore) RemoveTag(ctx context.Context, table, id, tag string) error {
+	_, err := f.updateBook(ctx, table, id, removeTag(tag))
+	return err
+}
+
+func (f *Firestore) SetGenre(ctx context.Context, table, id, genreId string) error {
+	_, err := f.updateBook(ctx, table, id, setGenre(genreId))
+	return err
+}
+
+func (f *Firestore) InsertGenre(ctx context.Context, data models.InsertGenreInput) (models.Genre, error) {
+	newGenre := models.Genre{
+		Id:       utils.UUID(),
+		Name:     data.Name,
+		ParentId: data.ParentId,
+	}
+
+	if _, err := f.Client.Collection("genres").Doc(newGenre.Id).Set(ctx, newGenre); err != nil {
+		log.Printf("Failed adding document:\n%v", err)
+		return models.Genre{}, err
+	}
+
+	return newGenre, nil
+}
+
+func (f *Firestore) AllGenres(ctx context.Context) ([]models.Genre, error) {
+	iter := f.Client.Collection("genres").OrderBy("name", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	genres := []models.Genre{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var genre models.Genre
+		if err := doc.DataTo(&genre); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Genre: %w", err)
+		}
+		genres = append(genres, genre)
+	}
+
+	return genres, nil
+}
+
+func (f *Firestore) InsertUser(ctx context.Context, data models.InsertUserInput) (models.User, error) {
+	newUser := models.User{
+		Id:      utils.UUID(),
+		Name:    data.Name,
+		Email:   data.Email,
+		Subject: data.Subject,
+	}
+
+	if _, err := f.Client.Collection("users").Doc(newUser.Id).Set(ctx, newUser); err != nil {
+		log.Printf("Failed adding document:\n%v", err)
+		return models.User{}, err
+	}
+
+	return newUser, nil
+}
+
+func (f *Firestore) GetUser(ctx context.Context, id string) (models.User, error) {
+	var user models.User
+	if err := f.getDoc(ctx, "users", id, &user); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// shelves and reading records live in sub-collections of each user document
+func (f *Firestore) InsertShelf(ctx context.Context, userId, name string) (models.Shelf, error) {
+	newShelf := models.Shelf{UserId: userId, Name: name}
+
+	_, err := f.Client.Collection("users").Doc(userId).Collection("shelves").Doc(name).Create(ctx, newShelf)
+	if status.Code(err) == codes.AlreadyExists {
+		return models.Shelf{}, fmt.Errorf("shelf %s: %w", name, ErrConflict)
+	}
+	if err != nil {
+		return models.Shelf{}, err
+	}
+
+	return newShelf, nil
+}
+
+func (f *Firestore) GetShelves(ctx context.Context, userId string) ([]models.Shelf, error) {
+	iter := f.Client.Collection("users").Doc(userId).Collection("shelves").Documents(ctx)
+	defer iter.Stop()
+
+	shelves := []models.Shelf{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var shelf models.Shelf
+		if err := doc.DataTo(&shelf); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Shelf: %w", err)
+		}
+		shelves = append(shelves, shelf)
+	}
+
+	return shelves, nil
+}
+
+func (f *Firestore) PutReadingRecord(ctx context.Context, record models.ReadingRecord) error {
+	ref := f.Client.Collection("users").Doc(record.UserId).Collection("reading").Doc(record.BookId)
+	if _, err := ref.Set(ctx, record); err != nil {
+		return fmt.Errorf("error saving reading record: %w", err)
+	}
+	return nil
+}
+
+func (f *Firestore) GetReadingRecords(ctx context.Context, userId string) ([]models.ReadingRecord, error) {
+	iter := f.Client.Collection("users").Doc(userId).Collection("reading").OrderBy("updated_at", firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+
+	records := []models.ReadingRecord{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record models.ReadingRecord
+		if err := doc.DataTo(&record); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to ReadingRecord: %w", err)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func (f *Firestore) DropReadingRecord(ctx context.Context, userId, bookId string) error {
+	_, err := f.Client.Collection("users").Doc(userId).Collection("reading").Doc(bookId).Delete(ctx)
+	return err
+}
+
+func (f *Firestore) InsertCopy(ctx context.Context, bookId string, data models.InsertCopyInput) (models.Copy, error) {
+	newCopy := models.Copy{
+		Id:      utils.UUID(),
+		BookId:  bookId,
+		Barcode: data.Barcode,
+		Status:  models.CopyAvailable,
+	}
+
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		next, err := f.nextWaitingHold(tx, bookId)
+		if err != nil {
+			return err
+		}
+
+		// a new copy can immediately satisfy the front of the holds queue
+		if next != nil {
+			newCopy.Status = models.CopyOnHold
+			newCopy.HeldFor = next.Data()["user_id"].(string)
+			err := tx.Update(next.Ref, []firestore.Update{
+				{Path: "status", Value: models.HoldReady},
+				{Path: "copy_id", Value: newCopy.Id},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(f.Client.Collection("copies").Doc(newCopy.Id), newCopy)
+	})
+	if err != nil {
+		return models.Copy{}, fmt.Errorf("error adding copy: %w", err)
+	}
+
+	return newCopy, nil
+}
+
+func (f *Firestore) GetCopies(ctx context.Context, bookId string) ([]models.Copy, error) {
+	iter := f.Client.Collection("copies").Where("book_id", "==", bookId).Documents(ctx)
+	defer iter.Stop()
+
+	copies := []models.Copy{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var c models.Copy
+		if err := doc.DataTo(&c); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Copy: %w", err)
+		}
+		copies = append(copies, c)
+	}
+
+	return copies, nil
+}
+
+// firestore transactions retry when a document they read changes underneath them, so two
+// checkouts racing for the same copy can't both commit
+func (f *Firestore) Checkout(ctx context.Context, bookId, userId string, due time.Time) (models.Checkout, error) {
+	var checkout models.Checkout
+
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		copies := f.Client.Collection("copies").Where("book_id", "==", bookId)
+
+		// prefer a copy held for this user, otherwise take any available copy
+		copyDoc, err := firstDoc(tx, copies.Where("status", "==", models.CopyOnHold).Where("held_for", "==", userId))
+		if err != nil {
+			return err
+		}
+		var readyHolds []*firestore.DocumentSnapshot
+		if copyDoc != nil {
+			readyHolds, err = tx.Documents(f.Client.Collection("holds").
+				Where("book_id", "==", bookId).
+				Where("user_id", "==", userId).
+				Where("status", "==", models.HoldReady)).GetAll()
+			if err != nil {
+				return err
+			}
+		} else {
+			copyDoc, err = firstDoc(tx, copies.Where("status", "==", models.CopyAvailable))
+			if err != nil {
+				return err
+			}
+		}
+		if copyDoc == nil {
+			return fmt.Errorf("book %s has no copies available: %w", bookId, ErrConflict)
+		}
+
+		checkout = models.Checkout{
+			Id:           utils.UUID(),
+			CopyId:       copyDoc.Ref.ID,
+			BookId:       bookId,
+			UserId:       userId,
+			CheckedOutAt: time.Now().UTC(),
+			DueAt:        due,
+		}
+
+		for _, hold := range readyHolds {
+			if err := tx.Update(hold.Ref, []firestore.Update{{Path: "status", Value: models.HoldFulfilled}}); err != nil {
+				return err
+			}
+		}
+		err = tx.Update(copyDoc.Ref, []firestore.Update{
+			{Path: "status", Value: models.CopyOnLoan},
+			{Path: "held_for", Value: ""},
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Create(f.Client.Collection("checkouts").Doc(checkout.Id), checkout)
+	})
+	if err != nil {
+		return models.Checkout{}, err
+	}
+
+	return checkout, nil
+}
+
+func (f *Firestore) GetCheckout(ctx context.Context, id string) (models.Checkout, error) {
+	var checkout models.Checkout
+	if err := f.getDoc(ctx, "checkouts", id, &checkout); err != nil {
+		return models.Checkout{}, err
+	}
+	return checkout, nil
+}
+
+func (f *Firestore) Return(ctx context.Context, checkoutId string) (models.Checkout, error) {
+	var checkout models.Checkout
+
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		ref := f.Client.Collection("checkouts").Doc(checkoutId)
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("checkout %s: %w", checkoutId, ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&checkout); err != nil {
+			return fmt.Errorf("can't cast docsnap to Checkout: %w", err)
+		}
+		if checkout.ReturnedAt != nil {
+			return fmt.Errorf("checkout %s already returned: %w", checkoutId, ErrConflict)
+		}
+
+		next, err := f.nextWaitingHold(tx, checkout.BookId)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		checkout.ReturnedAt = &now
+		if err := tx.Update(ref, []firestore.Update{{Path: "returned_at", Value: now}}); err != nil {
+			return err
+		}
+
+		// hand the copy to the oldest waiting hold, or put it back on the shelf
+		copyUpdates := []firestore.Update{{Path: "status", Value: models.CopyAvailable}, {Path: "held_for", Value: ""}}
+		if next != nil {
+			copyUpdates = []firestore.Update{{Path: "status", Value: models.CopyOnHold}, {Path: "held_for", Value: next.Data()["user_id"]}}
+			err := tx.Update(next.Ref, []firestore.Update{
+				{Path: "status", Value: models.HoldReady},
+				{Path: "copy_id", Value: checkout.CopyId},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Update(f.Client.Collection("copies").Doc(checkout.CopyId), copyUpdates)
+	})
+	if err != nil {
+		return models.Checkout{}, err
+	}
+
+	return checkout, nil
+}
+
+func (f *Firestore) PlaceHold(ctx context.Context, bookId, userId string) (models.Hold, error) {
+	hold := models.Hold{
+		Id:       utils.UUID(),
+		BookId:   bookId,
+		UserId:   userId,
+		Status:   models.HoldWaiting,
+		PlacedAt: time.Now().UTC(),
+	}
+
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		existing, err := tx.Documents(f.Client.Collection("holds").
+			Where("book_id", "==", bookId).
+			Where("user_id", "==", userId).
+			Where("status", "in", []string{models.HoldWaiting, models.HoldReady})).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("user %s already holds book %s: %w", userId, bookId, ErrConflict)
+		}
+
+		// the queue is only non-empty when nothing is available, so a free copy goes to this hold
+		available, err := firstDoc(tx, f.Client.Collection("copies").
+			Where("book_id", "==", bookId).
+			Where("status", "==", models.CopyAvailable))
+		if err != nil {
+			return err
+		}
+		if available != nil {
+			hold.Status = models.HoldReady
+			hold.CopyId = available.Ref.ID
+			err := tx.Update(available.Ref, []firestore.Update{
+				{Path: "status", Value: models.CopyOnHold},
+				{Path: "held_for", Value: userId},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(f.Client.Collection("holds").Doc(hold.Id), hold)
+	})
+	if err != nil {
+		return models.Hold{}, err
+	}
+
+	return hold, nil
+}
+
+func (f *Firestore) GetHolds(ctx context.Context, bookId string) ([]models.Hold, error) {
+	iter := f.Client.Collection("holds").
+		Where("book_id", "==", bookId).
+		Where("status", "in", []string{models.HoldWaiting, models.HoldReady}).
+		OrderBy("placed_at", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	holds := []models.Hold{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var hold models.Hold
+		if err := doc.DataTo(&hold); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Hold: %w", err)
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, nil
+}
+
+func (f *Firestore) OverdueCheckouts(ctx context.Context, now time.Time) ([]models.Checkout, error) {
+	iter := f.Client.Collection("checkouts").
+		Where("returned_at", "==", nil).
+		Where("due_at", "<", now).
+		OrderBy("due_at", firestore.Asc).
+		Documents(ctx)
+	defer iter.Stop()
+
+	overdue := []models.Checkout{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var checkout models.Checkout
+		if err := doc.DataTo(&checkout); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to Checkout: %w", err)
+		}
+		overdue = append(overdue, checkout)
+	}
+
+	return overdue, nil
+}
+
+func (f *Firestore) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) (models.AuditEntry, error) {
+	entry.Id = utils.UUID()
+
+	// Create rather than Set, entries are never overwritten
+	if _, err := f.Client.Collection("audit_log").Doc(entry.Id).Create(ctx, entry); err != nil {
+		log.Printf("Failed adding document:\n%v", err)
+		return entry, err
+	}
+
+	return entry, nil
+}
+
+func (f *Firestore) GetAuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	query := f.auditQuery(filter).OrderBy("timestamp", firestore.Desc)
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	entries := []models.AuditEntry{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry models.AuditEntry
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, fmt.Errorf("can't cast docsnap to AuditEntry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func (f *Firestore) CountAuditEntries(ctx context.Context, filter models.AuditFilter) (int, error) {
+	query := f.auditQuery(filter)
+	result, err := query.NewAggregationQuery().WithCount("count").Get(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error counting audit entries: %w", err)
+	}
+	count, ok := result["count"].(*firestorepb.Value)
+	if !ok {
+		return 0, errors.New("error counting audit entries: no count returned")
+	}
+	return int(count.GetIntegerValue()), nil
+}
+
+// the entries matching an audit filter's conditions
+func (f *Firestore) auditQuery(filter models.AuditFilter) firestore.Query {
+	query := f.Client.Collection("audit_log").Query
+	if filter.Actor != "" {
+		query = query.Where("actor", "==", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action", "==", filter.Action)
+	}
+	if filter.BookId != "" {
+		query = query.Where("book_id", "==", filter.BookId)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("timestamp", ">=", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("timestamp", "<", filter.Until)
+	}
+	return query
+}
+
+// the oldest waiting hold on a book, or nil when the queue is empty
+func (f *Firestore) nextWaitingHold(tx *firestore.Transaction, bookId string) (*firestore.DocumentSnapshot, error) {
+	return firstDoc(tx, f.Client.Collection("holds").
+		Where("book_id", "==", bookId).
+		Where("status", "==", models.HoldWaiting).
+		OrderBy("placed_at", firestore.Asc))
+}
+
+// the first document matched by a query within a transaction, or nil if there are none
+func firstDoc(tx *firestore.Transaction, q firestore.Query) (*firestore.DocumentSnapshot, error) {
+	docs, err := tx.Documents(q.Limit(1)).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return docs[0], nil
+}
+
+// applies a change to a single live book by id, recording a revision if anything changed.
+// Books are stored under generated document ids, so the book is found by querying its id
+func (f *Firestore) updateBook(ctx context.Context, table, id string, change bookChange) (models.Book, error) {
+	var book models.Book
+	err := f.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := firstDoc(tx, f.Client.Collection(table).Where("id", "==", id))
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return fmt.Errorf("book %s: %w", id, ErrNotFound)
+		}
+
+		book = models.Book{}
+		if err := doc.DataTo(&book); err != nil {
+			return fmt.Errorf("can't cast docsnap to Book: %w", err)
+		}
+		if book.DeletedAt != nil {
+			return fmt.Errorf("book %s: %w", id, ErrNotFound)
+		}
+		if err := checkRevision(ctx, book); err != nil {
+			return err
+		}
+
+		isbn := book.ISBN
+		if !change(&book) {
+			return nil
+		}
+		if book.ISBN != isbn && book.DeletedAt == nil {
+			if err := f.checkISBN(tx, table, book.ISBN, book.Id); err != nil {
+				return err
+			}
+		}
+		revision := nextRevision(&book, time.Now().UTC())
+		if err := tx.Set(doc.Ref, book); err != nil {
+			return err
+		}
+		return tx.Create(f.revisionRef(table, revision), revision)
+	})
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrDuplicateISBN) {
+		return models.Book{}, err
+	}
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error updating book %s: %w", id, err)
+	}
+
+	return book, nil
+}
+
+// fails if a live book other than id already has the ISBN. Firestore has no unique
+// indexes, but reading the matches in the transaction keeps a racing write from
+// taking the ISBN before it commits. Writes through a BulkWriter, like imports and
+// batch creates, only have the checks in the handlers
+func (f *Firestore) checkISBN(tx *firestore.Transaction, table, isbn, id string) error {
+	if isbn == "" {
+		return nil
+	}
+	docs, err := tx.Documents(f.Client.Collection(table).Where("isbn", "==", isbn)).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		var book models.Book
+		if err := doc.DataTo(&book); err != nil {
+			return fmt.Errorf("can't cast docsnap to Book: %w", err)
+		}
+		if book.Id != id && book.DeletedAt == nil {
+			return fmt.Errorf("isbn %s: %w", isbn, ErrDuplicateISBN)
+		}
+	}
+	return nil
+}
+
+// revisions are keyed by book id and revision number, so a revision can only be written once
+func (f *Firestore) revisionRef(table string, revision models.BookRevision) *firestore.DocumentRef {
+	return f.Client.Collection(table + "_revisions").Doc(fmt.Sprintf("%s@%d", revision.BookId, revision.Revision))
+}
+
+// reads a document keyed by id into dst, mapping a missing document onto ErrNotFound
+func (f *Firestore) getDoc(ctx context.Context, collection, id string, dst any) error {
+	doc, err := f.Client.Collection(collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%s %s: %w", collection, id, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	return doc.DataTo(dst)
+}
+
+// maps a models.Book field name (e.g. "Title") onto the firestore field set by its struct tag
+func fieldPath(key string) string {
+	field, ok := reflect.TypeOf(models.Book{}).FieldByName(key)
+	if !ok {
+		return key
+	}
+
+	name, _, _ := strings.Cut(field.Tag.Get("firestore"), ",")
+	if name == "" {
+		return key
+	}
+	return name
+}
+
+// reviews are only implemented for MemoryDB and Postgres
+func (f *Firestore) InsertReview(ctx context.Context, bookId string, data models.InsertReviewInput) (models.Review, error) {
+	return models.Review{}, ErrNotSupported
+}
+
+func (f *Firestore) GetReviews(ctx context.Context, bookId string) ([]models.Review, error) {
+	return nil, ErrNotSupported
+}
+
+func (f *Firestore) RatingSummaries(ctx context.Context, bookIds []string) (map[string]models.RatingSummary, error) {
+	return map[string]models.RatingSummary{}, nil
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,23 +17,37 @@ import (
 
 // fake in memory db for demo/testing
 type MemoryDB struct {
-	Client map[string][]models.Book
-	mu     sync.RWMutex
+	Client    map[string][]models.Book
+	works     []models.Work
+	series    []models.Series
+	reviews   []models.Review
+	ratings   map[string]*models.RatingSummary
+	genres    []models.Genre
+	users     []models.User
+	shelves   []models.Shelf
+	reading   []models.ReadingRecord
+	copies    []models.Copy
+	checkouts []models.Checkout
+	holds     []models.Hold
+	revisions map[string][]models.BookRevision // keyed by table
+	audit     []models.AuditEntry
+	mu        sync.RWMutex
 }
 
 func NewMemoryDB(data map[string][]models.Book) *MemoryDB {
 	log.Println("Creating new memoryBD...")
 	var memoryMap map[string][]models.Book
 
-	// if no seed data provided, init a new map
-	if data == nil {
-		memoryMap = make(map[string][]models.Book)
-	} else {
-		memoryMap = data
+	// copy any seed data so inserts and drops don't leak back into the caller's map
+	memoryMap = make(map[string][]models.Book, len(data))
+	for table, books := range data {
+		memoryMap[table] = slices.Clone(books)
 	}
 
 	return &MemoryDB{
-		Client: memoryMap,
+		Client:    memoryMap,
+		ratings:   make(map[string]*models.RatingSummary),
+		revisions: make(map[string][]models.BookRevision),
 	}
 }
 
@@ -51,6 +68,77 @@ func (m *MemoryDB) Close() error {
 	return nil
 }
 
+func (m *MemoryDB) InsertMany(ctx context.Context, table string, data []models.InsertBookInput) ([]models.Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// all or nothing, like the other backends
+	stored := slices.Clone(m.Client[table])
+	revisions := slices.Clone(m.revisions[table])
+
+	books := []models.Book{}
+	for i, d := range data {
+		book, err := m.insert(table, bookFromInput(d))
+		if err != nil {
+			m.Client[table] = stored
+			m.revisions[table] = revisions
+			return nil, fmt.Errorf("error adding book %d of %d: %w", i+1, len(data), err)
+		}
+		books = append(books, book)
+	}
+	return books, nil
+}
+
+func (m *MemoryDB) ApplyBatch(ctx context.Context, table string, ops []models.BatchOperation, atomic bool) ([]OperationResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// books are only ever replaced in the slices, never changed in place, so
+	// shallow copies are enough to roll back to
+	books := slices.Clone(m.Client[table])
+	revisions := slices.Clone(m.revisions[table])
+
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		book, err := m.applyOperation(ctx, table, op)
+		results[i] = OperationResult{Book: book, Err: err}
+
+		if err != nil && atomic {
+			m.Client[table] = books
+			m.revisions[table] = revisions
+			return abortBatch(results, i, err), nil
+		}
+	}
+
+	return results, nil
+}
+
+// caller holds the lock
+func (m *MemoryDB) applyOperation(ctx context.Context, table string, op models.BatchOperation) (models.Book, error) {
+	if err := checkOperation(op); err != nil {
+		return models.Book{}, err
+	}
+
+	switch op.Op {
+	case "create":
+		return m.insert(table, bookFromInput(*op.Book))
+	case "update":
+		return m.updateBook(operationContext(ctx, op), table, op.Id, updateFields(*op.Changes))
+	default:
+		return m.updateBook(operationContext(ctx, op), table, op.Id, trashBook(time.Now().UTC()))
+	}
+}
+
+// stores a new book with its first revision, caller holds the lock
+func (m *MemoryDB) insert(table string, book models.Book) (models.Book, error) {
+	if err := m.checkISBN(table, book.ISBN, book.Id); err != nil {
+		return models.Book{}, err
+	}
+	m.revisions[table] = append(m.revisions[table], nextRevision(&book, time.Now().UTC()))
+	m.Client[table] = append(m.Client[table], book)
+	return book, nil
+}
+
 func (m *MemoryDB) Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -58,10 +146,20 @@ func (m *MemoryDB) Insert(ctx context.Context, table string, data models.InsertB
 
 	// create new book struct
 	newBook := models.Book{
-		Id:     utils.UUID(),
-		Title:  data.Title,
-		Author: data.Author,
+		Id:      utils.UUID(),
+		Title:   data.Title,
+		Author:  data.Author,
+		WorkId:  data.WorkId,
+		ISBN:    data.ISBN,
+		Format:  data.Format,
+		Tags:    append([]string(nil), data.Tags...),
+		GenreId: data.GenreId,
+		Year:    data.Year,
+	}
+	if err := m.checkISBN(table, newBook.ISBN, newBook.Id); err != nil {
+		return models.Book{}, err
 	}
+	m.revisions[table] = append(m.revisions[table], nextRevision(&newBook, time.Now().UTC()))
 
 	// append new book to the 'table' array
 	m.Client[table] = append(m.Client[table], newBook)
@@ -76,15 +174,17 @@ func (m *MemoryDB) Get(ctx context.Context, table, key, val string) ([]models.Bo
 
 	log.Printf("map: %v\n", m.Client)
 
-	books, ok := m.Client[table]
-	if !ok {
-		return []models.Book{}, fmt.Errorf("data not found for: %v", key)
-	}
+	// a table with no inserts yet behaves like an empty one
+	books := m.Client[table]
 
 	matchingBooks := []models.Book{}
 
 	// filter books array
 	for _, book := range books {
+		if book.DeletedAt != nil {
+			continue
+		}
+
 		// use reflect to get struct field by string
 		fieldValue, err := utils.GetField(book, key)
 		if err != nil {
@@ -99,49 +199,721 @@ func (m *MemoryDB) Get(ctx context.Context, table, key, val string) ([]models.Bo
 	return matchingBooks, nil
 }
 
-func (m *MemoryDB) Drop(ctx context.Context, table, key, val string) (int, error) {
+func (m *MemoryDB) Drop(ctx context.Context, table, key, val string) ([]models.Book, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	var filteredBooks []models.Book
-	booksFound := 0
-
 	log.Printf("pre drop map: %v\n", m.Client[table])
 
-	for _, book := range m.Client[table] {
+	// find and check every match before any is moved, so a failed check changes nothing
+	matched := []int{}
+	for i, book := range m.Client[table] {
+		if book.DeletedAt != nil {
+			continue
+		}
+
 		// get book field value
 		fieldValue, err := utils.GetField(book, key)
 		if err != nil {
-			return booksFound, fmt.Errorf("error: %v", err)
+			return nil, fmt.Errorf("error: %v", err)
 		}
-
-		// if value matches, don't append to the output array
 		if fieldValue == val {
-			log.Printf("Book to delete: %v\n", book)
-			booksFound += 1
-			continue
+			matched = append(matched, i)
 		}
+	}
 
-		// if it's not to be deleted, add it to the re-created array
-		filteredBooks = append(filteredBooks, book)
+	deleted := []models.Book{}
+	for _, i := range matched {
+		deleted = append(deleted, m.Client[table][i])
+	}
+	if err := checkRevisions(ctx, deleted); err != nil {
+		return nil, err
+	}
+
+	// matching books are moved to the trash rather than removed
+	now := time.Now().UTC()
+	for _, i := range matched {
+		log.Printf("Book to delete: %v\n", m.Client[table][i])
+		m.Client[table][i].DeletedAt = &now
+		m.revisions[table] = append(m.revisions[table], nextRevision(&m.Client[table][i], now))
 	}
 
-	m.Client[table] = filteredBooks
 	log.Printf("Post-drop post-loop map: %v\n", m.Client[table])
-	return booksFound, nil
+	return deleted, nil
 }
 
 func (m *MemoryDB) All(ctx context.Context, table string) ([]models.Book, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	allRecords := m.Client[table]
+	// copy so callers can't modify the stored books
+	allRecords := []models.Book{}
+	for _, book := range m.Client[table] {
+		if book.DeletedAt == nil {
+			allRecords = append(allRecords, book)
+		}
+	}
 
 	return allRecords, nil
 }
 
+// the books are already in memory, so this works from a copy and fn can safely write to the database
+func (m *MemoryDB) Each(ctx context.Context, table string, fn func(book models.Book) error) error {
+	books, _ := m.All(ctx, table)
+	for _, book := range books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) Trash(ctx context.Context, table string) ([]models.Book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	trash := []models.Book{}
+	for _, book := range m.Client[table] {
+		if book.DeletedAt != nil {
+			trash = append(trash, book)
+		}
+	}
+
+	sort.SliceStable(trash, func(i, j int) bool {
+		return trash[i].DeletedAt.After(*trash[j].DeletedAt)
+	})
+
+	return trash, nil
+}
+
+func (m *MemoryDB) Restore(ctx context.Context, table, id string) (models.Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, book := range m.Client[table] {
+		if book.Id == id && book.DeletedAt != nil {
+			if err := m.checkISBN(table, book.ISBN, book.Id); err != nil {
+				return models.Book{}, err
+			}
+			m.Client[table][i].DeletedAt = nil
+			m.revisions[table] = append(m.revisions[table], nextRevision(&m.Client[table][i], time.Now().UTC()))
+			return m.Client[table][i], nil
+		}
+	}
+
+	return models.Book{}, fmt.Errorf("book %s in trash: %w", id, ErrNotFound)
+}
+
+func (m *MemoryDB) Purge(ctx context.Context, table string, before time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := []string{}
+	purged := map[string]bool{}
+	kept := []models.Book{}
+	for _, book := range m.Client[table] {
+		if book.DeletedAt != nil && book.DeletedAt.Before(before) {
+			ids = append(ids, book.Id)
+			purged[book.Id] = true
+			continue
+		}
+		kept = append(kept, book)
+	}
+	m.Client[table] = kept
+
+	// purged books go for good, history included
+	m.revisions[table] = slices.DeleteFunc(m.revisions[table], func(r models.BookRevision) bool { return purged[r.BookId] })
+
+	return ids, nil
+}
+
+func (m *MemoryDB) GetRevisions(ctx context.Context, table, id string) ([]models.BookRevision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revisions := []models.BookRevision{}
+	for _, revision := range m.revisions[table] {
+		if revision.BookId == id {
+			revisions = append(revisions, revision)
+		}
+	}
+
+	return revisions, nil
+}
+
+func (m *MemoryDB) BooksAsOf(ctx context.Context, table string, asOf time.Time) ([]models.Book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return latestRevisions(m.revisions[table], asOf), nil
+}
+
+func (m *MemoryDB) RevertBook(ctx context.Context, table, id string, revision int) (models.Book, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, old := range m.revisions[table] {
+		if old.BookId == id && old.Revision == revision {
+			return m.updateBook(ctx, table, id, revertTo(old.Book))
+		}
+	}
+
+	return models.Book{}, fmt.Errorf("book %s revision %d: %w", id, revision, ErrNotFound)
+}
+
 func (m *MemoryDB) IsConnected(ctx context.Context) bool {
 	return m.Client != nil
 }
 
 func (f *MemoryDB) Type() string { return "memorydb" }
+
+func (m *MemoryDB) GetWork(ctx context.Context, id string) (models.Work, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, work := range m.works {
+		if work.Id == id {
+			return work, nil
+		}
+	}
+
+	return models.Work{}, fmt.Errorf("work %s: %w", id, ErrNotFound)
+}
+
+func (m *MemoryDB) InsertWork(ctx context.Context, data models.InsertWorkInput) (models.Work, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newWork := models.Work{
+		Id:             utils.UUID(),
+		Title:          data.Title,
+		Author:         data.Author,
+		SeriesId:       data.SeriesId,
+		SeriesPosition: data.SeriesPosition,
+	}
+	m.works = append(m.works, newWork)
+
+	return newWork, nil
+}
+
+func (m *MemoryDB) GetSeries(ctx context.Context, id string) (models.Series, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, series := range m.series {
+		if series.Id == id {
+			return series, nil
+		}
+	}
+
+	return models.Series{}, fmt.Errorf("series %s: %w", id, ErrNotFound)
+}
+
+func (m *MemoryDB) InsertSeries(ctx context.Context, data models.InsertSeriesInput) (models.Series, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newSeries := models.Series{
+		Id:   utils.UUID(),
+		Name: data.Name,
+	}
+	m.series = append(m.series, newSeries)
+
+	return newSeries, nil
+}
+
+func (m *MemoryDB) SeriesWorks(ctx context.Context, seriesId string) ([]models.Work, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	works := []models.Work{}
+	for _, work := range m.works {
+		if work.SeriesId == seriesId {
+			works = append(works, work)
+		}
+	}
+
+	// stable sort keeps insertion order for works sharing a position
+	sort.SliceStable(works, func(i, j int) bool {
+		return works[i].SeriesPosition < works[j].SeriesPosition
+	})
+
+	return works, nil
+}
+
+func (m *MemoryDB) InsertReview(ctx context.Context, bookId string, data models.InsertReviewInput) (models.Review, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newReview := models.Review{
+		Id:        utils.UUID(),
+		BookId:    bookId,
+		Reviewer:  data.Reviewer,
+		Rating:    data.Rating,
+		Text:      data.Text,
+		CreatedAt: time.Now().UTC(),
+	}
+	m.reviews = append(m.reviews, newReview)
+
+	// update the aggregate in the same critical section as the insert
+	summary, ok := m.ratings[bookId]
+	if !ok {
+		summary = &models.RatingSummary{}
+		m.ratings[bookId] = summary
+	}
+	summary.Add(data.Rating)
+
+	return newReview, nil
+}
+
+func (m *MemoryDB) GetReviews(ctx context.Context, bookId string) ([]models.Review, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	reviews := []models.Review{}
+	for _, review := range m.reviews {
+		if review.BookId == bookId {
+			reviews = append(reviews, review)
+		}
+	}
+
+	return reviews, nil
+}
+
+func (m *MemoryDB) RatingSummaries(ctx context.Context, bookIds []string) (map[string]models.RatingSummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	summaries := make(map[string]models.RatingSummary)
+	for _, id := range bookIds {
+		if summary, ok := m.ratings[id]; ok {
+			summaries[id] = *summary
+		}
+	}
+
+	return summaries, nil
+}
+
+func (m *MemoryDB) AddTag(ctx context.Context, table, id, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.updateBook(ctx, table, id, addTag(tag))
+	return err
+}
+
+func (m *MemoryDB) RemoveTag(ctx context.Context, table, id, tag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.updateBook(ctx, table, id, removeTag(tag))
+	return err
+}
+
+func (m *MemoryDB) SetGenre(ctx context.Context, table, id, genreId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.updateBook(ctx, table, id, setGenre(genreId))
+	return err
+}
+
+func (m *MemoryDB) InsertGenre(ctx context.Context, data models.InsertGenreInput) (models.Genre, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newGenre := models.Genre{
+		Id:       utils.UUID(),
+		Name:     data.Name,
+		ParentId: data.ParentId,
+	}
+	m.genres = append(m.genres, newGenre)
+
+	return newGenre, nil
+}
+
+func (m *MemoryDB) AllGenres(ctx context.Context) ([]models.Genre, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return slices.Clone(m.genres), nil
+}
+
+func (m *MemoryDB) InsertUser(ctx context.Context, data models.InsertUserInput) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newUser := models.User{
+		Id:      utils.UUID(),
+		Name:    data.Name,
+		Email:   data.Email,
+		Subject: data.Subject,
+	}
+	m.users = append(m.users, newUser)
+
+	return newUser, nil
+}
+
+func (m *MemoryDB) GetUser(ctx context.Context, id string) (models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		if user.Id == id {
+			return user, nil
+		}
+	}
+
+	return models.User{}, fmt.Errorf("user %s: %w", id, ErrNotFound)
+}
+
+func (m *MemoryDB) InsertShelf(ctx context.Context, userId, name string) (models.Shelf, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, shelf := range m.shelves {
+		if shelf.UserId == userId && shelf.Name == name {
+			return models.Shelf{}, fmt.Errorf("shelf %s: %w", name, ErrConflict)
+		}
+	}
+
+	newShelf := models.Shelf{UserId: userId, Name: name}
+	m.shelves = append(m.shelves, newShelf)
+
+	return newShelf, nil
+}
+
+func (m *MemoryDB) GetShelves(ctx context.Context, userId string) ([]models.Shelf, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	shelves := []models.Shelf{}
+	for _, shelf := range m.shelves {
+		if shelf.UserId == userId {
+			shelves = append(shelves, shelf)
+		}
+	}
+
+	return shelves, nil
+}
+
+func (m *MemoryDB) PutReadingRecord(ctx context.Context, record models.ReadingRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record.Shelves = slices.Clone(record.Shelves)
+	for i, existing := range m.reading {
+		if existing.UserId == record.UserId && existing.BookId == record.BookId {
+			m.reading[i] = record
+			return nil
+		}
+	}
+	m.reading = append(m.reading, record)
+
+	return nil
+}
+
+func (m *MemoryDB) GetReadingRecords(ctx context.Context, userId string) ([]models.ReadingRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	records := []models.ReadingRecord{}
+	for _, record := range m.reading {
+		if record.UserId == userId {
+			record.Shelves = slices.Clone(record.Shelves)
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (m *MemoryDB) DropReadingRecord(ctx context.Context, userId, bookId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reading = slices.DeleteFunc(m.reading, func(r models.ReadingRecord) bool {
+		return r.UserId == userId && r.BookId == bookId
+	})
+
+	return nil
+}
+
+func (m *MemoryDB) InsertCopy(ctx context.Context, bookId string, data models.InsertCopyInput) (models.Copy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newCopy := models.Copy{
+		Id:      utils.UUID(),
+		BookId:  bookId,
+		Barcode: data.Barcode,
+		Status:  models.CopyAvailable,
+	}
+	m.copies = append(m.copies, newCopy)
+
+	// a new copy can immediately satisfy the front of the holds queue
+	m.fulfilNextHold(len(m.copies) - 1)
+
+	return m.copies[len(m.copies)-1], nil
+}
+
+func (m *MemoryDB) GetCopies(ctx context.Context, bookId string) ([]models.Copy, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	copies := []models.Copy{}
+	for _, c := range m.copies {
+		if c.BookId == bookId {
+			copies = append(copies, c)
+		}
+	}
+
+	return copies, nil
+}
+
+func (m *MemoryDB) Checkout(ctx context.Context, bookId, userId string, due time.Time) (models.Checkout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// prefer a copy held for this user, otherwise take any available copy
+	copyIndex := slices.IndexFunc(m.copies, func(c models.Copy) bool {
+		return c.BookId == bookId && c.Status == models.CopyOnHold && c.HeldFor == userId
+	})
+	if copyIndex >= 0 {
+		for i, hold := range m.holds {
+			if hold.BookId == bookId && hold.UserId == userId && hold.Status == models.HoldReady {
+				m.holds[i].Status = models.HoldFulfilled
+			}
+		}
+	} else {
+		copyIndex = slices.IndexFunc(m.copies, func(c models.Copy) bool {
+			return c.BookId == bookId && c.Status == models.CopyAvailable
+		})
+	}
+	if copyIndex < 0 {
+		return models.Checkout{}, fmt.Errorf("book %s has no copies available: %w", bookId, ErrConflict)
+	}
+
+	m.copies[copyIndex].Status = models.CopyOnLoan
+	m.copies[copyIndex].HeldFor = ""
+
+	checkout := models.Checkout{
+		Id:           utils.UUID(),
+		CopyId:       m.copies[copyIndex].Id,
+		BookId:       bookId,
+		UserId:       userId,
+		CheckedOutAt: time.Now().UTC(),
+		DueAt:        due,
+	}
+	m.checkouts = append(m.checkouts, checkout)
+
+	return checkout, nil
+}
+
+func (m *MemoryDB) GetCheckout(ctx context.Context, id string) (models.Checkout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i := slices.IndexFunc(m.checkouts, func(c models.Checkout) bool { return c.Id == id })
+	if i < 0 {
+		return models.Checkout{}, fmt.Errorf("checkout %s: %w", id, ErrNotFound)
+	}
+	return m.checkouts[i], nil
+}
+
+func (m *MemoryDB) Return(ctx context.Context, checkoutId string) (models.Checkout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := slices.IndexFunc(m.checkouts, func(c models.Checkout) bool { return c.Id == checkoutId })
+	if i < 0 {
+		return models.Checkout{}, fmt.Errorf("checkout %s: %w", checkoutId, ErrNotFound)
+	}
+	if m.checkouts[i].ReturnedAt != nil {
+		return models.Checkout{}, fmt.Errorf("checkout %s already returned: %w", checkoutId, ErrConflict)
+	}
+
+	now := time.Now().UTC()
+	m.checkouts[i].ReturnedAt = &now
+
+	copyIndex := slices.IndexFunc(m.copies, func(c models.Copy) bool { return c.Id == m.checkouts[i].CopyId })
+	if copyIndex >= 0 {
+		m.copies[copyIndex].Status = models.CopyAvailable
+		m.fulfilNextHold(copyIndex)
+	}
+
+	return m.checkouts[i], nil
+}
+
+func (m *MemoryDB) PlaceHold(ctx context.Context, bookId, userId string) (models.Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, hold := range m.holds {
+		if hold.BookId == bookId && hold.UserId == userId && hold.Status != models.HoldFulfilled {
+			return models.Hold{}, fmt.Errorf("user %s already holds book %s: %w", userId, bookId, ErrConflict)
+		}
+	}
+
+	hold := models.Hold{
+		Id:       utils.UUID(),
+		BookId:   bookId,
+		UserId:   userId,
+		Status:   models.HoldWaiting,
+		PlacedAt: time.Now().UTC(),
+	}
+	m.holds = append(m.holds, hold)
+
+	// if a copy is sitting on the shelf, reserve it straight away
+	copyIndex := slices.IndexFunc(m.copies, func(c models.Copy) bool {
+		return c.BookId == bookId && c.Status == models.CopyAvailable
+	})
+	if copyIndex >= 0 {
+		m.fulfilNextHold(copyIndex)
+	}
+
+	return m.holds[len(m.holds)-1], nil
+}
+
+func (m *MemoryDB) GetHolds(ctx context.Context, bookId string) ([]models.Hold, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	holds := []models.Hold{}
+	for _, hold := range m.holds {
+		if hold.BookId == bookId && hold.Status != models.HoldFulfilled {
+			holds = append(holds, hold)
+		}
+	}
+
+	return holds, nil
+}
+
+func (m *MemoryDB) OverdueCheckouts(ctx context.Context, now time.Time) ([]models.Checkout, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	overdue := []models.Checkout{}
+	for _, checkout := range m.checkouts {
+		if checkout.ReturnedAt == nil && checkout.DueAt.Before(now) {
+			overdue = append(overdue, checkout)
+		}
+	}
+
+	return overdue, nil
+}
+
+func (m *MemoryDB) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) (models.AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.Id = utils.UUID()
+	m.audit = append(m.audit, entry)
+
+	return entry, nil
+}
+
+func (m *MemoryDB) GetAuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// entries are appended as they happen, so walk backwards for newest first
+	entries := []models.AuditEntry{}
+	skipped := 0
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+		if !auditMatches(m.audit[i], filter) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		entries = append(entries, m.audit[i])
+	}
+
+	return entries, nil
+}
+
+func (m *MemoryDB) CountAuditEntries(ctx context.Context, filter models.AuditFilter) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, entry := range m.audit {
+		if auditMatches(entry, filter) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// reserves an available copy for the oldest waiting hold on its book, callers must hold the lock
+func (m *MemoryDB) fulfilNextHold(copyIndex int) {
+	available := &m.copies[copyIndex]
+
+	// holds are appended in the order they're placed, so the first match is the oldest
+	for i, hold := range m.holds {
+		if hold.BookId == available.BookId && hold.Status == models.HoldWaiting {
+			m.holds[i].Status = models.HoldReady
+			m.holds[i].CopyId = available.Id
+			available.Status = models.CopyOnHold
+			available.HeldFor = hold.UserId
+			return
+		}
+	}
+}
+
+// applies a change to a live book, recording a revision if anything changed. Callers must hold the lock
+func (m *MemoryDB) updateBook(ctx context.Context, table, id string, change bookChange) (models.Book, error) {
+	i, err := m.indexOf(table, id)
+	if err != nil {
+		return models.Book{}, err
+	}
+
+	book := m.Client[table][i]
+	if err := checkRevision(ctx, book); err != nil {
+		return models.Book{}, err
+	}
+	if !change(&book) {
+		return book, nil
+	}
+	if book.ISBN != m.Client[table][i].ISBN && book.DeletedAt == nil {
+		if err := m.checkISBN(table, book.ISBN, book.Id); err != nil {
+			return models.Book{}, err
+		}
+	}
+	m.revisions[table] = append(m.revisions[table], nextRevision(&book, time.Now().UTC()))
+	m.Client[table][i] = book
+
+	return book, nil
+}
+
+// fails if a live book other than id already has the ISBN, the backstop for the
+// checks in the handlers, which can race. Callers must hold the lock
+func (m *MemoryDB) checkISBN(table, isbn, id string) error {
+	if isbn == "" {
+		return nil
+	}
+	for _, book := range m.Client[table] {
+		if book.ISBN == isbn && book.Id != id && book.DeletedAt == nil {
+			return fmt.Errorf("isbn %s: %w", isbn, ErrDuplicateISBN)
+		}
+	}
+	return nil
+}
+
+// position of a live book in a table, callers must hold the lock
+func (m *MemoryDB) indexOf(table, id string) (int, error) {
+	for i, book := range m.Client[table] {
+		if book.Id == id && book.DeletedAt == nil {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("book %s: %w", id, ErrNotFound)
+}
@@ -3,16 +3,19 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/garbhank/gin-books-api/models"
 	"github.com/garbhank/gin-books-api/utils"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
@@ -23,6 +26,9 @@ const (
 	dbname   = "books"
 )
 
+// columns selected for a models.Book, in the order scanBooks expects them
+const bookColumns = "id, title, author, work_id, isbn, format, tags, genre_id, year, deleted_at, revision"
+
 type Postgres struct {
 	Client   *sql.DB
 	host     string
@@ -66,18 +72,172 @@ func (p *Postgres) IsConnected(ctx context.Context) bool {
 }
 
 func (p *Postgres) Setup(ctx context.Context) error {
-	// create the table if not present
-	createTableQuery := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (
-		id	   TEXT PRIMARY KEY,
-		title  VARCHAR(255),
-		author VARCHAR(255)
-	);`, "books")
+	// create the tables if not present, and add any columns missing from older schemas
+	setupQueries := []string{
+		`CREATE TABLE IF NOT EXISTS "books" (
+			id	   TEXT PRIMARY KEY,
+			title  VARCHAR(255),
+			author VARCHAR(255)
+		);`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS work_id TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS isbn VARCHAR(17) NOT NULL DEFAULT '';`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS format VARCHAR(64) NOT NULL DEFAULT '';`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS genre_id TEXT NOT NULL DEFAULT '';`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS year INTEGER NOT NULL DEFAULT 0;`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;`,
+		`ALTER TABLE "books" ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS "books_revisions" (
+			book_id    TEXT NOT NULL,
+			revision   INTEGER NOT NULL,
+			snapshot   JSONB NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (book_id, revision)
+		);`,
+		`CREATE INDEX IF NOT EXISTS books_revisions_created_at_idx ON "books_revisions" (created_at);`,
+		`CREATE INDEX IF NOT EXISTS books_deleted_at_idx ON "books" (deleted_at) WHERE deleted_at IS NOT NULL;`,
+		`CREATE TABLE IF NOT EXISTS "genres" (
+			id        TEXT PRIMARY KEY,
+			name      VARCHAR(255),
+			parent_id TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE TABLE IF NOT EXISTS "series" (
+			id   TEXT PRIMARY KEY,
+			name VARCHAR(255)
+		);`,
+		`CREATE TABLE IF NOT EXISTS "works" (
+			id              TEXT PRIMARY KEY,
+			title           VARCHAR(255),
+			author          VARCHAR(255),
+			series_id       TEXT NOT NULL DEFAULT '',
+			series_position INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS "users" (
+			id    TEXT PRIMARY KEY,
+			name  VARCHAR(255),
+			email VARCHAR(255) NOT NULL DEFAULT ''
+		);`,
+		`ALTER TABLE "users" ADD COLUMN IF NOT EXISTS subject VARCHAR(255) NOT NULL DEFAULT '';`,
+		`CREATE TABLE IF NOT EXISTS "shelves" (
+			user_id TEXT NOT NULL,
+			name    VARCHAR(255) NOT NULL,
+			PRIMARY KEY (user_id, name)
+		);`,
+		`CREATE TABLE IF NOT EXISTS "reading_records" (
+			user_id     TEXT NOT NULL,
+			book_id     TEXT NOT NULL,
+			status      VARCHAR(32) NOT NULL DEFAULT '',
+			shelves     TEXT[] NOT NULL DEFAULT '{}',
+			page        INTEGER NOT NULL DEFAULT 0,
+			percent     DOUBLE PRECISION NOT NULL DEFAULT 0,
+			started_at  TIMESTAMPTZ,
+			finished_at TIMESTAMPTZ,
+			updated_at  TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (user_id, book_id)
+		);`,
+		`ALTER TABLE "reading_records" ADD COLUMN IF NOT EXISTS rating SMALLINT NOT NULL DEFAULT 0;`,
+		`CREATE TABLE IF NOT EXISTS "copies" (
+			id       TEXT PRIMARY KEY,
+			book_id  TEXT NOT NULL,
+			barcode  VARCHAR(64) NOT NULL DEFAULT '',
+			status   VARCHAR(16) NOT NULL,
+			held_for TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE INDEX IF NOT EXISTS copies_book_id_idx ON "copies" (book_id, status);`,
+		`CREATE TABLE IF NOT EXISTS "checkouts" (
+			id             TEXT PRIMARY KEY,
+			copy_id        TEXT NOT NULL,
+			book_id        TEXT NOT NULL,
+			user_id        TEXT NOT NULL,
+			checked_out_at TIMESTAMPTZ NOT NULL,
+			due_at         TIMESTAMPTZ NOT NULL,
+			returned_at    TIMESTAMPTZ
+		);`,
+		// backstop for the row locks in Checkout, a copy can only be on one open loan
+		`CREATE UNIQUE INDEX IF NOT EXISTS checkouts_open_copy_idx ON "checkouts" (copy_id) WHERE returned_at IS NULL;`,
+		`CREATE TABLE IF NOT EXISTS "holds" (
+			id        TEXT PRIMARY KEY,
+			book_id   TEXT NOT NULL,
+			user_id   TEXT NOT NULL,
+			status    VARCHAR(16) NOT NULL,
+			copy_id   TEXT NOT NULL DEFAULT '',
+			placed_at TIMESTAMPTZ NOT NULL
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS holds_active_user_idx ON "holds" (book_id, user_id) WHERE status <> 'fulfilled';`,
+		`CREATE TABLE IF NOT EXISTS "reviews" (
+			id         TEXT PRIMARY KEY,
+			book_id    TEXT NOT NULL,
+			reviewer   VARCHAR(255),
+			rating     SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+			text       TEXT,
+			created_at TIMESTAMPTZ NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS reviews_book_id_idx ON "reviews" (book_id);`,
+		`CREATE TABLE IF NOT EXISTS "book_ratings" (
+			book_id TEXT PRIMARY KEY,
+			count   INTEGER NOT NULL DEFAULT 0,
+			r1      INTEGER NOT NULL DEFAULT 0,
+			r2      INTEGER NOT NULL DEFAULT 0,
+			r3      INTEGER NOT NULL DEFAULT 0,
+			r4      INTEGER NOT NULL DEFAULT 0,
+			r5      INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS "audit_log" (
+			id          TEXT PRIMARY KEY,
+			actor       VARCHAR(255) NOT NULL,
+			action      VARCHAR(64) NOT NULL,
+			book_id     TEXT NOT NULL DEFAULT '',
+			resource_id TEXT NOT NULL DEFAULT '',
+			before      JSONB,
+			after       JSONB,
+			request_id  VARCHAR(64) NOT NULL DEFAULT '',
+			created_at  TIMESTAMPTZ NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON "audit_log" (created_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS audit_log_book_id_idx ON "audit_log" (book_id);`,
+	}
+
+	for _, query := range setupQueries {
+		if _, err := p.Client.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("error creating table: %w", err)
+		}
+	}
+
+	return p.uniqueISBNs(ctx)
+}
 
-	_, err := p.Client.ExecContext(ctx, createTableQuery)
+// the ISBN checks in the handlers can race, a unique index keeps two live books
+// from ending up with one. Databases from before the index can already hold
+// duplicates, which are reported so they can be resolved rather than failing
+// on the index
+func (p *Postgres) uniqueISBNs(ctx context.Context) error {
+	rows, err := p.Client.QueryContext(ctx, `SELECT isbn FROM "books"
+		WHERE isbn <> '' AND deleted_at IS NULL
+		GROUP BY isbn HAVING COUNT(*) > 1 ORDER BY isbn LIMIT 10`)
 	if err != nil {
-		return fmt.Errorf("error creating table: %v", err)
+		return fmt.Errorf("error checking for duplicate ISBNs: %w", err)
+	}
+	defer rows.Close()
+
+	duplicates := []string{}
+	for rows.Next() {
+		var isbn string
+		if err := rows.Scan(&isbn); err != nil {
+			return fmt.Errorf("error checking for duplicate ISBNs: %w", err)
+		}
+		duplicates = append(duplicates, isbn)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error checking for duplicate ISBNs: %w", err)
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("books outside the trash share the ISBNs %s, change or trash all but one book for each before starting",
+			strings.Join(duplicates, ", "))
 	}
 
+	if _, err := p.Client.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS books_isbn_idx ON "books" (isbn) WHERE isbn <> '' AND deleted_at IS NULL;`); err != nil {
+		return fmt.Errorf("error creating ISBN index: %w", err)
+	}
 	return nil
 }
 
@@ -103,69 +263,263 @@ func (p *Postgres) Conn(ctx context.Context) error {
 func (p *Postgres) Close() error {
 	err := p.Client.Close()
 	if err != nil {
-		return fmt.Errorf("error closing database connection: %v", err)
+		return fmt.Errorf("error closing database connection: %w", err)
 	}
 	return nil
 }
 
 func (p *Postgres) Get(ctx context.Context, table, key, val string) ([]models.Book, error) {
+	column, err := columnName(key)
+	if err != nil {
+		return nil, err
+	}
+
 	// filter based on the selected column and value
-	selectQuery := fmt.Sprintf(`SELECT title, author FROM "%s" WHERE "%s" = $1`, table, strings.ToLower(key))
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE "%s" = $1 AND deleted_at IS NULL`, bookColumns, table, column)
 	rows, err := p.Client.QueryContext(ctx, selectQuery, val)
 	if err != nil {
-		return nil, fmt.Errorf("error while performing query: %v", err)
+		return nil, fmt.Errorf("error while performing query: %w", err)
 	}
-	defer func() {
-		if err := rows.Close(); err != nil {
-			log.Printf("error closing rows: %v\n", err)
-		}
-	}()
 
-	// create a slice with 0 elements
-	books := []models.Book{}
+	return scanBooks(rows)
+}
 
-	log.Printf("Iterating through rows...")
-	for rows.Next() {
-		var b models.Book
+func (p *Postgres) Drop(ctx context.Context, table, key, val string) ([]models.Book, error) {
+	column, err := columnName(key)
+	if err != nil {
+		return nil, err
+	}
 
-		if err := rows.Scan(&b.Title, &b.Author); err != nil {
-			return books, err
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// lock the matching books, so they can be checked against any expected revisions
+	// and returned as they were before the delete
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE "%s" = $1 AND deleted_at IS NULL FOR UPDATE`, bookColumns, table, column)
+	rows, err := tx.QueryContext(ctx, selectQuery, val)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	matched, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRevisions(ctx, matched); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, book := range matched {
+		ids = append(ids, book.Id)
+	}
+
+	// move the matched books to the trash
+	deleteQuery := fmt.Sprintf(`UPDATE "%s" SET deleted_at = $2, revision = revision + 1
+		WHERE id = ANY($1) RETURNING %s`, table, bookColumns)
+	rows, err = tx.QueryContext(ctx, deleteQuery, pq.Array(ids), time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	deleted, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertRevisions(ctx, tx, table, deleted...); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing delete: %w", err)
+	}
+
+	return matched, nil
+}
+
+func (p *Postgres) Trash(ctx context.Context, table string) ([]models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE deleted_at IS NOT NULL ORDER BY deleted_at DESC`, bookColumns, table)
+	rows, err := p.Client.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return scanBooks(rows)
+}
+
+func (p *Postgres) Restore(ctx context.Context, table, id string) (models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return models.Book{}, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	restoreQuery := fmt.Sprintf(`UPDATE "%s" SET deleted_at = NULL, revision = revision + 1
+		WHERE id = $1 AND deleted_at IS NOT NULL RETURNING %s`, table, bookColumns)
+	rows, err := tx.QueryContext(ctx, restoreQuery, id)
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	books, err := scanBooks(rows)
+	if err != nil {
+		return models.Book{}, err
+	}
+	if len(books) == 0 {
+		return models.Book{}, fmt.Errorf("book %s in trash: %w", id, ErrNotFound)
+	}
+
+	if err := insertRevisions(ctx, tx, table, books[0]); err != nil {
+		return models.Book{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.Book{}, fmt.Errorf("error committing restore: %w", err)
+	}
+
+	return books[0], nil
+}
+
+func (p *Postgres) Purge(ctx context.Context, table string, before time.Time) ([]string, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	purgeQuery := fmt.Sprintf(`DELETE FROM "%s" WHERE deleted_at < $1 RETURNING id`, table)
+	rows, err := tx.QueryContext(ctx, purgeQuery, before)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	purged := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
 		}
-		books = append(books, b)
+		purged = append(purged, id)
 	}
-	if err = rows.Err(); err != nil {
-		return books, err
+	if err := rows.Close(); err != nil {
+		return nil, err
 	}
 
-	return books, nil
+	// purged books go for good, history included
+	historyQuery := fmt.Sprintf(`DELETE FROM "%s_revisions" WHERE book_id = ANY($1)`, table)
+	if _, err := tx.ExecContext(ctx, historyQuery, pq.Array(purged)); err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing purge: %w", err)
+	}
+
+	return purged, nil
+}
+
+func (p *Postgres) GetRevisions(ctx context.Context, table, id string) ([]models.BookRevision, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	selectQuery := fmt.Sprintf(`SELECT book_id, revision, snapshot, created_at FROM "%s_revisions"
+		WHERE book_id = $1 ORDER BY revision`, table)
+	rows, err := p.Client.QueryContext(ctx, selectQuery, id)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return scanRevisions(rows)
 }
 
-func (p *Postgres) Drop(ctx context.Context, table, key, val string) (int, error) {
-	// TODO: make sure casting int64 to int isn't causing any trouble
+func (p *Postgres) BooksAsOf(ctx context.Context, table string, asOf time.Time) ([]models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	// the newest revision of each book at the time, dropping books that were in the trash
+	selectQuery := fmt.Sprintf(`SELECT book_id, revision, snapshot, created_at FROM (
+			SELECT DISTINCT ON (book_id) book_id, revision, snapshot, created_at FROM "%s_revisions"
+			WHERE created_at <= $1 ORDER BY book_id, revision DESC
+		) latest WHERE snapshot->>'deleted_at' IS NULL ORDER BY book_id`, table)
+	rows, err := p.Client.QueryContext(ctx, selectQuery, asOf)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
 
-	// delete data from the table based on the input table/key/value
-	deleteQuery := fmt.Sprintf(`DELETE FROM "%s" WHERE "%s" = $1`, table, strings.ToLower(key))
-	res, err := p.Client.ExecContext(ctx, deleteQuery, val)
+	revisions, err := scanRevisions(rows)
 	if err != nil {
-		return 0, fmt.Errorf("error while performing query: %v", err)
+		return nil, err
+	}
+
+	books := make([]models.Book, 0, len(revisions))
+	for _, revision := range revisions {
+		books = append(books, revision.Book)
+	}
+	return books, nil
+}
+
+func (p *Postgres) RevertBook(ctx context.Context, table, id string, revision int) (models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return models.Book{}, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
 	}
 
-	// get the number of rows deleted by the query
-	n, err := res.RowsAffected()
+	var snapshot []byte
+	selectQuery := fmt.Sprintf(`SELECT snapshot FROM "%s_revisions" WHERE book_id = $1 AND revision = $2`, table)
+	err := p.Client.QueryRowContext(ctx, selectQuery, id, revision).Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Book{}, fmt.Errorf("book %s revision %d: %w", id, revision, ErrNotFound)
+	}
 	if err != nil {
-		return int(n), fmt.Errorf("error while getting the number of rows affected by the DELETE command: %v", err)
+		return models.Book{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	var old models.Book
+	if err := json.Unmarshal(snapshot, &old); err != nil {
+		return models.Book{}, fmt.Errorf("error decoding revision: %w", err)
 	}
 
-	return int(n), nil
+	return p.updateBook(ctx, table, id, revertTo(old))
 }
 
 func (p *Postgres) All(ctx context.Context, table string) ([]models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
 
 	// filter based on the selected column and value
-	selectQuery := fmt.Sprintf(`SELECT title, author FROM "%s" LIMIT 100`, table)
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE deleted_at IS NULL LIMIT 100`, bookColumns, table)
+	rows, err := p.Client.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return scanBooks(rows)
+}
+
+// rows are read from the cursor as fn takes them, ordered by id
+func (p *Postgres) Each(ctx context.Context, table string, fn func(book models.Book) error) error {
+	if !utils.IsSafeIdentifier(table) {
+		return fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE deleted_at IS NULL ORDER BY id`, bookColumns, table)
 	rows, err := p.Client.QueryContext(ctx, selectQuery)
 	if err != nil {
-		return nil, fmt.Errorf("error while performing query: %v", err)
+		return fmt.Errorf("error while performing query: %w", err)
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
@@ -173,47 +527,1103 @@ func (p *Postgres) All(ctx context.Context, table string) ([]models.Book, error)
 		}
 	}()
 
-	// create a slice with 0 elements
-	books := []models.Book{}
-
-	log.Printf("Iterating through rows...")
 	for rows.Next() {
-		var b models.Book
-
-		if err := rows.Scan(&b.Title, &b.Author); err != nil {
-			return books, err
+		book, err := scanBook(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(book); err != nil {
+			return err
 		}
-		books = append(books, b)
-	}
-	if err = rows.Err(); err != nil {
-		return books, err
 	}
-
-	return books, nil
+	return rows.Err()
 }
 
 func (p *Postgres) Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error) {
 	book := models.Book{
-		Id:     utils.UUID(),
-		Title:  data.Title,
-		Author: data.Author,
+		Id:      utils.UUID(),
+		Title:   data.Title,
+		Author:  data.Author,
+		WorkId:  data.WorkId,
+		ISBN:    data.ISBN,
+		Format:  data.Format,
+		Tags:    data.Tags,
+		GenreId: data.GenreId,
+		Year:    data.Year,
 	}
 
 	if p.Client == nil {
-		return models.Book{}, fmt.Errorf("Database client is not initialised")
+		return models.Book{}, fmt.Errorf("database client is not initialised: %w", ErrUnavailable)
+	}
+
+	if !utils.IsSafeIdentifier(table) {
+		return models.Book{}, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return book, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if book, err = insertBook(ctx, tx, table, book); err != nil {
+		return book, err
+	}
+	if err := tx.Commit(); err != nil {
+		return book, fmt.Errorf("error committing insert: %w", err)
+	}
+
+	return book, nil
+}
+
+func (p *Postgres) InsertMany(ctx context.Context, table string, data []models.InsertBookInput) ([]models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	books := []models.Book{}
+	for _, d := range data {
+		book, err := insertBook(ctx, tx, table, bookFromInput(d))
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, book)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing inserts: %w", err)
 	}
+	return books, nil
+}
 
+func (p *Postgres) ApplyBatch(ctx context.Context, table string, ops []models.BatchOperation, atomic bool) ([]OperationResult, error) {
 	if !utils.IsSafeIdentifier(table) {
-		return models.Book{}, fmt.Errorf("invalid table name: %v", table)
+		return nil, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	// an atomic batch shares one transaction, otherwise every operation gets its own
+	var shared *sql.Tx
+	if atomic {
+		tx, err := p.Client.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error starting transaction: %w", err)
+		}
+		defer tx.Rollback()
+		shared = tx
+	}
+
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		tx := shared
+		if tx == nil {
+			var err error
+			if tx, err = p.Client.BeginTx(ctx, nil); err != nil {
+				results[i].Err = fmt.Errorf("error starting transaction: %w", err)
+				continue
+			}
+		}
+
+		book, err := applyOperation(ctx, tx, table, op)
+		if err != nil && atomic {
+			return abortBatch(results, i, err), nil
+		}
+		if !atomic {
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		results[i] = OperationResult{Book: book, Err: err}
+	}
+
+	if atomic {
+		if err := shared.Commit(); err != nil {
+			return nil, fmt.Errorf("error committing batch: %w", err)
+		}
+	}
+	return results, nil
+}
+
+func applyOperation(ctx context.Context, tx *sql.Tx, table string, op models.BatchOperation) (models.Book, error) {
+	if err := checkOperation(op); err != nil {
+		return models.Book{}, err
+	}
+
+	switch op.Op {
+	case "create":
+		return insertBook(ctx, tx, table, bookFromInput(*op.Book))
+	case "update":
+		return updateBookTx(operationContext(ctx, op), tx, table, op.Id, updateFields(*op.Changes))
+	default:
+		return updateBookTx(operationContext(ctx, op), tx, table, op.Id, trashBook(time.Now().UTC()))
 	}
+}
 
-	// insert new book into db table
-	insertQuery := fmt.Sprintf(`INSERT INTO "%s" (id, title, author) VALUES ($1, $2, $3)`, table)
+// inserts a new book alongside its first revision
+func insertBook(ctx context.Context, tx *sql.Tx, table string, book models.Book) (models.Book, error) {
+	revision := nextRevision(&book, time.Now().UTC())
+	insertQuery := fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`, table, bookColumns)
 
-	_, err := p.Client.ExecContext(ctx, insertQuery, book.Id, book.Title, book.Author)
+	_, err := tx.ExecContext(ctx, insertQuery,
+		book.Id, book.Title, book.Author, book.WorkId, book.ISBN, book.Format,
+		pq.Array(nonNil(book.Tags)), book.GenreId, book.Year, book.DeletedAt, book.Revision,
+	)
 	if err != nil {
-		return book, fmt.Errorf("error while performing query: %v", err)
+		return book, fmt.Errorf("error while performing query: %w", err)
 	}
 
+	if err := insertRevision(ctx, tx, table, revision); err != nil {
+		return book, err
+	}
 	return book, nil
 }
+
+func (p *Postgres) GetWork(ctx context.Context, id string) (models.Work, error) {
+	var w models.Work
+
+	selectQuery := `SELECT id, title, author, series_id, series_position FROM "works" WHERE id = $1`
+	err := p.Client.QueryRowContext(ctx, selectQuery, id).Scan(&w.Id, &w.Title, &w.Author, &w.SeriesId, &w.SeriesPosition)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Work{}, fmt.Errorf("work %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return models.Work{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return w, nil
+}
+
+func (p *Postgres) InsertWork(ctx context.Context, data models.InsertWorkInput) (models.Work, error) {
+	work := models.Work{
+		Id:             utils.UUID(),
+		Title:          data.Title,
+		Author:         data.Author,
+		SeriesId:       data.SeriesId,
+		SeriesPosition: data.SeriesPosition,
+	}
+
+	insertQuery := `INSERT INTO "works" (id, title, author, series_id, series_position) VALUES ($1, $2, $3, $4, $5)`
+	_, err := p.Client.ExecContext(ctx, insertQuery, work.Id, work.Title, work.Author, work.SeriesId, work.SeriesPosition)
+	if err != nil {
+		return work, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return work, nil
+}
+
+func (p *Postgres) GetSeries(ctx context.Context, id string) (models.Series, error) {
+	var s models.Series
+
+	err := p.Client.QueryRowContext(ctx, `SELECT id, name FROM "series" WHERE id = $1`, id).Scan(&s.Id, &s.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Series{}, fmt.Errorf("series %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return models.Series{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return s, nil
+}
+
+func (p *Postgres) InsertSeries(ctx context.Context, data models.InsertSeriesInput) (models.Series, error) {
+	series := models.Series{
+		Id:   utils.UUID(),
+		Name: data.Name,
+	}
+
+	_, err := p.Client.ExecContext(ctx, `INSERT INTO "series" (id, name) VALUES ($1, $2)`, series.Id, series.Name)
+	if err != nil {
+		return series, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return series, nil
+}
+
+func (p *Postgres) SeriesWorks(ctx context.Context, seriesId string) ([]models.Work, error) {
+	selectQuery := `SELECT id, title, author, series_id, series_position FROM "works"
+		WHERE series_id = $1 ORDER BY series_position, title`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, seriesId)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	works := []models.Work{}
+	for rows.Next() {
+		var w models.Work
+		if err := rows.Scan(&w.Id, &w.Title, &w.Author, &w.SeriesId, &w.SeriesPosition); err != nil {
+			return works, err
+		}
+		works = append(works, w)
+	}
+
+	return works, rows.Err()
+}
+
+func (p *Postgres) InsertReview(ctx context.Context, bookId string, data models.InsertReviewInput) (models.Review, error) {
+	review := models.Review{
+		Id:        utils.UUID(),
+		BookId:    bookId,
+		Reviewer:  data.Reviewer,
+		Rating:    data.Rating,
+		Text:      data.Text,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if review.Rating < 1 || review.Rating > 5 {
+		return models.Review{}, fmt.Errorf("rating out of range %d: %w", review.Rating, ErrInvalidArgument)
+	}
+
+	// the review and its aggregate are written together so they can't drift apart
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Review{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertQuery := `INSERT INTO "reviews" (id, book_id, reviewer, rating, text, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.ExecContext(ctx, insertQuery, review.Id, review.BookId, review.Reviewer, review.Rating, review.Text, review.CreatedAt)
+	if err != nil {
+		return models.Review{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	// rating is range checked above, so the column name is safe to format in
+	upsertQuery := fmt.Sprintf(`INSERT INTO "book_ratings" (book_id, count, r%[1]d) VALUES ($1, 1, 1)
+		ON CONFLICT (book_id) DO UPDATE SET
+			count = "book_ratings".count + 1,
+			r%[1]d = "book_ratings".r%[1]d + 1`, review.Rating)
+	if _, err := tx.ExecContext(ctx, upsertQuery, review.BookId); err != nil {
+		return models.Review{}, fmt.Errorf("error while updating rating summary: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Review{}, fmt.Errorf("error committing review: %w", err)
+	}
+
+	return review, nil
+}
+
+func (p *Postgres) GetReviews(ctx context.Context, bookId string) ([]models.Review, error) {
+	selectQuery := `SELECT id, book_id, reviewer, rating, text, created_at FROM "reviews"
+		WHERE book_id = $1 ORDER BY created_at`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, bookId)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	reviews := []models.Review{}
+	for rows.Next() {
+		var r models.Review
+		if err := rows.Scan(&r.Id, &r.BookId, &r.Reviewer, &r.Rating, &r.Text, &r.CreatedAt); err != nil {
+			return reviews, err
+		}
+		reviews = append(reviews, r)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (p *Postgres) RatingSummaries(ctx context.Context, bookIds []string) (map[string]models.RatingSummary, error) {
+	summaries := make(map[string]models.RatingSummary)
+	if len(bookIds) == 0 {
+		return summaries, nil
+	}
+
+	selectQuery := `SELECT book_id, r1, r2, r3, r4, r5 FROM "book_ratings" WHERE book_id = ANY($1)`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, pq.Array(bookIds))
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	for rows.Next() {
+		var bookId string
+		var h [5]int
+		if err := rows.Scan(&bookId, &h[0], &h[1], &h[2], &h[3], &h[4]); err != nil {
+			return summaries, err
+		}
+		summaries[bookId] = models.NewRatingSummary(h)
+	}
+
+	return summaries, rows.Err()
+}
+
+func (p *Postgres) AddTag(ctx context.Context, table, id, tag string) error {
+	_, err := p.updateBook(ctx, table, id, addTag(tag))
+	return err
+}
+
+func (p *Postgres) RemoveTag(ctx context.Context, table, id, tag string) error {
+	_, err := p.updateBook(ctx, table, id, removeTag(tag))
+	return err
+}
+
+func (p *Postgres) SetGenre(ctx context.Context, table, id, genreId string) error {
+	_, err := p.updateBook(ctx, table, id, setGenre(genreId))
+	return err
+}
+
+func (p *Postgres) InsertGenre(ctx context.Context, data models.InsertGenreInput) (models.Genre, error) {
+	genre := models.Genre{
+		Id:       utils.UUID(),
+		Name:     data.Name,
+		ParentId: data.ParentId,
+	}
+
+	insertQuery := `INSERT INTO "genres" (id, name, parent_id) VALUES ($1, $2, $3)`
+	if _, err := p.Client.ExecContext(ctx, insertQuery, genre.Id, genre.Name, genre.ParentId); err != nil {
+		return genre, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return genre, nil
+}
+
+func (p *Postgres) AllGenres(ctx context.Context) ([]models.Genre, error) {
+	rows, err := p.Client.QueryContext(ctx, `SELECT id, name, parent_id FROM "genres" ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	genres := []models.Genre{}
+	for rows.Next() {
+		var g models.Genre
+		if err := rows.Scan(&g.Id, &g.Name, &g.ParentId); err != nil {
+			return genres, err
+		}
+		genres = append(genres, g)
+	}
+
+	return genres, rows.Err()
+}
+
+func (p *Postgres) InsertUser(ctx context.Context, data models.InsertUserInput) (models.User, error) {
+	user := models.User{
+		Id:      utils.UUID(),
+		Name:    data.Name,
+		Email:   data.Email,
+		Subject: data.Subject,
+	}
+
+	insertQuery := `INSERT INTO "users" (id, name, email, subject) VALUES ($1, $2, $3, $4)`
+	if _, err := p.Client.ExecContext(ctx, insertQuery, user.Id, user.Name, user.Email, user.Subject); err != nil {
+		return user, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return user, nil
+}
+
+func (p *Postgres) GetUser(ctx context.Context, id string) (models.User, error) {
+	var u models.User
+
+	err := p.Client.QueryRowContext(ctx, `SELECT id, name, email, subject FROM "users" WHERE id = $1`, id).Scan(&u.Id, &u.Name, &u.Email, &u.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, fmt.Errorf("user %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return models.User{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return u, nil
+}
+
+func (p *Postgres) InsertShelf(ctx context.Context, userId, name string) (models.Shelf, error) {
+	insertQuery := `INSERT INTO "shelves" (user_id, name) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	res, err := p.Client.ExecContext(ctx, insertQuery, userId, name)
+	if err != nil {
+		return models.Shelf{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return models.Shelf{}, fmt.Errorf("shelf %s: %w", name, ErrConflict)
+	}
+
+	return models.Shelf{UserId: userId, Name: name}, nil
+}
+
+func (p *Postgres) GetShelves(ctx context.Context, userId string) ([]models.Shelf, error) {
+	rows, err := p.Client.QueryContext(ctx, `SELECT user_id, name FROM "shelves" WHERE user_id = $1 ORDER BY name`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	shelves := []models.Shelf{}
+	for rows.Next() {
+		var s models.Shelf
+		if err := rows.Scan(&s.UserId, &s.Name); err != nil {
+			return shelves, err
+		}
+		shelves = append(shelves, s)
+	}
+
+	return shelves, rows.Err()
+}
+
+func (p *Postgres) PutReadingRecord(ctx context.Context, r models.ReadingRecord) error {
+	upsertQuery := `INSERT INTO "reading_records"
+			(user_id, book_id, status, shelves, page, percent, started_at, finished_at, rating, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (user_id, book_id) DO UPDATE SET
+			status = EXCLUDED.status,
+			shelves = EXCLUDED.shelves,
+			page = EXCLUDED.page,
+			percent = EXCLUDED.percent,
+			started_at = EXCLUDED.started_at,
+			finished_at = EXCLUDED.finished_at,
+			rating = EXCLUDED.rating,
+			updated_at = EXCLUDED.updated_at`
+
+	_, err := p.Client.ExecContext(ctx, upsertQuery,
+		r.UserId, r.BookId, r.Status, pq.Array(nonNil(r.Shelves)), r.Page, r.Percent, r.StartedAt, r.FinishedAt, r.Rating, r.UpdatedAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) GetReadingRecords(ctx context.Context, userId string) ([]models.ReadingRecord, error) {
+	selectQuery := `SELECT user_id, book_id, status, shelves, page, percent, started_at, finished_at, rating, updated_at
+		FROM "reading_records" WHERE user_id = $1 ORDER BY updated_at`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	records := []models.ReadingRecord{}
+	for rows.Next() {
+		var r models.ReadingRecord
+		err := rows.Scan(&r.UserId, &r.BookId, &r.Status, pq.Array(&r.Shelves), &r.Page, &r.Percent, &r.StartedAt, &r.FinishedAt, &r.Rating, &r.UpdatedAt)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+func (p *Postgres) DropReadingRecord(ctx context.Context, userId, bookId string) error {
+	deleteQuery := `DELETE FROM "reading_records" WHERE user_id = $1 AND book_id = $2`
+	if _, err := p.Client.ExecContext(ctx, deleteQuery, userId, bookId); err != nil {
+		return fmt.Errorf("error while performing query: %w", err)
+	}
+	return nil
+}
+
+func (p *Postgres) InsertCopy(ctx context.Context, bookId string, data models.InsertCopyInput) (models.Copy, error) {
+	newCopy := models.Copy{
+		Id:      utils.UUID(),
+		BookId:  bookId,
+		Barcode: data.Barcode,
+		Status:  models.CopyAvailable,
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Copy{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertQuery := `INSERT INTO "copies" (id, book_id, barcode, status) VALUES ($1, $2, $3, $4)`
+	if _, err := tx.ExecContext(ctx, insertQuery, newCopy.Id, newCopy.BookId, newCopy.Barcode, newCopy.Status); err != nil {
+		return models.Copy{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	// a new copy can immediately satisfy the front of the holds queue
+	if newCopy.HeldFor, err = fulfilNextHold(ctx, tx, bookId, newCopy.Id); err != nil {
+		return models.Copy{}, err
+	}
+	if newCopy.HeldFor != "" {
+		newCopy.Status = models.CopyOnHold
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Copy{}, fmt.Errorf("error committing copy: %w", err)
+	}
+
+	return newCopy, nil
+}
+
+func (p *Postgres) GetCopies(ctx context.Context, bookId string) ([]models.Copy, error) {
+	selectQuery := `SELECT id, book_id, barcode, status, held_for FROM "copies" WHERE book_id = $1 ORDER BY id`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, bookId)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	copies := []models.Copy{}
+	for rows.Next() {
+		var c models.Copy
+		if err := rows.Scan(&c.Id, &c.BookId, &c.Barcode, &c.Status, &c.HeldFor); err != nil {
+			return copies, err
+		}
+		copies = append(copies, c)
+	}
+
+	return copies, rows.Err()
+}
+
+func (p *Postgres) Checkout(ctx context.Context, bookId, userId string, due time.Time) (models.Checkout, error) {
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Checkout{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// prefer a copy held for this user, otherwise lock any available copy. SKIP LOCKED lets
+	// concurrent checkouts of the same book each take a different copy rather than queueing
+	var copyId string
+	heldQuery := `SELECT id FROM "copies" WHERE book_id = $1 AND status = $2 AND held_for = $3 LIMIT 1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, heldQuery, bookId, models.CopyOnHold, userId).Scan(&copyId)
+	switch {
+	case err == nil:
+		fulfilQuery := `UPDATE "holds" SET status = $1 WHERE book_id = $2 AND user_id = $3 AND status = $4`
+		if _, err := tx.ExecContext(ctx, fulfilQuery, models.HoldFulfilled, bookId, userId, models.HoldReady); err != nil {
+			return models.Checkout{}, fmt.Errorf("error fulfilling hold: %w", err)
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		availableQuery := `SELECT id FROM "copies" WHERE book_id = $1 AND status = $2 LIMIT 1 FOR UPDATE SKIP LOCKED`
+		err = tx.QueryRowContext(ctx, availableQuery, bookId, models.CopyAvailable).Scan(&copyId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Checkout{}, fmt.Errorf("book %s has no copies available: %w", bookId, ErrConflict)
+		}
+		if err != nil {
+			return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+		}
+	default:
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	checkout := models.Checkout{
+		Id:           utils.UUID(),
+		CopyId:       copyId,
+		BookId:       bookId,
+		UserId:       userId,
+		CheckedOutAt: time.Now().UTC(),
+		DueAt:        due,
+	}
+
+	loanQuery := `UPDATE "copies" SET status = $1, held_for = '' WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, loanQuery, models.CopyOnLoan, copyId); err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	insertQuery := `INSERT INTO "checkouts" (id, copy_id, book_id, user_id, checked_out_at, due_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.ExecContext(ctx, insertQuery, checkout.Id, checkout.CopyId, checkout.BookId, checkout.UserId, checkout.CheckedOutAt, checkout.DueAt)
+	if err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Checkout{}, fmt.Errorf("error committing checkout: %w", err)
+	}
+
+	return checkout, nil
+}
+
+func (p *Postgres) GetCheckout(ctx context.Context, id string) (models.Checkout, error) {
+	var c models.Checkout
+
+	selectQuery := `SELECT id, copy_id, book_id, user_id, checked_out_at, due_at, returned_at FROM "checkouts" WHERE id = $1`
+	err := p.Client.QueryRowContext(ctx, selectQuery, id).Scan(&c.Id, &c.CopyId, &c.BookId, &c.UserId, &c.CheckedOutAt, &c.DueAt, &c.ReturnedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Checkout{}, fmt.Errorf("checkout %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return c, nil
+}
+
+func (p *Postgres) Return(ctx context.Context, checkoutId string) (models.Checkout, error) {
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Checkout{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var c models.Checkout
+	selectQuery := `SELECT id, copy_id, book_id, user_id, checked_out_at, due_at, returned_at
+		FROM "checkouts" WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, selectQuery, checkoutId).Scan(&c.Id, &c.CopyId, &c.BookId, &c.UserId, &c.CheckedOutAt, &c.DueAt, &c.ReturnedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Checkout{}, fmt.Errorf("checkout %s: %w", checkoutId, ErrNotFound)
+	}
+	if err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+	if c.ReturnedAt != nil {
+		return models.Checkout{}, fmt.Errorf("checkout %s already returned: %w", checkoutId, ErrConflict)
+	}
+
+	now := time.Now().UTC()
+	c.ReturnedAt = &now
+	if _, err := tx.ExecContext(ctx, `UPDATE "checkouts" SET returned_at = $1 WHERE id = $2`, now, c.Id); err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	availableQuery := `UPDATE "copies" SET status = $1, held_for = '' WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, availableQuery, models.CopyAvailable, c.CopyId); err != nil {
+		return models.Checkout{}, fmt.Errorf("error while performing query: %w", err)
+	}
+	if _, err := fulfilNextHold(ctx, tx, c.BookId, c.CopyId); err != nil {
+		return models.Checkout{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Checkout{}, fmt.Errorf("error committing return: %w", err)
+	}
+
+	return c, nil
+}
+
+func (p *Postgres) PlaceHold(ctx context.Context, bookId, userId string) (models.Hold, error) {
+	hold := models.Hold{
+		Id:       utils.UUID(),
+		BookId:   bookId,
+		UserId:   userId,
+		Status:   models.HoldWaiting,
+		PlacedAt: time.Now().UTC(),
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Hold{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the partial unique index rejects a second active hold by the same user
+	insertQuery := `INSERT INTO "holds" (id, book_id, user_id, status, placed_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT DO NOTHING`
+	res, err := tx.ExecContext(ctx, insertQuery, hold.Id, hold.BookId, hold.UserId, hold.Status, hold.PlacedAt)
+	if err != nil {
+		return models.Hold{}, fmt.Errorf("error while performing query: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return models.Hold{}, fmt.Errorf("user %s already holds book %s: %w", userId, bookId, ErrConflict)
+	}
+
+	// if a copy is sitting on the shelf, reserve it straight away
+	var copyId string
+	availableQuery := `SELECT id FROM "copies" WHERE book_id = $1 AND status = $2 LIMIT 1 FOR UPDATE SKIP LOCKED`
+	err = tx.QueryRowContext(ctx, availableQuery, bookId, models.CopyAvailable).Scan(&copyId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.Hold{}, fmt.Errorf("error while performing query: %w", err)
+	}
+	if copyId != "" {
+		heldFor, err := fulfilNextHold(ctx, tx, bookId, copyId)
+		if err != nil {
+			return models.Hold{}, err
+		}
+		if heldFor == userId {
+			hold.Status = models.HoldReady
+			hold.CopyId = copyId
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Hold{}, fmt.Errorf("error committing hold: %w", err)
+	}
+
+	return hold, nil
+}
+
+func (p *Postgres) GetHolds(ctx context.Context, bookId string) ([]models.Hold, error) {
+	selectQuery := `SELECT id, book_id, user_id, status, copy_id, placed_at FROM "holds"
+		WHERE book_id = $1 AND status <> $2 ORDER BY placed_at, id`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, bookId, models.HoldFulfilled)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	holds := []models.Hold{}
+	for rows.Next() {
+		var h models.Hold
+		if err := rows.Scan(&h.Id, &h.BookId, &h.UserId, &h.Status, &h.CopyId, &h.PlacedAt); err != nil {
+			return holds, err
+		}
+		holds = append(holds, h)
+	}
+
+	return holds, rows.Err()
+}
+
+func (p *Postgres) OverdueCheckouts(ctx context.Context, now time.Time) ([]models.Checkout, error) {
+	selectQuery := `SELECT id, copy_id, book_id, user_id, checked_out_at, due_at, returned_at FROM "checkouts"
+		WHERE returned_at IS NULL AND due_at < $1 ORDER BY due_at`
+	rows, err := p.Client.QueryContext(ctx, selectQuery, now)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	overdue := []models.Checkout{}
+	for rows.Next() {
+		var c models.Checkout
+		if err := rows.Scan(&c.Id, &c.CopyId, &c.BookId, &c.UserId, &c.CheckedOutAt, &c.DueAt, &c.ReturnedAt); err != nil {
+			return overdue, err
+		}
+		overdue = append(overdue, c)
+	}
+
+	return overdue, rows.Err()
+}
+
+func (p *Postgres) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) (models.AuditEntry, error) {
+	entry.Id = utils.UUID()
+
+	before, err := snapshotJSON(entry.Before)
+	if err != nil {
+		return entry, err
+	}
+	after, err := snapshotJSON(entry.After)
+	if err != nil {
+		return entry, err
+	}
+
+	insertQuery := `INSERT INTO "audit_log" (id, actor, action, book_id, resource_id, before, after, request_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err = p.Client.ExecContext(ctx, insertQuery, entry.Id, entry.Actor, entry.Action, entry.BookId, entry.ResourceId,
+		before, after, entry.RequestId, entry.Timestamp)
+	if err != nil {
+		return entry, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return entry, nil
+}
+
+func (p *Postgres) GetAuditEntries(ctx context.Context, filter models.AuditFilter) ([]models.AuditEntry, error) {
+	where, args := auditWhere(filter)
+	selectQuery := `SELECT id, actor, action, book_id, resource_id, before, after, request_id, created_at FROM "audit_log"` + where
+	selectQuery += " ORDER BY created_at DESC, id"
+	if filter.Limit > 0 {
+		selectQuery += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	if filter.Offset > 0 {
+		selectQuery += fmt.Sprintf(" OFFSET %d", filter.Offset)
+	}
+
+	rows, err := p.Client.QueryContext(ctx, selectQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while performing query: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		var before, after []byte
+		if err := rows.Scan(&e.Id, &e.Actor, &e.Action, &e.BookId, &e.ResourceId, &before, &after, &e.RequestId, &e.Timestamp); err != nil {
+			return entries, err
+		}
+		if before != nil {
+			if err := json.Unmarshal(before, &e.Before); err != nil {
+				return entries, fmt.Errorf("error decoding audit snapshot: %w", err)
+			}
+		}
+		if after != nil {
+			if err := json.Unmarshal(after, &e.After); err != nil {
+				return entries, fmt.Errorf("error decoding audit snapshot: %w", err)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+func (p *Postgres) CountAuditEntries(ctx context.Context, filter models.AuditFilter) (int, error) {
+	where, args := auditWhere(filter)
+
+	var count int
+	if err := p.Client.QueryRowContext(ctx, `SELECT COUNT(*) FROM "audit_log"`+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error while performing query: %w", err)
+	}
+	return count, nil
+}
+
+// the WHERE clause and its arguments for an audit filter's conditions
+func auditWhere(filter models.AuditFilter) (string, []any) {
+	conditions := []string{}
+	args := []any{}
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.BookId != "" {
+		where("book_id = $%d", filter.BookId)
+	}
+	if !filter.Since.IsZero() {
+		where("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("created_at < $%d", filter.Until)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// encodes an audit snapshot for a JSONB column, nil snapshots are stored as NULL.
+// Sent as a string since pq would encode []byte as bytea
+func snapshotJSON(snapshot map[string]any) (sql.NullString, error) {
+	if snapshot == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("error encoding audit snapshot: %w", err)
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// reserves an available copy for the oldest waiting hold on a book, returning the user it's held for
+func fulfilNextHold(ctx context.Context, tx *sql.Tx, bookId, copyId string) (string, error) {
+	var holdId, userId string
+	nextQuery := `SELECT id, user_id FROM "holds" WHERE book_id = $1 AND status = $2
+		ORDER BY placed_at, id LIMIT 1 FOR UPDATE SKIP LOCKED`
+	err := tx.QueryRowContext(ctx, nextQuery, bookId, models.HoldWaiting).Scan(&holdId, &userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error while performing query: %w", err)
+	}
+
+	readyQuery := `UPDATE "holds" SET status = $1, copy_id = $2 WHERE id = $3`
+	if _, err := tx.ExecContext(ctx, readyQuery, models.HoldReady, copyId, holdId); err != nil {
+		return "", fmt.Errorf("error while performing query: %w", err)
+	}
+	reserveQuery := `UPDATE "copies" SET status = $1, held_for = $2 WHERE id = $3`
+	if _, err := tx.ExecContext(ctx, reserveQuery, models.CopyOnHold, userId, copyId); err != nil {
+		return "", fmt.Errorf("error while performing query: %w", err)
+	}
+
+	return userId, nil
+}
+
+// applies a change to a live book under a row lock, recording a revision if anything changed
+func (p *Postgres) updateBook(ctx context.Context, table, id string, change bookChange) (models.Book, error) {
+	if !utils.IsSafeIdentifier(table) {
+		return models.Book{}, fmt.Errorf("invalid table name %v: %w", table, ErrInvalidArgument)
+	}
+
+	tx, err := p.Client.BeginTx(ctx, nil)
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	book, err := updateBookTx(ctx, tx, table, id, change)
+	if err != nil {
+		return models.Book{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.Book{}, fmt.Errorf("error committing update to book %s: %w", id, err)
+	}
+
+	return book, nil
+}
+
+// applies a change to a locked book within tx, recording a revision if anything changed
+func updateBookTx(ctx context.Context, tx *sql.Tx, table, id string, change bookChange) (models.Book, error) {
+	selectQuery := fmt.Sprintf(`SELECT %s FROM "%s" WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, bookColumns, table)
+	rows, err := tx.QueryContext(ctx, selectQuery, id)
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error while performing query: %w", err)
+	}
+	books, err := scanBooks(rows)
+	if err != nil {
+		return models.Book{}, err
+	}
+	if len(books) == 0 {
+		return models.Book{}, fmt.Errorf("book %s: %w", id, ErrNotFound)
+	}
+
+	book := books[0]
+	if err := checkRevision(ctx, book); err != nil {
+		return models.Book{}, err
+	}
+	if !change(&book) {
+		return book, nil
+	}
+	revision := nextRevision(&book, time.Now().UTC())
+
+	updateQuery := fmt.Sprintf(`UPDATE "%s" SET title = $2, author = $3, work_id = $4, isbn = $5, format = $6,
+		tags = $7, genre_id = $8, year = $9, revision = $10, deleted_at = $11 WHERE id = $1`, table)
+	_, err = tx.ExecContext(ctx, updateQuery, book.Id, book.Title, book.Author, book.WorkId, book.ISBN, book.Format,
+		pq.Array(nonNil(book.Tags)), book.GenreId, book.Year, book.Revision, book.DeletedAt)
+	if err != nil {
+		return models.Book{}, fmt.Errorf("error while performing query: %w", err)
+	}
+
+	if err := insertRevision(ctx, tx, table, revision); err != nil {
+		return models.Book{}, err
+	}
+
+	return book, nil
+}
+
+// snapshots books already written at their new revision numbers
+func insertRevisions(ctx context.Context, tx *sql.Tx, table string, books ...models.Book) error {
+	now := time.Now().UTC()
+	for _, book := range books {
+		if err := insertRevision(ctx, tx, table, snapshotRevision(book, now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertRevision(ctx context.Context, tx *sql.Tx, table string, revision models.BookRevision) error {
+	snapshot, err := json.Marshal(revision.Book)
+	if err != nil {
+		return fmt.Errorf("error encoding revision: %w", err)
+	}
+
+	// sent as a string since pq would encode []byte as bytea
+	insertQuery := fmt.Sprintf(`INSERT INTO "%s_revisions" (book_id, revision, snapshot, created_at) VALUES ($1, $2, $3, $4)`, table)
+	if _, err := tx.ExecContext(ctx, insertQuery, revision.BookId, revision.Revision, string(snapshot), revision.CreatedAt); err != nil {
+		return fmt.Errorf("error while recording revision: %w", err)
+	}
+	return nil
+}
+
+// reads every row selected from a revisions table, closing the rows when done
+func scanRevisions(rows *sql.Rows) ([]models.BookRevision, error) {
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	revisions := []models.BookRevision{}
+	for rows.Next() {
+		var r models.BookRevision
+		var snapshot []byte
+		if err := rows.Scan(&r.BookId, &r.Revision, &snapshot, &r.CreatedAt); err != nil {
+			return revisions, err
+		}
+		if err := json.Unmarshal(snapshot, &r.Book); err != nil {
+			return revisions, fmt.Errorf("error decoding revision: %w", err)
+		}
+		r.Book.Revision = r.Revision // not part of the JSON snapshot
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+// pq encodes a nil slice as NULL, which the NOT NULL array columns reject
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// maps a models.Book field name onto its snake_case column, rejecting anything unsafe
+func columnName(key string) (string, error) {
+	column := utils.ToSnakeCase(key)
+	if !utils.IsSafeIdentifier(column) {
+		return "", fmt.Errorf("invalid column name %v: %w", key, ErrInvalidArgument)
+	}
+	return column, nil
+}
+
+// reads every row selected with bookColumns into a slice of books, closing the rows when done
+func scanBooks(rows *sql.Rows) ([]models.Book, error) {
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("error closing rows: %v\n", err)
+		}
+	}()
+
+	// create a slice with 0 elements
+	books := []models.Book{}
+
+	log.Printf("Iterating through rows...")
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return books, err
+		}
+		books = append(books, b)
+	}
+	if err := rows.Err(); err != nil {
+		return books, err
+	}
+
+	return books, nil
+}
+
+// reads the row the cursor is on, selected with bookColumns
+func scanBook(rows *sql.Rows) (models.Book, error) {
+	var b models.Book
+	err := rows.Scan(&b.Id, &b.Title, &b.Author, &b.WorkId, &b.ISBN, &b.Format, pq.Array(&b.Tags), &b.GenreId, &b.Year, &b.DeletedAt, &b.Revision)
+	return b, err
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// a change to a single book, applied the same way by every backend. It reports
+// whether anything changed so that no-op updates don't create a revision
+type bookChange func(book *models.Book) bool
+
+func addTag(tag string) bookChange {
+	return func(book *models.Book) bool {
+		if slices.Contains(book.Tags, tag) {
+			return false
+		}
+		// build a new slice so copies handed out by reads are left alone
+		book.Tags = append(slices.Clone(book.Tags), tag)
+		return true
+	}
+}
+
+func removeTag(tag string) bookChange {
+	return func(book *models.Book) bool {
+		if !slices.Contains(book.Tags, tag) {
+			return false
+		}
+		book.Tags = slices.DeleteFunc(slices.Clone(book.Tags), func(t string) bool { return t == tag })
+		return true
+	}
+}
+
+func setGenre(genreId string) bookChange {
+	return func(book *models.Book) bool {
+		if book.GenreId == genreId {
+			return false
+		}
+		book.GenreId = genreId
+		return true
+	}
+}
+
+// puts back the catalogue fields of an earlier revision, the id and trash state are left alone
+func revertTo(old models.Book) bookChange {
+	return func(book *models.Book) bool {
+		book.Title = old.Title
+		book.Author = old.Author
+		book.WorkId = old.WorkId
+		book.ISBN = old.ISBN
+		book.Format = old.Format
+		book.Tags = slices.Clone(old.Tags)
+		book.GenreId = old.GenreId
+		book.Year = old.Year
+		return true
+	}
+}
+
+type expectedRevisionKey struct{}
+
+// ExpectRevision makes writes to a book through the returned context fail with
+// ErrVersionMismatch unless the book is still at the given revision
+func ExpectRevision(ctx context.Context, revision int) context.Context {
+	return context.WithValue(ctx, expectedRevisionKey{}, revision)
+}
+
+type expectedRevisionsKey struct{}
+
+// ExpectRevisions makes a write to several books through the returned context
+// fail with ErrVersionMismatch, changing none of them, unless it matches exactly
+// the books given by id and each is still at its revision
+func ExpectRevisions(ctx context.Context, revisions map[string]int) context.Context {
+	return context.WithValue(ctx, expectedRevisionsKey{}, revisions)
+}
+
+// whether writes through ctx are conditional on revisions
+func conditional(ctx context.Context) bool {
+	_, one := ctx.Value(expectedRevisionKey{}).(int)
+	_, many := ctx.Value(expectedRevisionsKey{}).(map[string]int)
+	return one || many
+}
+
+// checks a book against the revision expected by ctx, if any. Backends call it
+// inside the same transaction or lock as the write itself
+func checkRevision(ctx context.Context, book models.Book) error {
+	expected, ok := ctx.Value(expectedRevisionKey{}).(int)
+	if ok && book.Revision != expected {
+		return fmt.Errorf("book %s is at revision %d, not %d: %w", book.Id, book.Revision, expected, ErrVersionMismatch)
+	}
+	if revisions, ok := ctx.Value(expectedRevisionsKey{}).(map[string]int); ok {
+		if expected, ok := revisions[book.Id]; !ok || book.Revision != expected {
+			return fmt.Errorf("book %s is not at an expected revision: %w", book.Id, ErrVersionMismatch)
+		}
+	}
+	return nil
+}
+
+// checks every book a write matched before any of them is changed, including
+// that none of the books ExpectRevisions named have gone
+func checkRevisions(ctx context.Context, books []models.Book) error {
+	for _, book := range books {
+		if err := checkRevision(ctx, book); err != nil {
+			return err
+		}
+	}
+	if revisions, ok := ctx.Value(expectedRevisionsKey{}).(map[string]int); ok && len(books) != len(revisions) {
+		return fmt.Errorf("matched %d books, not the %d expected: %w", len(books), len(revisions), ErrVersionMismatch)
+	}
+	return nil
+}
+
+// moves a book to the trash
+func trashBook(now time.Time) bookChange {
+	return func(book *models.Book) bool {
+		book.DeletedAt = &now
+		return true
+	}
+}
+
+// bumps a book's revision number and snapshots the result
+func nextRevision(book *models.Book, now time.Time) models.BookRevision {
+	book.Revision++
+	return snapshotRevision(*book, now)
+}
+
+// snapshots a book at the revision number it already has
+func snapshotRevision(book models.Book, now time.Time) models.BookRevision {
+	book.Tags = slices.Clone(book.Tags)
+	book.Rating = nil
+
+	return models.BookRevision{BookId: book.Id, Revision: book.Revision, Book: book, CreatedAt: now}
+}
+
+// the latest revision of each book as of a point in time, leaving out books that
+// were in the trash by then. Sorted by book id so the result is stable
+func latestRevisions(revisions []models.BookRevision, asOf time.Time) []models.Book {
+	latest := map[string]models.BookRevision{}
+	for _, revision := range revisions {
+		if revision.CreatedAt.After(asOf) {
+			continue
+		}
+		if current, ok := latest[revision.BookId]; !ok || revision.Revision > current.Revision {
+			latest[revision.BookId] = revision
+		}
+	}
+
+	books := []models.Book{}
+	for _, revision := range latest {
+		if revision.Book.DeletedAt == nil {
+			books = append(books, revision.Book)
+		}
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].Id < books[j].Id })
+
+	return books
+}
@@ -0,0 +1,183 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+const header = "Idempotency-Key"
+
+// the most of a request body that's read to fingerprint it
+const maxBody = 1 << 20
+
+// only these headers are replayed, the rest belong to the original request
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// what's kept for each key. A record that isn't done marks a request that's
+// still being handled
+type record struct {
+	Fingerprint string
+	Done        bool
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+}
+
+// remembers the first response to each Idempotency-Key for a window, so that a
+// client retrying after a timeout gets the same response instead of a duplicate
+type Keys struct {
+	store  persistence.CacheStore
+	window time.Duration
+}
+
+func New(store persistence.CacheStore, window time.Duration) *Keys {
+	return &Keys{store: store, window: window}
+}
+
+// middleware replaying the stored response for a repeated Idempotency-Key. The
+// key is scoped to the caller, so it must run after auth.Require. Reusing a key
+// with a different body is a 422, and retrying while the first request is still
+// running is a 409. Only successful responses are kept, anything else releases
+// the key so the request can be retried
+func (k *Keys) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(header)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > 255 {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "Idempotency-Key can be at most 255 characters"))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			problem.Abort(c, problem.New(http.StatusRequestEntityTooLarge, fmt.Sprintf("Request bodies with an Idempotency-Key can be at most %d bytes", maxBody)))
+			return
+		}
+		if err != nil {
+			problem.Abort(c, problem.New(http.StatusBadRequest, "Unable to read the request body"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// keys are per caller, so one client can never replay another's response
+		storeKey := "idempotency:" + auth.ClientKey(c) + ":" + key
+		fingerprint := fingerprintOf(c.Request, body)
+
+		var previous record
+		err = k.store.Get(storeKey, &previous)
+		switch {
+		case err == nil:
+			replay(c, previous, fingerprint)
+			return
+		case !errors.Is(err, persistence.ErrCacheMiss):
+			// carry on without idempotency rather than failing the request
+			log.Errorf("Unable to look up idempotency key: %v", err)
+			c.Next()
+			return
+		}
+
+		// claim the key, unless a concurrent retry got there first
+		if err := k.store.Add(storeKey, record{Fingerprint: fingerprint}, k.window); err != nil {
+			if errors.Is(err, persistence.ErrNotStored) && k.store.Get(storeKey, &previous) == nil {
+				replay(c, previous, fingerprint)
+				return
+			}
+			log.Errorf("Unable to store idempotency key: %v", err)
+			c.Next()
+			return
+		}
+
+		w := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		if w.Status() < http.StatusOK || w.Status() >= http.StatusMultipleChoices {
+			if err := k.store.Delete(storeKey); err != nil {
+				log.Errorf("Unable to release idempotency key: %v", err)
+			}
+			return
+		}
+
+		done := record{Fingerprint: fingerprint, Done: true, Status: w.Status(), Header: map[string][]string{}, Body: w.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if values := w.Header().Values(name); len(values) > 0 {
+				done.Header[name] = values
+			}
+		}
+		if err := k.store.Set(storeKey, done, k.window); err != nil {
+			log.Errorf("Unable to store idempotent response: %v", err)
+		}
+	}
+}
+
+// answers a repeated request from the stored record
+func replay(c *gin.Context, previous record, fingerprint string) {
+	if previous.Fingerprint != fingerprint {
+		problem.Abort(c, problem.New(http.StatusUnprocessableEntity, "Idempotency-Key has already been used for a different request").WithCode("idempotency_key_reused"))
+		return
+	}
+	if !previous.Done {
+		problem.Abort(c, problem.New(http.StatusConflict, "A request with this Idempotency-Key is still in progress").WithCode("idempotency_key_in_progress"))
+		return
+	}
+
+	for name, values := range previous.Header {
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Status(previous.Status)
+	c.Writer.Write(previous.Body)
+	c.Abort()
+}
+
+// identifies a request by route and body. JSON bodies are compared by value, so
+// a retry that only reorders keys or changes whitespace still matches
+func fingerprintOf(req *http.Request, body []byte) string {
+	var value any
+	if err := json.Unmarshal(body, &value); err == nil {
+		if canonical, err := json.Marshal(value); err == nil {
+			body = canonical
+		}
+	}
+
+	sum := sha256.New()
+	sum.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// keeps a copy of the response body as it's written
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
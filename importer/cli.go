@@ -0,0 +1,115 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+const importUsage = `usage: main import -file <path> [-format csv|ndjson] [-map "Header=field,..."] [-db <database>]
+       main import -file <path> -source goodreads|librarything -user <id> [-db <database>]
+
+imports books from a CSV or NDJSON file into -db, defaulting to $PRIMARY_DB.
+CSV headers are matched to title, author, work_id, isbn, format, tags, genre_id
+and year, use -map for columns named differently. Tags are separated by semicolons.
+
+with -source, the file is a Goodreads or LibraryThing export and the user's shelves,
+ratings and dates read are imported too, adding any books the catalogue is missing`
+
+// entrypoint for the "import" subcommand of the API binary
+func RunImportCommand(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("file", "", "path to the CSV or NDJSON file")
+	format := fs.String("format", "", "csv or ndjson, worked out from the file extension if not given")
+	mapping := fs.String("map", "", `header to field mapping, e.g. "Book Title=title,Writer=author"`)
+	source := fs.String("source", "", "goodreads or librarything, to import a reading history export")
+	userId := fs.String("user", "", "the user whose reading history is imported, with -source")
+	dbName := fs.String("db", os.Getenv("PRIMARY_DB"), "memorydb, firestore or postgres")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" || (*source != "") != (*userId != "") {
+		return errors.New(importUsage)
+	}
+	if *format == "" {
+		*format = DetectFormat(*file, "")
+	}
+	parsedMapping, err := ParseMapping(*mapping)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	db := database.GetDB(*dbName)
+	if err := db.Conn(ctx); err != nil {
+		return fmt.Errorf("unable to connect to %s: %v", *dbName, err)
+	}
+	defer db.Close()
+	if err := db.Setup(ctx); err != nil {
+		return fmt.Errorf("unable to set up %s: %v", *dbName, err)
+	}
+
+	// imports from the command line are audited like any other write
+	audit := func(entry models.AuditEntry) {
+		entry.Actor, entry.Timestamp = "cli", time.Now().UTC()
+		if _, err := db.InsertAuditEntry(ctx, entry); err != nil {
+			fmt.Fprintf(out, "unable to audit %s of %s: %v\n", entry.Action, entry.BookId, err)
+		}
+	}
+	onInsert := func(book models.Book) {
+		audit(models.AuditEntry{Action: "book.create", BookId: book.Id, After: asMap(book)})
+	}
+
+	job := NewJob()
+	if *source != "" {
+		opts := HistoryOptions{Source: *source, UserId: *userId, CreateBooks: true, OnInsert: onInsert,
+			OnRecord: func(before *models.ReadingRecord, after models.ReadingRecord) {
+				var previous map[string]any
+				if before != nil {
+					previous = asMap(*before)
+				}
+				audit(models.AuditEntry{Action: "reading.update", BookId: after.BookId, ResourceId: *userId, Before: previous, After: asMap(after)})
+			},
+		}
+		err = RunHistory(ctx, db, f, opts, job)
+	} else {
+		err = Run(ctx, db, f, Options{Format: *format, Mapping: parsedMapping, OnInsert: onInsert}, job)
+	}
+	if err != nil {
+		return err
+	}
+
+	progress := job.Progress()
+	for _, rowError := range progress.Errors {
+		fmt.Fprintf(out, "line %d: %s\n", rowError.Line, rowError.Error)
+	}
+	fmt.Fprintf(out, "imported %d of %d rows, %d failed\n", progress.Imported, progress.Processed, progress.Failed)
+	if progress.Created > 0 {
+		fmt.Fprintf(out, "added %d books to the catalogue\n", progress.Created)
+	}
+
+	return nil
+}
+
+func asMap(record any) map[string]any {
+	var m map[string]any
+	raw, _ := json.Marshal(record)
+	json.Unmarshal(raw, &m)
+	return m
+}
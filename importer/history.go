@@ -0,0 +1,504 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// sites whose reading history exports can be imported
+const (
+	Goodreads    = "goodreads"
+	LibraryThing = "librarything"
+)
+
+// one book from a reading history export along with what the user recorded about it.
+// Err is set when the row couldn't be read
+type HistoryRow struct {
+	Line       int
+	Book       models.InsertBookInput
+	Status     string   // one of the status shelves, empty if the export doesn't say
+	Shelves    []string // custom shelves
+	Rating     int
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+	Err        error
+}
+
+// reads a Goodreads or LibraryThing export one row at a time, returning io.EOF
+// after the last row
+type HistoryReader struct {
+	source  string
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+// Goodreads exports are CSV, LibraryThing's are CSV or tab separated
+func NewHistoryReader(source string, r io.Reader) (*HistoryReader, error) {
+	if source != Goodreads && source != LibraryThing {
+		return nil, fmt.Errorf("unknown export source %q, expected %s or %s", source, Goodreads, LibraryThing)
+	}
+
+	buffered := bufio.NewReader(r)
+	reader := csv.NewReader(buffered)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if head, _ := buffered.Peek(4096); isTabSeparated(head) {
+		reader.Comma = '\t'
+	}
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header row: %v", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		name = normaliseHeader(strings.TrimPrefix(name, "\ufeff"))
+		if _, seen := columns[name]; !seen {
+			columns[name] = i
+		}
+	}
+
+	author := "author"
+	if source == LibraryThing {
+		author = "primary_author"
+	}
+	if _, ok := columns["title"]; !ok {
+		return nil, fmt.Errorf("the header row has no Title column, is this a %s export?", source)
+	}
+	if _, ok := columns[author]; !ok {
+		return nil, fmt.Errorf("the header row has no author column, is this a %s export?", source)
+	}
+
+	return &HistoryReader{source: source, reader: reader, columns: columns}, nil
+}
+
+func (h *HistoryReader) Next() (HistoryRow, error) {
+	record, err := h.reader.Read()
+	if err == io.EOF {
+		return HistoryRow{}, io.EOF
+	}
+
+	line, _ := h.reader.FieldPos(0)
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return HistoryRow{Line: parseErr.StartLine, Err: parseErr.Err}, nil
+	}
+	if err != nil {
+		return HistoryRow{}, err
+	}
+
+	value := func(column string) string {
+		i, ok := h.columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	row := HistoryRow{Line: line}
+	if h.source == Goodreads {
+		row.Err = goodreadsRow(&row, value)
+	} else {
+		row.Err = libraryThingRow(&row, value)
+	}
+	row.Shelves = normaliseTags(row.Shelves)
+
+	// a date read is as good as saying the book was read
+	if row.Status == "" && row.FinishedAt != nil {
+		row.Status = models.ShelfRead
+	}
+	return row, nil
+}
+
+// Goodreads' exclusive shelves are its status shelves under other names
+var goodreadsStatuses = map[string]string{
+	"to-read":           models.ShelfWantToRead,
+	"currently-reading": models.ShelfReading,
+	"read":              models.ShelfRead,
+}
+
+// Goodreads appends the series to titles, "Guards! Guards! (Discworld, #8)"
+var seriesSuffix = regexp.MustCompile(`\s*\([^()]*#\d+(\.\d+)?\)$`)
+
+func goodreadsRow(row *HistoryRow, value func(string) string) error {
+	row.Book.Title = seriesSuffix.ReplaceAllString(value("title"), "")
+	row.Book.Author = value("author")
+	row.Book.Format = value("binding")
+
+	row.Book.ISBN = cleanISBN(value("isbn13"))
+	if row.Book.ISBN == "" {
+		row.Book.ISBN = cleanISBN(value("isbn"))
+	}
+
+	year := value("original_publication_year")
+	if year == "" {
+		year = value("year_published")
+	}
+	if year != "" {
+		n, err := strconv.Atoi(year)
+		if err != nil {
+			return fmt.Errorf("year %q isn't a number", year)
+		}
+		row.Book.Year = n
+	}
+
+	if rating := value("my_rating"); rating != "" {
+		n, err := strconv.Atoi(rating)
+		if err != nil || n < 0 || n > 5 {
+			return fmt.Errorf("rating %q isn't between 0 and 5", rating)
+		}
+		row.Rating = n
+	}
+
+	exclusive := strings.ToLower(value("exclusive_shelf"))
+	row.Status = goodreadsStatuses[exclusive]
+	if row.Status == "" && exclusive != "" {
+		// custom exclusive shelves like "did-not-finish" become ordinary shelves
+		row.Shelves = append(row.Shelves, exclusive)
+	}
+	for _, shelf := range splitList(value("bookshelves")) {
+		if _, status := goodreadsStatuses[strings.ToLower(shelf)]; !status {
+			row.Shelves = append(row.Shelves, shelf)
+		}
+	}
+
+	var err error
+	row.FinishedAt, err = parseDate(value("date_read"))
+	return err
+}
+
+// the LibraryThing collections that stand for a status shelf
+var libraryThingStatuses = map[string]string{
+	"to read":           models.ShelfWantToRead,
+	"wishlist":          models.ShelfWantToRead,
+	"currently reading": models.ShelfReading,
+	"read but unowned":  models.ShelfRead,
+}
+
+func libraryThingRow(row *HistoryRow, value func(string) string) error {
+	row.Book.Title = value("title")
+	row.Book.Author = authorFirstLast(value("primary_author"))
+	row.Book.Format = value("media")
+
+	row.Book.ISBN = cleanISBN(value("isbn"))
+	if row.Book.ISBN == "" {
+		row.Book.ISBN = cleanISBN(value("isbns"))
+	}
+
+	// the publication date can be a year, a full date or a range
+	if date := value("date"); len(date) >= 4 {
+		if year, err := strconv.Atoi(date[:4]); err == nil {
+			row.Book.Year = year
+		}
+	}
+
+	// half stars are rounded up
+	if rating := value("rating"); rating != "" {
+		f, err := strconv.ParseFloat(rating, 64)
+		if err != nil || f < 0 || f > 5 {
+			return fmt.Errorf("rating %q isn't between 0 and 5", rating)
+		}
+		row.Rating = int(math.Round(f))
+	}
+
+	for _, collection := range splitList(value("collections")) {
+		name := strings.ToLower(collection)
+		if status, ok := libraryThingStatuses[name]; ok {
+			row.Status = status
+		} else if name != "your library" {
+			row.Shelves = append(row.Shelves, collection)
+		}
+	}
+
+	var err error
+	if row.StartedAt, err = parseDate(value("date_started")); err != nil {
+		return err
+	}
+	row.FinishedAt, err = parseDate(value("date_read"))
+	return err
+}
+
+// ISBNs come wrapped to stop spreadsheets mangling them, ="0123" from Goodreads and
+// [0123] from LibraryThing, sometimes several to a cell. Anything that still isn't an
+// ISBN is dropped rather than failing the row
+func cleanISBN(s string) string {
+	s = strings.NewReplacer("=", "", `"`, "", "[", "", "]", "", "-", "", " ", "").Replace(s)
+	s, _, _ = strings.Cut(s, ",")
+	s = strings.ToUpper(s)
+
+	if len(s) != 10 && len(s) != 13 {
+		return ""
+	}
+	for i, r := range s {
+		isCheckDigit := i == 9 && len(s) == 10 && r == 'X'
+		if (r < '0' || r > '9') && !isCheckDigit {
+			return ""
+		}
+	}
+	return s
+}
+
+// "Borges, Jorge Luis" becomes "Jorge Luis Borges"
+func authorFirstLast(author string) string {
+	last, first, found := strings.Cut(author, ",")
+	if !found || strings.Contains(first, ",") {
+		return author
+	}
+	return strings.TrimSpace(first) + " " + strings.TrimSpace(last)
+}
+
+// dates are 2006/01/02 in Goodreads exports and 2006-01-02 in LibraryThing's
+func parseDate(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{"2006/01/02", "2006-01-02", "2006/01", "2006-01"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("date %q isn't in a known format", s)
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func isTabSeparated(head []byte) bool {
+	header, _, _ := bytes.Cut(head, []byte("\n"))
+	return bytes.Count(header, []byte("\t")) > bytes.Count(header, []byte(","))
+}
+
+type HistoryOptions struct {
+	Source string
+	UserId string
+
+	// whether books missing from the catalogue are added, otherwise their rows fail
+	CreateBooks bool
+
+	// called for every book added to the catalogue
+	OnInsert func(book models.Book)
+	// called for every reading record saved, with the record as it was before or nil
+	OnRecord func(before *models.ReadingRecord, after models.ReadingRecord)
+}
+
+// imports a user's reading history. Each row is matched to a catalogue book by
+// ISBN, then by title and author, and the user's shelves, rating and dates are
+// merged into their reading record for it. Rows that fail are reported on the job
+func RunHistory(ctx context.Context, db database.Database, r io.Reader, opts HistoryOptions, job *Job) error {
+	err := runHistory(ctx, db, r, opts, job)
+	job.finish(err)
+	return err
+}
+
+func runHistory(ctx context.Context, db database.Database, r io.Reader, opts HistoryOptions, job *Job) error {
+	reader, err := NewHistoryReader(opts.Source, r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.GetUser(ctx, opts.UserId); err != nil {
+		return fmt.Errorf("unable to find user %s: %v", opts.UserId, err)
+	}
+
+	catalogue, err := newCatalogue(ctx, db)
+	if err != nil {
+		return err
+	}
+	check, err := newChecker(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	existing, err := db.GetReadingRecords(ctx, opts.UserId)
+	if err != nil {
+		return fmt.Errorf("unable to read the user's reading records: %v", err)
+	}
+	records := map[string]models.ReadingRecord{}
+	for _, record := range existing {
+		records[record.BookId] = record
+	}
+
+	shelves, err := db.GetShelves(ctx, opts.UserId)
+	if err != nil {
+		return fmt.Errorf("unable to read the user's shelves: %v", err)
+	}
+	knownShelves := map[string]bool{}
+	for _, shelf := range shelves {
+		knownShelves[shelf.Name] = true
+	}
+
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read the file: %v", err)
+		}
+		if row.Err != nil {
+			job.rowFailed(row.Line, row.Err)
+			continue
+		}
+
+		book, found := catalogue.match(row.Book)
+		if !found {
+			if !opts.CreateBooks {
+				job.rowFailed(row.Line, errors.New("no book in the catalogue matches, an editor has to add it first"))
+				continue
+			}
+			if err := check.row(ctx, &row.Book); err != nil {
+				job.rowFailed(row.Line, err)
+				continue
+			}
+			book, err = db.Insert(ctx, "books", row.Book)
+			if err != nil {
+				job.rowFailed(row.Line, fmt.Errorf("unable to save the book"))
+				continue
+			}
+			catalogue.add(book)
+			if opts.OnInsert != nil {
+				opts.OnInsert(book)
+			}
+			job.update(func(p *Progress) { p.Created++ })
+		}
+
+		failed := false
+		for _, shelf := range row.Shelves {
+			if knownShelves[shelf] || slices.Contains(models.StatusShelves, shelf) {
+				continue
+			}
+			if _, err := db.InsertShelf(ctx, opts.UserId, shelf); err != nil && !errors.Is(err, database.ErrConflict) {
+				job.rowFailed(row.Line, fmt.Errorf("unable to create shelf %s", shelf))
+				failed = true
+				break
+			}
+			knownShelves[shelf] = true
+		}
+		if failed {
+			continue
+		}
+
+		var before *models.ReadingRecord
+		record, ok := records[book.Id]
+		if ok {
+			previous := record
+			previous.Shelves = slices.Clone(record.Shelves)
+			before = &previous
+		} else {
+			record = models.ReadingRecord{UserId: opts.UserId, BookId: book.Id}
+		}
+		mergeHistory(&record, row)
+
+		if err := db.PutReadingRecord(ctx, record); err != nil {
+			job.rowFailed(row.Line, fmt.Errorf("unable to save the reading record"))
+			continue
+		}
+		records[book.Id] = record
+		if opts.OnRecord != nil {
+			opts.OnRecord(before, record)
+		}
+
+		job.update(func(p *Progress) {
+			p.Processed++
+			p.Imported++
+		})
+	}
+}
+
+// what the export says wins over what was recorded before, but blanks in the
+// export don't clear anything
+func mergeHistory(record *models.ReadingRecord, row HistoryRow) {
+	if row.Status != "" {
+		record.Status = row.Status
+	}
+	for _, shelf := range row.Shelves {
+		if !slices.Contains(record.Shelves, shelf) && !slices.Contains(models.StatusShelves, shelf) {
+			record.Shelves = append(record.Shelves, shelf)
+		}
+	}
+	if row.Rating > 0 {
+		record.Rating = row.Rating
+	}
+	if row.StartedAt != nil {
+		record.StartedAt = row.StartedAt
+	}
+	if row.FinishedAt != nil {
+		record.FinishedAt = row.FinishedAt
+	}
+	if record.Status == models.ShelfRead {
+		record.Percent = 100
+	}
+	record.UpdatedAt = time.Now().UTC()
+}
+
+// the catalogue indexed for matching export rows, including books added by the import
+type catalogue struct {
+	byISBN        map[string]models.Book
+	byTitleAuthor map[string]models.Book
+}
+
+func newCatalogue(ctx context.Context, db database.Database) (*catalogue, error) {
+	c := &catalogue{byISBN: map[string]models.Book{}, byTitleAuthor: map[string]models.Book{}}
+	err := db.Each(ctx, "books", func(book models.Book) error {
+		c.add(book)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the catalogue: %v", err)
+	}
+	return c, nil
+}
+
+func (c *catalogue) add(book models.Book) {
+	if book.ISBN != "" {
+		c.byISBN[book.ISBN] = book
+	}
+	key := titleAuthorKey(book.Title, book.Author)
+	if _, taken := c.byTitleAuthor[key]; !taken {
+		c.byTitleAuthor[key] = book
+	}
+}
+
+// an ISBN identifies the edition. When the catalogue doesn't have that one, any
+// edition with the same title and author will do
+func (c *catalogue) match(input models.InsertBookInput) (models.Book, bool) {
+	if input.ISBN != "" {
+		if book, ok := c.byISBN[input.ISBN]; ok {
+			return book, true
+		}
+	}
+	book, ok := c.byTitleAuthor[titleAuthorKey(input.Title, input.Author)]
+	return book, ok
+}
+
+func titleAuthorKey(title, author string) string {
+	normalise := func(s string) string {
+		return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+	}
+	return normalise(title) + "\x00" + normalise(author)
+}
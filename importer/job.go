@@ -0,0 +1,311 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// import job states
+const (
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// valid rows are inserted this many at a time
+const chunkSize = 500
+
+// only the first errors are kept, a badly mapped file would otherwise report every row
+const maxRowErrors = 1000
+
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// how far an import has got. Processed counts every row read, whether it was
+// imported or failed. Created counts the books a reading history import had to
+// add to the catalogue
+type Progress struct {
+	Id         string     `json:"id"`
+	Status     string     `json:"status"`
+	Processed  int        `json:"processed"`
+	Imported   int        `json:"imported"`
+	Failed     int        `json:"failed"`
+	Created    int        `json:"created,omitempty"`
+	Errors     []RowError `json:"errors"`
+	Error      string     `json:"error,omitempty"` // why a failed import stopped
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type Options struct {
+	Format  string
+	Mapping map[string]string
+
+	// called for every book once it's been saved, e.g. to audit it
+	OnInsert func(book models.Book)
+}
+
+// a single import, safe to poll while it runs
+type Job struct {
+	mu       sync.Mutex
+	progress Progress
+}
+
+func NewJob() *Job {
+	return &Job{progress: Progress{Id: utils.UUID(), Status: StatusRunning, Errors: []RowError{}, StartedAt: time.Now().UTC()}}
+}
+
+// ids never change, so they can be read without the lock
+func (j *Job) Id() string {
+	return j.progress.Id
+}
+
+func (j *Job) Progress() Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	progress := j.progress
+	progress.Errors = slices.Clone(j.progress.Errors)
+	return progress
+}
+
+func (j *Job) update(f func(p *Progress)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.progress)
+}
+
+func (j *Job) rowFailed(line int, err error) {
+	j.update(func(p *Progress) {
+		p.Processed++
+		p.Failed++
+		if len(p.Errors) < maxRowErrors {
+			p.Errors = append(p.Errors, RowError{Line: line, Error: err.Error()})
+		}
+	})
+}
+
+func (j *Job) finish(err error) {
+	now := time.Now().UTC()
+	j.update(func(p *Progress) {
+		p.Status = StatusDone
+		if err != nil {
+			p.Status = StatusFailed
+			p.Error = err.Error()
+		}
+		p.FinishedAt = &now
+	})
+}
+
+// reads every row, validating it the way POST /books would, and inserts the valid
+// ones in chunks. Rows that fail are reported on the job rather than stopping it
+func Run(ctx context.Context, db database.Database, r io.Reader, opts Options, job *Job) error {
+	err := run(ctx, db, r, opts, job)
+	job.finish(err)
+	return err
+}
+
+func run(ctx context.Context, db database.Database, r io.Reader, opts Options, job *Job) error {
+	reader, err := NewReader(opts.Format, r, opts.Mapping)
+	if err != nil {
+		return err
+	}
+
+	check, err := newChecker(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	pending := []Row{}
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		data := make([]models.InsertBookInput, len(pending))
+		for i, row := range pending {
+			data[i] = row.Book
+		}
+
+		books, err := db.InsertMany(ctx, "books", data)
+		if err != nil {
+			log.Errorf("Import %s failed to insert a chunk: %v", job.Id(), err)
+		}
+
+		// books that made it in despite an error still count
+		for i, row := range pending {
+			if i >= len(books) || books[i].Id == "" {
+				job.rowFailed(row.Line, fmt.Errorf("unable to save the book"))
+				continue
+			}
+			if opts.OnInsert != nil {
+				opts.OnInsert(books[i])
+			}
+			job.update(func(p *Progress) {
+				p.Processed++
+				p.Imported++
+			})
+		}
+		pending = pending[:0]
+	}
+
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read the file: %v", err)
+		}
+
+		if row.Err == nil {
+			row.Err = check.row(ctx, &row.Book)
+		}
+		if row.Err != nil {
+			job.rowFailed(row.Line, row.Err)
+			continue
+		}
+
+		pending = append(pending, row)
+		if len(pending) == chunkSize {
+			flush()
+		}
+	}
+
+	flush()
+	return nil
+}
+
+// validates rows against the catalogue as it was when the import started, plus
+// the rows accepted so far
+type checker struct {
+	db     database.Database
+	isbns  map[string]bool
+	genres map[string]bool
+	works  map[string]bool
+}
+
+func newChecker(ctx context.Context, db database.Database) (*checker, error) {
+	c := &checker{db: db, isbns: map[string]bool{}, genres: map[string]bool{}, works: map[string]bool{}}
+	err := db.Each(ctx, "books", func(book models.Book) error {
+		if book.ISBN != "" {
+			c.isbns[book.ISBN] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the catalogue: %v", err)
+	}
+	genres, err := db.AllGenres(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the genres: %v", err)
+	}
+
+	for _, genre := range genres {
+		c.genres[genre.Id] = true
+	}
+	return c, nil
+}
+
+func (c *checker) row(ctx context.Context, book *models.InsertBookInput) error {
+	if err := binding.Validator.ValidateStruct(book); err != nil {
+		return err
+	}
+	book.Tags = normaliseTags(book.Tags)
+
+	if book.GenreId != "" && !c.genres[book.GenreId] {
+		return fmt.Errorf("no genre found with id %s", book.GenreId)
+	}
+	if book.WorkId != "" {
+		known, checked := c.works[book.WorkId]
+		if !checked {
+			_, err := c.db.GetWork(ctx, book.WorkId)
+			known = err == nil
+			c.works[book.WorkId] = known
+		}
+		if !known {
+			return fmt.Errorf("no work found with id %s", book.WorkId)
+		}
+	}
+	if book.ISBN != "" {
+		if c.isbns[book.ISBN] {
+			return fmt.Errorf("a book with ISBN %s already exists", book.ISBN)
+		}
+		c.isbns[book.ISBN] = true
+	}
+	return nil
+}
+
+// tags are stored the way POST /books stores them, lowercased and without repeats
+func normaliseTags(tags []string) []string {
+	normalised := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !slices.Contains(normalised, tag) {
+			normalised = append(normalised, tag)
+		}
+	}
+	return normalised
+}
+
+// keeps track of running and finished imports in this process
+type Jobs struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewJobs() *Jobs {
+	return &Jobs{jobs: map[string]*Job{}}
+}
+
+// runs an import in the background, closing r once it's done
+func (js *Jobs) Start(db database.Database, r io.ReadCloser, opts Options) *Job {
+	return js.start(r, func(ctx context.Context, job *Job) error {
+		return Run(ctx, db, r, opts, job)
+	})
+}
+
+// runs a reading history import in the background, closing r once it's done
+func (js *Jobs) StartHistory(db database.Database, r io.ReadCloser, opts HistoryOptions) *Job {
+	return js.start(r, func(ctx context.Context, job *Job) error {
+		return RunHistory(ctx, db, r, opts, job)
+	})
+}
+
+func (js *Jobs) start(r io.Closer, run func(ctx context.Context, job *Job) error) *Job {
+	job := NewJob()
+
+	js.mu.Lock()
+	js.jobs[job.Id()] = job
+	js.mu.Unlock()
+
+	go func() {
+		defer r.Close()
+		if err := run(context.Background(), job); err != nil {
+			log.Errorf("Import %s failed: %v", job.Id(), err)
+		}
+	}()
+
+	return job
+}
+
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	job, ok := js.jobs[id]
+	return job, ok
+}
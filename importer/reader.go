@@ -0,0 +1,230 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// upload formats
+const (
+	CSV    = "csv"
+	NDJSON = "ndjson"
+)
+
+// the InsertBookInput fields a CSV column can be mapped onto
+var fields = []string{"title", "author", "work_id", "isbn", "format", "tags", "genre_id", "year"}
+
+// one book read from an upload. Err is set when the row itself couldn't be read,
+// it hasn't been validated yet
+type Row struct {
+	Line int
+	Book models.InsertBookInput
+	Err  error
+}
+
+// reads an upload one row at a time, returning io.EOF after the last row
+type Reader interface {
+	Next() (Row, error)
+}
+
+func NewReader(format string, r io.Reader, mapping map[string]string) (Reader, error) {
+	switch format {
+	case CSV:
+		return newCSVReader(r, mapping)
+	case NDJSON:
+		return &ndjsonReader{scanner: newScanner(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown import format %q, expected csv or ndjson", format)
+}
+
+// works out the format from a file name or content type, empty when neither says
+func DetectFormat(filename, contentType string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return CSV
+	case ".ndjson", ".jsonl":
+		return NDJSON
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/csv":
+		return CSV
+	case "application/x-ndjson", "application/jsonl", "application/json-seq":
+		return NDJSON
+	}
+	return ""
+}
+
+// parses "Book Title=title,Writer=author" into a header to field mapping
+func ParseMapping(s string) (map[string]string, error) {
+	mapping := map[string]string{}
+	if strings.TrimSpace(s) == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		header, field, found := strings.Cut(pair, "=")
+		field = strings.TrimSpace(field)
+		if !found || strings.TrimSpace(header) == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected header=field", pair)
+		}
+		if !isField(field) {
+			return nil, fmt.Errorf("unknown field %q in mapping, expected one of %s", field, strings.Join(fields, ", "))
+		}
+		mapping[normaliseHeader(header)] = field
+	}
+	return mapping, nil
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns []string // the field each column maps onto, empty for ignored columns
+}
+
+// the header row decides which column is which. Headers are matched to fields
+// ignoring case, spaces and dashes unless the mapping says otherwise
+func newCSVReader(r io.Reader, mapping map[string]string) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the header row: %v", err)
+	}
+
+	columns := make([]string, len(header))
+	seen := map[string]bool{}
+	for i, name := range header {
+		name = normaliseHeader(strings.TrimPrefix(name, "\ufeff"))
+		if field, ok := mapping[name]; ok {
+			columns[i] = field
+		} else if isField(name) {
+			columns[i] = name
+		}
+		seen[columns[i]] = true
+	}
+	if !seen["title"] || !seen["author"] {
+		return nil, errors.New("the header row needs title and author columns, map them with header=field if they're named differently")
+	}
+
+	return &csvReader{reader: reader, columns: columns}, nil
+}
+
+func (c *csvReader) Next() (Row, error) {
+	record, err := c.reader.Read()
+	if err == io.EOF {
+		return Row{}, io.EOF
+	}
+
+	line, _ := c.reader.FieldPos(0)
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return Row{Line: parseErr.StartLine, Err: parseErr.Err}, nil
+	}
+	if err != nil {
+		return Row{}, err
+	}
+
+	row := Row{Line: line}
+	for i, value := range record {
+		if i >= len(c.columns) || c.columns[i] == "" {
+			continue
+		}
+		if err := setField(&row.Book, c.columns[i], strings.TrimSpace(value)); err != nil {
+			row.Err = err
+		}
+	}
+	return row, nil
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (n *ndjsonReader) Next() (Row, error) {
+	for n.scanner.Scan() {
+		n.line++
+		text := strings.TrimSpace(n.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := Row{Line: n.line}
+		if err := json.Unmarshal([]byte(text), &row.Book); err != nil {
+			row.Err = fmt.Errorf("invalid JSON: %v", err)
+		}
+		return row, nil
+	}
+
+	if err := n.scanner.Err(); err != nil {
+		return Row{}, err
+	}
+	return Row{}, io.EOF
+}
+
+// lines can be as long as a book record needs to be
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return scanner
+}
+
+func setField(book *models.InsertBookInput, field, value string) error {
+	switch field {
+	case "title":
+		book.Title = value
+	case "author":
+		book.Author = value
+	case "work_id":
+		book.WorkId = value
+	case "isbn":
+		book.ISBN = value
+	case "format":
+		book.Format = value
+	case "tags":
+		// spreadsheets list tags separated by semicolons
+		for _, tag := range strings.Split(value, ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				book.Tags = append(book.Tags, tag)
+			}
+		}
+	case "genre_id":
+		book.GenreId = value
+	case "year":
+		if value == "" {
+			return nil
+		}
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("year %q isn't a number", value)
+		}
+		book.Year = year
+	}
+	return nil
+}
+
+func normaliseHeader(header string) string {
+	header = strings.ToLower(strings.TrimSpace(header))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(header)
+}
+
+func isField(name string) bool {
+	return slices.Contains(fields, name)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestAuditTrail(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	w := doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/Fiction", nil)
+	assert.Equal(t, 200, w.Code)
+
+	// a caller's request id is kept and recorded
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/api/v1/books/"+book.Id, nil)
+	req.Header.Set("X-Request-Id", "trace-123")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "trace-123", w.Header().Get("X-Request-Id"))
+
+	// the failed delete isn't recorded
+	w = doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil)
+	assert.Equal(t, 404, w.Code)
+	assert.NotEmpty(t, w.Header().Get("X-Request-Id"))
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit", nil), &entries)
+	assert.Len(t, entries, 3)
+
+	// newest first
+	actions := []string{}
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+		assert.Equal(t, book.Id, entry.BookId)
+		assert.Equal(t, "anonymous", entry.Actor)
+		assert.False(t, entry.Timestamp.IsZero())
+	}
+	assert.Equal(t, []string{"book.delete", "book.tag", "book.create"}, actions)
+
+	deleted := entries[0]
+	assert.Equal(t, "trace-123", deleted.RequestId)
+	assert.Equal(t, "Labyrinths", deleted.Before["title"])
+	assert.Equal(t, []any{"fiction"}, deleted.Before["tags"])
+	assert.Nil(t, deleted.After)
+
+	tagged := entries[1]
+	assert.Nil(t, tagged.Before["tags"])
+	assert.Equal(t, []any{"fiction"}, tagged.After["tags"])
+
+	created := entries[2]
+	assert.Nil(t, created.Before)
+	assert.Equal(t, "Jorge Luis Borges", created.After["author"])
+}
+
+func TestAuditFilters(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	start := time.Now().UTC().Add(-time.Second).Format(time.RFC3339)
+	for _, title := range []string{"Labyrinths", "The Aleph", "Ficciones"} {
+		doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: title, Author: "Jorge Luis Borges"})
+	}
+	doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ada"})
+
+	// delete by title records every book removed
+	w := doRequest(router, http.MethodDelete, "/api/v1/books/?title=Fictions", nil)
+	assert.Equal(t, 200, w.Code)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.create", nil), &entries)
+	assert.Len(t, entries, 3)
+
+	entries = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.delete", nil), &entries)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "Fictions", entry.Before["title"])
+	}
+
+	entries = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=user.create", nil), &entries)
+	assert.Len(t, entries, 1)
+	assert.NotEmpty(t, entries[0].ResourceId)
+	assert.Empty(t, entries[0].BookId)
+
+	entries = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?limit=2&since="+start, nil), &entries)
+	assert.Len(t, entries, 2)
+
+	entries = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?until="+start, nil), &entries)
+	assert.Len(t, entries, 0)
+
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/audit?since=yesterday", nil).Code)
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/audit?limit=0", nil).Code)
+}
+
+func TestAuditActorAndAccess(t *testing.T) {
+	sequentialUUIDs(t)
+	_, keys := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	w := requestWithKey(router, http.MethodPost, "/api/v1/books", `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}`, keys[auth.RoleEditor])
+	assert.Equal(t, 200, w.Code)
+
+	// only admins can read the trail
+	assert.Equal(t, 403, requestWithKey(router, http.MethodGet, "/api/v1/audit", "", keys[auth.RoleEditor]).Code)
+
+	w = requestWithKey(router, http.MethodGet, "/api/v1/audit", "", keys[auth.RoleAdmin])
+	assert.Equal(t, 200, w.Code)
+	var entries []models.AuditEntry
+	decodeData(t, w, &entries)
+	assert.Len(t, entries, 1)
+	assert.Regexp(t, "^key:", entries[0].Actor)
+}
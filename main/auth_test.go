@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// creates a key file holding one key per role and points API_KEYS_FILE at it
+func setupKeys(t *testing.T) (*auth.KeyStore, map[auth.Role]string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	t.Setenv("API_KEYS_FILE", path)
+
+	keys, err := auth.LoadKeyStore(path)
+	assert.NoError(t, err)
+
+	plaintext := map[auth.Role]string{}
+	for _, role := range []auth.Role{auth.RoleReader, auth.RoleEditor, auth.RoleAdmin} {
+		key, _, err := keys.Create(string(role)+"-key", role)
+		assert.NoError(t, err)
+		plaintext[role] = key
+	}
+
+	return keys, plaintext
+}
+
+func requestWithKey(router *gin.Engine, method, path, body, key string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// the identity subject an API key acts as
+func subjectOf(t *testing.T, router *gin.Engine, key string) string {
+	t.Helper()
+
+	var identity auth.Identity
+	decodeData(t, requestWithKey(router, http.MethodGet, "/api/v1/whoami", "", key), &identity)
+	return identity.Subject
+}
+
+func TestAPIKeyRoles(t *testing.T) {
+	_, keys := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+	book := `{"Author":"Jorge Luis Borges","Title":"Labyrinths"}`
+
+	// ping stays public
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/ping", "", "").Code)
+
+	w := requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", "")
+	assert.Equal(t, 401, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "ApiKey")
+	assert.Equal(t, 401, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", "gba_wrong").Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", keys[auth.RoleReader]).Code)
+
+	assert.Equal(t, 403, requestWithKey(router, http.MethodPost, "/api/v1/books", book, keys[auth.RoleReader]).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodPost, "/api/v1/books", book, keys[auth.RoleEditor]).Code)
+
+	assert.Equal(t, 403, requestWithKey(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "", keys[auth.RoleEditor]).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "", keys[auth.RoleAdmin]).Code)
+
+	// the Authorization header works too
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/v1/books/title/?title=Fictions", nil)
+	req.Header.Set("Authorization", "ApiKey "+keys[auth.RoleReader])
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestRevokedKeyIsRejected(t *testing.T) {
+	keys, plaintext := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataSingle), nil)
+	router := setupRouter(handler, true)
+
+	for _, stored := range keys.List() {
+		if stored.Role == auth.RoleReader {
+			var out bytes.Buffer
+			err := auth.RunKeysCommand([]string{"revoke", "-id", stored.Id}, &out)
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(out.String(), "revoked key"))
+		}
+	}
+
+	assert.Equal(t, 401, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", plaintext[auth.RoleReader]).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", plaintext[auth.RoleAdmin]).Code)
+}
+
+func TestKeysAreHashedAtRest(t *testing.T) {
+	keys, plaintext := setupKeys(t)
+
+	for _, stored := range keys.List() {
+		assert.NotEqual(t, plaintext[stored.Role], stored.Hash)
+		assert.Len(t, stored.Hash, 64)
+	}
+}
+
+func TestAuthFailsClosed(t *testing.T) {
+	t.Setenv("AUTH_DISABLED", "")
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil), true)
+
+	// without credentials configured every authenticated route is refused
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/ping", "", "").Code)
+	assert.Equal(t, 401, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", "").Code)
+	assert.Equal(t, 401, requestWithKey(router, http.MethodGet, "/api/v1/whoami", "", "").Code)
+
+	// AUTH_DISABLED only opens it up when nothing is configured
+	t.Setenv("AUTH_DISABLED", "true")
+	_, keys := setupKeys(t)
+	router = setupRouter(controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil), true)
+	assert.Equal(t, 401, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", "").Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", keys[auth.RoleReader]).Code)
+}
+
+func TestReadersActOnlyAsThemselves(t *testing.T) {
+	sequentialUUIDs(t)
+	store, keys := setupKeys(t)
+	other, _, err := store.Create("other-reader-key", auth.RoleReader)
+	assert.NoError(t, err)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+	editor, admin := keys[auth.RoleEditor], keys[auth.RoleAdmin]
+
+	// users A and B, each linked to their own reader key
+	var a, b models.User
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/users", `{"name":"A","subject":"`+subjectOf(t, router, keys[auth.RoleReader])+`"}`, editor), &a)
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/users", `{"name":"B","subject":"`+subjectOf(t, router, other)+`"}`, editor), &b)
+	var book models.Book
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/books", `{"title":"Fictions","author":"Jorge Luis Borges"}`, editor), &book)
+	requestWithKey(router, http.MethodPost, "/api/v1/books/"+book.Id+"/copies", `{}`, editor)
+
+	// reader A can't touch B's shelves, history, loans or holds
+	readerA := keys[auth.RoleReader]
+	for _, request := range []struct{ method, path, body string }{
+		{http.MethodGet, "/api/v1/users/" + b.Id + "/shelves", ""},
+		{http.MethodPost, "/api/v1/users/" + b.Id + "/shelves", `{"name":"favourites"}`},
+		{http.MethodGet, "/api/v1/users/" + b.Id + "/shelves/read", ""},
+		{http.MethodPut, "/api/v1/users/" + b.Id + "/shelves/read/books/" + book.Id, ""},
+		{http.MethodDelete, "/api/v1/users/" + b.Id + "/shelves/read/books/" + book.Id, ""},
+		{http.MethodPost, "/api/v1/users/" + b.Id + "/import?source=goodreads", goodreadsExport},
+		{http.MethodPost, "/api/v1/books/" + book.Id + "/checkouts", `{"user_id":"` + b.Id + `"}`},
+		{http.MethodPost, "/api/v1/books/" + book.Id + "/holds", `{"user_id":"` + b.Id + `"}`},
+	} {
+		w := requestWithKey(router, request.method, request.path, request.body, readerA)
+		assert.Equal(t, 403, w.Code, request.method+" "+request.path)
+	}
+
+	// B borrows the copy, A can't return it for them but an admin can
+	var checkout models.Checkout
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/books/"+book.Id+"/checkouts", `{"user_id":"`+b.Id+`"}`, other), &checkout)
+	assert.Equal(t, 403, requestWithKey(router, http.MethodPost, "/api/v1/checkouts/"+checkout.Id+"/return", "", readerA).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodPost, "/api/v1/checkouts/"+checkout.Id+"/return", "", admin).Code)
+
+	// and each reader still manages their own
+	assert.Equal(t, 200, requestWithKey(router, http.MethodPut, "/api/v1/users/"+a.Id+"/shelves/read/books/"+book.Id, "", readerA).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodPost, "/api/v1/books/"+book.Id+"/holds", `{"user_id":"`+a.Id+`"}`, readerA).Code)
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/users/"+a.Id+"/shelves", "", readerA).Code)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestBatchBooks(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var existing models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges", ISBN: "9780811216999"}), &existing)
+
+	title := "Labyrinths: Selected Stories"
+	stale := 7
+	batch := map[string]any{"operations": []map[string]any{
+		{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Jorge Luis Borges", "tags": []string{" Fiction "}}},
+		{"op": "create", "book": map[string]any{"title": "The Aleph"}},
+		{"op": "create", "book": map[string]any{"title": "Labyrinths", "author": "Jorge Luis Borges", "isbn": "9780811216999"}},
+		{"op": "update", "id": existing.Id, "changes": map[string]any{"title": title}},
+		{"op": "update", "id": existing.Id, "revision": stale, "changes": map[string]any{"year": 1962}},
+		{"op": "delete", "id": "unknown"},
+		{"op": "rename", "id": existing.Id},
+	}}
+
+	w := doRequest(router, http.MethodPost, "/api/v1/books:batch", batch)
+	assert.Equal(t, 200, w.Code)
+	var results []models.BatchResult
+	decodeData(t, w, &results)
+	assert.Len(t, results, 7)
+
+	statuses := []int{}
+	for i, result := range results {
+		assert.Equal(t, i, result.Index)
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal(t, []int{200, 400, 409, 200, 412, 404, 400}, statuses)
+	assert.Equal(t, []string{"fiction"}, results[0].Book.Tags)
+	assert.Equal(t, existing.Id, results[2].Id)
+	assert.Equal(t, title, results[3].Book.Title)
+
+	var all []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &all)
+	assert.Len(t, all, 2)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.update", nil), &entries)
+	assert.Len(t, entries, 1)
+
+	assert.Equal(t, 404, doRequest(router, http.MethodPost, "/api/v1/books:unknown", batch).Code)
+	assert.Equal(t, 400, doRequest(router, http.MethodPost, "/api/v1/books:batch", map[string]any{"operations": []any{}}).Code)
+}
+
+func TestAtomicBatch(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var existing models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &existing)
+
+	// the delete fails in the database, so the create and update before it are rolled back
+	batch := map[string]any{"atomic": true, "operations": []map[string]any{
+		{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Jorge Luis Borges"}},
+		{"op": "update", "id": existing.Id, "changes": map[string]any{"year": 1962}},
+		{"op": "delete", "id": "unknown"},
+	}}
+	w := doRequest(router, http.MethodPost, "/api/v1/books:batch", batch)
+	assert.Equal(t, 422, w.Code)
+	var results []models.BatchResult
+	decodeData(t, w, &results)
+	assert.Equal(t, 424, results[0].Status)
+	assert.Equal(t, 424, results[1].Status)
+	assert.Equal(t, 404, results[2].Status)
+
+	var all []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &all)
+	assert.Len(t, all, 1)
+	assert.Zero(t, all[0].Year)
+
+	var revisions []models.BookRevision
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+existing.Id+"/revisions", nil), &revisions)
+	assert.Len(t, revisions, 1)
+
+	// an invalid operation stops the batch before anything is written
+	batch["operations"] = []map[string]any{
+		{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Jorge Luis Borges"}},
+		{"op": "create", "book": map[string]any{"title": "The Aleph"}},
+	}
+	w = doRequest(router, http.MethodPost, "/api/v1/books:batch", batch)
+	assert.Equal(t, 422, w.Code)
+	decodeData(t, w, &results)
+	assert.Equal(t, 424, results[0].Status)
+	assert.Equal(t, 400, results[1].Status)
+
+	batch["operations"] = []map[string]any{
+		{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Jorge Luis Borges"}},
+		{"op": "delete", "id": existing.Id},
+	}
+	w = doRequest(router, http.MethodPost, "/api/v1/books:batch", batch)
+	assert.Equal(t, 200, w.Code)
+
+	all = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &all)
+	assert.Len(t, all, 1)
+	assert.Equal(t, "Ficciones", all[0].Title)
+}
+
+func TestBatchDeleteNeedsAdmin(t *testing.T) {
+	sequentialUUIDs(t)
+	_, keys := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	w := requestWithKey(router, http.MethodPost, "/api/v1/books", `{"title":"Labyrinths","author":"Jorge Luis Borges"}`, keys[auth.RoleEditor])
+	var book models.Book
+	decodeData(t, w, &book)
+
+	body := `{"operations":[{"op":"delete","id":"` + book.Id + `"}]}`
+	assert.Equal(t, 403, requestWithKey(router, http.MethodPost, "/api/v1/books:batch", body, keys[auth.RoleReader]).Code)
+
+	var results []models.BatchResult
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/books:batch", body, keys[auth.RoleEditor]), &results)
+	assert.Equal(t, 403, results[0].Status)
+
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/books:batch", body, keys[auth.RoleAdmin]), &results)
+	assert.Equal(t, 200, results[0].Status)
+}
+
+func TestBatchISBNs(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(cappedDB{Database: database.NewMemoryDB(nil), limit: 0}, nil)
+	router := setupRouter(handler, true)
+
+	var first, second models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"}), &first)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "The Aleph", Author: "Jorge Luis Borges", ISBN: "9780142437889"}), &second)
+
+	statuses := func(batch map[string]any) []int {
+		w := doRequest(router, http.MethodPost, "/api/v1/books:batch", batch)
+		var results []models.BatchResult
+		decodeData(t, w, &results)
+		statuses := []int{}
+		for _, result := range results {
+			statuses = append(statuses, result.Status)
+		}
+		return statuses
+	}
+	swap := []map[string]any{
+		{"op": "update", "id": first.Id, "changes": map[string]any{"isbn": "9780141183848"}},
+		{"op": "update", "id": second.Id, "changes": map[string]any{"isbn": "9780802130303"}},
+		{"op": "create", "book": map[string]any{"title": "The Aleph", "author": "Someone Else", "isbn": "9780142437889"}},
+	}
+
+	// ISBNs taken by books All doesn't return are still taken, and one given up by an
+	// earlier operation stays taken unless the batch is atomic, since the operation
+	// giving it up could fail on its own
+	taken := append([]map[string]any{{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Someone Else", "isbn": "9780802130303"}}}, swap...)
+	assert.Equal(t, []int{409, 200, 409, 409}, statuses(map[string]any{"operations": taken}))
+	assert.Equal(t, []int{200, 200, 200}, statuses(map[string]any{"operations": swap, "atomic": true}))
+}
+
+func TestBatchDuplicateCreates(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("DUPLICATE_POLICY", "reject")
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	// the second create duplicates the first even though neither is stored yet
+	batch := map[string]any{"operations": []map[string]any{
+		{"op": "create", "book": map[string]any{"title": "Ficciones", "author": "Jorge Luis Borges"}},
+		{"op": "create", "book": map[string]any{"title": "ficciones", "author": "Jorge Luis Borges"}},
+	}}
+	var results []models.BatchResult
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books:batch", batch), &results)
+	assert.Equal(t, 200, results[0].Status)
+	assert.Equal(t, 409, results[1].Status)
+	assert.Contains(t, results[1].Error, "Operation 0")
+
+	// and is flagged when duplicates are only warned about
+	t.Setenv("DUPLICATE_POLICY", "warn")
+	batch["operations"].([]map[string]any)[0]["book"].(map[string]any)["title"] = "Labyrinths"
+	batch["operations"].([]map[string]any)[1]["book"].(map[string]any)["title"] = "Labyrinths"
+	results = nil
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books:batch", batch), &results)
+	assert.Equal(t, []int{200, 200}, []int{results[0].Status, results[1].Status})
+	assert.Contains(t, results[1].Warning, "operation 0")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/citation"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// records as other catalogues and reference managers export them
+var citationSamples = map[string]string{
+	citation.BibTeX: `% exported from a reference manager
+@article{unrelated, title = {Not a book}}
+
+@Book{borges1962,
+  Title     = "{Labyrinths}: Selected Stories {\&} Other Writings",
+  Author    = {Borges, Jorge Luis},
+  Year      = 1962,
+  ISBN      = {9780811216999},
+  Keywords  = {fiction, short stories},
+  Publisher = {New Directions}
+}`,
+	citation.RIS: "TY  - BOOK\r\n" +
+		"TI  - Labyrinths: Selected Stories & Other Writings\r\n" +
+		"AU  - Borges, Jorge Luis\r\n" +
+		"PY  - 1962///\r\n" +
+		"PB  - New Directions\r\n" +
+		"SN  - 9780811216999\r\n" +
+		"KW  - fiction\r\n" +
+		"KW  - short stories\r\n" +
+		"ER  - \r\n",
+	citation.MARCXML: `<?xml version="1.0" encoding="UTF-8"?>
+<record xmlns="http://www.loc.gov/MARC21/slim">
+  <leader>01142cam  2200301 a 4500</leader>
+  <controlfield tag="008">620101s1962    nyu           000 1 eng  </controlfield>
+  <datafield tag="020" ind1=" " ind2=" ">
+    <subfield code="a">9780811216999 (pbk.)</subfield>
+  </datafield>
+  <datafield tag="100" ind1="1" ind2=" ">
+    <subfield code="a">Borges, Jorge Luis,</subfield>
+    <subfield code="d">1899-1986.</subfield>
+  </datafield>
+  <datafield tag="245" ind1="1" ind2="0">
+    <subfield code="a">Labyrinths :</subfield>
+    <subfield code="b">selected stories &amp; other writings /</subfield>
+  </datafield>
+  <datafield tag="260" ind1=" " ind2=" ">
+    <subfield code="b">New Directions,</subfield>
+    <subfield code="c">c1962.</subfield>
+  </datafield>
+  <datafield tag="650" ind1=" " ind2="0">
+    <subfield code="a">Fiction.</subfield>
+  </datafield>
+</record>`,
+	citation.DublinCore: `<oai_dc:dc xmlns:oai_dc="http://www.openarchives.org/OAI/2.0/oai_dc/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <dc:title>Labyrinths: Selected Stories &amp; Other Writings</dc:title>
+  <dc:creator>Borges, Jorge Luis</dc:creator>
+  <dc:date>1962</dc:date>
+  <dc:identifier>ISBN: 9780811216999</dc:identifier>
+  <dc:subject>fiction</dc:subject>
+  <dc:publisher>New Directions</dc:publisher>
+  <dc:format>Paperback</dc:format>
+</oai_dc:dc>`,
+}
+
+var citationExpected = map[string]models.Book{
+	citation.BibTeX:     {Title: "Labyrinths: Selected Stories & Other Writings", Author: "Jorge Luis Borges", Year: 1962, ISBN: "9780811216999", Tags: []string{"fiction", "short stories"}},
+	citation.RIS:        {Title: "Labyrinths: Selected Stories & Other Writings", Author: "Jorge Luis Borges", Year: 1962, ISBN: "9780811216999", Tags: []string{"fiction", "short stories"}},
+	citation.MARCXML:    {Title: "Labyrinths: selected stories & other writings", Author: "Jorge Luis Borges", Year: 1962, ISBN: "9780811216999", Format: "pbk", Tags: []string{"Fiction"}},
+	citation.DublinCore: {Title: "Labyrinths: Selected Stories & Other Writings", Author: "Jorge Luis Borges", Year: 1962, ISBN: "9780811216999", Format: "Paperback", Tags: []string{"fiction"}},
+}
+
+func TestCitationSamplesRoundTrip(t *testing.T) {
+	for _, format := range citation.Formats {
+		t.Run(format, func(t *testing.T) {
+			books, err := citation.Decode(strings.NewReader(citationSamples[format]), format)
+			assert.NoError(t, err)
+			assert.Equal(t, []models.Book{citationExpected[format]}, books)
+
+			// written out and read back in, nothing changes
+			var buf bytes.Buffer
+			assert.NoError(t, citation.Encode(&buf, format, books))
+			again, err := citation.Decode(&buf, format)
+			assert.NoError(t, err)
+			assert.Equal(t, books, again)
+		})
+	}
+}
+
+func TestCitationFormats(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	input := models.InsertBookInput{Title: "Ficciones {50% & more}", Author: "Jorge Luis Borges", ISBN: "9780802130303", Format: "Paperback", Tags: []string{"fiction", "short stories"}, Year: 1944}
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", input), &book)
+
+	// each format keeps the fields it has a place for
+	carried := map[string]models.Book{
+		citation.BibTeX:     {Title: book.Title, Author: book.Author, ISBN: book.ISBN, Tags: book.Tags, Year: book.Year},
+		citation.RIS:        {Id: book.Id, Title: book.Title, Author: book.Author, ISBN: book.ISBN, Format: book.Format, Tags: book.Tags, Year: book.Year},
+		citation.MARCXML:    {Id: book.Id, Title: book.Title, Author: book.Author, ISBN: book.ISBN, Format: book.Format, Tags: book.Tags, Year: book.Year},
+		citation.DublinCore: {Id: book.Id, Title: book.Title, Author: book.Author, ISBN: book.ISBN, Format: book.Format, Tags: book.Tags, Year: book.Year},
+	}
+
+	for _, format := range citation.Formats {
+		t.Run(format, func(t *testing.T) {
+			w := doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"?format="+format, nil)
+			assert.Equal(t, 200, w.Code)
+			assert.Contains(t, w.Header().Get("Content-Type"), citation.ContentTypes[format])
+
+			books, err := citation.Decode(w.Body, format)
+			assert.NoError(t, err)
+			assert.Equal(t, []models.Book{carried[format]}, books)
+
+			// lists use the same formats, picked by Accept here
+			w = requestWithHeader(router, http.MethodGet, "/api/v1/books/?table=books", "Accept", citation.ContentTypes[format])
+			assert.Equal(t, 200, w.Code)
+			books, err = citation.Decode(w.Body, format)
+			assert.NoError(t, err)
+			assert.Equal(t, []models.Book{carried[format]}, books)
+		})
+	}
+
+	w := doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"?format=bibtex", nil)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "@book{borges1944ficciones,\n"))
+	assert.Contains(t, w.Body.String(), `title = {Ficciones \{50\% \& more\}}`)
+
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/author/?name=Jorge Luis Borges", "Accept", "application/x-research-info-systems")
+	assert.Equal(t, "application/x-research-info-systems; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// JSON is still the default, and ?format= wins over Accept
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "text/html, */*")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id+"?format=json", "Accept", "application/x-bibtex")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"?format=mods", nil).Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/books/unknown?format=ris", nil).Code)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestDuplicatePolicyReject(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("DUPLICATE_POLICY", "reject")
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "The Garden of Forking Paths", Author: "Jorge Luis Borges"}), &book)
+
+	// case, punctuation and a leading article don't make a new book
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "garden of forking paths!", Author: "jorge  luis borges"})
+	assert.Equal(t, 409, w.Code)
+	var conflict map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, book.Id, conflict["id"])
+
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "The Garden of Forking Paths", Author: "Someone Else"})
+	assert.Equal(t, 200, w.Code)
+
+	// editions with their own ISBNs aren't duplicates of each other
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"})
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780141183848"})
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 409, w.Code)
+}
+
+func TestDuplicatePolicyWarnAndAllow(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	// warning is the default
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 200, w.Code)
+	var warned struct {
+		Warning    string   `json:"warning"`
+		Duplicates []string `json:"duplicates"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &warned))
+	assert.NotEmpty(t, warned.Warning)
+	assert.Equal(t, []string{book.Id}, warned.Duplicates)
+
+	t.Setenv("DUPLICATE_POLICY", "allow")
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), "duplicates")
+}
+
+func TestDuplicatesReport(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	t.Setenv("DUPLICATE_POLICY", "allow")
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "the aleph", Author: "Jorge Luis Borges"})
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "John Smith", ISBN: "9780000000001"})
+
+	var groups []models.DuplicateGroup
+	w := doRequest(router, http.MethodGet, "/api/v1/books/duplicates", nil)
+	assert.Equal(t, 200, w.Code)
+	decodeData(t, w, &groups)
+
+	// the two "Fictions" by different authors aren't duplicates of each other
+	assert.Len(t, groups, 2)
+	keys := []string{}
+	for _, group := range groups {
+		assert.Equal(t, "title_author", group.Reason)
+		assert.Len(t, group.Books, 2)
+		keys = append(keys, group.Key)
+	}
+	assert.Equal(t, []string{"aleph|jorge luis borges", "fictions|john smith"}, keys)
+}
+
+func TestDuplicatesBeyondAll(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("DUPLICATE_POLICY", "reject")
+	db := database.NewMemoryDB(nil)
+	handler := controllers.NewHandler(cappedDB{Database: db, limit: 0}, nil)
+	router := setupRouter(handler, true)
+
+	// books that All would never return are still checked and reported
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "labyrinths", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 409, w.Code)
+
+	t.Setenv("DUPLICATE_POLICY", "allow")
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "labyrinths", Author: "Jorge Luis Borges"})
+	var groups []models.DuplicateGroup
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/duplicates", nil), &groups)
+	assert.Len(t, groups, 1)
+}
+
+// a database that never finds a book by ISBN, as if the other create hadn't committed yet
+type racingISBNDB struct {
+	database.Database
+}
+
+func (db racingISBNDB) Get(ctx context.Context, table, key, val string) ([]models.Book, error) {
+	if key == "ISBN" {
+		return []models.Book{}, nil
+	}
+	return db.Database.Get(ctx, table, key, val)
+}
+
+func TestDuplicateISBNRace(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("DUPLICATE_POLICY", "allow")
+	router := setupRouter(controllers.NewHandler(racingISBNDB{database.NewMemoryDB(nil)}, nil), true)
+
+	// the handler's check misses the first book, the database still refuses the second
+	book := models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"}
+	assert.Equal(t, 200, doRequest(router, http.MethodPost, "/api/v1/books", book).Code)
+	w := doRequest(router, http.MethodPost, "/api/v1/books", book)
+	assert.Equal(t, 409, w.Code)
+	var conflict map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, "duplicate_isbn", conflict["code"])
+}
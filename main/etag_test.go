@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// sends a request with a single extra header
+func requestWithHeader(router http.Handler, method, path, header, value string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set(header, value)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBookETags(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"})
+	decodeData(t, w, &book)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	w = doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id, nil)
+	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "If-None-Match", etag)
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// a matching If-Match lets the write through and returns the new version
+	w = requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", "If-Match", etag)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	// the old ETag is stale now
+	w = requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/short-stories", "If-Match", etag)
+	assert.Equal(t, 412, w.Code)
+	w = requestWithHeader(router, http.MethodDelete, "/api/v1/books/"+book.Id, "If-Match", etag)
+	assert.Equal(t, 412, w.Code)
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "If-None-Match", etag)
+	assert.Equal(t, 200, w.Code)
+
+	// weak tags never satisfy If-Match
+	w = requestWithHeader(router, http.MethodDelete, "/api/v1/books/"+book.Id, "If-Match", `W/"2"`)
+	assert.Equal(t, 412, w.Code)
+
+	w = requestWithHeader(router, http.MethodDelete, "/api/v1/books/"+book.Id, "If-Match", `"1", "2"`)
+	assert.Equal(t, 200, w.Code)
+
+	// a book that's gone matches nothing, not even *
+	for _, ifMatch := range []string{"*", `"2"`, `"3"`} {
+		w = requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", "If-Match", ifMatch)
+		assert.Equal(t, 412, w.Code, ifMatch)
+	}
+	assert.Equal(t, 404, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil).Code)
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("REQUIRE_IF_MATCH", "true")
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	assert.Equal(t, 428, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil).Code)
+	assert.Equal(t, 428, doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil).Code)
+
+	assert.Equal(t, 200, requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", "If-Match", "*").Code)
+	assert.Equal(t, 200, requestWithHeader(router, http.MethodDelete, "/api/v1/books/"+book.Id, "If-Match", `"2"`).Code)
+}
+
+func TestConditionalListRoutes(t *testing.T) {
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, false)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil)
+	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Regexp(t, `^W/".+"$`, etag)
+
+	// answered from the page cache or not, an unchanged list is a 304
+	for i := 0; i < 2; i++ {
+		w = requestWithHeader(router, http.MethodGet, "/api/v1/books/?table=books", "If-None-Match", etag)
+		assert.Equal(t, 304, w.Code)
+	}
+
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/?table=books", "If-None-Match", `W/"something-else"`)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	// errors are passed through untouched
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/unknown", "If-None-Match", "*")
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestBookETagsPerRepresentation(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	// each encoding of a version has its own tag, and they all vary on Accept
+	tags := map[string]string{}
+	for _, accept := range []string{"application/json", "application/xml", "application/yaml", "application/msgpack"} {
+		w := requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", accept)
+		assert.Equal(t, 200, w.Code, accept)
+		assert.Equal(t, []string{"Accept"}, w.Header().Values("Vary"), accept)
+		tags[accept] = w.Header().Get("ETag")
+	}
+	assert.Equal(t, map[string]string{
+		"application/json":    `"1"`,
+		"application/xml":     `"1-xml"`,
+		"application/yaml":    `"1-yaml"`,
+		"application/msgpack": `"1-msgpack"`,
+	}, tags)
+
+	// a JSON tag doesn't revalidate the XML representation
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/api/v1/books/"+book.Id, nil)
+	req.Header.Set("Accept", "application/xml")
+	req.Header.Set("If-None-Match", `"1"`)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// but the tag of any representation of the current version satisfies If-Match
+	w = requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", "If-Match", tags["application/xml"])
+	assert.Equal(t, 200, w.Code)
+	w = requestWithHeader(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fantasy", "If-Match", tags["application/yaml"])
+	assert.Equal(t, 412, w.Code)
+}
+
+func TestDeleteByTitleIfMatch(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	var first, second models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &first)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", ISBN: "9780802130303"}), &second)
+	assert.Equal(t, 200, doRequest(router, http.MethodPut, "/api/v1/books/"+second.Id+"/tags/fiction", nil).Code)
+
+	// every book with the title has to match
+	w := requestWithHeader(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "If-Match", `"1"`)
+	assert.Equal(t, 412, w.Code)
+	assert.Contains(t, w.Body.String(), second.Id)
+	assert.Equal(t, 412, requestWithHeader(router, http.MethodDelete, "/api/v1/books/?title=Nothing", "If-Match", "*").Code)
+
+	var deleted int
+	decodeData(t, requestWithHeader(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "If-Match", `"1", "2"`), &deleted)
+	assert.Equal(t, 2, deleted)
+
+	// strict mode wants the header here too
+	t.Setenv("REQUIRE_IF_MATCH", "true")
+	router = setupRouter(controllers.NewHandler(database.NewMemoryDB(seedDataSingle), nil), true)
+	assert.Equal(t, 428, doRequest(router, http.MethodDelete, "/api/v1/books/?title=Fictions", nil).Code)
+	assert.Equal(t, 200, requestWithHeader(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "If-Match", "*").Code)
+}
+
+// a database where another writer gets in between a read and the write that follows it
+type racingDB struct {
+	database.Database
+	race func()
+}
+
+func (db *racingDB) Get(ctx context.Context, table, key, val string) ([]models.Book, error) {
+	books, err := db.Database.Get(ctx, table, key, val)
+	if db.race != nil {
+		db.race()
+		db.race = nil
+	}
+	return books, err
+}
+
+func TestDeleteByTitleIsAtomic(t *testing.T) {
+	sequentialUUIDs(t)
+	memory := database.NewMemoryDB(nil)
+	db := &racingDB{Database: memory}
+	router := setupRouter(controllers.NewHandler(db, nil), true)
+
+	var first, second models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &first)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", ISBN: "9780802130303"}), &second)
+
+	// the second book is tagged after its ETag was checked, so neither is deleted
+	db.race = func() { assert.NoError(t, memory.AddTag(context.Background(), "books", second.Id, "fiction")) }
+	w := requestWithHeader(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "If-Match", `"1"`)
+	assert.Equal(t, 412, w.Code)
+
+	var trash []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/trash", nil), &trash)
+	assert.Empty(t, trash)
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.delete", nil), &entries)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// a catalogue bigger than a flush, with one book in the trash
+func exportCatalogue(t *testing.T) *gin.Engine {
+	sequentialUUIDs(t)
+	db := database.NewMemoryDB(nil)
+	for i := 0; i < 250; i++ {
+		_, err := db.Insert(context.Background(), "books", models.InsertBookInput{Title: fmt.Sprintf("Book %d", i), Author: "Anon", Tags: []string{"a", "b"}, Year: 1900 + i})
+		assert.NoError(t, err)
+	}
+	trashed, _ := db.Insert(context.Background(), "books", models.InsertBookInput{Title: "Trashed", Author: "Anon"})
+	_, err := db.Drop(context.Background(), "books", "Id", trashed.Id)
+	assert.NoError(t, err)
+
+	return setupRouter(controllers.NewHandler(db, nil), true)
+}
+
+func TestExportJSON(t *testing.T) {
+	router := exportCatalogue(t)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/export", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Regexp(t, `^attachment; filename="books-\d{8}\.json"$`, w.Header().Get("Content-Disposition"))
+	assert.True(t, w.Flushed)
+
+	var books []models.Book
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &books))
+	assert.Len(t, books, 250)
+	assert.Equal(t, "Book 0", books[0].Title)
+
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/export?format=xml", nil).Code)
+}
+
+func TestExportNDJSONGzipped(t *testing.T) {
+	router := exportCatalogue(t)
+
+	w := requestWithHeader(router, http.MethodGet, "/api/v1/export?format=ndjson", "Accept-Encoding", "br;q=1.0, gzip;q=0.8")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, []string{"Accept", "Accept-Encoding"}, w.Header().Values("Vary"))
+
+	body, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	lines := 0
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var book models.Book
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &book))
+		lines++
+	}
+	assert.NoError(t, scanner.Err())
+	assert.Equal(t, 250, lines)
+
+	// gzip can be refused
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/export?format=ndjson", "Accept-Encoding", "gzip;q=0")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
+func TestExportCSVRoundTrip(t *testing.T) {
+	router := exportCatalogue(t)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/export?format=csv", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, records, 251)
+	assert.Equal(t, []string{"id", "title", "author", "work_id", "isbn", "format", "tags", "genre_id", "year"}, records[0])
+	assert.Equal(t, "a; b", records[1][6])
+
+	// the export imports cleanly into an empty catalogue
+	target := database.NewMemoryDB(nil)
+	job := importer.NewJob()
+	assert.NoError(t, importer.Run(context.Background(), target, strings.NewReader(w.Body.String()), importer.Options{Format: importer.CSV}, job))
+	assert.Equal(t, 250, job.Progress().Imported)
+
+	books, _ := target.All(context.Background(), "books")
+	assert.Equal(t, []string{"a", "b"}, books[0].Tags)
+	assert.Equal(t, 1900, books[0].Year)
+}
+
+func TestExportEmptyCatalogue(t *testing.T) {
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/export", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("Content-Disposition"))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// most tests exercise the routes without credentials, those checking auth set API_KEYS_FILE or JWT_JWKS
+func TestMain(m *testing.M) {
+	os.Setenv("AUTH_DISABLED", "true")
+	os.Exit(m.Run())
+}
+
+// swaps utils.UUID for a counter so each insert in a test gets a distinct, predictable id
+func sequentialUUIDs(t *testing.T) {
+	t.Helper()
+
+	original := utils.UUID
+	var n atomic.Int64
+	utils.UUID = func() string {
+		return fmt.Sprintf("uuid-%d", n.Add(1))
+	}
+	t.Cleanup(func() { utils.UUID = original })
+}
+
+// a database whose All is capped like the backends', returning at most limit books.
+// Postgres stops at 100 and Firestore's All returns none at all
+type cappedDB struct {
+	database.Database
+	limit int
+}
+
+func (db cappedDB) All(ctx context.Context, table string) ([]models.Book, error) {
+	books, err := db.Database.All(ctx, table)
+	return books[:min(db.limit, len(books))], err
+}
+
+// sends a request with an optional JSON body through the router
+func doRequest(router *gin.Engine, method, path string, body any) *httptest.ResponseRecorder {
+	var reqBody *bytes.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		reqBody = bytes.NewReader(b)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, reqBody)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// decodes the "data" field of a response body into dst
+func decodeData(t *testing.T, w *httptest.ResponseRecorder, dst any) {
+	t.Helper()
+
+	envelope := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("unable to decode response %q: %v", w.Body.String(), err)
+	}
+	if err := json.Unmarshal(envelope.Data, dst); err != nil {
+		t.Fatalf("unable to decode data %q: %v", envelope.Data, err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+const goodreadsExport = `Book Id,Title,Author,Author l-f,Additional Authors,ISBN,ISBN13,My Rating,Average Rating,Publisher,Binding,Number of Pages,Year Published,Original Publication Year,Date Read,Date Added,Bookshelves,Bookshelves with positions,Exclusive Shelf,My Review,Spoiler,Private Notes,Read Count,Owned Copies
+1,Ficciones,Jorge Luis Borges,"Borges, Jorge Luis",,"=""0802130305""","=""9780802130303""",5,4.46,Grove Press,Paperback,174,1994,1944,2021/03/14,2020/12/01,"favourites, read","favourites (#1), read (#3)",read,,,,1,0
+2,"Guards! Guards! (Discworld, #8)",Terry Pratchett,"Pratchett, Terry",,"=""""","=""""",0,4.33,Corgi,Paperback,413,1990,1989,,2022/01/05,currently-reading,currently-reading (#1),currently-reading,,,,0,0
+3,Labyrinths,Jorge Luis Borges,"Borges, Jorge Luis",,"=""""","=""""",4,4.40,New Directions,Paperback,251,2007,1962,last tuesday,2020/12/01,read,read (#2),read,,,,1,0
+`
+
+const libraryThingExport = "Book Id\tTitle\tPrimary Author\tDate\tISBNs\tRating\tCollections\tDate Started\tDate Read\n" +
+	"10\tFicciones\tBorges, Jorge Luis\t1944\t[0802130305]\t3.5\tYour library, Favourites\t2021-02-01\t\n" +
+	"11\tThe Aleph\tBorges, Jorge Luis\t1949\t\t\tTo read\t\t\n"
+
+func TestImportGoodreads(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var user models.User
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ana"}), &user)
+	var existing models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"}), &existing)
+
+	w := upload(router, "/api/v1/users/"+user.Id+"/import?source=goodreads", "text/csv", goodreadsExport)
+	assert.Equal(t, 200, w.Code)
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, 3, progress.Processed)
+	assert.Equal(t, 2, progress.Imported)
+	assert.Equal(t, 1, progress.Created)
+	assert.Equal(t, []importer.RowError{{Line: 4, Error: `date "last tuesday" isn't in a known format`}}, progress.Errors)
+
+	// the ="..." wrapped ISBN matched the book already in the catalogue
+	var read []models.ReadingRecord
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/users/"+user.Id+"/shelves/read", nil), &read)
+	assert.Len(t, read, 1)
+	assert.Equal(t, existing.Id, read[0].BookId)
+	assert.Equal(t, 5, read[0].Rating)
+	assert.Equal(t, "2021-03-14", read[0].FinishedAt.Format("2006-01-02"))
+	assert.Equal(t, float64(100), read[0].Percent)
+	assert.Equal(t, []string{"favourites"}, read[0].Shelves)
+
+	// the series is taken off the title of the book that had to be added
+	var reading []models.ReadingRecord
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/users/"+user.Id+"/shelves/reading", nil), &reading)
+	assert.Len(t, reading, 1)
+	assert.Equal(t, "Guards! Guards!", reading[0].Book.Title)
+	assert.Equal(t, 1989, reading[0].Book.Year)
+	assert.Zero(t, reading[0].Rating)
+
+	var shelves []models.Shelf
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/users/"+user.Id+"/shelves", nil), &shelves)
+	names := []string{}
+	for _, shelf := range shelves {
+		names = append(names, shelf.Name)
+	}
+	assert.Contains(t, names, "favourites")
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=reading.update", nil), &entries)
+	assert.Len(t, entries, 2)
+
+	// importing again updates the same records rather than adding books
+	var again importer.Progress
+	decodeData(t, upload(router, "/api/v1/users/"+user.Id+"/import?source=goodreads", "text/csv", goodreadsExport), &again)
+	assert.Equal(t, 2, again.Imported)
+	assert.Equal(t, 0, again.Created)
+	var books []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &books)
+	assert.Len(t, books, 2)
+
+	assert.Equal(t, 400, upload(router, "/api/v1/users/"+user.Id+"/import", "text/csv", goodreadsExport).Code)
+	assert.Equal(t, 400, upload(router, "/api/v1/users/"+user.Id+"/import?source=librarything", "text/csv", goodreadsExport).Code)
+	assert.Equal(t, 404, upload(router, "/api/v1/users/unknown/import?source=goodreads", "text/csv", goodreadsExport).Code)
+}
+
+func TestImportHistoryMatchesWholeCatalogue(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(cappedDB{Database: database.NewMemoryDB(nil), limit: 0}, nil)
+	router := setupRouter(handler, true)
+
+	var user models.User
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ana"}), &user)
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"})
+
+	// books All doesn't return are matched rather than added again
+	var progress importer.Progress
+	decodeData(t, upload(router, "/api/v1/users/"+user.Id+"/import?source=goodreads", "text/csv", goodreadsExport), &progress)
+	assert.Equal(t, 2, progress.Imported)
+	assert.Equal(t, 1, progress.Created)
+
+	var again importer.Progress
+	decodeData(t, upload(router, "/api/v1/users/"+user.Id+"/import?source=goodreads", "text/csv", goodreadsExport), &again)
+	assert.Equal(t, 2, again.Imported)
+	assert.Equal(t, 0, again.Created)
+}
+
+func TestImportLibraryThingAsReader(t *testing.T) {
+	sequentialUUIDs(t)
+	_, keys := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var user models.User
+	decodeData(t, requestWithKey(router, http.MethodPost, "/api/v1/users", `{"name":"Ana","subject":"`+subjectOf(t, router, keys[auth.RoleReader])+`"}`, keys[auth.RoleEditor]), &user)
+	requestWithKey(router, http.MethodPost, "/api/v1/books", `{"title":"Ficciones","author":"Jorge Luis Borges"}`, keys[auth.RoleEditor])
+
+	// readers can only shelve books the catalogue already has
+	w := requestWithKey(router, http.MethodPost, "/api/v1/users/"+user.Id+"/import?source=librarything", libraryThingExport, keys[auth.RoleReader])
+	assert.Equal(t, 200, w.Code)
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, 1, progress.Imported)
+	assert.Equal(t, 0, progress.Created)
+	assert.Len(t, progress.Errors, 1)
+	assert.Equal(t, 3, progress.Errors[0].Line)
+
+	// matched on title and the author flipped to first name first, half stars round up
+	var favourites []models.ReadingRecord
+	decodeData(t, requestWithKey(router, http.MethodGet, "/api/v1/users/"+user.Id+"/shelves/favourites", "", keys[auth.RoleReader]), &favourites)
+	assert.Len(t, favourites, 1)
+	assert.Equal(t, 4, favourites[0].Rating)
+	assert.Equal(t, "2021-02-01", favourites[0].StartedAt.Format("2006-01-02"))
+	assert.Empty(t, favourites[0].Status)
+}
+
+func TestImportHistoryCommand(t *testing.T) {
+	sequentialUUIDs(t)
+	path := filepath.Join(t.TempDir(), "goodreads_library_export.csv")
+	assert.NoError(t, os.WriteFile(path, []byte(goodreadsExport), 0o600))
+
+	var out bytes.Buffer
+	// the command line has its own database, so the user doesn't exist there
+	err := importer.RunImportCommand([]string{"-file", path, "-db", "memorydb", "-source", "goodreads", "-user", "ana"}, &out)
+	assert.ErrorContains(t, err, "unable to find user ana")
+
+	assert.Error(t, importer.RunImportCommand([]string{"-file", path, "-source", "goodreads"}, &out))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// posts a book with an Idempotency-Key, and optionally an API key
+func postWithIdempotencyKey(router http.Handler, body, key, apiKey string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/books", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotentCreateBook(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	first := postWithIdempotencyKey(router, `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}`, "retry-1", "")
+	assert.Equal(t, 200, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// the same body, give or take key order and whitespace, gets the first response back
+	retry := postWithIdempotencyKey(router, `{ "Author": "Jorge Luis Borges", "Title": "Labyrinths" }`, "retry-1", "")
+	assert.Equal(t, 200, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"))
+
+	var all []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &all)
+	assert.Len(t, all, 1)
+
+	// a different body can't reuse the key
+	w := postWithIdempotencyKey(router, `{"Title":"The Aleph","Author":"Jorge Luis Borges"}`, "retry-1", "")
+	assert.Equal(t, 422, w.Code)
+
+	// a new key is a new book
+	w = postWithIdempotencyKey(router, `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}`, "retry-2", "")
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, first.Body.String(), w.Body.String())
+
+	// rejected requests aren't kept, so the key can be used again once the body is fixed
+	w = postWithIdempotencyKey(router, `{"Title":"Ficciones"}`, "retry-3", "")
+	assert.Equal(t, 400, w.Code)
+	w = postWithIdempotencyKey(router, `{"Title":"Ficciones","Author":"Jorge Luis Borges"}`, "retry-3", "")
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+}
+
+// a database whose first insert fails
+type flakyInsertDB struct {
+	database.Database
+	failed *bool
+}
+
+func (db flakyInsertDB) Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error) {
+	if !*db.failed {
+		*db.failed = true
+		return models.Book{}, fmt.Errorf("dial tcp: %w", database.ErrUnavailable)
+	}
+	return db.Database.Insert(ctx, table, data)
+}
+
+func TestIdempotentCreateBookRetriesFailures(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(flakyInsertDB{Database: database.NewMemoryDB(nil), failed: new(bool)}, nil)
+	router := setupRouter(handler, true)
+
+	body := `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}`
+	first := postWithIdempotencyKey(router, body, "retry-1", "")
+	assert.Equal(t, 503, first.Code)
+
+	// the failure isn't replayed, the retry creates the book
+	retry := postWithIdempotencyKey(router, body, "retry-1", "")
+	assert.Equal(t, 200, retry.Code)
+	assert.Empty(t, retry.Header().Get("Idempotent-Replayed"))
+	var book models.Book
+	decodeData(t, retry, &book)
+	assert.NotEmpty(t, book.Id)
+
+	// and from then on it's the created book that's replayed
+	again := postWithIdempotencyKey(router, body, "retry-1", "")
+	assert.Equal(t, "true", again.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, retry.Body.String(), again.Body.String())
+}
+
+func TestIdempotencyKeysPerClient(t *testing.T) {
+	sequentialUUIDs(t)
+	_, keys := setupKeys(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	body := `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}`
+	first := postWithIdempotencyKey(router, body, "shared-key", keys[auth.RoleEditor])
+	assert.Equal(t, 200, first.Code)
+
+	// another caller using the same key isn't handed the first caller's response
+	other := postWithIdempotencyKey(router, body, "shared-key", keys[auth.RoleAdmin])
+	assert.Equal(t, 200, other.Code)
+	assert.Empty(t, other.Header().Get("Idempotent-Replayed"))
+	assert.NotEqual(t, first.Body.String(), other.Body.String())
+}
+
+func TestIdempotencyKeyBodyLimit(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	// the body is read whole to fingerprint it, so it's capped
+	body := `{"Title":"Labyrinths","Author":"Jorge Luis Borges"}` + strings.Repeat(" ", 1<<20)
+	w := postWithIdempotencyKey(router, body, "large", "")
+	assert.Equal(t, 413, w.Code)
+
+	assert.Equal(t, 200, postWithIdempotencyKey(router, strings.TrimSpace(body), "large", "").Code)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+const catalogueCSV = `Book Title,Writer,ISBN,Tags,Year,Shelf
+Ficciones,Jorge Luis Borges,9780802130303,Fiction; Short Stories,1944,A1
+The Aleph,,9780142437889,,1949,A1
+Labyrinths,Jorge Luis Borges,9780811216999,,nineteen sixty-two,A2
+Ficciones,Jorge Luis Borges,9780802130303,,1944,A3
+Dreamtigers,Jorge Luis Borges,,,1960,B1
+`
+
+// sends an upload as the raw request body
+func upload(router http.Handler, path, contentType, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestImportCSV(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	w := upload(router, "/api/v1/import?mapping=Book Title=title,Writer=author", "text/csv", catalogueCSV)
+	assert.Equal(t, 200, w.Code)
+
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, importer.StatusDone, progress.Status)
+	assert.Equal(t, 5, progress.Processed)
+	assert.Equal(t, 2, progress.Imported)
+	assert.Equal(t, 3, progress.Failed)
+
+	// lines count the header, so the first book is on line 2
+	lines := []int{}
+	for _, rowError := range progress.Errors {
+		lines = append(lines, rowError.Line)
+	}
+	assert.Equal(t, []int{3, 4, 5}, lines)
+	assert.Contains(t, progress.Errors[0].Error, "Author")
+	assert.Contains(t, progress.Errors[1].Error, "year")
+	assert.Contains(t, progress.Errors[2].Error, "ISBN")
+
+	var books []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &books)
+	assert.Len(t, books, 2)
+	assert.Equal(t, []string{"fiction", "short stories"}, books[0].Tags)
+	assert.Equal(t, 1944, books[0].Year)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.create", nil), &entries)
+	assert.Len(t, entries, 2)
+
+	// without the mapping there's no title or author column
+	w = upload(router, "/api/v1/import", "text/csv", catalogueCSV)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, 400, upload(router, "/api/v1/import?mapping=Writer=writer", "text/csv", catalogueCSV).Code)
+	assert.Equal(t, 400, upload(router, "/api/v1/import", "text/plain", catalogueCSV).Code)
+}
+
+func TestImportChecksWholeCatalogue(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(cappedDB{Database: database.NewMemoryDB(nil), limit: 0}, nil)
+	router := setupRouter(handler, true)
+
+	// books All doesn't return still hold their ISBNs
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303"})
+	assert.Equal(t, 200, w.Code)
+
+	w = upload(router, "/api/v1/import?mapping=Book Title=title,Writer=author", "text/csv", catalogueCSV)
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, 1, progress.Imported)
+	assert.Contains(t, progress.Errors[0].Error, "ISBN")
+	assert.Equal(t, 2, progress.Errors[0].Line)
+}
+
+func TestImportNDJSONInBackground(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	ndjson := `{"title":"Ficciones","author":"Jorge Luis Borges"}
+
+{"title":"The Aleph","author":"Jorge Luis Borges","year":1949}
+{"title":"Labyrinths"
+`
+	w := upload(router, "/api/v1/import?async=true", "application/x-ndjson", ndjson)
+	assert.Equal(t, 202, w.Code)
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, "/api/v1/import/"+progress.Id, w.Header().Get("Location"))
+
+	assert.Eventually(t, func() bool {
+		decodeData(t, doRequest(router, http.MethodGet, "/api/v1/import/"+progress.Id, nil), &progress)
+		return progress.Status == importer.StatusDone
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, progress.Imported)
+	assert.Equal(t, []importer.RowError{{Line: 4, Error: progress.Errors[0].Error}}, progress.Errors)
+	assert.NotNil(t, progress.FinishedAt)
+
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/import/unknown", nil).Code)
+}
+
+func TestImportMultipart(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "catalogue.csv")
+	part.Write([]byte("title,author\nFicciones,Jorge Luis Borges\n"))
+	form.Close()
+
+	w := upload(router, "/api/v1/import", form.FormDataContentType(), body.String())
+	assert.Equal(t, 200, w.Code)
+	var progress importer.Progress
+	decodeData(t, w, &progress)
+	assert.Equal(t, 1, progress.Imported)
+}
+
+func TestImportCommand(t *testing.T) {
+	sequentialUUIDs(t)
+	path := filepath.Join(t.TempDir(), "catalogue.csv")
+	assert.NoError(t, os.WriteFile(path, []byte(catalogueCSV), 0o600))
+
+	var out bytes.Buffer
+	err := importer.RunImportCommand([]string{"-file", path, "-db", "memorydb", "-map", "Book Title=title,Writer=author"}, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "line 3: ")
+	assert.Contains(t, out.String(), "imported 2 of 5 rows, 3 failed")
+
+	assert.Error(t, importer.RunImportCommand([]string{}, &out))
+}
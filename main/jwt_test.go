@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+)
+
+type testIssuer struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// serves the issuer's public keys as a JWKS and configures the API to trust it
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(server.Close)
+
+	t.Setenv("JWT_JWKS", server.URL)
+	t.Setenv("JWT_ISSUER", "https://sso.example.com")
+	t.Setenv("JWT_AUDIENCE", "gin-books-api")
+	t.Setenv("JWT_ROLE_MAP", "librarians=admin")
+
+	return &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func (ti *testIssuer) token(t *testing.T, alg string, claims map[string]any) string {
+	t.Helper()
+
+	kid := map[string]string{"RS256": "rsa-1", "ES256": "ec-1"}[alg]
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case "RS256":
+		s, err := rsa.SignPKCS1v15(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:])
+		assert.NoError(t, err)
+		sig = s
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, ti.ecKey, digest[:])
+		assert.NoError(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func validClaims(roles ...string) map[string]any {
+	return map[string]any{
+		"sub":   "user-123",
+		"iss":   "https://sso.example.com",
+		"aud":   []string{"gin-books-api"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": roles,
+	}
+}
+
+func requestWithToken(router *gin.Engine, method, path, body, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestJWTRoles(t *testing.T) {
+	issuer := newTestIssuer(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+	book := `{"Author":"Jorge Luis Borges","Title":"Labyrinths"}`
+
+	reader := issuer.token(t, "RS256", validClaims("reader"))
+	assert.Equal(t, 200, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", reader).Code)
+	assert.Equal(t, 403, requestWithToken(router, http.MethodPost, "/api/v1/books", book, reader).Code)
+
+	editor := issuer.token(t, "ES256", validClaims("editor"))
+	assert.Equal(t, 200, requestWithToken(router, http.MethodPost, "/api/v1/books", book, editor).Code)
+
+	// claim values can be mapped onto roles
+	librarian := issuer.token(t, "RS256", validClaims("librarians"))
+	assert.Equal(t, 200, requestWithToken(router, http.MethodDelete, "/api/v1/books/?title=Fictions", "", librarian).Code)
+
+	// the caller's identity is available to handlers
+	w := requestWithToken(router, http.MethodGet, "/api/v1/whoami", "", librarian)
+	var identity auth.Identity
+	decodeData(t, w, &identity)
+	assert.Equal(t, auth.Identity{Subject: "user-123", Issuer: "https://sso.example.com", Role: auth.RoleAdmin, Method: "jwt"}, identity)
+}
+
+func TestJWTRejected(t *testing.T) {
+	issuer := newTestIssuer(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataSingle), nil)
+	router := setupRouter(handler, true)
+
+	expired := validClaims("reader")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := validClaims("reader")
+	wrongAudience["aud"] = "another-api"
+	wrongIssuer := validClaims("reader")
+	wrongIssuer["iss"] = "https://evil.example.com"
+	noExpiry := validClaims("reader")
+	delete(noExpiry, "exp")
+
+	for name, token := range map[string]string{
+		"expired":        issuer.token(t, "RS256", expired),
+		"wrong audience": issuer.token(t, "RS256", wrongAudience),
+		"wrong issuer":   issuer.token(t, "RS256", wrongIssuer),
+		"no expiry":      issuer.token(t, "RS256", noExpiry),
+		"garbage":        "not.a.token",
+	} {
+		w := requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", token)
+		assert.Equal(t, 401, w.Code, name)
+		assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Bearer", name)
+	}
+
+	// a valid token with its payload swapped fails the signature check
+	valid := issuer.token(t, "RS256", validClaims("reader"))
+	admin := issuer.token(t, "RS256", validClaims("admin"))
+	tampered := admin[:lastDot(admin)] + valid[lastDot(valid):]
+	assert.Equal(t, 401, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", tampered).Code)
+
+	// a token without any recognised role is authenticated but can't do anything
+	noRole := issuer.token(t, "RS256", validClaims("guests"))
+	assert.Equal(t, 403, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", noRole).Code)
+}
+
+func lastDot(s string) int {
+	return strings.LastIndex(s, ".")
+}
+
+func TestJWTRequiresIssuerAndAudience(t *testing.T) {
+	issuer := newTestIssuer(t)
+	jwks, err := auth.NewJWKS(os.Getenv("JWT_JWKS"))
+	assert.NoError(t, err)
+
+	// a verifier missing either check refuses every token rather than skipping it
+	token := issuer.token(t, "RS256", validClaims("reader"))
+	for name, config := range map[string]auth.JWTConfig{
+		"no issuer":   {Audience: "gin-books-api"},
+		"no audience": {Issuer: "https://sso.example.com"},
+	} {
+		_, err := auth.NewJWTVerifier(jwks, config).Verify(token)
+		assert.Error(t, err, name)
+	}
+
+	_, err = auth.NewJWTVerifier(jwks, auth.JWTConfig{Issuer: "https://sso.example.com", Audience: "gin-books-api"}).Verify(token)
+	assert.NoError(t, err)
+}
+
+func TestJWKSSkipsUnusableKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	// an Ed25519 key and a broken one sit alongside the RSA key the tokens are signed with
+	var fetches atomic.Int64
+	jwks := map[string]any{"keys": []map[string]string{
+		{"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": b64(make([]byte, 32))},
+		{"kty": "EC", "kid": "ec-broken", "crv": "P-256", "x": b64([]byte{1}), "y": b64([]byte{2})},
+		{"kty": "RSA", "kid": "rsa-1", "n": b64(issuer.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(issuer.rsaKey.E)).Bytes())},
+	}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("JWT_JWKS", server.URL)
+
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(seedDataSingle), nil), true)
+	token := issuer.token(t, "RS256", validClaims("reader"))
+	assert.Equal(t, 200, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", token).Code)
+
+	// tokens for unknown keys don't refetch the set again straight away
+	unknown := issuer.token(t, "ES256", validClaims("reader"))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 401, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", unknown).Code)
+	}
+	assert.Equal(t, int64(1), fetches.Load())
+}
+
+func TestJWKSRejectsWeakRSAKeys(t *testing.T) {
+	issuer := newTestIssuer(t)
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	// the exponent 2^64+65537 used to be truncated to 65537, passing for the real key
+	overflow := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(int64(issuer.rsaKey.E)))
+	for name, key := range map[string]map[string]string{
+		"short modulus":      {"kty": "RSA", "kid": "rsa-1", "n": b64(weak.N.Bytes()), "e": b64(big.NewInt(int64(weak.E)).Bytes())},
+		"oversized exponent": {"kty": "RSA", "kid": "rsa-1", "n": b64(issuer.rsaKey.N.Bytes()), "e": b64(overflow.Bytes())},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the EC key keeps the set usable, startup fails without one
+			jwks := map[string]any{"keys": []map[string]string{key, {
+				"kty": "EC", "kid": "ec-1", "crv": "P-256",
+				"x": b64(issuer.ecKey.X.FillBytes(make([]byte, 32))), "y": b64(issuer.ecKey.Y.FillBytes(make([]byte, 32))),
+			}}}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(jwks)
+			}))
+			t.Cleanup(server.Close)
+			t.Setenv("JWT_JWKS", server.URL)
+
+			signer := *issuer
+			if name == "short modulus" {
+				signer.rsaKey = weak
+			}
+			router := setupRouter(controllers.NewHandler(database.NewMemoryDB(seedDataSingle), nil), true)
+			token := signer.token(t, "RS256", validClaims("reader"))
+			assert.Equal(t, 401, requestWithToken(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", "", token).Code)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// creates a book and n users, returning their ids
+func seedLibrary(t *testing.T, router *gin.Engine, users int) (string, []string) {
+	t.Helper()
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &book)
+
+	userIds := []string{}
+	for i := 0; i < users; i++ {
+		var user models.User
+		decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "reader"}), &user)
+		userIds = append(userIds, user.Id)
+	}
+
+	return book.Id, userIds
+}
+
+func TestConcurrentCheckoutOfOneCopy(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	bookId, users := seedLibrary(t, router, 20)
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/copies", models.InsertCopyInput{Barcode: "0001"})
+	assert.Equal(t, 200, w.Code)
+
+	// every user races for the single copy, exactly one of them gets it
+	var wg sync.WaitGroup
+	codes := make(chan int, len(users))
+	for _, userId := range users {
+		wg.Add(1)
+		go func(userId string) {
+			defer wg.Done()
+			w := doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/checkouts", models.CheckoutInput{UserId: userId})
+			codes <- w.Code
+		}(userId)
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	assert.Equal(t, map[int]int{200: 1, 409: len(users) - 1}, counts)
+
+	var copies []models.Copy
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+bookId+"/copies", nil), &copies)
+	assert.Equal(t, models.CopyOnLoan, copies[0].Status)
+}
+
+func TestHoldsAreFulfilledInOrder(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	bookId, users := seedLibrary(t, router, 3)
+	borrower, first, second := users[0], users[1], users[2]
+	doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/copies", nil)
+
+	var checkout models.Checkout
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/checkouts", models.CheckoutInput{UserId: borrower}), &checkout)
+
+	for _, userId := range []string{first, second} {
+		w := doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/holds", models.HoldInput{UserId: userId})
+		assert.Equal(t, 200, w.Code)
+	}
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/holds", models.HoldInput{UserId: first})
+	assert.Equal(t, 409, w.Code)
+
+	w = doRequest(router, http.MethodPost, "/api/v1/checkouts/"+checkout.Id+"/return", nil)
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/checkouts/"+checkout.Id+"/return", nil)
+	assert.Equal(t, 409, w.Code)
+
+	// the returned copy is reserved for the first hold, so the second user can't take it
+	var holds []models.Hold
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+bookId+"/holds", nil), &holds)
+	assert.Equal(t, first, holds[0].UserId)
+	assert.Equal(t, models.HoldReady, holds[0].Status)
+	assert.Equal(t, models.HoldWaiting, holds[1].Status)
+
+	w = doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/checkouts", models.CheckoutInput{UserId: second})
+	assert.Equal(t, 409, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/checkouts", models.CheckoutInput{UserId: first})
+	assert.Equal(t, 200, w.Code)
+
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+bookId+"/holds", nil), &holds)
+	assert.Len(t, holds, 1)
+	assert.Equal(t, second, holds[0].UserId)
+}
+
+func TestOverdueCheckouts(t *testing.T) {
+	sequentialUUIDs(t)
+	db := database.NewMemoryDB(nil)
+	handler := controllers.NewHandler(db, nil)
+	router := setupRouter(handler, true)
+
+	bookId, users := seedLibrary(t, router, 2)
+	doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/copies", nil)
+	doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/copies", nil)
+
+	// one loan is already past due, the other uses the default loan period
+	late, err := db.Checkout(context.Background(), bookId, users[0], time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+bookId+"/checkouts", models.CheckoutInput{UserId: users[1]})
+	assert.Equal(t, 200, w.Code)
+
+	var overdue []models.Checkout
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/checkouts/overdue", nil), &overdue)
+	assert.Len(t, overdue, 1)
+	assert.Equal(t, late.Id, overdue[0].Id)
+}
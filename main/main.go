@@ -9,8 +9,12 @@ import (
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/garbhank/gin-books-api/auth"
 	"github.com/garbhank/gin-books-api/controllers"
 	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/idempotency"
+	"github.com/garbhank/gin-books-api/importer"
+	"github.com/garbhank/gin-books-api/ratelimit"
 	"github.com/garbhank/gin-books-api/utils"
 	"github.com/gin-contrib/cache"
 	"github.com/gin-contrib/cache/persistence"
@@ -23,8 +27,49 @@ func init() {
 	}
 }
 
+// when v1 was deprecated in favour of v2, and when it's due to be turned off
+// unless API_V1_SUNSET says otherwise
+var (
+	v1Deprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	v1Sunset     = time.Date(2027, time.June, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// where rate limits are counted. RATE_LIMIT_MEMCACHED lists memcached servers as
+// comma separated host:port pairs, and every instance counting there shares the
+// limits. Without it each instance counts its own, in process
+var rateLimitStore = func() persistence.CacheStore {
+	servers := []string{}
+	for _, server := range strings.Split(os.Getenv("RATE_LIMIT_MEMCACHED"), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+	log.Infof("Counting rate limits in memcached at %v", servers)
+	return persistence.NewMemcachedStore(servers, time.Minute)
+}
+
+// the comma separated addresses and CIDR ranges in TRUSTED_PROXIES, none by default
+func trustedProxies() []string {
+	proxies := []string{}
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
 func setupRouter(handler *controllers.Handler, noCache bool) *gin.Engine {
 	r := gin.Default()
+	// client addresses are only taken from X-Forwarded-For when it's set by a proxy
+	// listed in TRUSTED_PROXIES, so anonymous clients can't dodge the rate limits
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	r.Use(controllers.RequestId(), controllers.ConditionalGet(), controllers.Negotiate())
 
 	// cache endpoints which calls the Firestore db
 	store := persistence.NewInMemoryStore(time.Second)
@@ -32,6 +77,7 @@ func setupRouter(handler *controllers.Handler, noCache bool) *gin.Engine {
 
 	var (
 		handleGetAllBooks,
+		handleListBooks,
 		handleFindAuthor,
 		handleFindBook func(c *gin.Context)
 	)
@@ -40,30 +86,178 @@ func setupRouter(handler *controllers.Handler, noCache bool) *gin.Engine {
 	if noCache {
 		log.Info("Setting up router with caching disabled...")
 		handleGetAllBooks = handler.GetAllBooks
+		handleListBooks = handler.ListBooks
 		handleFindAuthor = handler.FindAuthor
 		handleFindBook = handler.FindBook
 	} else {
 		log.Info("Setting up router with caching enabled...")
-		handleGetAllBooks = cache.CachePage(store, ttl, handler.GetAllBooks)
-		handleFindAuthor = cache.CachePage(store, ttl, handler.FindAuthor)
-		handleFindBook = cache.CachePage(store, ttl, handler.FindBook)
+		handleGetAllBooks = cachePage(store, ttl, handler.GetAllBooks)
+		handleListBooks = cachePage(store, ttl, handler.ListBooks)
+		handleFindAuthor = cachePage(store, ttl, handler.FindAuthor)
+		handleFindBook = cachePage(store, ttl, handler.FindBook)
 	}
 
-	v1 := r.Group("/api/v1")
+	// API keys and bearer tokens gate every route except the root and ping
+	authn := auth.FromEnv()
+
+	// per-client rate limits, shared between instances when they count in memcached.
+	// limitAddress runs before credentials are checked, so bad ones are throttled too
+	limitStore := rateLimitStore()
+	limitAddress := ratelimit.New("address", ratelimit.PolicyFromEnv("RATE_LIMIT_ADDRESS", "1200/min"), limitStore).AddressHandler()
+	limitAll := ratelimit.New("all", ratelimit.PolicyFromEnv("RATE_LIMIT_DEFAULT", "600/min"), limitStore).Handler()
+	limitCreate := ratelimit.New("create", ratelimit.PolicyFromEnv("RATE_LIMIT_CREATE", "30/min,1000/day"), limitStore).Handler()
+	limitDelete := ratelimit.New("delete", ratelimit.PolicyFromEnv("RATE_LIMIT_DELETE", "10/min"), limitStore).Handler()
+
+	// responses to POST /books are kept for IDEMPOTENCY_TTL_MIN so retries with the same Idempotency-Key replay them
+	idempotencyWindow := time.Minute * time.Duration(utils.GetEnvInt("IDEMPOTENCY_TTL_MIN", 24*60))
+	idempotent := idempotency.New(store, idempotencyWindow).Handler()
+
+	// requests are checked against openapi/openapi.json before they reach a handler
+	validate := controllers.ValidateRequests()
+
+	// v1 stays up alongside v2 until its sunset, API_V1_SUNSET as a date
+	sunset := v1Sunset
+	if at, err := time.Parse(time.DateOnly, os.Getenv("API_V1_SUNSET")); err == nil {
+		sunset = at
+	}
+	v1 := r.Group("/api/v1", controllers.DeprecatedV1(v1Deprecated, sunset))
+	v2 := r.Group("/api/v2", controllers.Envelope())
+
+	// registers the routes both versions share, returning the groups for each
+	// role so a version can add its own
+	shared := func(api *gin.RouterGroup) (reader, editor, admin *gin.RouterGroup) {
+		api.GET("/", handler.Root)
+		api.GET("/ping", handler.Ping)
+		api.GET("/openapi.json", handler.OpenAPI)
+		api.GET("/docs", handler.SwaggerUI)
+
+		// readers can browse the catalogue and manage their own reviews, shelves and loans,
+		// acting only as the user linked to their identity
+		reader = api.Group("", limitAddress, authn.Require(auth.RoleReader), limitAll, validate)
+		{
+			reader.GET("/whoami", handler.Whoami)
+			reader.GET("/books/duplicates", handler.GetDuplicates)
+			reader.GET("/export", handler.ExportBooks)
+			reader.GET("/opds", handler.OPDSRoot)
+			reader.GET("/opds/new", handler.OPDSNew)
+			reader.GET("/opds/popular", handler.OPDSPopular)
+			reader.GET("/opds/authors", handler.OPDSAuthors)
+			reader.GET("/opds/author", handler.OPDSAuthor)
+			reader.GET("/opds/search", handler.OPDSSearch)
+			reader.GET("/opds/opensearch.xml", handler.OPDSOpenSearch)
+			reader.GET("/books/:id", handler.GetBook)
+			reader.GET("/books/:id/revisions", handler.GetRevisions)
+			reader.GET("/books/:id/reviews", handler.GetReviews)
+			reader.POST("/books/:id/reviews", handler.CreateReview)
+			reader.GET("/books/:id/copies", handler.GetCopies)
+			reader.POST("/books/:id/checkouts", handler.CheckoutBook)
+			reader.GET("/books/:id/holds", handler.GetHolds)
+			reader.POST("/books/:id/holds", handler.PlaceHold)
+
+			reader.GET("/works/:id/editions", handler.GetWorkEditions)
+			reader.GET("/series/:id/works", handler.GetSeriesWorks)
+			reader.GET("/genres", handler.GetGenres)
+
+			reader.GET("/users/:id", handler.GetUser)
+			reader.GET("/users/:id/shelves", handler.GetShelves)
+			reader.POST("/users/:id/shelves", handler.CreateShelf)
+			reader.GET("/users/:id/shelves/:shelf", handler.GetShelf)
+			reader.PUT("/users/:id/shelves/:shelf/books/:book_id", handler.ShelveBook)
+			reader.DELETE("/users/:id/shelves/:shelf/books/:book_id", handler.UnshelveBook)
+			reader.POST("/users/:id/import", limitCreate, handler.ImportHistory)
+			reader.GET("/import/:id", handler.GetImport)
+
+			reader.GET("/checkouts/overdue", handler.GetOverdue)
+			reader.POST("/checkouts/:id/return", handler.ReturnBook)
+		}
+
+		// editors maintain the catalogue
+		editor = api.Group("", limitAddress, authn.Require(auth.RoleEditor), limitAll, validate)
+		{
+			// custom methods like /books:batch, gin matches them as a parameter
+			editor.POST("/books", limitCreate, idempotent, handler.CreateBook)
+			editor.POST("/books:action", limitCreate, handler.BookAction)
+			editor.POST("/import", limitCreate, handler.ImportBooks)
+			editor.PUT("/books/:id/tags/:tag", handler.AddTag)
+			editor.DELETE("/books/:id/tags/:tag", handler.RemoveTag)
+			editor.PUT("/books/:id/genre", handler.SetBookGenre)
+			editor.POST("/books/:id/revisions/:revision/revert", handler.RevertBook)
+			editor.POST("/books/:id/copies", handler.CreateCopy)
+
+			editor.POST("/works", handler.CreateWork)
+			editor.POST("/series", handler.CreateSeries)
+			editor.POST("/genres", handler.CreateGenre)
+			editor.POST("/users", handler.CreateUser)
+		}
+
+		// only admins can delete and restore books and read the audit trail
+		admin = api.Group("", limitAddress, authn.Require(auth.RoleAdmin), limitAll, validate)
+		{
+			admin.GET("/audit", handler.GetAudit)
+			admin.GET("/trash", handler.GetTrash)
+			admin.DELETE("/books/:id", limitDelete, handler.DeleteBookById)
+			admin.POST("/books/:id/restore", handler.RestoreBook)
+		}
+		return reader, editor, admin
+	}
+
+	// v1 selects books with query parameters
+	reader, _, admin := shared(v1)
+	{
+		reader.GET("/books/", handleGetAllBooks)
+		reader.GET("/books/author/", handleFindAuthor)
+		reader.GET("/books/title/", handleFindBook)
+		admin.DELETE("/books/", limitDelete, handler.DeleteBook)
+	}
+
+	// where v2 filters the collection instead
+	reader, _, _ = shared(v2)
 	{
-		v1.GET("/", handler.Root)
-		v1.GET("/ping", handler.Ping)
-		v1.GET("/books/", handleGetAllBooks)
-		v1.GET("/books/author/", handleFindAuthor)
-		v1.GET("/books/title/", handleFindBook)
-		v1.POST("/books", handler.CreateBook)
-		v1.DELETE("/books/", handler.DeleteBook)
+		reader.GET("/books", handleListBooks)
 	}
 
 	return r
 }
 
+// caches a page by its URL. Responses picked by the Accept header rather than
+// ?format= would share a key with the JSON, so they're never cached
+func cachePage(store persistence.CacheStore, ttl time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
+	cached := cache.CachePage(store, ttl, handle)
+	return func(c *gin.Context) {
+		if controllers.Negotiated(c) {
+			handle(c)
+			return
+		}
+		cached(c)
+	}
+}
+
 func main() {
+	// "keys" manages API keys, "import" loads a catalogue file and "openapi" prints the
+	// API's description, rather than starting the server
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := auth.RunKeysCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := importer.RunImportCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// "openapi" prints the API's description, generated from the routes
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		gin.SetMode(gin.ReleaseMode)
+		r := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+		if err := controllers.WriteOpenAPI(os.Stdout, r.Routes()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// parse database environment variables
 	var primary, secondary string // 'memory', 'firestore', or 'postgres'
 	if v := os.Getenv("PRIMARY_DB"); v != "" {
@@ -109,6 +303,11 @@ func main() {
 	handler := controllers.NewHandler(primaryDB, secondaryDB)
 	r := setupRouter(handler, noCache)
 
+	// deleted books stay in the trash for TRASH_RETENTION_DAYS, 0 keeps them forever
+	retention := time.Duration(utils.GetEnvInt("TRASH_RETENTION_DAYS", 30)) * 24 * time.Hour
+	stopPurge := handler.StartTrashPurge(retention, time.Hour)
+	defer stopPurge()
+
 	err = r.Run(":8080")
 	if err != nil {
 		return
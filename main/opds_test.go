@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/opds"
+)
+
+// the parts of a feed the tests look at, read the way an OPDS client would
+type testFeed struct {
+	Total   int         `xml:"http://a9.com/-/spec/opensearch/1.1/ totalResults"`
+	Links   []opds.Link `xml:"http://www.w3.org/2005/Atom link"`
+	Entries []struct {
+		Title      string      `xml:"http://www.w3.org/2005/Atom title"`
+		Identifier string      `xml:"http://purl.org/dc/terms/ identifier"`
+		Issued     string      `xml:"http://purl.org/dc/terms/ issued"`
+		Links      []opds.Link `xml:"http://www.w3.org/2005/Atom link"`
+	} `xml:"http://www.w3.org/2005/Atom entry"`
+}
+
+func (f testFeed) link(rel string) string {
+	for _, link := range f.Links {
+		if link.Rel == rel {
+			return link.Href
+		}
+	}
+	return ""
+}
+
+func (f testFeed) titles() []string {
+	titles := []string{}
+	for _, entry := range f.Entries {
+		titles = append(titles, entry.Title)
+	}
+	return titles
+}
+
+func getFeed(t *testing.T, router http.Handler, path, contentType string) testFeed {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+
+	var feed testFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("unable to decode feed %q: %v", w.Body.String(), err)
+	}
+	return feed
+}
+
+func TestOPDSFeeds(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	var ficciones, aleph models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303", Year: 1944, Tags: []string{"fiction"}}), &ficciones)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "The Aleph", Author: "Jorge Luis Borges", Year: 1949}), &aleph)
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Pale Fire", Author: "Vladimir Nabokov", Year: 1962})
+	for _, rating := range []int{5, 4} {
+		doRequest(router, http.MethodPost, "/api/v1/books/"+aleph.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: rating})
+	}
+	doRequest(router, http.MethodPost, "/api/v1/books/"+ficciones.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: 5})
+
+	root := getFeed(t, router, "/api/v1/opds", opds.NavigationType)
+	assert.Equal(t, []string{"New", "Popular", "Authors"}, root.titles())
+	assert.Equal(t, "/api/v1/opds/new", root.link(opds.RelSortNew))
+	assert.Equal(t, "/api/v1/opds/popular", root.link(opds.RelSortPopular))
+	assert.Equal(t, "/api/v1/opds/opensearch.xml", root.link("search"))
+
+	newest := getFeed(t, router, "/api/v1/opds/new", opds.AcquisitionType)
+	assert.Equal(t, []string{"Pale Fire", "The Aleph", "Ficciones"}, newest.titles())
+	assert.Equal(t, 3, newest.Total)
+
+	popular := getFeed(t, router, "/api/v1/opds/popular", opds.AcquisitionType)
+	assert.Equal(t, []string{"The Aleph", "Ficciones", "Pale Fire"}, popular.titles())
+
+	authors := getFeed(t, router, "/api/v1/opds/authors", opds.NavigationType)
+	assert.Equal(t, []string{"Jorge Luis Borges", "Vladimir Nabokov"}, authors.titles())
+	href := authors.Entries[0].Links[0].Href
+	assert.Equal(t, "/api/v1/opds/author?name=Jorge+Luis+Borges", href)
+
+	borges := getFeed(t, router, href, opds.AcquisitionType)
+	assert.Equal(t, []string{"Ficciones", "The Aleph"}, borges.titles())
+	entry := borges.Entries[0]
+	assert.Equal(t, "urn:isbn:9780802130303", entry.Identifier)
+	assert.Equal(t, "1944", entry.Issued)
+	assert.Contains(t, entry.Links, opds.Link{Rel: opds.RelBorrow, Href: "/api/v1/books/" + ficciones.Id + "/checkouts", Type: "application/json"})
+
+	search := getFeed(t, router, "/api/v1/opds/search?q=PALE", opds.AcquisitionType)
+	assert.Equal(t, []string{"Pale Fire"}, search.titles())
+
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/opds/search", nil).Code)
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/opds/author", nil).Code)
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/opds/new?page=0", nil).Code)
+}
+
+func TestOPDSPagination(t *testing.T) {
+	sequentialUUIDs(t)
+	// the feeds cover the whole catalogue, not just what All returns
+	router := setupRouter(controllers.NewHandler(cappedDB{Database: database.NewMemoryDB(nil), limit: 10}, nil), true)
+
+	for i := 1; i <= 30; i++ {
+		doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: fmt.Sprintf("Book %02d", i), Author: "Anon", Year: 1900 + i})
+	}
+
+	first := getFeed(t, router, "/api/v1/opds/author?name=Anon", opds.AcquisitionType)
+	assert.Len(t, first.Entries, 25)
+	assert.Equal(t, 30, first.Total)
+	assert.Equal(t, "/api/v1/opds/author?name=Anon&page=1", first.link("self"))
+	assert.Equal(t, "/api/v1/opds/author?name=Anon&page=2", first.link("next"))
+	assert.Equal(t, "/api/v1/opds/author?name=Anon&page=2", first.link("last"))
+	assert.Equal(t, "", first.link("previous"))
+
+	second := getFeed(t, router, first.link("next"), opds.AcquisitionType)
+	assert.Equal(t, []string{"Book 26", "Book 27", "Book 28", "Book 29", "Book 30"}, second.titles())
+	assert.Equal(t, "/api/v1/opds/author?name=Anon&page=1", second.link("previous"))
+	assert.Equal(t, "", second.link("next"))
+
+	// past the end is an empty page that leads back
+	beyond := getFeed(t, router, "/api/v1/opds/new?page=9", opds.AcquisitionType)
+	assert.Empty(t, beyond.Entries)
+	assert.Equal(t, "/api/v1/opds/new?page=2", beyond.link("previous"))
+
+	for _, path := range []string{"/api/v1/opds/new", "/api/v1/opds/popular", "/api/v1/opds/search?q=book"} {
+		assert.Equal(t, 30, getFeed(t, router, path, opds.AcquisitionType).Total, path)
+	}
+	newest := getFeed(t, router, "/api/v1/opds/new", opds.AcquisitionType)
+	assert.Equal(t, "Book 30", newest.Entries[0].Title)
+	authors := getFeed(t, router, "/api/v1/opds/authors", opds.NavigationType)
+	assert.Equal(t, 1, authors.Total)
+}
+
+func TestOPDSOpenSearch(t *testing.T) {
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://books.example/api/v1/opds/opensearch.xml", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, opds.OpenSearchType, w.Header().Get("Content-Type"))
+
+	var description opds.OpenSearchDescription
+	assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &description))
+	assert.Equal(t, opds.AcquisitionType, description.Url.Type)
+	assert.Equal(t, "http://books.example/api/v1/opds/search?q={searchTerms}&page={startPage?}", description.Url.Template)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/openapi"
+)
+
+// the published spec has to be regenerated whenever a route or model changes
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	var generated bytes.Buffer
+	if err := controllers.WriteOpenAPI(&generated, router.Routes()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated.Bytes(), openapi.Spec) {
+		t.Fatal("openapi/openapi.json doesn't match the routes, regenerate it with: go run main/main.go openapi > openapi/openapi.json")
+	}
+
+	// a route without a description can't be published
+	router.GET("/api/v1/undescribed", func(c *gin.Context) {})
+	_, err := controllers.GenerateOpenAPI(router.Routes())
+	assert.ErrorContains(t, err, "GET /api/v1/undescribed")
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/openapi.json", nil)
+	assert.Equal(t, 200, w.Code)
+	var doc openapi.Document
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+
+	// request bodies come from the models, binding tags and all
+	create := doc.Paths["/api/v1/books"]["post"]
+	assert.Equal(t, "#/components/schemas/InsertBookInput", create.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, []string{"title", "author"}, doc.Components.Schemas["InsertBookInput"].Required)
+	rating := doc.Components.Schemas["InsertReviewInput"].Properties["rating"]
+	assert.Equal(t, 1.0, *rating.Minimum)
+	assert.Equal(t, 5.0, *rating.Maximum)
+	assert.Equal(t, "email", doc.Components.Schemas["InsertUserInput"].Properties["email"].Format)
+
+	assert.Contains(t, doc.Paths, "/api/v1/books/{id}/revisions/{revision}/revert")
+	assert.Contains(t, doc.Paths, "/api/v1/books:batch")
+
+	w = doRequest(router, http.MethodGet, "/api/v1/docs", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `url: "openapi.json"`)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// a database whose listings fail with err
+type failingDB struct {
+	database.Database
+	err error
+}
+
+func (db failingDB) All(ctx context.Context, table string) ([]models.Book, error) {
+	return nil, db.err
+}
+
+// a database whose inserts fail with err
+type failingInsertDB struct {
+	database.Database
+	err error
+}
+
+func (db failingInsertDB) Insert(ctx context.Context, table string, data models.InsertBookInput) (models.Book, error) {
+	return models.Book{}, db.err
+}
+
+func TestProblemDetails(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("DUPLICATE_POLICY", "reject")
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	decode := func(body []byte) map[string]any {
+		var p map[string]any
+		assert.NoError(t, json.Unmarshal(body, &p))
+		return p
+	}
+
+	// every error is a problem carrying a code and the request's id
+	w := requestWithHeader(router, http.MethodGet, "/api/v1/books/unknown", "X-Request-Id", "trace-1")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Equal(t, map[string]any{
+		"type":       "urn:gin-books-api:problem:not_found",
+		"title":      "Not Found",
+		"status":     404.0,
+		"code":       "not_found",
+		"detail":     "No book found with that id",
+		"instance":   "/api/v1/books/unknown",
+		"request_id": "trace-1",
+	}, decode(w.Body.Bytes()))
+
+	// the conflicts callers handle get codes of their own, and keep their extra members
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges"}), &book)
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 409, w.Code)
+	conflict := decode(w.Body.Bytes())
+	assert.Equal(t, "duplicate_book", conflict["code"])
+	assert.Equal(t, book.Id, conflict["id"])
+}
+
+func TestDatabaseErrorStatuses(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{fmt.Errorf("dial tcp: %w", database.ErrUnavailable), 503, problem.Unavailable},
+		{&pq.Error{Code: "08006"}, 503, problem.Unavailable},
+		{context.DeadlineExceeded, 503, problem.Unavailable},
+		{fmt.Errorf("error while performing query: %w", &pq.Error{Code: "22P02", Message: `invalid input syntax for type integer: "secret"`}), 400, problem.InvalidArgument},
+		{fmt.Errorf("error while performing query: %w", &pq.Error{Code: "42P01", Message: `relation "secret_books" does not exist`}), 500, problem.Internal},
+		{&pq.Error{Code: "23505"}, 409, problem.Conflict},
+		{fmt.Errorf("error while performing query: %w", &pq.Error{Code: "23505", Constraint: "books_isbn_idx"}), 409, "duplicate_isbn"},
+		{database.ErrNotFound, 404, problem.NotFound},
+		{errors.New("disk on fire"), 500, problem.Internal},
+	}
+
+	for _, test := range tests {
+		handler := controllers.NewHandler(failingDB{Database: database.NewMemoryDB(nil), err: test.err}, nil)
+		w := doRequest(setupRouter(handler, true), http.MethodGet, "/api/v1/books/?table=books", nil)
+		assert.Equal(t, test.status, w.Code, test.err.Error())
+
+		var p problem.Problem
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		assert.Equal(t, test.code, p.Code, test.err.Error())
+		if test.status == 503 {
+			assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		}
+		// what went wrong inside isn't given away
+		if test.status == 500 {
+			assert.Equal(t, "Unable to complete query", p.Detail)
+		}
+		if test.status == 400 {
+			assert.Equal(t, "The database can't take that request", p.Detail)
+		}
+	}
+}
+
+func TestCreateBookDatabaseError(t *testing.T) {
+	db := database.NewMemoryDB(nil)
+	handler := controllers.NewHandler(failingInsertDB{Database: db, err: fmt.Errorf("dial tcp: %w", database.ErrUnavailable)}, nil)
+	router := setupRouter(handler, true)
+
+	// a failed insert is reported rather than answered with an empty book
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges"})
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("ETag"))
+
+	// and nothing was audited as created
+	entries, err := db.GetAuditEntries(context.Background(), models.AuditFilter{})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestRateLimitCreateBook(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("RATE_LIMIT_CREATE", "2/min")
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	titles := []string{"Labyrinths", "The Aleph", "Ficciones"}
+	codes := []int{}
+	for _, title := range titles {
+		w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: title, Author: "Jorge Luis Borges"})
+		codes = append(codes, w.Code)
+
+		if title == "Labyrinths" {
+			assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+			assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+			assert.Equal(t, "2;w=60", w.Header().Get("RateLimit-Policy"))
+		}
+		if title == "Ficciones" {
+			assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+			assert.NotEmpty(t, w.Header().Get("Retry-After"))
+			assert.NotEqual(t, "0", w.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, []int{200, 200, 429}, codes)
+
+	// the limit is per route, reads carry on as normal
+	w := doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestRateLimitPerAPIKey(t *testing.T) {
+	sequentialUUIDs(t)
+	_, keys := setupKeys(t)
+	t.Setenv("RATE_LIMIT_DEFAULT", "2/min")
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/books/?table=books", "", keys[auth.RoleReader]).Code)
+	}
+	w := requestWithKey(router, http.MethodGet, "/api/v1/books/?table=books", "", keys[auth.RoleReader])
+	assert.Equal(t, 429, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// another key has its own bucket
+	assert.Equal(t, 200, requestWithKey(router, http.MethodGet, "/api/v1/books/?table=books", "", keys[auth.RoleEditor]).Code)
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	_, keys := setupKeys(t)
+	t.Setenv("RATE_LIMIT_ADDRESS", "2/min")
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	// guesses at a key count against the address, so a valid key from it waits too
+	codes := []int{}
+	for _, key := range []string{"guess-1", "guess-2", keys[auth.RoleReader]} {
+		codes = append(codes, requestWithKey(router, http.MethodGet, "/api/v1/genres", "", key).Code)
+	}
+	assert.Equal(t, []int{401, 401, 429}, codes)
+}
+
+func TestRateLimitShared(t *testing.T) {
+	// counted in a cache store the way they would be in memcached
+	original := rateLimitStore
+	rateLimitStore = func() persistence.CacheStore { return persistence.NewInMemoryStore(time.Minute) }
+	t.Cleanup(func() { rateLimitStore = original })
+	t.Setenv("RATE_LIMIT_DELETE", "1/min,5/day")
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	w := doRequest(router, http.MethodDelete, "/api/v1/books/uuid-does-not-exist", nil)
+	assert.NotEqual(t, 429, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "1;w=60, 5;w=86400", w.Header().Get("RateLimit-Policy"))
+
+	w = doRequest(router, http.MethodDelete, "/api/v1/books/uuid-does-not-exist", nil)
+	assert.Equal(t, 429, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// the default policy is counted separately from the delete policy
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestRateLimitIgnoresForwardedFor(t *testing.T) {
+	t.Setenv("RATE_LIMIT_DEFAULT", "2/min")
+
+	get := func(router http.Handler, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/genres", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// a client can't get a fresh bucket by making up addresses
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+	codes := []int{}
+	for _, address := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		codes = append(codes, get(router, address))
+	}
+	assert.Equal(t, []int{200, 200, 429}, codes)
+
+	// but the addresses a trusted proxy passes on are used
+	t.Setenv("TRUSTED_PROXIES", "192.0.2.0/24")
+	router = setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+	codes = []int{}
+	for _, address := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		codes = append(codes, get(router, address))
+	}
+	assert.Equal(t, []int{200, 200, 200}, codes)
+}
+
+func TestRateLimitStoreFromEnv(t *testing.T) {
+	assert.Nil(t, rateLimitStore())
+
+	t.Setenv("RATE_LIMIT_MEMCACHED", "cache-1:11211, cache-2:11211")
+	assert.IsType(t, &persistence.MemcachedStore{}, rateLimitStore())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+	"gopkg.in/yaml.v3"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestContentNegotiation(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges", ISBN: "9780802130303", Tags: []string{"fiction", "short stories"}, Year: 1944}), &book)
+	doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: 4})
+
+	t.Run("xml", func(t *testing.T) {
+		w := requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "application/xml")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/xml", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), "<response>\n  <data>\n    <id>"+book.Id+"</id>\n    <title>Ficciones</title>")
+
+		var response struct {
+			Data struct {
+				Title  string   `xml:"title"`
+				Tags   []string `xml:"tags>item"`
+				Year   int      `xml:"year"`
+				Rating struct {
+					Count int `xml:"count"`
+				} `xml:"rating"`
+			} `xml:"data"`
+		}
+		assert.NoError(t, xml.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, "Ficciones", response.Data.Title)
+		assert.Equal(t, []string{"fiction", "short stories"}, response.Data.Tags)
+		assert.Equal(t, 1944, response.Data.Year)
+		assert.Equal(t, 1, response.Data.Rating.Count)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		w := requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "application/yaml")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+
+		var response struct {
+			Data map[string]any `yaml:"data"`
+		}
+		assert.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &response))
+		// the ISBN is quoted so it stays a string
+		assert.Equal(t, "9780802130303", response.Data["isbn"])
+		assert.Equal(t, 1944, response.Data["year"])
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		w := requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "application/msgpack")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "application/msgpack", w.Header().Get("Content-Type"))
+
+		var response map[string]map[string]any
+		handle := &codec.MsgpackHandle{}
+		handle.RawToString = true
+		assert.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), handle).Decode(&response))
+		assert.Equal(t, "Ficciones", response["data"]["title"])
+		assert.Equal(t, []any{"fiction", "short stories"}, response["data"]["tags"])
+		assert.EqualValues(t, 1944, response["data"]["year"])
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		w := requestWithHeader(router, http.MethodGet, "/api/v1/books/?table=books", "Accept", "text/csv")
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+		records, err := csv.NewReader(w.Body).ReadAll()
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{
+			{"id", "title", "author", "isbn", "tags", "year", "rating.mean", "rating.count", "rating.histogram"},
+			{book.Id, "Ficciones", "Jorge Luis Borges", "9780802130303", "fiction; short stories", "1944", "4", "1", "0; 0; 0; 1; 0"},
+		}, records)
+	})
+
+	// a single book isn't a list, so CSV falls back to whatever else is accepted
+	w := requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "text/csv, application/yaml")
+	assert.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "text/csv")
+	assert.Equal(t, 406, w.Code)
+
+	// errors are still sent when the accepted type can't carry them
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/unknown", "Accept", "text/csv")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/unknown", "Accept", "application/xml")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "application/problem+xml", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<code>not_found</code>")
+
+	// JSON is the default, and anything nothing can be produced for is turned away
+	// before the handler runs
+	w = requestWithHeader(router, http.MethodGet, "/api/v1/books/"+book.Id, "Accept", "*/*")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"Accept"}, w.Header().Values("Vary"))
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/books", strings.NewReader(`{"title": "Labyrinths", "author": "Jorge Luis Borges"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "image/png")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 406, w.Code)
+	var books []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &books)
+	assert.Len(t, books, 1)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestReviewsAggregate(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &book)
+
+	for _, rating := range []int{5, 4, 5} {
+		w := doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: rating})
+		assert.Equal(t, 200, w.Code)
+	}
+
+	// ratings are limited to 1-5 stars, and only existing books can be reviewed
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: 6})
+	assert.Equal(t, 400, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/books/nope/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: 3})
+	assert.Equal(t, 404, w.Code)
+
+	w = doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"/reviews", nil)
+	assert.Equal(t, 200, w.Code)
+	var resp struct {
+		Data   []models.Review      `json:"data"`
+		Rating models.RatingSummary `json:"rating"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 3)
+	assert.Equal(t, 3, resp.Rating.Count)
+	assert.InDelta(t, 14.0/3.0, resp.Rating.Mean, 1e-9)
+	assert.Equal(t, [5]int{0, 0, 0, 1, 2}, resp.Rating.Histogram)
+
+	// the summary is also returned on the book itself
+	var fetched models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id, nil), &fetched)
+	assert.NotNil(t, fetched.Rating)
+	assert.Equal(t, 3, fetched.Rating.Count)
+}
+
+func TestGetAllBooksSortByRating(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	ratings := map[string]int{"Fictions": 3, "The Aleph": 5, "Labyrinths": 0}
+	for _, title := range []string{"Fictions", "The Aleph", "Labyrinths"} {
+		var book models.Book
+		decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: title, Author: "Jorge Luis Borges"}), &book)
+		if ratings[title] > 0 {
+			doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/reviews", models.InsertReviewInput{Reviewer: "ana", Rating: ratings[title]})
+		}
+	}
+
+	w := doRequest(router, http.MethodGet, "/api/v1/books/?table=books&sort=-rating", nil)
+	assert.Equal(t, 200, w.Code)
+	var books []models.Book
+	decodeData(t, w, &books)
+	assert.Equal(t, "The Aleph", books[0].Title)
+	assert.Equal(t, "Fictions", books[1].Title)
+	assert.Equal(t, "Labyrinths", books[2].Title)
+	assert.Nil(t, books[2].Rating)
+
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?table=books&sort=shoe_size", nil)
+	assert.Equal(t, 400, w.Code)
+}
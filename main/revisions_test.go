@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestBookRevisions(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	assert.Equal(t, 200, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil).Code)
+	// tagging twice changes nothing, so no revision is recorded
+	assert.Equal(t, 200, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil).Code)
+	assert.Equal(t, 200, doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil).Code)
+	assert.Equal(t, 200, doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/restore", nil).Code)
+
+	var revisions []models.BookRevision
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"/revisions", nil), &revisions)
+	assert.Len(t, revisions, 4)
+	for i, revision := range revisions {
+		assert.Equal(t, i+1, revision.Revision)
+		assert.Equal(t, book.Id, revision.BookId)
+	}
+	assert.Empty(t, revisions[0].Book.Tags)
+	assert.Equal(t, []string{"fiction"}, revisions[1].Book.Tags)
+	assert.NotNil(t, revisions[2].Book.DeletedAt)
+	assert.Nil(t, revisions[3].Book.DeletedAt)
+
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/books/unknown/revisions", nil).Code)
+}
+
+func TestSeededBookHasNoRevisions(t *testing.T) {
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	var books []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &books)
+	assert.NotEmpty(t, books)
+
+	w := doRequest(router, http.MethodGet, "/api/v1/books/"+books[0].Id+"/revisions", nil)
+	assert.Equal(t, 200, w.Code)
+	var revisions []models.BookRevision
+	decodeData(t, w, &revisions)
+	assert.Empty(t, revisions)
+}
+
+func TestBooksAsOf(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	before := time.Now().UTC()
+	time.Sleep(5 * time.Millisecond)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+	time.Sleep(5 * time.Millisecond)
+	created := time.Now().UTC()
+	time.Sleep(5 * time.Millisecond)
+
+	doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil)
+	time.Sleep(5 * time.Millisecond)
+	tagged := time.Now().UTC()
+	time.Sleep(5 * time.Millisecond)
+
+	doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil)
+
+	at := func(ts time.Time) string { return "?as_of=" + ts.Format(time.RFC3339Nano) }
+
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+at(before), nil).Code)
+
+	var old models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+at(created), nil), &old)
+	assert.Equal(t, "Labyrinths", old.Title)
+	assert.Empty(t, old.Tags)
+
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+at(tagged), nil), &old)
+	assert.Equal(t, []string{"fiction"}, old.Tags)
+
+	// the book is in the trash now
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+at(time.Now().UTC()), nil).Code)
+
+	var all []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+at(tagged)+"&table=books", nil), &all)
+	assert.Len(t, all, 1)
+
+	all = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+at(before)+"&table=books", nil), &all)
+	assert.Empty(t, all)
+
+	assert.Equal(t, 400, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"?as_of=yesterday", nil).Code)
+}
+
+func TestRevertBook(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+	doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil)
+	doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/short-stories", nil)
+
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/revisions/2/revert", nil)
+	assert.Equal(t, 200, w.Code)
+	var reverted models.Book
+	decodeData(t, w, &reverted)
+	assert.Equal(t, []string{"fiction"}, reverted.Tags)
+
+	// reverting is itself a new revision
+	var revisions []models.BookRevision
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id+"/revisions", nil), &revisions)
+	assert.Len(t, revisions, 4)
+	assert.Equal(t, []string{"fiction"}, revisions[3].Book.Tags)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.revert", nil), &entries)
+	assert.Len(t, entries, 1)
+
+	assert.Equal(t, 404, doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/revisions/9/revert", nil).Code)
+	assert.Equal(t, 400, doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/revisions/first/revert", nil).Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodPost, "/api/v1/books/unknown/revisions/1/revert", nil).Code)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+type listBooksTest struct {
+	Data   []models.Book `json:"data"`
+	Facets models.Facets `json:"facets"`
+}
+
+func TestTagAndUntagBook(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", Tags: []string{"Classic"}}), &book)
+	assert.Equal(t, []string{"classic"}, book.Tags)
+
+	w := doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/Short-Stories", nil)
+	assert.Equal(t, 200, w.Code)
+	decodeData(t, w, &book)
+	assert.Equal(t, []string{"classic", "short-stories"}, book.Tags)
+
+	// tagging again doesn't duplicate the tag
+	decodeData(t, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/classic", nil), &book)
+	assert.Equal(t, []string{"classic", "short-stories"}, book.Tags)
+
+	decodeData(t, doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id+"/tags/classic", nil), &book)
+	assert.Equal(t, []string{"short-stories"}, book.Tags)
+
+	w = doRequest(router, http.MethodPut, "/api/v1/books/nope/tags/classic", nil)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestFilterByGenreAndTagWithFacets(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var fiction, fantasy models.Genre
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/genres", models.InsertGenreInput{Name: "Fiction"}), &fiction)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/genres", models.InsertGenreInput{Name: "Fantasy", ParentId: fiction.Id}), &fantasy)
+
+	w := doRequest(router, http.MethodPost, "/api/v1/genres", models.InsertGenreInput{Name: "Orphan", ParentId: "nope"})
+	assert.Equal(t, 404, w.Code)
+
+	for _, book := range []models.InsertBookInput{
+		{Title: "Fictions", Author: "Jorge Luis Borges", GenreId: fiction.Id, Year: 1944, Tags: []string{"classic"}},
+		{Title: "A Wizard of Earthsea", Author: "Ursula K. Le Guin", GenreId: fantasy.Id, Year: 1968, Tags: []string{"classic"}},
+		{Title: "The Lathe of Heaven", Author: "Ursula K. Le Guin", Year: 1971},
+	} {
+		w := doRequest(router, http.MethodPost, "/api/v1/books", book)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	// the fiction filter includes the fantasy sub-genre
+	var resp listBooksTest
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?table=books&genre="+fiction.Id, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 2)
+
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 3)
+	assert.Equal(t, map[string]int{fiction.Id: 2, fantasy.Id: 1}, resp.Facets.Genre)
+	assert.Equal(t, map[string]int{"Jorge Luis Borges": 1, "Ursula K. Le Guin": 2}, resp.Facets.Author)
+	assert.Equal(t, map[string]int{"1940s": 1, "1960s": 1, "1970s": 1}, resp.Facets.Decade)
+
+	resp = listBooksTest{}
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?table=books&tag=CLASSIC&genre="+fantasy.Id, nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 1)
+	assert.Equal(t, "A Wizard of Earthsea", resp.Data[0].Title)
+	assert.Equal(t, map[string]int{"Ursula K. Le Guin": 1}, resp.Facets.Author)
+}
+
+func TestSetBookGenre(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var genre models.Genre
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/genres", models.InsertGenreInput{Name: "Fiction"}), &genre)
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &book)
+
+	w := doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/genre", models.SetGenreInput{GenreId: genre.Id})
+	assert.Equal(t, 200, w.Code)
+	decodeData(t, w, &book)
+	assert.Equal(t, genre.Id, book.GenreId)
+
+	w = doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/genre", models.SetGenreInput{GenreId: "nope"})
+	assert.Equal(t, 404, w.Code)
+}
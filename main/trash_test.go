@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+
+	assert.Equal(t, 200, doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil).Code)
+
+	// deleted books are hidden from reads and writes
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id, nil).Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodPut, "/api/v1/books/"+book.Id+"/tags/fiction", nil).Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil).Code)
+
+	var all []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/?table=books", nil), &all)
+	assert.Empty(t, all)
+
+	var trash []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/trash", nil), &trash)
+	assert.Len(t, trash, 1)
+	assert.Equal(t, book.Id, trash[0].Id)
+	assert.NotNil(t, trash[0].DeletedAt)
+
+	var restored models.Book
+	w := doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/restore", nil)
+	assert.Equal(t, 200, w.Code)
+	decodeData(t, w, &restored)
+	assert.Equal(t, "Labyrinths", restored.Title)
+	assert.Nil(t, restored.DeletedAt)
+
+	assert.Equal(t, 200, doRequest(router, http.MethodGet, "/api/v1/books/"+book.Id, nil).Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/restore", nil).Code)
+
+	trash = nil
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/trash", nil), &trash)
+	assert.Empty(t, trash)
+}
+
+func TestDeleteByTitleMovesToTrash(t *testing.T) {
+	handler := controllers.NewHandler(database.NewMemoryDB(seedDataMultiple), nil)
+	router := setupRouter(handler, true)
+
+	var deleted int
+	decodeData(t, doRequest(router, http.MethodDelete, "/api/v1/books/?title=Fictions", nil), &deleted)
+	assert.Equal(t, 2, deleted)
+
+	// deleting again finds nothing left to delete
+	decodeData(t, doRequest(router, http.MethodDelete, "/api/v1/books/?title=Fictions", nil), &deleted)
+	assert.Equal(t, 0, deleted)
+
+	var trash []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/trash", nil), &trash)
+	assert.Len(t, trash, 2)
+}
+
+func TestRestoreConflictingISBN(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var original models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges", ISBN: "9780811216999"}), &original)
+	doRequest(router, http.MethodDelete, "/api/v1/books/"+original.Id, nil)
+
+	// the ISBN is free again once the book is in the trash
+	w := doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges", ISBN: "9780811216999"})
+	assert.Equal(t, 200, w.Code)
+
+	w = doRequest(router, http.MethodPost, "/api/v1/books/"+original.Id+"/restore", nil)
+	assert.Equal(t, 409, w.Code)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+	doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil)
+
+	// still within the retention period
+	purged, err := handler.PurgeTrash(context.Background(), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	purged, err = handler.PurgeTrash(context.Background(), -time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	var trash []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/trash", nil), &trash)
+	assert.Empty(t, trash)
+	assert.Equal(t, 404, doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/restore", nil).Code)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.purge", nil), &entries)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "system", entries[0].Actor)
+	assert.Equal(t, book.Id, entries[0].BookId)
+}
+
+// a database whose trash listing is out of date by the time it's purged: it
+// lists a book that's already gone and misses the one that's really there
+type staleTrashDB struct {
+	database.Database
+}
+
+func (db staleTrashDB) Trash(ctx context.Context, table string) ([]models.Book, error) {
+	deletedAt := time.Now().UTC().Add(-time.Hour)
+	return []models.Book{{Id: "restored-meanwhile", Title: "Ficciones", DeletedAt: &deletedAt}}, nil
+}
+
+func TestPurgeAuditsWhatWasPurged(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(staleTrashDB{database.NewMemoryDB(nil)}, nil)
+	router := setupRouter(handler, true)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Labyrinths", Author: "Jorge Luis Borges"}), &book)
+	doRequest(router, http.MethodDelete, "/api/v1/books/"+book.Id, nil)
+
+	purged, err := handler.PurgeTrash(context.Background(), -time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?action=book.purge", nil), &entries)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, book.Id, entries[0].BookId)
+}
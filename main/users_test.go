@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestReadingStatusShelves(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var user models.User
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ana"}), &user)
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &book)
+	shelfPath := "/api/v1/users/" + user.Id + "/shelves/"
+
+	w := doRequest(router, http.MethodPut, shelfPath+"want-to-read/books/"+book.Id, nil)
+	assert.Equal(t, 200, w.Code)
+
+	// moving to "reading" takes the book off "want-to-read" and records progress
+	page := 42
+	w = doRequest(router, http.MethodPut, shelfPath+"reading/books/"+book.Id, models.ShelveBookInput{Page: &page})
+	assert.Equal(t, 200, w.Code)
+	var record models.ReadingRecord
+	decodeData(t, w, &record)
+	assert.Equal(t, models.ShelfReading, record.Status)
+	assert.Equal(t, 42, record.Page)
+	assert.NotNil(t, record.StartedAt)
+	assert.Nil(t, record.FinishedAt)
+
+	var shelved []models.ReadingRecord
+	decodeData(t, doRequest(router, http.MethodGet, shelfPath+"want-to-read", nil), &shelved)
+	assert.Len(t, shelved, 0)
+	decodeData(t, doRequest(router, http.MethodGet, shelfPath+"reading", nil), &shelved)
+	assert.Len(t, shelved, 1)
+	assert.Equal(t, "Fictions", shelved[0].Book.Title)
+
+	decodeData(t, doRequest(router, http.MethodPut, shelfPath+"read/books/"+book.Id, nil), &record)
+	assert.Equal(t, models.ShelfRead, record.Status)
+	assert.Equal(t, 100.0, record.Percent)
+	assert.NotNil(t, record.FinishedAt)
+
+	// invalid progress, unknown books and unknown users
+	percent := 120.0
+	w = doRequest(router, http.MethodPut, shelfPath+"reading/books/"+book.Id, models.ShelveBookInput{Percent: &percent})
+	assert.Equal(t, 400, w.Code)
+	w = doRequest(router, http.MethodPut, shelfPath+"reading/books/nope", nil)
+	assert.Equal(t, 404, w.Code)
+	w = doRequest(router, http.MethodGet, "/api/v1/users/nope/shelves", nil)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestCustomShelves(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var user models.User
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ana"}), &user)
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges"}), &book)
+	shelvesPath := "/api/v1/users/" + user.Id + "/shelves"
+
+	// custom shelves must exist before books go on them, and can't shadow status shelves
+	w := doRequest(router, http.MethodPut, shelvesPath+"/favourites/books/"+book.Id, nil)
+	assert.Equal(t, 404, w.Code)
+	w = doRequest(router, http.MethodPost, shelvesPath, models.InsertShelfInput{Name: "Read"})
+	assert.Equal(t, 409, w.Code)
+	w = doRequest(router, http.MethodPost, shelvesPath, models.InsertShelfInput{Name: "Favourites"})
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodPost, shelvesPath, models.InsertShelfInput{Name: "favourites"})
+	assert.Equal(t, 409, w.Code)
+
+	doRequest(router, http.MethodPut, shelvesPath+"/favourites/books/"+book.Id, nil)
+	doRequest(router, http.MethodPut, shelvesPath+"/read/books/"+book.Id, nil)
+
+	var shelves []models.Shelf
+	decodeData(t, doRequest(router, http.MethodGet, shelvesPath, nil), &shelves)
+	counts := map[string]int{}
+	for _, shelf := range shelves {
+		counts[shelf.Name] = shelf.Count
+	}
+	assert.Equal(t, map[string]int{"want-to-read": 0, "reading": 0, "read": 1, "favourites": 1}, counts)
+
+	// removing from a custom shelf leaves the status shelf alone
+	w = doRequest(router, http.MethodDelete, shelvesPath+"/favourites/books/"+book.Id, nil)
+	assert.Equal(t, 200, w.Code)
+	w = doRequest(router, http.MethodDelete, shelvesPath+"/favourites/books/"+book.Id, nil)
+	assert.Equal(t, 404, w.Code)
+
+	var shelved []models.ReadingRecord
+	decodeData(t, doRequest(router, http.MethodGet, shelvesPath+"/read", nil), &shelved)
+	assert.Len(t, shelved, 1)
+}
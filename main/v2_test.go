@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/openapi"
+)
+
+// the v2 envelope, with the list and page of a paged response
+type envelope struct {
+	Data  json.RawMessage   `json:"data"`
+	Meta  map[string]any    `json:"meta"`
+	Links *models.PageLinks `json:"links"`
+}
+
+func TestV2Books(t *testing.T) {
+	sequentialUUIDs(t)
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	for i := 1; i <= 5; i++ {
+		w := doRequest(router, http.MethodPost, "/api/v2/books", models.InsertBookInput{Title: fmt.Sprintf("Book %d", i), Author: "Ursula K. Le Guin"})
+		assert.Equal(t, 200, w.Code)
+	}
+	doRequest(router, http.MethodPost, "/api/v2/books", models.InsertBookInput{Title: "Dune", Author: "Frank Herbert"})
+
+	decode := func(body []byte) envelope {
+		var e envelope
+		assert.NoError(t, json.Unmarshal(body, &e))
+		return e
+	}
+	list := func(path string) (envelope, []models.Book) {
+		w := doRequest(router, http.MethodGet, path, nil)
+		assert.Equal(t, 200, w.Code, path)
+		e := decode(w.Body.Bytes())
+		var books []models.Book
+		assert.NoError(t, json.Unmarshal(e.Data, &books))
+		return e, books
+	}
+
+	// the collection is paged, with its place in meta and the other pages in links
+	e, books := list("/api/v2/books?author=Ursula+K.+Le+Guin&sort=title&per_page=2&page=2")
+	assert.Equal(t, []string{"Book 3", "Book 4"}, []string{books[0].Title, books[1].Title})
+	assert.Equal(t, 2.0, e.Meta["page"])
+	assert.Equal(t, 2.0, e.Meta["per_page"])
+	assert.Equal(t, 5.0, e.Meta["total"])
+	assert.Equal(t, 3.0, e.Meta["total_pages"])
+	assert.Contains(t, e.Meta, "facets")
+	assert.Equal(t, &models.PageLinks{
+		Self:  "/api/v2/books?author=Ursula+K.+Le+Guin&page=2&per_page=2&sort=title",
+		First: "/api/v2/books?author=Ursula+K.+Le+Guin&page=1&per_page=2&sort=title",
+		Last:  "/api/v2/books?author=Ursula+K.+Le+Guin&page=3&per_page=2&sort=title",
+		Prev:  "/api/v2/books?author=Ursula+K.+Le+Guin&page=1&per_page=2&sort=title",
+		Next:  "/api/v2/books?author=Ursula+K.+Le+Guin&page=3&per_page=2&sort=title",
+	}, e.Links)
+
+	// filters replace v1's /books/title/ and /books/author/, and an empty match is an empty page
+	_, books = list("/api/v2/books?title=Dune")
+	assert.Len(t, books, 1)
+	e, books = list("/api/v2/books?author=Nobody")
+	assert.Empty(t, books)
+	assert.Equal(t, 1.0, e.Meta["total_pages"])
+	assert.Empty(t, e.Links.Next)
+
+	// a single resource is enveloped too, without paging
+	w := doRequest(router, http.MethodGet, "/api/v2/books/"+firstBook(t, router).Id, nil)
+	assert.Equal(t, 200, w.Code)
+	e = decode(w.Body.Bytes())
+	assert.Nil(t, e.Meta)
+	assert.Nil(t, e.Links)
+
+	// books are deleted by id rather than by a title parameter
+	id := firstBook(t, router).Id
+	w = doRequest(router, http.MethodDelete, "/api/v2/books/"+id, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v2/books/"+id, nil).Code)
+
+	// the v1 query parameter routes aren't part of v2
+	assert.Equal(t, 404, doRequest(router, http.MethodGet, "/api/v2/books/title?title=Dune", nil).Code)
+
+	// bad paging is refused
+	for _, query := range []string{"page=0", "per_page=0", "per_page=101", "page=two"} {
+		w := doRequest(router, http.MethodGet, "/api/v2/books?"+query, nil)
+		assert.Equal(t, 400, w.Code, query)
+		assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestV2Paging(t *testing.T) {
+	sequentialUUIDs(t)
+	t.Setenv("RATE_LIMIT_CREATE", "1000/min")
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	for i := 1; i <= 105; i++ {
+		w := doRequest(router, http.MethodPost, "/api/v2/books", models.InsertBookInput{Title: fmt.Sprintf("Book %03d", i), Author: "Anon"})
+		assert.Equal(t, 200, w.Code)
+	}
+
+	page := func(path string) (envelope, int) {
+		w := doRequest(router, http.MethodGet, path, nil)
+		assert.Equal(t, 200, w.Code, path)
+		var e envelope
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+		var items []any
+		assert.NoError(t, json.Unmarshal(e.Data, &items))
+		return e, len(items)
+	}
+
+	// the total is counted, not taken from a list cut short by a limit
+	e, n := page("/api/v2/audit?per_page=100&page=2")
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 105.0, e.Meta["total"])
+	assert.Equal(t, 2.0, e.Meta["total_pages"])
+
+	// books are paged as they're read when they don't have to be sorted
+	e, n = page("/api/v2/books?per_page=50&page=3")
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 105.0, e.Meta["total"])
+	facets := e.Meta["facets"].(map[string]any)
+	assert.Equal(t, 105.0, facets["author"].(map[string]any)["Anon"])
+
+	// and v1 lists stay whole
+	var entries []models.AuditEntry
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/audit?limit=1000", nil), &entries)
+	assert.Len(t, entries, 105)
+}
+
+// the first book in the v2 listing
+func firstBook(t *testing.T, router *gin.Engine) models.Book {
+	w := doRequest(router, http.MethodGet, "/api/v2/books?sort=title", nil)
+	var e envelope
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &e))
+	var books []models.Book
+	assert.NoError(t, json.Unmarshal(e.Data, &books))
+	return books[0]
+}
+
+func TestV1Deprecation(t *testing.T) {
+	router := setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+
+	// v1 keeps working but says when it goes away and what replaces it
+	w := doRequest(router, http.MethodGet, "/api/v1/books/title/?title=Dune", nil)
+	assert.Equal(t, "@1792368000", w.Header().Get("Deprecation"))
+	assert.Equal(t, "Wed, 30 Jun 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+	assert.Equal(t, `</api/v2/books>; rel="successor-version"`, w.Header().Get("Link"))
+
+	w = doRequest(router, http.MethodGet, "/api/v1/ping", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `</api/v2/ping>; rel="successor-version"`, w.Header().Get("Link"))
+
+	// deleting by title has nothing to point to
+	w = doRequest(router, http.MethodDelete, "/api/v1/books/?title=Dune", nil)
+	assert.Equal(t, "@1792368000", w.Header().Get("Deprecation"))
+	assert.Empty(t, w.Header().Get("Link"))
+
+	w = doRequest(router, http.MethodGet, "/api/v2/ping", nil)
+	assert.Empty(t, w.Header().Get("Deprecation"))
+	assert.Empty(t, w.Header().Get("Sunset"))
+
+	// the sunset can be moved
+	t.Setenv("API_V1_SUNSET", "2027-12-31")
+	router = setupRouter(controllers.NewHandler(database.NewMemoryDB(nil), nil), true)
+	w = doRequest(router, http.MethodGet, "/api/v1/ping", nil)
+	assert.Equal(t, "Fri, 31 Dec 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+
+	// and the description marks v1 deprecated
+	var spec openapi.Document
+	assert.NoError(t, json.Unmarshal(openapi.Spec, &spec))
+	assert.True(t, spec.Paths["/api/v1/books/title/"]["get"].Deprecated)
+	assert.False(t, spec.Paths["/api/v2/books"]["get"].Deprecated)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+	"github.com/garbhank/gin-books-api/openapi"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+func TestRequestValidation(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	type invalid struct {
+		problem.Problem
+		Errors []openapi.Violation `json:"errors"`
+	}
+	decode := func(w *httptest.ResponseRecorder) invalid {
+		assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+		var p invalid
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		return p
+	}
+
+	// every violation in the body is listed, not just the first
+	w := doRequest(router, http.MethodPost, "/api/v1/books", map[string]any{
+		"title":     strings.Repeat("x", 501),
+		"tags":      []any{"fiction", ""},
+		"year":      "1944",
+		"publisher": "Sur",
+	})
+	assert.Equal(t, 400, w.Code)
+	p := decode(w)
+	assert.Equal(t, 400, p.Status)
+	assert.Equal(t, "invalid_request", p.Code)
+	assert.Equal(t, "/api/v1/books", p.Instance)
+	assert.Equal(t, []openapi.Violation{
+		{In: "body", Field: "/author", Reason: "is required"},
+		{In: "body", Field: "/publisher", Reason: "isn't a known field"},
+		{In: "body", Field: "/tags/1", Reason: "must not be empty"},
+		{In: "body", Field: "/title", Reason: "must be at most 500 characters"},
+		{In: "body", Field: "/year", Reason: "must be a number"},
+	}, p.Errors)
+
+	// as are missing and unexpected query parameters
+	w = doRequest(router, http.MethodGet, "/api/v1/books/?format=mods", nil)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, []openapi.Violation{
+		{In: "query", Field: "table", Reason: "is required"},
+		{In: "query", Field: "format", Reason: "must be one of json, bibtex, ris, marcxml, dc"},
+	}, decode(w).Errors)
+
+	// formats, ranges and malformed bodies
+	w = doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ada", Email: "not an address"})
+	assert.Equal(t, []openapi.Violation{{In: "body", Field: "/email", Reason: "must be an email address"}}, decode(w).Errors)
+
+	var book models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Ficciones", Author: "Jorge Luis Borges"}), &book)
+	w = doRequest(router, http.MethodPost, "/api/v1/books/"+book.Id+"/reviews", map[string]any{"reviewer": "ana", "rating": 4.5})
+	assert.Equal(t, []openapi.Violation{{In: "body", Field: "/rating", Reason: "must be a whole number"}}, decode(w).Errors)
+	w = upload(router, "/api/v1/books/"+book.Id+"/checkouts", "application/json", `{"user_id": `)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, []openapi.Violation{{In: "body", Field: "", Reason: "isn't valid JSON: unexpected EOF"}}, decode(w).Errors)
+
+	// zero values of optional fields and field names in another case bind as before
+	w = doRequest(router, http.MethodPost, "/api/v1/books", map[string]any{"Title": "Labyrinths", "Author": "Jorge Luis Borges", "isbn": "", "year": 0, "tags": nil})
+	assert.Equal(t, 200, w.Code)
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/users", models.InsertUserInput{Name: "Ada"}), &models.User{})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/garbhank/gin-books-api/controllers"
+	"github.com/garbhank/gin-books-api/database"
+	"github.com/garbhank/gin-books-api/models"
+)
+
+func TestSeriesWorksOrdered(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	w := doRequest(router, http.MethodPost, "/api/v1/series", models.InsertSeriesInput{Name: "Earthsea"})
+	assert.Equal(t, 200, w.Code)
+	var series models.Series
+	decodeData(t, w, &series)
+
+	// insert out of order, the listing should follow series_position
+	for _, work := range []models.InsertWorkInput{
+		{Title: "The Tombs of Atuan", Author: "Ursula K. Le Guin", SeriesId: series.Id, SeriesPosition: 2},
+		{Title: "A Wizard of Earthsea", Author: "Ursula K. Le Guin", SeriesId: series.Id, SeriesPosition: 1},
+		{Title: "The Farthest Shore", Author: "Ursula K. Le Guin", SeriesId: series.Id, SeriesPosition: 3},
+	} {
+		w := doRequest(router, http.MethodPost, "/api/v1/works", work)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	w = doRequest(router, http.MethodGet, "/api/v1/series/"+series.Id+"/works", nil)
+	assert.Equal(t, 200, w.Code)
+
+	var works []models.Work
+	decodeData(t, w, &works)
+	titles := []string{}
+	for _, work := range works {
+		titles = append(titles, work.Title)
+	}
+	assert.Equal(t, []string{"A Wizard of Earthsea", "The Tombs of Atuan", "The Farthest Shore"}, titles)
+
+	// unknown series
+	w = doRequest(router, http.MethodGet, "/api/v1/series/nope/works", nil)
+	assert.Equal(t, 404, w.Code)
+	w = doRequest(router, http.MethodPost, "/api/v1/works", models.InsertWorkInput{Title: "x", Author: "y", SeriesId: "nope"})
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestWorkEditions(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	w := doRequest(router, http.MethodPost, "/api/v1/works", models.InsertWorkInput{Title: "Fictions", Author: "Jorge Luis Borges"})
+	var work models.Work
+	decodeData(t, w, &work)
+
+	hardback := models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", WorkId: work.Id, ISBN: "9780141183800", Format: "hardback"}
+	paperback := models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", WorkId: work.Id, ISBN: "9780802130303", Format: "paperback"}
+	for _, edition := range []models.InsertBookInput{hardback, paperback} {
+		w := doRequest(router, http.MethodPost, "/api/v1/books", edition)
+		assert.Equal(t, 200, w.Code)
+	}
+
+	// an ISBN identifies exactly one edition
+	w = doRequest(router, http.MethodPost, "/api/v1/books", paperback)
+	assert.Equal(t, 409, w.Code)
+
+	// editions can't be attached to a missing work
+	w = doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "x", Author: "y", WorkId: "nope"})
+	assert.Equal(t, 404, w.Code)
+
+	w = doRequest(router, http.MethodGet, "/api/v1/works/"+work.Id+"/editions", nil)
+	assert.Equal(t, 200, w.Code)
+	var editions []models.Book
+	decodeData(t, w, &editions)
+	assert.Len(t, editions, 2)
+	assert.Equal(t, "hardback", editions[0].Format)
+	assert.Equal(t, "paperback", editions[1].Format)
+}
+
+// DELETE /api/v1/books/:id
+func TestDeleteBookByIdKeepsOtherEditions(t *testing.T) {
+	sequentialUUIDs(t)
+	handler := controllers.NewHandler(database.NewMemoryDB(nil), nil)
+	router := setupRouter(handler, true)
+
+	var first models.Book
+	decodeData(t, doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", ISBN: "1"}), &first)
+	doRequest(router, http.MethodPost, "/api/v1/books", models.InsertBookInput{Title: "Fictions", Author: "Jorge Luis Borges", ISBN: "2"})
+
+	w := doRequest(router, http.MethodDelete, "/api/v1/books/"+first.Id, nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `{"data":1}`, w.Body.String())
+
+	w = doRequest(router, http.MethodGet, "/api/v1/books/"+first.Id, nil)
+	assert.Equal(t, 404, w.Code)
+
+	var remaining []models.Book
+	decodeData(t, doRequest(router, http.MethodGet, "/api/v1/books/title/?title=Fictions", nil), &remaining)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "2", remaining[0].ISBN)
+}
@@ -1,9 +1,219 @@
 package models
 
+import "time"
+
+// a Book is a single edition of a Work, identified by its own ISBN and format
 type Book struct {
 	Id     string `json:"id" firestore:"id"`
 	Title  string `json:"title" firestore:"title"`
 	Author string `json:"author" firestore:"author"`
+	WorkId string `json:"work_id,omitempty" firestore:"work_id"`
+	ISBN   string `json:"isbn,omitempty" firestore:"isbn"`
+	Format string `json:"format,omitempty" firestore:"format"`
+
+	// categorisation, tags are free-form while genres come from the taxonomy
+	Tags    []string `json:"tags,omitempty" firestore:"tags"`
+	GenreId string   `json:"genre_id,omitempty" firestore:"genre_id"`
+	Year    int      `json:"year,omitempty" firestore:"year"`
+
+	// set when the book is moved to the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty" firestore:"deleted_at"`
+
+	// bumped on every change, each revision is kept as a BookRevision. Clients see it
+	// through the revisions routes rather than in the book itself
+	Revision int `json:"-" firestore:"revision"`
+
+	// aggregated from reviews at read time, never stored on the book itself
+	Rating *RatingSummary `json:"rating,omitempty" firestore:"-"`
+}
+
+// the state of a book as of one of its revisions
+type BookRevision struct {
+	BookId    string    `json:"book_id" firestore:"book_id"`
+	Revision  int       `json:"revision" firestore:"revision"`
+	Book      Book      `json:"book" firestore:"book"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// a Work groups every edition of the same book, and can optionally belong to a Series
+type Work struct {
+	Id             string `json:"id" firestore:"id"`
+	Title          string `json:"title" firestore:"title"`
+	Author         string `json:"author" firestore:"author"`
+	SeriesId       string `json:"series_id,omitempty" firestore:"series_id"`
+	SeriesPosition int    `json:"series_position,omitempty" firestore:"series_position"`
+}
+
+type Series struct {
+	Id   string `json:"id" firestore:"id"`
+	Name string `json:"name" firestore:"name"`
+}
+
+// genres form a tree, a genre without a parent is a root of the taxonomy
+type Genre struct {
+	Id       string `json:"id" firestore:"id"`
+	Name     string `json:"name" firestore:"name"`
+	ParentId string `json:"parent_id,omitempty" firestore:"parent_id"`
+}
+
+// number of books per genre id, author and decade (e.g. "1940s") in a set of results
+type Facets struct {
+	Genre  map[string]int `json:"genre"`
+	Author map[string]int `json:"author"`
+	Decade map[string]int `json:"decade"`
+}
+
+// books that look like the same edition, either by ISBN or by title and author
+type DuplicateGroup struct {
+	Reason string `json:"reason"` // "isbn" or "title_author"
+	Key    string `json:"key"`    // the shared ISBN, or the normalised title and author
+	Books  []Book `json:"books"`
+}
+
+type Review struct {
+	Id        string    `json:"id" firestore:"id"`
+	BookId    string    `json:"book_id" firestore:"book_id"`
+	Reviewer  string    `json:"reviewer" firestore:"reviewer"`
+	Rating    int       `json:"rating" firestore:"rating"`
+	Text      string    `json:"text" firestore:"text"`
+	CreatedAt time.Time `json:"created_at" firestore:"created_at"`
+}
+
+// per-book aggregate of review ratings, kept up to date as each review is added
+type RatingSummary struct {
+	Mean      float64 `json:"mean"`
+	Count     int     `json:"count"`
+	Histogram [5]int  `json:"histogram"` // number of 1 to 5 star ratings, in that order
+}
+
+// folds a single 1-5 rating into the summary without revisiting earlier reviews
+func (r *RatingSummary) Add(rating int) {
+	r.Histogram[rating-1]++
+	r.Count++
+	r.Mean += (float64(rating) - r.Mean) / float64(r.Count)
+}
+
+// builds a summary from a stored histogram
+func NewRatingSummary(histogram [5]int) RatingSummary {
+	summary := RatingSummary{Histogram: histogram}
+
+	total := 0
+	for i, n := range histogram {
+		summary.Count += n
+		total += (i + 1) * n
+	}
+	if summary.Count > 0 {
+		summary.Mean = float64(total) / float64(summary.Count)
+	}
+
+	return summary
+}
+
+type User struct {
+	Id      string `json:"id" firestore:"id"`
+	Name    string `json:"name" firestore:"name"`
+	Email   string `json:"email,omitempty" firestore:"email"`
+	Subject string `json:"subject,omitempty" firestore:"subject"` // the identity that acts as this user, a JWT "sub" or "key:<id>"
+}
+
+// the reading status shelves every user has, a book sits on at most one of them
+const (
+	ShelfWantToRead = "want-to-read"
+	ShelfReading    = "reading"
+	ShelfRead       = "read"
+)
+
+var StatusShelves = []string{ShelfWantToRead, ShelfReading, ShelfRead}
+
+// a user's shelf along with how many books are on it
+type Shelf struct {
+	UserId  string `json:"user_id" firestore:"user_id"`
+	Name    string `json:"name" firestore:"name"`
+	Builtin bool   `json:"builtin" firestore:"-"`
+	Count   int    `json:"count" firestore:"-"`
+}
+
+// everything a user has recorded about one book: its status shelf, custom shelves and progress
+type ReadingRecord struct {
+	UserId     string     `json:"user_id" firestore:"user_id"`
+	BookId     string     `json:"book_id" firestore:"book_id"`
+	Status     string     `json:"status,omitempty" firestore:"status"`
+	Shelves    []string   `json:"shelves,omitempty" firestore:"shelves"`
+	Page       int        `json:"page,omitempty" firestore:"page"`
+	Percent    float64    `json:"percent,omitempty" firestore:"percent"`
+	StartedAt  *time.Time `json:"started_at,omitempty" firestore:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" firestore:"finished_at"`
+	Rating     int        `json:"rating,omitempty" firestore:"rating"` // the user's own 1 to 5 stars, 0 when unrated
+	UpdatedAt  time.Time  `json:"updated_at" firestore:"updated_at"`
+
+	// filled in when listing a shelf
+	Book *Book `json:"book,omitempty" firestore:"-"`
+}
+
+// copy statuses, a copy that's on hold is reserved for the user at the front of the queue
+const (
+	CopyAvailable = "available"
+	CopyOnLoan    = "on_loan"
+	CopyOnHold    = "on_hold"
+)
+
+// hold statuses, holds wait in FIFO order until a returned copy makes them ready
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+)
+
+// a physical copy of a book in the lending library
+type Copy struct {
+	Id      string `json:"id" firestore:"id"`
+	BookId  string `json:"book_id" firestore:"book_id"`
+	Barcode string `json:"barcode,omitempty" firestore:"barcode"`
+	Status  string `json:"status" firestore:"status"`
+	HeldFor string `json:"held_for,omitempty" firestore:"held_for"`
+}
+
+type Checkout struct {
+	Id           string     `json:"id" firestore:"id"`
+	CopyId       string     `json:"copy_id" firestore:"copy_id"`
+	BookId       string     `json:"book_id" firestore:"book_id"`
+	UserId       string     `json:"user_id" firestore:"user_id"`
+	CheckedOutAt time.Time  `json:"checked_out_at" firestore:"checked_out_at"`
+	DueAt        time.Time  `json:"due_at" firestore:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at,omitempty" firestore:"returned_at"`
+}
+
+type Hold struct {
+	Id       string    `json:"id" firestore:"id"`
+	BookId   string    `json:"book_id" firestore:"book_id"`
+	UserId   string    `json:"user_id" firestore:"user_id"`
+	Status   string    `json:"status" firestore:"status"`
+	CopyId   string    `json:"copy_id,omitempty" firestore:"copy_id"`
+	PlacedAt time.Time `json:"placed_at" firestore:"placed_at"`
+}
+
+// one write made through the API. Entries are only ever appended, never changed
+type AuditEntry struct {
+	Id         string         `json:"id" firestore:"id"`
+	Actor      string         `json:"actor" firestore:"actor"`
+	Action     string         `json:"action" firestore:"action"` // e.g. "book.create", "checkout.return"
+	BookId     string         `json:"book_id,omitempty" firestore:"book_id"`
+	ResourceId string         `json:"resource_id,omitempty" firestore:"resource_id"` // the record written, when it isn't the book itself
+	Before     map[string]any `json:"before,omitempty" firestore:"before"`
+	After      map[string]any `json:"after,omitempty" firestore:"after"`
+	RequestId  string         `json:"request_id,omitempty" firestore:"request_id"`
+	Timestamp  time.Time      `json:"timestamp" firestore:"timestamp"`
+}
+
+// narrows GET /audit, zero values match everything
+type AuditFilter struct {
+	Actor  string
+	Action string
+	BookId string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+	Offset int
 }
 
 type APIStatus struct {
@@ -19,15 +229,132 @@ type DBStatus struct {
 }
 
 type InsertBookInput struct {
-	Title  string `json:"title" binding:"required"`
-	Author string `json:"author" binding:"required"`
+	Title  string `json:"title" binding:"required,max=500"`
+	Author string `json:"author" binding:"required,max=300"`
+	WorkId string `json:"work_id"`
+	ISBN   string `json:"isbn" binding:"omitempty,max=17"`
+	Format string `json:"format" binding:"omitempty,max=50"`
+
+	Tags    []string `json:"tags" binding:"omitempty,max=50,dive,min=1,max=100"`
+	GenreId string   `json:"genre_id"`
+	Year    int      `json:"year" binding:"omitempty,min=0,max=9999"`
+}
+
+type InsertUserInput struct {
+	Name    string `json:"name" binding:"required,max=100"`
+	Email   string `json:"email" binding:"omitempty,email,max=254"`
+	Subject string `json:"subject" binding:"omitempty,max=255"`
+}
+
+type InsertShelfInput struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+// progress fields are optional, omitted fields keep their current value
+type ShelveBookInput struct {
+	Page       *int       `json:"page" binding:"omitempty,min=0"`
+	Percent    *float64   `json:"percent" binding:"omitempty,min=0,max=100"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Rating     *int       `json:"rating" binding:"omitempty,min=0,max=5"`
+}
+
+type InsertCopyInput struct {
+	Barcode string `json:"barcode" binding:"omitempty,max=100"`
+}
+
+type CheckoutInput struct {
+	UserId string `json:"user_id" binding:"required"`
+	Days   int    `json:"days" binding:"omitempty,min=1,max=365"`
+}
+
+type HoldInput struct {
+	UserId string `json:"user_id" binding:"required"`
+}
+
+type InsertGenreInput struct {
+	Name     string `json:"name" binding:"required,max=100"`
+	ParentId string `json:"parent_id"`
 }
 
+// fields left out of an update are kept as they are
 type UpdateBookInput struct {
-	Title  string `json:"title"`
-	Author string `json:"author"`
+	Title  *string `json:"title" binding:"omitempty,min=1,max=500"`
+	Author *string `json:"author" binding:"omitempty,min=1,max=300"`
+	ISBN   *string `json:"isbn" binding:"omitempty,max=17"`
+	Format *string `json:"format" binding:"omitempty,max=50"`
+
+	Tags    *[]string `json:"tags" binding:"omitempty,max=50,dive,min=1,max=100"`
+	GenreId *string   `json:"genre_id"`
+	Year    *int      `json:"year" binding:"omitempty,min=0,max=9999"`
+}
+
+// one operation in a POST /books:batch request. Creates take a book, updates take
+// changes and an id, and deletes just an id
+type BatchOperation struct {
+	Op      string           `json:"op" binding:"required,oneof=create update delete"`
+	Id      string           `json:"id" binding:"required_unless=Op create"`
+	Book    *InsertBookInput `json:"book" binding:"required_if=Op create"`
+	Changes *UpdateBookInput `json:"changes" binding:"required_if=Op update"`
+
+	// like If-Match, an update or delete only applies if the book is still at this revision
+	Revision *int `json:"revision"`
+}
+
+type BatchInput struct {
+	Operations []BatchOperation `json:"operations" binding:"required,min=1,max=1000"`
+	Atomic     bool             `json:"atomic"` // apply every operation or none of them
+}
+
+// the outcome of one operation in a batch, in the same position as the operation
+type BatchResult struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Status  int    `json:"status"`
+	Id      string `json:"id,omitempty"`
+	Book    *Book  `json:"book,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Warning string `json:"warning,omitempty"`
+}
+
+type SetGenreInput struct {
+	GenreId string `json:"genre_id" binding:"required"`
+}
+
+type InsertReviewInput struct {
+	Reviewer string `json:"reviewer" binding:"required,max=100"`
+	Rating   int    `json:"rating" binding:"required,min=1,max=5"`
+	Text     string `json:"text" binding:"omitempty,max=10000"`
+}
+
+type InsertWorkInput struct {
+	Title          string `json:"title" binding:"required,max=500"`
+	Author         string `json:"author" binding:"required,max=300"`
+	SeriesId       string `json:"series_id"`
+	SeriesPosition int    `json:"series_position"`
+}
+
+type InsertSeriesInput struct {
+	Name string `json:"name" binding:"required,max=300"`
 }
 
 type FindAuthorInput struct {
 	Author string `json:"author"`
 }
+
+// where a page of a v2 list sits in the whole list
+type Pagination struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+// links to the other pages of a v2 list, prev and next only where there's one
+type PageLinks struct {
+	Self  string `json:"self"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+}
@@ -0,0 +1,242 @@
+package opds
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/garbhank/gin-books-api/models"
+)
+
+// content types for the two kinds of catalogue feed and the search description
+const (
+	NavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	AcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	OpenSearchType  = "application/opensearchdescription+xml"
+)
+
+// link relations OPDS adds to Atom's
+const (
+	RelSortNew     = "http://opds-spec.org/sort/new"
+	RelSortPopular = "http://opds-spec.org/sort/popular"
+	RelBorrow      = "http://opds-spec.org/acquisition/borrow"
+)
+
+const (
+	atomNamespace       = "http://www.w3.org/2005/Atom"
+	dcNamespace         = "http://purl.org/dc/terms/"
+	opdsNamespace       = "http://opds-spec.org/2010/catalog"
+	openSearchNamespace = "http://a9.com/-/spec/opensearch/1.1/"
+)
+
+// an Atom feed. Go's encoder can't declare namespace prefixes, so the extension
+// elements have theirs spelled out in their names
+type Feed struct {
+	XMLName         xml.Name `xml:"feed"`
+	Xmlns           string   `xml:"xmlns,attr"`
+	XmlnsDC         string   `xml:"xmlns:dc,attr"`
+	XmlnsOPDS       string   `xml:"xmlns:opds,attr"`
+	XmlnsOpenSearch string   `xml:"xmlns:opensearch,attr"`
+
+	Id      string    `xml:"id"`
+	Title   string    `xml:"title"`
+	Updated time.Time `xml:"updated"`
+	Author  Author    `xml:"author"`
+
+	// set on paginated feeds
+	TotalResults int `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage int `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   int `xml:"opensearch:startIndex,omitempty"`
+
+	Links   []Link  `xml:"link"`
+	Entries []Entry `xml:"entry"`
+}
+
+type Entry struct {
+	Title      string     `xml:"title"`
+	Id         string     `xml:"id"`
+	Updated    time.Time  `xml:"updated"`
+	Authors    []Author   `xml:"author"`
+	Identifier string     `xml:"dc:identifier,omitempty"`
+	Issued     string     `xml:"dc:issued,omitempty"`
+	Categories []Category `xml:"category"`
+	Content    *Content   `xml:"content"`
+	Links      []Link     `xml:"link"`
+}
+
+type Author struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type Link struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type Category struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type Content struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+func NewFeed(id, title string, updated time.Time) *Feed {
+	return &Feed{
+		Xmlns:           atomNamespace,
+		XmlnsDC:         dcNamespace,
+		XmlnsOPDS:       opdsNamespace,
+		XmlnsOpenSearch: openSearchNamespace,
+		Id:              id,
+		Title:           title,
+		Updated:         updated.UTC().Truncate(time.Second),
+		Author:          Author{Name: "gin-books-api"},
+		Links:           []Link{},
+		Entries:         []Entry{},
+	}
+}
+
+// one page of a feed, numbered from 1
+type Page struct {
+	Number int
+	Size   int
+	Total  int
+}
+
+// the books on this page
+func (p Page) Slice(books []models.Book) []models.Book {
+	start := min((p.Number-1)*p.Size, len(books))
+	end := min(start+p.Size, len(books))
+	return books[start:end]
+}
+
+func (p Page) last() int {
+	return max(1, (p.Total+p.Size-1)/p.Size)
+}
+
+// adds the OpenSearch counts and the first, previous, next and last links. The
+// links keep the feed's other query parameters, like the author or search terms
+func (f *Feed) Paginate(path string, query url.Values, page Page, feedType string) {
+	f.TotalResults = page.Total
+	f.ItemsPerPage = page.Size
+	f.StartIndex = (page.Number-1)*page.Size + 1
+
+	href := func(number int) string {
+		q := url.Values{}
+		for key, values := range query {
+			q[key] = values
+		}
+		q.Set("page", strconv.Itoa(number))
+		return path + "?" + q.Encode()
+	}
+
+	f.Links = append(f.Links,
+		Link{Rel: "self", Href: href(page.Number), Type: feedType},
+		Link{Rel: "first", Href: href(1), Type: feedType},
+		Link{Rel: "last", Href: href(page.last()), Type: feedType},
+	)
+	if page.Number > 1 {
+		f.Links = append(f.Links, Link{Rel: "previous", Href: href(min(page.Number, page.last()+1) - 1), Type: feedType})
+	}
+	if page.Number < page.last() {
+		f.Links = append(f.Links, Link{Rel: "next", Href: href(page.Number + 1), Type: feedType})
+	}
+}
+
+// an acquisition entry for a book. There are no files to download, so the
+// acquisition link borrows a copy, and the alternates are the book's own
+// JSON and MARC records. base is the API's path prefix, like /api/v1
+func BookEntry(book models.Book, base string, updated time.Time) Entry {
+	entry := Entry{
+		Title:   book.Title,
+		Id:      "urn:x-book:" + book.Id,
+		Updated: updated.UTC().Truncate(time.Second),
+		Authors: []Author{{Name: book.Author, URI: base + "/opds/author?" + url.Values{"name": {book.Author}}.Encode()}},
+		Links: []Link{
+			{Rel: RelBorrow, Href: base + "/books/" + book.Id + "/checkouts", Type: "application/json"},
+			{Rel: "alternate", Href: base + "/books/" + book.Id, Type: "application/json"},
+			{Rel: "alternate", Href: base + "/books/" + book.Id + "?format=marcxml", Type: "application/marcxml+xml"},
+		},
+	}
+	if book.ISBN != "" {
+		entry.Identifier = "urn:isbn:" + book.ISBN
+	}
+	if book.Year != 0 {
+		entry.Issued = strconv.Itoa(book.Year)
+	}
+	for _, tag := range book.Tags {
+		entry.Categories = append(entry.Categories, Category{Term: tag, Label: tag})
+	}
+	if book.Rating != nil && book.Rating.Count > 0 {
+		entry.Content = &Content{Type: "text", Text: "Rated " + strconv.FormatFloat(book.Rating.Mean, 'f', 1, 64) + " from " + strconv.Itoa(book.Rating.Count) + " reviews"}
+	}
+	return entry
+}
+
+// a navigation entry leading to another feed
+func NavigationEntry(id, title, description string, link Link, updated time.Time) Entry {
+	return Entry{
+		Title:   title,
+		Id:      id,
+		Updated: updated.UTC().Truncate(time.Second),
+		Content: &Content{Type: "text", Text: description},
+		Links:   []Link{link},
+	}
+}
+
+func (f *Feed) Write(w io.Writer) error {
+	return writeXML(w, f)
+}
+
+// tells clients how to search the catalogue. template is the search URL with
+// {searchTerms} and {startPage?} where the query and page go
+type OpenSearchDescription struct {
+	XMLName        xml.Name      `xml:"OpenSearchDescription"`
+	Xmlns          string        `xml:"xmlns,attr"`
+	ShortName      string        `xml:"ShortName"`
+	Description    string        `xml:"Description"`
+	InputEncoding  string        `xml:"InputEncoding"`
+	OutputEncoding string        `xml:"OutputEncoding"`
+	Url            OpenSearchURL `xml:"Url"`
+}
+
+type OpenSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+func NewOpenSearchDescription(template string) *OpenSearchDescription {
+	return &OpenSearchDescription{
+		Xmlns:          openSearchNamespace,
+		ShortName:      "Books",
+		Description:    "Search the catalogue by title or author",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		Url:            OpenSearchURL{Type: AcquisitionType, Template: template},
+	}
+}
+
+func (d *OpenSearchDescription) Write(w io.Writer) error {
+	return writeXML(w, d)
+}
+
+func writeXML(w io.Writer, v any) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
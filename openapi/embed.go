@@ -0,0 +1,15 @@
+package openapi
+
+import _ "embed"
+
+// the published description, regenerated from the routes with
+// go run main/main.go openapi > openapi/openapi.json
+//
+//go:embed openapi.json
+var Spec []byte
+
+// a Swagger UI page for the description. The page is served by the API, while
+// Swagger UI's own scripts and styles come from a pinned swagger-ui-dist release
+//
+//go:embed swagger.html
+var SwaggerUI []byte
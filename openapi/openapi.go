@@ -0,0 +1,327 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// the parts of an OpenAPI 3 document the API's description uses
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Security   []map[string][]string `json:"security,omitempty"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components Components            `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// operations keyed by lower case method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Tags        []string               `json:"tags,omitempty"`
+	Summary     string                 `json:"summary,omitempty"`
+	OperationId string                 `json:"operationId"`
+	Parameters  []Parameter            `json:"parameters,omitempty"`
+	RequestBody *RequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]Response    `json:"responses"`
+	Security    *[]map[string][]string `json:"security,omitempty"`
+	Deprecated  bool                   `json:"deprecated,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+// what the router can't say about a route: what it's for, what it takes and
+// what it responds with
+type Route struct {
+	Method string
+	Path   string // as registered, like /api/v1/books/:id
+	// published in place of Path, for routes registered as a pattern like /books:action
+	As      string
+	Tag     string
+	Summary string
+	Public  bool // no API key or token needed
+
+	Query []Param
+	// the models struct a JSON body binds to, or the content types of a raw body
+	Body         any
+	BodyTypes    []string
+	OptionalBody bool
+	// the handler checks the body itself, like a batch reporting each operation's
+	// problems in its own result, rather than having it rejected up front
+	OwnValidation bool
+
+	// the value under "data" in a JSON response, and any members alongside it.
+	// Responses the negotiation layer can re-encode are also listed as XML, YAML,
+	// MessagePack and, for lists, CSV
+	Status   int // 200 when unset
+	Response any
+	Meta     map[string]any
+	// other content types the handler writes itself, like citations and feeds
+	Produces []string
+	// responses that aren't the {"data": ...} envelope, like the spec itself
+	Raw bool
+
+	Deprecated bool
+}
+
+// an object described by an example of each of its members, for envelopes that
+// aren't a models struct
+type Object map[string]any
+
+type Param struct {
+	Name        string
+	Description string
+	Required    bool
+	Type        string // string when unset
+	Enum        []string
+}
+
+// the content types any JSON response can be re-encoded in by the negotiation layer
+var negotiated = []string{"application/json", "application/xml", "application/yaml", "application/msgpack"}
+
+// a :param starting a path segment, unlike the custom method in /books:batch
+var pathParam = regexp.MustCompile(`/:([A-Za-z_]+)`)
+
+// builds the document for the routes registered with gin. Every route needs a
+// Route describing it and every Route a registered route, so the two can't drift
+// apart without this failing
+func Generate(info Info, registered gin.RoutesInfo, routes []Route) (*Document, error) {
+	described := map[string]Route{}
+	for _, route := range routes {
+		described[route.Method+" "+route.Path] = route
+	}
+
+	missing := []string{}
+	for _, r := range registered {
+		if _, ok := described[r.Method+" "+r.Path]; !ok {
+			missing = append(missing, r.Method+" "+r.Path)
+		}
+	}
+	unrouted := []string{}
+	for _, route := range routes {
+		if !slices.ContainsFunc(registered, func(r gin.RouteInfo) bool { return r.Method == route.Method && r.Path == route.Path }) {
+			unrouted = append(unrouted, route.Method+" "+route.Path)
+		}
+	}
+	if len(missing) > 0 || len(unrouted) > 0 {
+		sort.Strings(missing)
+		sort.Strings(unrouted)
+		return nil, fmt.Errorf("routes and their descriptions don't match: undescribed %v, described but not routed %v", missing, unrouted)
+	}
+
+	schemas := newSchemas()
+	doc := &Document{
+		OpenAPI:  "3.0.3",
+		Info:     info,
+		Security: []map[string][]string{{"apiKey": {}}, {"bearer": {}}},
+		Paths:    map[string]PathItem{},
+		Components: Components{
+			Schemas: schemas.components,
+			SecuritySchemes: map[string]SecurityScheme{
+				"apiKey": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+	// RFC 7807 problem details, which can carry members of their own
+	schemas.components["Problem"] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"type":       {Type: "string", Format: "uri"},
+			"title":      {Type: "string"},
+			"status":     {Type: "integer"},
+			"code":       {Type: "string", Description: "what went wrong, stable for callers to act on"},
+			"detail":     {Type: "string"},
+			"instance":   {Type: "string"},
+			"request_id": {Type: "string"},
+		},
+		Required:             []string{"type", "title", "status", "code"},
+		AdditionalProperties: &Schema{},
+	}
+
+	for _, route := range routes {
+		path := route.PublishedPath()
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = route.operation(schemas)
+	}
+	return doc, nil
+}
+
+// the path a route is published under, like /api/v1/books/{id}
+func (route Route) PublishedPath() string {
+	path := route.Path
+	if route.As != "" {
+		path = route.As
+	}
+	return pathParam.ReplaceAllString(path, "/{$1}")
+}
+
+// the operation describing a route, nil if the document doesn't have one
+func (d *Document) Operation(route Route) *Operation {
+	return d.Paths[route.PublishedPath()][strings.ToLower(route.Method)]
+}
+
+func (route Route) operation(schemas *schemas) *Operation {
+	op := &Operation{
+		Summary:     route.Summary,
+		OperationId: operationId(route),
+		Responses:   map[string]Response{},
+		Deprecated:  route.Deprecated,
+	}
+	if route.Tag != "" {
+		op.Tags = []string{route.Tag}
+	}
+	if route.Public {
+		op.Security = &[]map[string][]string{}
+	}
+
+	path := route.Path
+	if route.As != "" {
+		path = route.As
+	}
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, param := range route.Query {
+		schema := &Schema{Type: param.Type}
+		if schema.Type == "" {
+			schema.Type = "string"
+		}
+		for _, value := range param.Enum {
+			schema.Enum = append(schema.Enum, value)
+		}
+		op.Parameters = append(op.Parameters, Parameter{Name: param.Name, In: "query", Description: param.Description, Required: param.Required, Schema: schema})
+	}
+
+	switch {
+	case route.Body != nil:
+		op.RequestBody = &RequestBody{Required: !route.OptionalBody, Content: map[string]MediaType{"application/json": {Schema: schemas.of(route.Body)}}}
+	case len(route.BodyTypes) > 0:
+		op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{}}
+		for _, contentType := range route.BodyTypes {
+			op.RequestBody.Content[contentType] = MediaType{Schema: &Schema{Type: "string", Format: "binary"}}
+		}
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := Response{Description: http.StatusText(status), Content: map[string]MediaType{}}
+	if route.Response != nil {
+		body := schemas.of(route.Response)
+		list := body.Type == "array"
+		if !route.Raw {
+			body = &Schema{Type: "object", Properties: map[string]*Schema{"data": body}, Required: []string{"data"}}
+			for name, value := range route.Meta {
+				body.Properties[name] = schemas.of(value)
+			}
+		}
+
+		contentTypes := negotiated
+		if list {
+			contentTypes = append(slices.Clone(negotiated), "text/csv")
+		}
+		for _, contentType := range contentTypes {
+			response.Content[contentType] = MediaType{Schema: body}
+		}
+	}
+	for _, contentType := range route.Produces {
+		response.Content[contentType] = MediaType{Schema: &Schema{Type: "string"}}
+	}
+	op.Responses[fmt.Sprint(status)] = response
+
+	problemSchema := &Schema{Ref: "#/components/schemas/Problem"}
+	op.Responses["default"] = Response{Description: "Problem", Content: map[string]MediaType{"application/problem+json": {Schema: problemSchema}}}
+	return op
+}
+
+// a version prefix like /api/v2
+var versionPrefix = regexp.MustCompile(`^/api/(v[0-9]+)`)
+
+// like getBooksByIdRevisions for GET /api/v1/books/:id/revisions, and
+// getBooksByIdRevisionsV2 for the same route in v2
+func operationId(route Route) string {
+	path := route.Path
+	if route.As != "" {
+		path = route.As
+	}
+	version := ""
+	if match := versionPrefix.FindStringSubmatch(path); match != nil {
+		path = strings.TrimPrefix(path, match[0])
+		if match[1] != "v1" {
+			version = camel(match[1])
+		}
+	}
+
+	id := strings.ToLower(route.Method)
+	for _, segment := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			id += "By" + camel(name)
+			continue
+		}
+		for _, part := range strings.Split(segment, ":") {
+			id += camel(part)
+		}
+	}
+	if id == strings.ToLower(route.Method) {
+		id += "Root"
+	}
+	return id + version
+}
+
+// book_id and opensearch.xml become BookId and OpensearchXml
+func camel(name string) string {
+	out := ""
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '.' || r == '-' }) {
+		out += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return out
+}
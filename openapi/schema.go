@@ -0,0 +1,208 @@
+package openapi
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+
+	MinLength *int     `json:"minLength,omitempty"`
+	MaxLength *int     `json:"maxLength,omitempty"`
+	Minimum   *float64 `json:"minimum,omitempty"`
+	Maximum   *float64 `json:"maximum,omitempty"`
+	MinItems  *int     `json:"minItems,omitempty"`
+	MaxItems  *int     `json:"maxItems,omitempty"`
+
+	// the field's zero value, like "" or 0, stands for leaving it out and isn't
+	// held to the other constraints, following the omitempty binding rule
+	OmitEmpty bool `json:"x-omitempty,omitempty"`
+}
+
+// the named structs met so far, written once under components and referred to
+// everywhere else
+type schemas struct {
+	components map[string]*Schema
+}
+
+func newSchemas() *schemas {
+	return &schemas{components: map[string]*Schema{}}
+}
+
+// the schema of a value's type. Schemas of models structs follow their json tags,
+// and their binding tags for what's required and the limits on each field
+func (s *schemas) of(value any) *Schema {
+	if object, ok := value.(Object); ok {
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for name, member := range object {
+			schema.Properties[name] = s.of(member)
+		}
+		return schema
+	}
+	return s.forType(reflect.TypeOf(value))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (s *schemas) forType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := s.components[t.Name()]; !ok {
+			// claimed before the fields are walked, so a struct can refer to itself
+			s.components[t.Name()] = &Schema{}
+			*s.components[t.Name()] = *s.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return s.object(t)
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: s.forType(t.Elem())}
+	case reflect.Array:
+		return &Schema{Type: "array", Items: s.forType(t.Elem()), MinItems: intPtr(t.Len()), MaxItems: intPtr(t.Len())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.forType(t.Elem())}
+	}
+	// interfaces could hold anything
+	return &Schema{}
+}
+
+func (s *schemas) object(t reflect.Type) *Schema {
+	object := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	s.fields(t, object)
+	return object
+}
+
+func (s *schemas) fields(t reflect.Type, object *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.fields(field.Type, object)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := s.forType(field.Type)
+		if rules := field.Tag.Get("binding"); rules != "" {
+			// constraints can't sit alongside a $ref in OpenAPI 3.0
+			if schema.Ref == "" {
+				constrain(schema, rules)
+			}
+			if hasRule(rules, "required") {
+				object.Required = append(object.Required, name)
+				// required strings can't be empty either
+				if schema.Type == "string" && schema.MinLength == nil {
+					schema.MinLength = intPtr(1)
+				}
+			}
+			if hasRule(rules, "omitempty") && field.Type.Kind() != reflect.Pointer && schema.Ref == "" {
+				schema.OmitEmpty = true
+			}
+		}
+		if field.Type.Kind() == reflect.Pointer && schema.Ref == "" {
+			schema.Nullable = true
+		}
+		object.Properties[name] = schema
+	}
+}
+
+// applies the validator rules that have an OpenAPI equivalent. Conditional
+// rules like required_if are left to the handlers. Rules after dive apply to
+// each item of a list
+func constrain(schema *Schema, rules string) {
+	rules, items, dive := strings.Cut(rules, ",dive")
+	if dive && schema.Items != nil && schema.Items.Ref == "" {
+		constrain(schema.Items, strings.TrimPrefix(items, ","))
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			switch schema.Type {
+			case "string":
+				if name == "min" {
+					schema.MinLength = intPtr(int(n))
+				} else {
+					schema.MaxLength = intPtr(int(n))
+				}
+			case "array":
+				if name == "min" {
+					schema.MinItems = intPtr(int(n))
+				} else {
+					schema.MaxItems = intPtr(int(n))
+				}
+			default:
+				if name == "min" {
+					schema.Minimum = &n
+				} else {
+					schema.Maximum = &n
+				}
+			}
+		case "oneof":
+			for _, value := range strings.Fields(arg) {
+				schema.Enum = append(schema.Enum, value)
+			}
+		case "email":
+			schema.Format = "email"
+		case "url":
+			schema.Format = "uri"
+		}
+	}
+}
+
+func hasRule(rules, name string) bool {
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+func intPtr(n int) *int {
+	return &n
+}
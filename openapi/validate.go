@@ -0,0 +1,280 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// one way a request breaks its operation's schema. Field is the query parameter's
+// name, or a JSON pointer into the body like /operations/0/op
+type Violation struct {
+	In     string `json:"in"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// checks a request's query parameters and JSON body against the operation,
+// returning every violation rather than stopping at the first. Bodies in other
+// content types, like imports, are left to their handlers
+func (d *Document) Validate(op *Operation, query url.Values, contentType string, body []byte) []Violation {
+	violations := []Violation{}
+
+	for _, param := range op.Parameters {
+		if param.In != "query" {
+			continue
+		}
+		values, ok := query[param.Name]
+		if !ok || len(values) == 0 || values[0] == "" {
+			if param.Required {
+				violations = append(violations, Violation{In: "query", Field: param.Name, Reason: "is required"})
+			}
+			continue
+		}
+		if reason := checkQueryValue(param.Schema, values[0]); reason != "" {
+			violations = append(violations, Violation{In: "query", Field: param.Name, Reason: reason})
+		}
+	}
+
+	if op.RequestBody == nil {
+		return violations
+	}
+	media, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return violations
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			violations = append(violations, Violation{In: "body", Field: "", Reason: "is required"})
+		}
+		return violations
+	}
+	if contentType != "" && !strings.HasSuffix(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]), "json") {
+		return append(violations, Violation{In: "body", Field: "", Reason: "must be sent as application/json"})
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return append(violations, Violation{In: "body", Field: "", Reason: "isn't valid JSON: " + err.Error()})
+	}
+	return append(violations, d.check(media.Schema, value, "")...)
+}
+
+func checkQueryValue(schema *Schema, value string) string {
+	if schema == nil {
+		return ""
+	}
+	if schema.Type == "integer" {
+		if _, err := strconv.Atoi(value); err != nil {
+			return "must be a whole number"
+		}
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, any(value)) {
+		return "must be one of " + enumList(schema.Enum)
+	}
+	return ""
+}
+
+// the violations of a decoded JSON value against a schema
+func (d *Document) check(schema *Schema, value any, pointer string) []Violation {
+	if schema == nil {
+		return nil
+	}
+	// encoding/json binds null as leaving a field out, required fields are
+	// checked by their object
+	if value == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		return d.check(d.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], value, pointer)
+	}
+	if schema.OmitEmpty && isZero(value) {
+		return nil
+	}
+
+	violation := func(reason string) []Violation {
+		return []Violation{{In: "body", Field: pointer, Reason: reason}}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return violation("must be an object")
+		}
+		return d.checkObject(schema, object, pointer)
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return violation("must be an array")
+		}
+		violations := []Violation{}
+		if schema.MinItems != nil && len(array) < *schema.MinItems {
+			violations = append(violations, violation(fmt.Sprintf("must have at least %d items", *schema.MinItems))...)
+		}
+		if schema.MaxItems != nil && len(array) > *schema.MaxItems {
+			violations = append(violations, violation(fmt.Sprintf("must have at most %d items", *schema.MaxItems))...)
+		}
+		for i, item := range array {
+			violations = append(violations, d.check(schema.Items, item, pointer+"/"+strconv.Itoa(i))...)
+		}
+		return violations
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return violation("must be a string")
+		}
+		return checkString(schema, s, violation)
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return violation("must be a number")
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return violation("must be a number")
+		}
+		if schema.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return violation("must be a whole number")
+			}
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return violation("must be at least " + strconv.FormatFloat(*schema.Minimum, 'f', -1, 64))
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return violation("must be at most " + strconv.FormatFloat(*schema.Maximum, 'f', -1, 64))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return violation("must be true or false")
+		}
+	}
+	return nil
+}
+
+// properties not in the schema are violations unless it allows additional ones.
+// Names are matched without regard to case, as encoding/json binds them
+func (d *Document) checkObject(schema *Schema, object map[string]any, pointer string) []Violation {
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// the property each member of the body binds to
+	bound := map[string]string{}
+	for _, name := range names {
+		if _, ok := schema.Properties[name]; ok {
+			bound[name] = name
+			continue
+		}
+		for property := range schema.Properties {
+			if strings.EqualFold(name, property) {
+				bound[name] = property
+				break
+			}
+		}
+	}
+
+	violations := []Violation{}
+	for _, property := range schema.Required {
+		present := false
+		for name, to := range bound {
+			if to == property && object[name] != nil {
+				present = true
+			}
+		}
+		if !present {
+			violations = append(violations, Violation{In: "body", Field: pointer + "/" + escapePointer(property), Reason: "is required"})
+		}
+	}
+
+	for _, name := range names {
+		field := pointer + "/" + escapePointer(name)
+		property, ok := bound[name]
+		switch {
+		case ok:
+			if object[name] == nil && slices.Contains(schema.Required, property) {
+				continue
+			}
+			violations = append(violations, d.check(schema.Properties[property], object[name], field)...)
+		case schema.AdditionalProperties != nil:
+			violations = append(violations, d.check(schema.AdditionalProperties, object[name], field)...)
+		case len(schema.Properties) > 0:
+			violations = append(violations, Violation{In: "body", Field: field, Reason: "isn't a known field"})
+		}
+	}
+	return violations
+}
+
+func checkString(schema *Schema, s string, violation func(string) []Violation) []Violation {
+	length := utf8.RuneCountInString(s)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		if *schema.MinLength == 1 {
+			return violation("must not be empty")
+		}
+		return violation(fmt.Sprintf("must be at least %d characters", *schema.MinLength))
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return violation(fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+	}
+	if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, any(s)) {
+		return violation("must be one of " + enumList(schema.Enum))
+	}
+
+	switch schema.Format {
+	case "email":
+		if address, err := mail.ParseAddress(s); err != nil || address.Address != s {
+			return violation("must be an email address")
+		}
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			return violation("must be an RFC 3339 time")
+		}
+	case "uri":
+		if u, err := url.Parse(s); err != nil || !u.IsAbs() {
+			return violation("must be an absolute URL")
+		}
+	}
+	return nil
+}
+
+// the zero values omitempty skips, of the types a JSON value decodes to
+func isZero(value any) bool {
+	switch v := value.(type) {
+	case string:
+		return v == ""
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == 0
+	case bool:
+		return !v
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+func enumList(values []any) string {
+	parts := []string{}
+	for _, value := range values {
+		parts = append(parts, fmt.Sprint(value))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// RFC 6901 escaping for a property name in a JSON pointer
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
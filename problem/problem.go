@@ -0,0 +1,159 @@
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ContentType = "application/problem+json"
+
+// stable codes for what went wrong, for callers to act on rather than parsing
+// the detail. Each problem's type is its code under typePrefix
+const (
+	InvalidRequest       = "invalid_request" // the request doesn't match the API description
+	InvalidArgument      = "invalid_argument"
+	Unauthenticated      = "unauthenticated"
+	PermissionDenied     = "permission_denied"
+	NotFound             = "not_found"
+	NotAcceptable        = "not_acceptable"
+	Conflict             = "conflict"
+	PreconditionFailed   = "precondition_failed"
+	PreconditionRequired = "precondition_required"
+	Unprocessable        = "unprocessable"
+	RateLimited          = "rate_limited"
+	Internal             = "internal"
+	NotImplemented       = "not_implemented"
+	Unavailable          = "unavailable"
+)
+
+const typePrefix = "urn:gin-books-api:problem:"
+
+// the code a problem gets from its status when it isn't given one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           InvalidArgument,
+	http.StatusUnauthorized:         Unauthenticated,
+	http.StatusForbidden:            PermissionDenied,
+	http.StatusNotFound:             NotFound,
+	http.StatusNotAcceptable:        NotAcceptable,
+	http.StatusConflict:             Conflict,
+	http.StatusPreconditionFailed:   PreconditionFailed,
+	http.StatusPreconditionRequired: PreconditionRequired,
+	http.StatusUnprocessableEntity:  Unprocessable,
+	http.StatusTooManyRequests:      RateLimited,
+	http.StatusInternalServerError:  Internal,
+	http.StatusNotImplemented:       NotImplemented,
+	http.StatusServiceUnavailable:   Unavailable,
+}
+
+// an RFC 7807 problem details body, what every error response carries
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
+
+	// members particular to the problem, like the id of the book a new one
+	// duplicates, written alongside the others
+	Extensions map[string]any `json:"-"`
+}
+
+// a problem with the code its status usually stands for
+func New(status int, detail string) Problem {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = Internal
+	}
+	return Problem{Status: status, Code: code, Detail: detail}
+}
+
+// the problem with a code more specific than its status gives it
+func (p Problem) WithCode(code string) Problem {
+	p.Code = code
+	return p
+}
+
+// the problem with an extension member
+func (p Problem) With(name string, value any) Problem {
+	extensions := map[string]any{name: value}
+	for k, v := range p.Extensions {
+		if k != name {
+			extensions[k] = v
+		}
+	}
+	p.Extensions = extensions
+	return p
+}
+
+// the standard members first, then the extensions in name order. Extensions
+// can't replace a standard member
+func (p Problem) MarshalJSON() ([]byte, error) {
+	type members Problem
+	standard, err := json.Marshal(members(p))
+	if err != nil || len(p.Extensions) == 0 {
+		return standard, err
+	}
+
+	names := make([]string, 0, len(p.Extensions))
+	for name := range p.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var taken map[string]json.RawMessage
+	if err := json.Unmarshal(standard, &taken); err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(standard[:len(standard)-1])
+	for _, name := range names {
+		if _, ok := taken[name]; ok {
+			continue
+		}
+		key, _ := json.Marshal(name)
+		value, err := json.Marshal(p.Extensions[name])
+		if err != nil {
+			return nil, err
+		}
+		out.WriteByte(',')
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// the problem with its type, title, the request's path and the id the
+// X-Request-Id header was given filled in where they aren't set
+func (p Problem) For(c *gin.Context) Problem {
+	if p.Code == "" {
+		p.Code = New(p.Status, "").Code
+	}
+	if p.Type == "" {
+		p.Type = typePrefix + p.Code
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = c.Request.URL.RequestURI()
+	}
+	if p.RequestId == "" {
+		p.RequestId = c.Writer.Header().Get("X-Request-Id")
+	}
+	return p
+}
+
+// ends the request with a problem. gin only sets a JSON content type when
+// there isn't one, so problem+json is set first
+func Abort(c *gin.Context, p Problem) {
+	p = p.For(c)
+	c.Header("Content-Type", ContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
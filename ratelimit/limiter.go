@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	log "github.com/sirupsen/logrus"
+)
+
+// the outcome of a single request against a policy, reported for the most
+// restrictive rule
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the rule is back to its full limit
+	RetryAfter time.Duration // how long to wait before retrying, when not allowed
+}
+
+// token bucket limiter for one route or group of routes. Buckets are kept in
+// process unless a cache store is given, in which case every instance sharing
+// that store shares the limits
+type Limiter struct {
+	name   string
+	policy Policy
+	store  persistence.CacheStore
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string][]bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// store can be nil to keep the buckets in this process
+func New(name string, policy Policy, store persistence.CacheStore) *Limiter {
+	return &Limiter{
+		name:    name,
+		policy:  policy,
+		store:   store,
+		now:     time.Now,
+		buckets: map[string][]bucket{},
+	}
+}
+
+// takes a token for the client from every rule in the policy
+func (l *Limiter) Allow(client string) Result {
+	if len(l.policy) == 0 {
+		return Result{Allowed: true}
+	}
+
+	now := l.now()
+	if l.store != nil {
+		return l.allowShared(client, now)
+	}
+	return l.allowLocal(client, now)
+}
+
+// tokens refill continuously at Limit per Window, up to Limit
+func (l *Limiter) allowLocal(client string, now time.Time) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	buckets, ok := l.buckets[client]
+	if !ok {
+		buckets = make([]bucket, len(l.policy))
+		for i, rule := range l.policy {
+			buckets[i] = bucket{tokens: float64(rule.Limit), updated: now}
+		}
+		l.buckets[client] = buckets
+	}
+
+	allowed := true
+	for i, rule := range l.policy {
+		b := &buckets[i]
+		b.tokens = math.Min(float64(rule.Limit), b.tokens+now.Sub(b.updated).Seconds()*rate(rule))
+		b.updated = now
+		if b.tokens < 1 {
+			allowed = false
+		}
+	}
+
+	results := make([]Result, len(l.policy))
+	for i, rule := range l.policy {
+		b := &buckets[i]
+		if allowed {
+			b.tokens--
+		}
+		results[i] = Result{
+			Allowed:   allowed,
+			Limit:     rule.Limit,
+			Remaining: int(math.Max(0, math.Floor(b.tokens))),
+			Reset:     seconds((float64(rule.Limit) - b.tokens) / rate(rule)),
+		}
+		if b.tokens < 1 {
+			results[i].RetryAfter = seconds((1 - b.tokens) / rate(rule))
+		}
+	}
+	return combine(allowed, results)
+}
+
+// drops buckets that have refilled completely, they are no different from a new bucket
+func (l *Limiter) sweep(now time.Time) {
+	longest := time.Duration(0)
+	for _, rule := range l.policy {
+		longest = max(longest, rule.Window)
+	}
+	if now.Sub(l.lastSweep) < longest {
+		return
+	}
+	l.lastSweep = now
+
+	for client, buckets := range l.buckets {
+		if now.Sub(buckets[0].updated) >= longest {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// the cache stores can only add and increment atomically, so shared limits
+// refill the whole bucket at the start of each window instead of continuously
+func (l *Limiter) allowShared(client string, now time.Time) Result {
+	allowed := true
+	results := make([]Result, len(l.policy))
+	for i, rule := range l.policy {
+		window := now.UnixNano() / int64(rule.Window)
+		reset := time.Unix(0, (window+1)*int64(rule.Window)).Sub(now)
+		key := fmt.Sprintf("ratelimit:%s:%d:%s:%d", l.name, i, hashClient(client), window)
+
+		count, err := l.increment(key, rule.Window)
+		if err != nil {
+			// an unreachable cache shouldn't take the API down with it
+			log.Warnf("Unable to check rate limit %s: %v", key, err)
+			count = 0
+		}
+
+		results[i] = Result{
+			Limit:     rule.Limit,
+			Remaining: max(0, rule.Limit-int(count)),
+			Reset:     reset,
+		}
+		if count > uint64(rule.Limit) {
+			allowed = false
+			results[i].RetryAfter = reset
+		}
+	}
+
+	for i := range results {
+		results[i].Allowed = allowed
+	}
+	return combine(allowed, results)
+}
+
+// token subjects can be long or contain spaces, which memcached keys can't
+func hashClient(client string) string {
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:16])
+}
+
+// counts a request in the window, creating the counter if this is the first
+func (l *Limiter) increment(key string, expires time.Duration) (uint64, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		err := l.store.Add(key, uint64(1), expires)
+		if err == nil {
+			return 1, nil
+		}
+		if !errors.Is(err, persistence.ErrNotStored) {
+			return 0, err
+		}
+
+		count, err := l.store.Increment(key, 1)
+		if errors.Is(err, persistence.ErrCacheMiss) {
+			// expired between the add and the increment, start again
+			continue
+		}
+		return count, err
+	}
+	return 0, fmt.Errorf("counter %s kept expiring", key)
+}
+
+// reports the rule closest to being exhausted, and the longest wait when denied
+func combine(allowed bool, results []Result) Result {
+	if len(results) == 0 {
+		return Result{Allowed: true}
+	}
+
+	combined := results[0]
+	for _, result := range results[1:] {
+		if result.Remaining < combined.Remaining ||
+			(result.Remaining == combined.Remaining && result.Reset > combined.Reset) {
+			retryAfter := combined.RetryAfter
+			combined = result
+			combined.RetryAfter = max(retryAfter, result.RetryAfter)
+		} else {
+			combined.RetryAfter = max(combined.RetryAfter, result.RetryAfter)
+		}
+	}
+	combined.Allowed = allowed
+	return combined
+}
+
+// tokens per second
+func rate(rule Rule) float64 {
+	return float64(rule.Limit) / rule.Window.Seconds()
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/auth"
+	"github.com/garbhank/gin-books-api/problem"
+)
+
+// middleware rejecting clients over the limit with 429. Every response gets
+// the RateLimit-* headers, and rejected ones get Retry-After. It must run after
+// auth.Require so authenticated callers are limited per key or token subject
+// rather than per IP address
+func (l *Limiter) Handler() gin.HandlerFunc {
+	return l.handler(auth.ClientKey)
+}
+
+// like Handler, but limits every request by IP address whoever it claims to be
+// from, so it can run ahead of auth.Require and slow down guessing at credentials
+func (l *Limiter) AddressHandler() gin.HandlerFunc {
+	return l.handler(auth.AddressKey)
+}
+
+func (l *Limiter) handler(key func(*gin.Context) string) gin.HandlerFunc {
+	if len(l.policy) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		result := l.Allow(key(c))
+
+		// with several limiters on a route, report whichever has the least left
+		header := c.Writer.Header()
+		previous, err := strconv.Atoi(header.Get("RateLimit-Remaining"))
+		if err != nil || result.Remaining <= previous {
+			header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+			header.Set("RateLimit-Policy", l.policy.String())
+		}
+
+		if !result.Allowed {
+			log.Infof("Rate limit %s exceeded by %s", l.name, key(c))
+			c.Header("Retry-After", ceilSeconds(result.RetryAfter))
+			problem.Abort(c, problem.New(http.StatusTooManyRequests, "Rate limit exceeded, try again later"))
+			return
+		}
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/garbhank/gin-books-api/utils"
+)
+
+// a rule allows Limit requests per Window, e.g. 30 per minute
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// every rule in a policy must allow a request, so "10/min,1000/day" is a
+// burst limit with a daily quota on top
+type Policy []Rule
+
+var windows = map[string]time.Duration{
+	"s":    time.Second,
+	"sec":  time.Second,
+	"m":    time.Minute,
+	"min":  time.Minute,
+	"h":    time.Hour,
+	"hour": time.Hour,
+	"d":    24 * time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// parses comma separated "<limit>/<window>" rules, where the window is one
+// of s, min, hour or day with an optional count such as "100/15min".
+// "off" and the empty string give an empty policy, which allows everything
+func ParsePolicy(s string) (Policy, error) {
+	policy := Policy{}
+	if strings.TrimSpace(s) == "" || strings.EqualFold(strings.TrimSpace(s), "off") {
+		return policy, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		limitStr, windowStr, ok := strings.Cut(strings.TrimSpace(part), "/")
+		if !ok {
+			return nil, fmt.Errorf("expected limit/window, got %q", part)
+		}
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid limit in %q", part)
+		}
+
+		// split "15min" into the count and the unit
+		digits := strings.IndexFunc(windowStr, func(r rune) bool { return r < '0' || r > '9' })
+		if digits < 0 {
+			return nil, fmt.Errorf("missing window unit in %q", part)
+		}
+		count := 1
+		if digits > 0 {
+			count, _ = strconv.Atoi(windowStr[:digits])
+		}
+		unit, ok := windows[strings.ToLower(windowStr[digits:])]
+		if !ok || count < 1 {
+			return nil, fmt.Errorf("invalid window in %q", part)
+		}
+
+		policy = append(policy, Rule{Limit: limit, Window: time.Duration(count) * unit})
+	}
+	return policy, nil
+}
+
+// the RateLimit-Policy header value, e.g. "10;w=60, 1000;w=86400"
+func (p Policy) String() string {
+	rules := make([]string, len(p))
+	for i, rule := range p {
+		rules[i] = fmt.Sprintf("%d;w=%d", rule.Limit, int(rule.Window.Seconds()))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// reads a policy from the environment variable, using fallback when it's unset
+func PolicyFromEnv(name, fallback string) Policy {
+	policy, err := ParsePolicy(utils.GetenvDefault(name, fallback))
+	if err != nil {
+		log.Fatalf("Failed to parse %s: %v", name, err)
+	}
+	return policy
+}
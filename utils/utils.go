@@ -8,6 +8,8 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -82,18 +84,37 @@ func IsSafeIdentifier(id string) bool {
 	return re.MatchString(id)
 }
 
+func ToSnakeCase(name string) string {
+	// converts a Go field name to a column name, e.g. "WorkId" -> "work_id", "ISBN" -> "isbn"
+	runes := []rune(name)
+	var b strings.Builder
+
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
 func GetEnvInt(name string, default_value int) int {
-	cacheTTL := os.Getenv("CACHE_TTL_MIN")
-	if cacheTTL == "" {
+	envValue := os.Getenv(name)
+	if envValue == "" {
 		return default_value
 	}
 
-	ttlDuration, err := strconv.Atoi(cacheTTL)
+	intValue, err := strconv.Atoi(envValue)
 	if err != nil {
 		log.Fatalf("Failed to parse %s environment variable: %v\n", name, err)
 	}
 
-	return ttlDuration
+	return intValue
 }
 
 var UUID = func() string {